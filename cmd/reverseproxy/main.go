@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/application/startup"
@@ -10,6 +11,7 @@ import (
 func main() {
 	var configFile = flag.String("config", "", "globalConfig File")
 	var validateOnly = flag.Bool("validate", false, "validate configuration and exit")
+	var rotateMasterKey = flag.String("rotate-master-key", "", "encrypt the stored private keys with the master key of this file and exit")
 	flag.Parse()
 	if len(*configFile) == 0 {
 		_, _ = os.Stderr.WriteString("You must set a config file!\n")
@@ -30,6 +32,17 @@ func main() {
 		return
 	}
 
+	if len(*rotateMasterKey) > 0 {
+		validator := startup.NewConfigValidator()
+		rotated, err := validator.RotateMasterKey(*configFile, defaultConfig, *rotateMasterKey)
+		if err != nil {
+			_, _ = os.Stderr.WriteString("Master key rotation failed: " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		_, _ = os.Stdout.WriteString(fmt.Sprintf("Rotated %d files and storage entries, set the new master key in key_encryption\n", rotated))
+		return
+	}
+
 	container := bootstrapper.BuildContainer()
 
 	validator := startup.NewConfigValidator()
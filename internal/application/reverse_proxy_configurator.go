@@ -1,22 +1,23 @@
 package application
 
 import (
-	"crypto/tls"
 	"fmt"
 	"net/http"
+	"path/filepath"
 
 	"github.com/janmbaco/go-infrastructure/v2/configuration"
 	"github.com/janmbaco/go-infrastructure/v2/server"
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/domain"
 	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
-	"golang.org/x/crypto/acme/autocert"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/ipfilter"
 )
 
 type ReverseProxyConfigurator struct {
-	logger        domain.Logger
-	vhResolver    domain.VirtualHostResolver
-	configHandler configuration.ConfigHandler
-	serverState   *ServerState
+	logger         domain.Logger
+	vhResolver     domain.VirtualHostResolver
+	configHandler  configuration.ConfigHandler
+	serverState    *ServerState
+	httpRedirector domain.HTTPRedirector
 }
 
 func NewReverseProxyConfigurator(logger domain.Logger, vhResolver domain.VirtualHostResolver, configHandler configuration.ConfigHandler, serverState *ServerState) *ReverseProxyConfigurator {
@@ -28,17 +29,35 @@ func NewReverseProxyConfigurator(logger domain.Logger, vhResolver domain.Virtual
 	}
 }
 
+// SetHTTPRedirector sets the HTTP redirector that serves the ACME HTTP-01 challenges of the
+// certificate manager of each configuration.
+func (rpc *ReverseProxyConfigurator) SetHTTPRedirector(httpRedirector domain.HTTPRedirector) {
+	rpc.httpRedirector = httpRedirector
+}
+
 func (rpc *ReverseProxyConfigurator) Configure(config interface{}, serverSetter *server.ServerSetter) error {
 	cfg := config.(*domain.Config)
 
 	mux := rpc.setupMux()
 	certMgr := rpc.setupCertManager(cfg)
 
-	rpc.registerVirtualHosts(mux, certMgr, cfg)
+	vhCollection := rpc.registerVirtualHosts(mux, certMgr, cfg)
 
 	serverSetter.Addr = cfg.ReverseProxyPort
-	serverSetter.Handler = mux
+	serverSetter.Handler = rpc.setupRealIP(cfg, mux)
 	serverSetter.TLSConfig = certMgr.GetTLSConfig()
+	if rpc.httpRedirector != nil {
+		rpc.httpRedirector.UpdateCertManager(certMgr)
+	}
+	rpc.stopPreviousCertManager()
+	rpc.watchCertificateFiles(certMgr, vhCollection, cfg)
+	certMgr.StartDNS01()
+	if !cfg.DisableOCSPStapling {
+		certMgr.StartOCSPStapling(filepath.Join(cfg.GetCertDir(), "ocsp"), rpc.logger)
+	}
+	certMgr.StartExpiryMonitor(cfg.GetCertExpiryWarning(), rpc.logger)
+	certMgr.StartSessionTicketRotation(cfg.SessionTickets, rpc.logger)
+	certMgr.StartECHKeyRotation(rpc.logger)
 
 	rpc.serverState.UpdateMux(mux)
 	rpc.serverState.UpdateCertMgr(certMgr)
@@ -55,31 +74,62 @@ func (rpc *ReverseProxyConfigurator) setupMux() *http.ServeMux {
 	return http.NewServeMux()
 }
 
+func (rpc *ReverseProxyConfigurator) setupRealIP(cfg *domain.Config, handler http.Handler) http.Handler {
+	realIP, err := ipfilter.NewRealIP(cfg.TrustedProxies)
+	if err != nil {
+		rpc.logger.Error(fmt.Sprintf("Failed to load trusted proxies: %v", err))
+		return handler
+	}
+	return realIP.Handler(handler)
+}
+
 func (rpc *ReverseProxyConfigurator) setupCertManager(cfg *domain.Config) domain.CertificateManager {
-	certMgr := certs.NewCertManager(&autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		Cache:  autocert.DirCache("./certs"),
-	})
+	if err := certs.LoadMasterKey(cfg.KeyEncryption); err != nil {
+		rpc.logger.Error(fmt.Sprintf("Failed to load the master key, the previous one is kept and no private key is written: %v", err))
+	}
+	acmeManager, err := certs.NewACMEManager(cfg.ACME, cfg.GetCertDir())
+	if err != nil {
+		rpc.logger.Error(fmt.Sprintf("Failed to load ACME settings: %v", err))
+	}
+	certMgr := certs.NewCertManager(acmeManager)
+	dns01Manager, err := certs.NewDNS01Manager(cfg.ACME, acmeManager, rpc.logger)
+	if err != nil {
+		rpc.logger.Error(fmt.Sprintf("Failed to set up DNS-01 certificates: %v", err))
+	} else if dns01Manager != nil {
+		certMgr.SetDNS01Manager(dns01Manager)
+	}
+	localCA, err := certs.NewLocalCA(cfg.LocalCA, cfg.GetLocalCADir())
+	if err != nil {
+		rpc.logger.Error(fmt.Sprintf("Failed to set up the local CA: %v", err))
+	} else if localCA != nil {
+		certMgr.SetLocalCA(localCA)
+	}
+	echKeys, err := certs.NewECHKeys(cfg.ECH, cfg.GetECHKeysFile())
+	if err != nil {
+		rpc.logger.Error(fmt.Sprintf("Failed to load the ECH keys: %v", err))
+	} else if echKeys != nil {
+		certMgr.SetECHKeys(echKeys)
+	}
+	certMgr.SetDefaultTLSPolicy(cfg.TLSPolicy)
 
 	if cfg.DefaultServerCert != "" && cfg.DefaultServerKey != "" {
-		cert, err := tls.LoadX509KeyPair(cfg.DefaultServerCert, cfg.DefaultServerKey)
-		if err != nil {
+		if err := certMgr.AddCertificateFiles(cfg.DefaultHost, cfg.DefaultServerCert, cfg.DefaultServerKey); err != nil {
 			rpc.logger.Error(fmt.Sprintf("Failed to load default certificate: %v", err))
-		} else {
-			certMgr.AddCertificate(cfg.DefaultHost, &cert)
 		}
 	} else if cfg.DefaultHost != "" {
-		certMgr.AddAutoCertificate(cfg.DefaultHost)
+		if err := certMgr.AddAutoCertificate(cfg.DefaultHost); err != nil {
+			rpc.logger.Error(fmt.Sprintf("Failed to set up the automatic certificate of %v: %v", cfg.DefaultHost, err))
+		}
 	}
 
 	return certMgr
 }
 
-func (rpc *ReverseProxyConfigurator) registerVirtualHosts(mux *http.ServeMux, certMgr domain.CertificateManager, cfg *domain.Config) {
+func (rpc *ReverseProxyConfigurator) registerVirtualHosts(mux *http.ServeMux, certMgr domain.CertificateManager, cfg *domain.Config) []domain.IVirtualHost {
 	vhCollection, err := rpc.vhResolver.Resolve(cfg)
 	if err != nil {
 		rpc.logger.Error(fmt.Sprintf("Failed to resolve virtual hosts: %v", err))
-		return
+		return nil
 	}
 
 	for _, vh := range vhCollection {
@@ -90,22 +140,43 @@ func (rpc *ReverseProxyConfigurator) registerVirtualHosts(mux *http.ServeMux, ce
 
 		if !certMgr.HasCertificateFor(vh.GetHostToReplace()) {
 			if vh.GetServerCertificate() != nil {
-				cert, err := vh.GetServerCertificate().GetCertificate()
-				if err != nil {
+				if err := certMgr.AddKeyPair(vh.GetHostToReplace(), vh.GetServerCertificate()); err != nil {
 					rpc.logger.Error(fmt.Sprintf("Failed to get certificate for %v: %v", vh.GetHostToReplace(), err))
 					continue
 				}
-				certMgr.AddCertificate(vh.GetHostToReplace(), cert)
-			} else {
-				certMgr.AddAutoCertificate(vh.GetFrom())
+			} else if err := certMgr.AddAutoCertificate(vh.GetFrom()); err != nil {
+				rpc.logger.Error(fmt.Sprintf("Failed to set up the automatic certificate of %v: %v", vh.GetFrom(), err))
 			}
 		}
 
-		certMgr.AddClientCA(vh.GetAuthorizedCAs())
+		if host, isUpstreamCertificateHost := vh.(domain.UpstreamCertificateHost); isUpstreamCertificateHost && host.GetClientCertificate() != nil {
+			certMgr.AddUpstreamCertificate(vh.GetHostToReplace(), host.GetClientCertificate())
+		}
+		certMgr.SetClientAuth(vh.GetHostToReplace(), vh.GetClientAuth(), vh.GetAuthorizedCAs())
+		certMgr.SetTLSPolicy(vh.GetHostToReplace(), vh.GetTLSPolicy())
 		RedirectToWWW(urlToReplace, mux)
 	}
 
 	rpc.registerDefaultHost(mux, vhCollection, cfg)
+	return vhCollection
+}
+
+// stopPreviousCertManager ends the background work of the certificate manager of the previous configuration.
+func (rpc *ReverseProxyConfigurator) stopPreviousCertManager() {
+	if previous := rpc.serverState.GetCertMgr(); previous != nil {
+		previous.Stop()
+	}
+}
+
+// watchCertificateFiles watches the files of the new configuration. Changed client CAs are
+// also reloaded in the virtual hosts.
+func (rpc *ReverseProxyConfigurator) watchCertificateFiles(certMgr domain.CertificateManager, vhCollection []domain.IVirtualHost, cfg *domain.Config) {
+	certMgr.WatchFiles(cfg.GetCertReloadInterval(), func(changed []string) {
+		rpc.logger.Info(fmt.Sprintf("certificate files changed: %v", changed))
+		for _, vh := range vhCollection {
+			vh.ReloadClientCAs(changed)
+		}
+	})
 }
 
 func (rpc *ReverseProxyConfigurator) registerDefaultHost(mux *http.ServeMux, vhCollection []domain.IVirtualHost, cfg *domain.Config) {
@@ -40,6 +40,7 @@ func (ar *ApplicationRunner) Start(container dependencyinjection.Container) {
 
 	httpRedirector := infrastructureResolver.GetHTTPRedirector(container.Resolver(), logger)
 	proxyConfigurator := applicationResolver.GetReverseProxyConfigurator(container.Resolver(), logger, configHandler)
+	proxyConfigurator.SetHTTPRedirector(httpRedirector)
 
 	ar.setLogConfiguration(configHandler.GetConfig().(*domain.Config), logger)
 
@@ -1,6 +1,7 @@
 package startup
 
 import (
+	"context"
 	"errors"
 
 	"github.com/janmbaco/go-infrastructure/v2/configuration"
@@ -13,6 +14,7 @@ import (
 	logsIoc "github.com/janmbaco/go-infrastructure/v2/logs/ioc"
 	serverIoc "github.com/janmbaco/go-infrastructure/v2/server/ioc"
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/domain"
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
 	presentationIoc "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/presentation/ioc"
 )
 
@@ -23,6 +25,54 @@ func NewConfigValidator() *ConfigValidator {
 }
 
 func (cv *ConfigValidator) Validate(configFile string, defaultConfig *domain.Config) error {
+	config := loadConfig(configFile, defaultConfig)
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	masterKey, err := certs.NewMasterKey(config.KeyEncryption)
+	if err != nil {
+		return errors.New("key_encryption: " + err.Error())
+	}
+	certs.SetMasterKey(masterKey)
+	return config.ValidateCertificates()
+}
+
+// RotateMasterKey encrypts the stored private keys again with the master key read from
+// newKeyFile and returns how many files and entries of the ACME storage were rotated. The configured key must still be the
+// current one, and it must be changed to the new key once the rotation succeeds.
+func (cv *ConfigValidator) RotateMasterKey(configFile string, defaultConfig *domain.Config, newKeyFile string) (int, error) {
+	config := loadConfig(configFile, defaultConfig)
+	if err := config.Validate(); err != nil {
+		return 0, err
+	}
+	if config.KeyEncryption == nil {
+		return 0, errors.New("key_encryption: no master key is configured")
+	}
+	current, err := certs.NewMasterKey(config.KeyEncryption)
+	if err != nil {
+		return 0, errors.New("key_encryption: " + err.Error())
+	}
+	next, err := certs.NewMasterKey(&certs.KeyEncryption{File: newKeyFile})
+	if err != nil {
+		return 0, errors.New("new master key: " + err.Error())
+	}
+	rotated, err := certs.RotateMasterKey(config.GetKeyStorePaths(), current, next)
+	if err != nil || config.ACME == nil || config.ACME.Storage == nil || config.ACME.Storage.Type == certs.CacheStorageDir {
+		return rotated, err
+	}
+	// the entries of a shared store are not under the paths
+	store, err := config.ACME.Storage.NewCacheStore("")
+	if err != nil {
+		return rotated, errors.New("acme storage: " + err.Error())
+	}
+	storeRotated, err := certs.RotateCacheMasterKey(context.Background(), store, current, next)
+	if err != nil {
+		err = errors.New("acme storage: " + err.Error())
+	}
+	return rotated + storeRotated, err
+}
+
+func loadConfig(configFile string, defaultConfig *domain.Config) *domain.Config {
 	container := dependencyinjection.NewBuilder().
 		AddModule(logsIoc.NewLogsModule()).
 		AddModule(errorsIoc.NewErrorsModule()).
@@ -40,8 +90,7 @@ func (cv *ConfigValidator) Validate(configFile string, defaultConfig *domain.Con
 	)
 
 	dependencyinjection.RegisterSingleton(container.Register(), func() configuration.ConfigHandler { return configHandler })
-	config := configHandler.GetConfig().(*domain.Config)
-	return config.Validate()
+	return configHandler.GetConfig().(*domain.Config)
 }
 
 func (cv *ConfigValidator) ValidateRuntime(config interface{}) (bool, error) {
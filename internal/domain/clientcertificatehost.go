@@ -1,20 +1,131 @@
 package domain
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
 	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/clientcert"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/forwardauth"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/jwt"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/jwtauth"
 )
 
 // ClientCertificateHost is used to configure a simple virtual host using TLS client communication.
 type ClientCertificateHost struct {
 	VirtualHostBase
-	ClientCertificate *certs.CertificateDefs `json:"client_certificate"`
+	ClientCertificate *certs.CertificateDefs    `json:"client_certificate"`
+	ForwardClientCert *clientcert.ForwardConfig `json:"forward_client_cert,omitempty"`
+	ForwardAuth       *forwardauth.Config       `json:"forward_auth,omitempty"`
+	JWT               *jwtauth.Config           `json:"jwt,omitempty"`
+	authorizer        *forwardauth.Authorizer
+	jwtValidator      *jwtauth.Validator
+}
+
+// GetClientCertificate gets the client certificate presented to the upstream server, or nil.
+func (clientCertificateHost *ClientCertificateHost) GetClientCertificate() CertificateProvider {
+	if clientCertificateHost.ClientCertificate == nil {
+		return nil
+	}
+	return clientCertificateHost.ClientCertificate
+}
+
+// forwardClientCertificate sets the client certificate headers of the upstream request in the
+// format of config. Client supplied copies of those headers are always removed. Only certificates
+// that verify against the CAs of the virtual host are forwarded, whatever the client_auth mode.
+func (clientCertificateHost *ClientCertificateHost) forwardClientCertificate(header http.Header, req *http.Request, config *clientcert.ForwardConfig) {
+	var chain []*x509.Certificate
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 && clientCertificateHost.clientCAs != nil {
+		if _, err := certs.VerifyClientCertificate(clientCertificateHost.clientCAs.Pool(), req.TLS.PeerCertificates); err == nil {
+			chain = req.TLS.PeerCertificates
+		}
+	}
+	config.Apply(header, chain)
+}
+
+func (clientCertificateHost *ClientCertificateHost) setUpForwardAuth() {
+	if clientCertificateHost.ForwardAuth == nil {
+		return
+	}
+
+	var tlsConfig *tls.Config
+	if clientCertificateHost.ForwardAuth.UseClientCertificate && clientCertificateHost.ClientCertificate != nil {
+		var err error
+		// the auth service has its own identity, only the key pair and the CAs are shared
+		if tlsConfig, err = clientCertificateHost.ClientCertificate.GetClientTLSConfig(); err != nil {
+			clientCertificateHost.logger.Error(fmt.Sprintf("Failed to get TLS config for forward auth of %v: %v", clientCertificateHost.From, err))
+			return
+		}
+	}
+
+	authorizer, err := forwardauth.NewAuthorizer(clientCertificateHost.ForwardAuth, tlsConfig, clientCertificateHost.logger)
+	if err != nil {
+		clientCertificateHost.logger.Error(fmt.Sprintf("Failed to configure forward auth for %v: %v", clientCertificateHost.From, err))
+		return
+	}
+	clientCertificateHost.authorizer = authorizer
+}
+
+// authorize runs the forward auth subrequest, if configured. It returns false when the response was already written.
+func (clientCertificateHost *ClientCertificateHost) authorize(rw http.ResponseWriter, req *http.Request) (http.Header, bool) {
+	if clientCertificateHost.ForwardAuth == nil {
+		return nil, true
+	}
+	if clientCertificateHost.authorizer == nil {
+		http.Error(rw, "Authorization is not available", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return clientCertificateHost.authorizer.Authorize(rw, req)
+}
+
+func (clientCertificateHost *ClientCertificateHost) applyAuthHeaders(header http.Header, upstream http.Header) {
+	if clientCertificateHost.authorizer != nil {
+		clientCertificateHost.authorizer.ApplyHeaders(header, upstream)
+	}
+}
+
+func (clientCertificateHost *ClientCertificateHost) setUpJWT() {
+	if clientCertificateHost.JWT == nil {
+		return
+	}
+
+	validator, err := jwtauth.NewValidator(clientCertificateHost.JWT, nil)
+	if err != nil {
+		clientCertificateHost.logger.Error(fmt.Sprintf("Failed to configure JWT validation for %v: %v", clientCertificateHost.From, err))
+		return
+	}
+	clientCertificateHost.jwtValidator = validator
+}
+
+// validateToken checks the bearer token of the request, if configured. It returns false when the
+// response was already written, as a gRPC-Web status when grpcWeb is true.
+func (clientCertificateHost *ClientCertificateHost) validateToken(rw http.ResponseWriter, req *http.Request, grpcWeb bool) (jwt.Claims, bool) {
+	if clientCertificateHost.JWT == nil {
+		return nil, true
+	}
+
+	if clientCertificateHost.jwtValidator == nil {
+		http.Error(rw, "Token validation is not available", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	claims, err := clientCertificateHost.jwtValidator.Validate(req)
+	if err == nil {
+		return claims, true
+	}
+
+	if grpcWeb {
+		jwtauth.WriteGrpcWebError(rw, err)
+	} else {
+		jwtauth.WriteError(rw, err)
+	}
+	return nil, false
 }
 
-// GetAuthorizedCAs gets the certificate authorities public keys to use with TLS client.
-func (clientCertificateHost *ClientCertificateHost) GetAuthorizedCAs() []string {
-	CAs := clientCertificateHost.VirtualHostBase.GetAuthorizedCAs()
-	if clientCertificateHost.ClientCertificate != nil && len(clientCertificateHost.ClientCertificate.GetAuthorizedCAs()) > 0 {
-		CAs = append(CAs, clientCertificateHost.ClientCertificate.GetAuthorizedCAs()...)
+func (clientCertificateHost *ClientCertificateHost) applyClaimHeaders(header http.Header, claims jwt.Claims) {
+	if clientCertificateHost.jwtValidator != nil {
+		clientCertificateHost.jwtValidator.ApplyClaimHeaders(header, claims)
 	}
-	return CAs
 }
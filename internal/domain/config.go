@@ -2,10 +2,21 @@ package domain
 
 import (
 	"errors"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/janmbaco/go-infrastructure/v2/logs"
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/ipfilter"
+)
+
+const (
+	defaultCertDir            = "./certs"
+	defaultCertReloadInterval = 30 * time.Second
+	defaultCertExpiryWarning  = 14
 )
 
 // for the reverse proxy, in addition to the various configuration
@@ -22,6 +33,16 @@ type Config struct {
 	LogFileLevel        logs.LogLevel         `json:"log_file_level"`
 	LogsDir             string                `json:"logs_dir"`
 	ConfigUIPort        string                `json:"config_ui_port"`
+	TrustedProxies      []string              `json:"trusted_proxies,omitempty"`
+	CertReloadInterval  string                `json:"cert_reload_interval,omitempty"`
+	DisableOCSPStapling bool                  `json:"disable_ocsp_stapling,omitempty"`
+	CertExpiryDays      int                   `json:"cert_expiry_warning_days,omitempty"`
+	TLSPolicy           *certs.TLSPolicy      `json:"tls_policy,omitempty"`
+	ACME                *certs.ACMEConfig     `json:"acme,omitempty"`
+	LocalCA             *certs.LocalCAConfig  `json:"local_ca,omitempty"`
+	KeyEncryption       *certs.KeyEncryption  `json:"key_encryption,omitempty"`
+	SessionTickets      *certs.SessionTickets `json:"session_tickets,omitempty"`
+	ECH                 *certs.ECHConfig      `json:"ech,omitempty"`
 	// Deprecated fields for backward compatibility - ignored
 	SSHVirtualHosts      interface{} `json:"ssh_virtual_hosts,omitempty"`
 	GrpcVirtualHosts     interface{} `json:"grpc_virtual_hosts,omitempty"`
@@ -48,6 +69,63 @@ func (c *Config) Validate() error {
 		return err
 	}
 
+	// Validate trusted proxies
+	if _, err := ipfilter.ParsePrefixes(c.TrustedProxies); err != nil {
+		return errors.New("trusted_proxies: " + err.Error())
+	}
+
+	// Validate TLS policies
+	if err := c.validateTLSPolicies(); err != nil {
+		return err
+	}
+
+	// Validate ACME settings
+	if c.ACME != nil {
+		if err := c.ACME.Validate(); err != nil {
+			return errors.New("acme." + err.Error())
+		}
+	}
+
+	// Validate local CA settings
+	if c.LocalCA != nil {
+		if err := c.LocalCA.Validate(); err != nil {
+			return errors.New("local_ca." + err.Error())
+		}
+	}
+
+	// Validate key encryption settings
+	if c.KeyEncryption != nil {
+		if err := c.KeyEncryption.Validate(); err != nil {
+			return errors.New("key_encryption." + err.Error())
+		}
+	}
+
+	// Validate session ticket settings
+	if c.SessionTickets != nil {
+		if err := c.SessionTickets.Validate(); err != nil {
+			return errors.New("session_tickets." + err.Error())
+		}
+	}
+
+	// Validate Encrypted Client Hello settings
+	if c.ECH != nil {
+		if err := c.ECH.Validate(); err != nil {
+			return errors.New("ech." + err.Error())
+		}
+	}
+
+	// Validate certificate reload interval
+	if c.CertReloadInterval != "" {
+		if interval, err := time.ParseDuration(c.CertReloadInterval); err != nil || interval < 0 {
+			return errors.New("cert_reload_interval: '" + c.CertReloadInterval + "' is not a valid duration")
+		}
+	}
+
+	// Validate certificate expiry warning
+	if c.CertExpiryDays < 0 {
+		return errors.New("cert_expiry_warning_days: must not be negative")
+	}
+
 	// Validate log levels
 	if err := c.validateLogLevels(); err != nil {
 		return err
@@ -56,6 +134,127 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// GetCertDir gets the directory of the certificates managed by the reverse proxy.
+func (c *Config) GetCertDir() string {
+	if c.CertDir == "" {
+		return defaultCertDir
+	}
+	return c.CertDir
+}
+
+// GetLocalCADir gets the directory of the local CA when the local_ca settings do not set one.
+func (c *Config) GetLocalCADir() string {
+	return filepath.Join(c.GetCertDir(), "local-ca")
+}
+
+// GetECHKeysFile gets the file of the ECH keys when the ech settings do not set one.
+func (c *Config) GetECHKeysFile() string {
+	return filepath.Join(c.GetCertDir(), "ech-keys.pem")
+}
+
+// GetKeyStorePaths gets the directories and files where the private keys used by the reverse
+// proxy are stored: the certificate directory, the ACME cache, the local CA, the session ticket
+// and ECH keys and the files of the custom certificates.
+func (c *Config) GetKeyStorePaths() []string {
+	paths := []string{c.GetCertDir()}
+	if c.ACME != nil && c.ACME.CacheDir != "" {
+		paths = append(paths, c.ACME.CacheDir)
+	}
+	if c.LocalCA != nil && c.LocalCA.Dir != "" {
+		paths = append(paths, c.LocalCA.Dir)
+	}
+	if c.SessionTickets.GetFile() != "" {
+		paths = append(paths, c.SessionTickets.GetFile())
+	}
+	if c.ECH != nil && c.ECH.File != "" {
+		paths = append(paths, c.ECH.File)
+	}
+	if c.DefaultServerKey != "" {
+		paths = append(paths, c.DefaultServerKey)
+	}
+	for _, host := range c.WebVirtualHosts {
+		paths = append(paths, host.ServerCertificate.Files()...)
+		paths = append(paths, host.ClientCertificate.Files()...)
+	}
+	for _, host := range c.GrpcWebVirtualHosts {
+		paths = append(paths, host.ServerCertificate.Files()...)
+		paths = append(paths, host.ClientCertificate.Files()...)
+	}
+	return paths
+}
+
+// GetCertExpiryWarning gets how long before expiry a certificate is reported as expiring.
+func (c *Config) GetCertExpiryWarning() time.Duration {
+	days := c.CertExpiryDays
+	if days == 0 {
+		days = defaultCertExpiryWarning
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// GetCertReloadInterval gets the interval to check the certificate files for changes. Zero disables the checks.
+func (c *Config) GetCertReloadInterval() time.Duration {
+	if c.CertReloadInterval == "" {
+		return defaultCertReloadInterval
+	}
+	interval, _ := time.ParseDuration(c.CertReloadInterval)
+	return interval
+}
+
+// ValidateCertificates loads the custom certificates and checks them as they are served: the keys
+// must match, the certificates must be currently valid with a complete chain and cover the
+// server names of their virtual hosts. Unlike Validate it reads the certificate files.
+func (c *Config) ValidateCertificates() error {
+	if c.DefaultServerCert != "" && c.DefaultServerKey != "" {
+		defaultCertificate := &certs.CertificateDefs{PublicKey: c.DefaultServerCert, PrivateKey: c.DefaultServerKey}
+		if err := defaultCertificate.CheckServerCertificate(c.DefaultHost); err != nil {
+			return errors.New("default_server_cert: " + err.Error())
+		}
+	}
+	for i, host := range c.WebVirtualHosts {
+		if err := validateHostCertificates(&host.ClientCertificateHost, i, "web_virtual_hosts"); err != nil {
+			return err
+		}
+	}
+	for i, host := range c.GrpcWebVirtualHosts {
+		if err := validateHostCertificates(&host.ClientCertificateHost, i, "grpc_web_virtual_hosts"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServerNameOf gets the server name of the 'from' field of a virtual host, without its path.
+func ServerNameOf(from string) string {
+	serverName, _, _ := strings.Cut(from, "/")
+	return serverName
+}
+
+// PathOf gets the path of the 'from' field of a virtual host, starting with '/', or empty when
+// it has none.
+func PathOf(from string) string {
+	if _, path, isContained := strings.Cut(from, "/"); isContained {
+		return "/" + path
+	}
+	return ""
+}
+
+// validateHostCertificates checks the server certificate and the key pair of the client certificate of a virtual host
+func validateHostCertificates(host *ClientCertificateHost, index int, arrayName string) error {
+	if host.ServerCertificate != nil {
+		if err := host.ServerCertificate.CheckServerCertificate(ServerNameOf(host.From)); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].server_certificate: " + err.Error())
+		}
+	}
+	clientCertificate := host.ClientCertificate
+	if clientCertificate != nil && (clientCertificate.PKCS12 != "" || clientCertificate.PublicKey != "" && clientCertificate.PrivateKey != "") {
+		if _, err := clientCertificate.LoadKeyPair(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].client_certificate: " + err.Error())
+		}
+	}
+	return nil
+}
+
 // validateVirtualHostBase validates common virtual host fields
 func (c *Config) validateVirtualHostBase(host *VirtualHostBase, index int, arrayName string) error {
 	// Validate required fields
@@ -74,15 +273,120 @@ func (c *Config) validateVirtualHostBase(host *VirtualHostBase, index int, array
 	if host.Port > 65535 {
 		return errors.New(arrayName + "[" + strconv.Itoa(index) + "]: 'port' field must be between 1 and 65535")
 	}
+	if err := host.ClientAuth.Validate(); err != nil {
+		return errors.New(arrayName + "[" + strconv.Itoa(index) + "]: " + err.Error())
+	}
+	if host.IPRules != nil {
+		if err := host.IPRules.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].ip_rules: " + err.Error())
+		}
+	}
+	if host.TLSPolicy != nil {
+		if err := host.TLSPolicy.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].tls_policy: " + err.Error())
+		}
+	}
+	if host.ServerCertificate != nil {
+		if err := host.ServerCertificate.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].server_certificate: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// validateClientCertificateHost validates the fields shared by web and gRPC-Web virtual hosts
+func (c *Config) validateClientCertificateHost(host *ClientCertificateHost, index int, arrayName string) error {
+	if err := c.validateVirtualHostBase(&host.VirtualHostBase, index, arrayName); err != nil {
+		return err
+	}
+
+	if host.ClientCertificate != nil {
+		if err := host.ClientCertificate.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].client_certificate: " + err.Error())
+		}
+	}
+
+	if host.ClientAuth == certs.ClientAuthVerify && len(host.GetAuthorizedCAs()) == 0 {
+		return errors.New(arrayName + "[" + strconv.Itoa(index) + "]: client_auth 'verify' requires CA certificates")
+	}
+
+	if !host.ClientCertRules.IsEmpty() {
+		if err := host.ClientCertRules.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].client_certificate_rules: " + err.Error())
+		}
+		// Rules are only meaningful for certificates verified against the host CAs.
+		if (host.ClientAuth != "" && host.ClientAuth != certs.ClientAuthVerify) || len(host.GetAuthorizedCAs()) == 0 {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "]: client_certificate_rules require CA certificates and client_auth 'verify' or default")
+		}
+	}
+
+	if host.Revocation != nil {
+		if err := host.Revocation.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].revocation: " + err.Error())
+		}
+		// Only certificates verified against the host CAs have a known issuer to check.
+		if (host.ClientAuth != "" && host.ClientAuth != certs.ClientAuthVerify) || len(host.GetAuthorizedCAs()) == 0 {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "]: revocation requires CA certificates and client_auth 'verify' or default")
+		}
+	}
+
+	if host.ForwardClientCert != nil {
+		if err := host.ForwardClientCert.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].forward_client_cert: " + err.Error())
+		}
+	}
+
+	if host.ForwardAuth != nil {
+		if err := host.ForwardAuth.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].forward_auth: " + err.Error())
+		}
+	}
+
+	if host.JWT != nil {
+		if err := host.JWT.Validate(); err != nil {
+			return errors.New(arrayName + "[" + strconv.Itoa(index) + "].jwt: " + err.Error())
+		}
+	}
 
 	return nil
 }
 
 // Helper methods for Validate
 
+// validateTLSPolicies checks the global TLS policy and that virtual hosts sharing a server name,
+// which share the TLS handshake, do not set different policies.
+func (c *Config) validateTLSPolicies() error {
+	if c.TLSPolicy != nil {
+		if err := c.TLSPolicy.Validate(); err != nil {
+			return errors.New("tls_policy: " + err.Error())
+		}
+	}
+
+	policies := make(map[string]*certs.TLSPolicy)
+	hosts := make([]*VirtualHostBase, 0, len(c.WebVirtualHosts)+len(c.GrpcWebVirtualHosts))
+	for _, host := range c.WebVirtualHosts {
+		hosts = append(hosts, &host.VirtualHostBase)
+	}
+	for _, host := range c.GrpcWebVirtualHosts {
+		hosts = append(hosts, &host.VirtualHostBase)
+	}
+	for _, host := range hosts {
+		if host.TLSPolicy == nil {
+			continue
+		}
+		serverName := ServerNameOf(host.From)
+		if policy, isContained := policies[serverName]; isContained && !reflect.DeepEqual(policy, host.TLSPolicy) {
+			return errors.New("tls_policy: virtual hosts of '" + serverName + "' have different TLS policies")
+		}
+		policies[serverName] = host.TLSPolicy
+	}
+	return nil
+}
+
 func (c *Config) validateWebVirtualHosts(domains map[string]bool) error {
 	for i, host := range c.WebVirtualHosts {
-		if err := c.validateVirtualHostBase(&host.VirtualHostBase, i, "web_virtual_hosts"); err != nil {
+		if err := c.validateClientCertificateHost(&host.ClientCertificateHost, i, "web_virtual_hosts"); err != nil {
 			return err
 		}
 
@@ -91,6 +395,13 @@ func (c *Config) validateWebVirtualHosts(domains map[string]bool) error {
 			return errors.New("web_virtual_hosts[" + strconv.Itoa(i) + "]: scheme must be 'http' or 'https'")
 		}
 
+		// Validate OpenID Connect login
+		if host.OIDC != nil {
+			if err := host.OIDC.Validate(); err != nil {
+				return errors.New("web_virtual_hosts[" + strconv.Itoa(i) + "].oidc: " + err.Error())
+			}
+		}
+
 		// Check domain uniqueness
 		if domains[host.From] {
 			return errors.New("web_virtual_hosts[" + strconv.Itoa(i) + "]: domain '" + host.From + "' is already used by another virtual host")
@@ -102,7 +413,7 @@ func (c *Config) validateWebVirtualHosts(domains map[string]bool) error {
 
 func (c *Config) validateGrpcWebVirtualHosts(domains map[string]bool) error {
 	for i, host := range c.GrpcWebVirtualHosts {
-		if err := c.validateVirtualHostBase(&host.VirtualHostBase, i, "grpc_web_virtual_hosts"); err != nil {
+		if err := c.validateClientCertificateHost(&host.ClientCertificateHost, i, "grpc_web_virtual_hosts"); err != nil {
 			return err
 		}
 
@@ -4,7 +4,13 @@ import (
 	"encoding/json"
 	"testing"
 
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/clientcert"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/forwardauth"
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/grpcutil"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/ipfilter"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/jwtauth"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/oidc"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -255,6 +261,265 @@ func TestConfig_Validate_WhenMissingRequiredFields_ThenReturnsError(t *testing.T
 			},
 			expected: "log_console_level must be between 0 and 5",
 		},
+		{
+			name: "invalid oidc block",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "dashboard.example.com",
+								Scheme:   "http",
+								HostName: "localhost",
+								Port:     3000,
+							},
+						},
+						OIDC: &oidc.Config{Issuer: "https://idp.example.com"},
+					},
+				},
+			},
+			expected: "web_virtual_hosts[0].oidc: 'client_id' field is required",
+		},
+		{
+			name: "invalid forward_auth address",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "app.example.com",
+								Scheme:   "http",
+								HostName: "localhost",
+								Port:     3000,
+							},
+							ForwardAuth: &forwardauth.Config{Address: "auth-service/verify"},
+						},
+					},
+				},
+			},
+			expected: "web_virtual_hosts[0].forward_auth: 'address' must be an absolute http or https URL",
+		},
+		{
+			name: "invalid ip rule",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "app.example.com",
+								Scheme:   "http",
+								HostName: "localhost",
+								Port:     3000,
+								IPRules:  &ipfilter.Rules{Deny: []string{"10.0.0.300"}},
+							},
+						},
+					},
+				},
+			},
+			expected: "web_virtual_hosts[0].ip_rules: deny: invalid IP address '10.0.0.300'",
+		},
+		{
+			name: "client_auth verify without CAs",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:       "app.example.com",
+								Scheme:     "http",
+								HostName:   "localhost",
+								Port:       3000,
+								ClientAuth: "verify",
+							},
+						},
+					},
+				},
+			},
+			expected: "web_virtual_hosts[0]: client_auth 'verify' requires CA certificates",
+		},
+		{
+			name: "client certificate rules without CAs",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:            "app.example.com",
+								Scheme:          "http",
+								HostName:        "localhost",
+								Port:            3000,
+								ClientCertRules: &clientcert.Rules{Allow: []*clientcert.Match{{CommonName: "alice"}}},
+							},
+						},
+					},
+				},
+			},
+			expected: "web_virtual_hosts[0]: client_certificate_rules require CA certificates and client_auth 'verify' or default",
+		},
+		{
+			name: "unknown tls policy preset",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:      "app.example.com",
+								Scheme:    "http",
+								HostName:  "localhost",
+								Port:      3000,
+								TLSPolicy: &certs.TLSPolicy{Preset: "strict"},
+							},
+						},
+					},
+				},
+			},
+			expected: "web_virtual_hosts[0].tls_policy: preset: unknown preset 'strict'",
+		},
+		{
+			name: "pkcs12 with key files",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:              "app.example.com",
+								Scheme:            "http",
+								HostName:          "localhost",
+								Port:              3000,
+								ServerCertificate: &certs.CertificateDefs{PKCS12: "app.p12", PrivateKey: "app.key"},
+							},
+						},
+					},
+				},
+			},
+			expected: "web_virtual_hosts[0].server_certificate: pkcs12: cannot be used with public_key and private_key",
+		},
+		{
+			name: "different tls policies for the same server name",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:      "app.example.com/api",
+								Scheme:    "http",
+								HostName:  "localhost",
+								Port:      3000,
+								TLSPolicy: &certs.TLSPolicy{Preset: certs.TLSPresetModern},
+							},
+						},
+					},
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:      "app.example.com/web",
+								Scheme:    "http",
+								HostName:  "localhost",
+								Port:      3001,
+								TLSPolicy: &certs.TLSPolicy{Preset: certs.TLSPresetLegacy},
+							},
+						},
+					},
+				},
+			},
+			expected: "tls_policy: virtual hosts of 'app.example.com' have different TLS policies",
+		},
+		{
+			name: "invalid acme directory url",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "app.example.com",
+								Scheme:   "http",
+								HostName: "localhost",
+								Port:     3000,
+							},
+						},
+					},
+				},
+				ACME: &certs.ACMEConfig{DirectoryURL: "staging"},
+			},
+			expected: "acme.directory_url: 'staging' must be an http or https URL",
+		},
+		{
+			name: "local ca without hosts",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "app.internal",
+								Scheme:   "http",
+								HostName: "localhost",
+								Port:     3000,
+							},
+						},
+					},
+				},
+				LocalCA: &certs.LocalCAConfig{},
+			},
+			expected: "local_ca.hosts: at least one host is required",
+		},
+		{
+			name: "key encryption with file and env",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "app.example.com",
+								Scheme:   "http",
+								HostName: "localhost",
+								Port:     3000,
+							},
+						},
+					},
+				},
+				KeyEncryption: &certs.KeyEncryption{File: "master.key", Env: "MASTER_KEY"},
+			},
+			expected: "key_encryption.master_key_file: cannot be used with master_key_env",
+		},
+		{
+			name: "negative cert expiry warning",
+			config: &Config{
+				WebVirtualHosts: []*WebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "app.example.com",
+								Scheme:   "http",
+								HostName: "localhost",
+								Port:     3000,
+							},
+						},
+					},
+				},
+				CertExpiryDays: -1,
+			},
+			expected: "cert_expiry_warning_days: must not be negative",
+		},
+		{
+			name: "jwt without keys",
+			config: &Config{
+				GrpcWebVirtualHosts: []*GrpcWebVirtualHost{
+					{
+						ClientCertificateHost: ClientCertificateHost{
+							VirtualHostBase: VirtualHostBase{
+								From:     "grpc.example.com",
+								Scheme:   "http",
+								HostName: "grpc-service",
+								Port:     9090,
+							},
+							JWT: &jwtauth.Config{Issuer: "https://idp.example.com"},
+						},
+						GrpcWebProxy: &grpcutil.GrpcWebProxy{},
+					},
+				},
+			},
+			expected: "grpc_web_virtual_hosts[0].jwt: either 'jwks_url' or 'key_files' is required",
+		},
 		{
 			name: "missing grpc_web_proxy in grpc_web_virtual_host",
 			config: &Config{
@@ -287,3 +552,52 @@ func TestConfig_Validate_WhenMissingRequiredFields_ThenReturnsError(t *testing.T
 		})
 	}
 }
+
+func TestConfig_ValidateCertificates_WhenCertificateDoesNotCoverHost_ThenReturnsError(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_KEY_PASSWORD", "changeit")
+	newHost := func(from string) *WebVirtualHost {
+		return &WebVirtualHost{
+			ClientCertificateHost: ClientCertificateHost{
+				VirtualHostBase: VirtualHostBase{
+					From:              from,
+					ServerCertificate: &certs.CertificateDefs{PKCS12: "../infrastructure/certificates/testdata/bundle.p12", PasswordEnv: "TEST_KEY_PASSWORD"},
+				},
+			},
+		}
+	}
+	covered := &Config{WebVirtualHosts: []*WebVirtualHost{newHost("example.com/api")}}
+	notCovered := &Config{WebVirtualHosts: []*WebVirtualHost{newHost("example.com/api"), newHost("www.example.com")}}
+
+	// Act
+	coveredErr := covered.ValidateCertificates()
+	err := notCovered.ValidateCertificates()
+
+	// Assert
+	assert.NoError(t, coveredErr)
+	assert.EqualError(t, err, "web_virtual_hosts[1].server_certificate: certificate does not cover 'www.example.com', it covers example.com")
+}
+
+func TestServerNameOfAndPathOf_WhenFromHasOrLacksPath_ThenSplitsIt(t *testing.T) {
+	tests := []struct {
+		from       string
+		serverName string
+		path       string
+	}{
+		{from: "app.example.com", serverName: "app.example.com", path: ""},
+		{from: "app.example.com/", serverName: "app.example.com", path: "/"},
+		{from: "app.example.com/api/v1", serverName: "app.example.com", path: "/api/v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			// Act
+			serverName := ServerNameOf(tt.from)
+			path := PathOf(tt.from)
+
+			// Assert
+			assert.Equal(t, tt.serverName, serverName)
+			assert.Equal(t, tt.path, path)
+		})
+	}
+}
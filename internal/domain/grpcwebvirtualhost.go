@@ -18,10 +18,30 @@ type GrpcWebVirtualHost struct {
 func GrpcWebVirtualHostProvider(host *GrpcWebVirtualHost, server *grpcutil.WrappedGrpcServer, logger Logger) IVirtualHost {
 	host.server = server
 	host.logger = logger
+	host.setUpIPRules()
+	host.setUpClientAuth(host.GetAuthorizedCAs())
+	host.setUpRevocation()
+	host.setUpClientCertRules()
+	host.setUpForwardAuth()
+	host.setUpJWT()
 	return host
 }
 
 func (g *GrpcWebVirtualHost) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !g.allowClient(rw, req) || !g.checkClientCertificate(rw, req) || !g.authorizeClientCertificate(rw, req) {
+		return
+	}
+
+	claims, valid := g.validateToken(rw, req, true)
+	if !valid {
+		return
+	}
+
+	authHeaders, allowed := g.authorize(rw, req)
+	if !allowed {
+		return
+	}
+
 	var outReq http.Request
 	if err := copier.Copy(&outReq, req); err != nil {
 		g.logger.Error("Failed to copy request: " + err.Error())
@@ -29,5 +49,8 @@ func (g *GrpcWebVirtualHost) ServeHTTP(rw http.ResponseWriter, req *http.Request
 		return
 	}
 	g.redirectRequest(&outReq, req, false)
+	g.applyAuthHeaders(outReq.Header, authHeaders)
+	g.applyClaimHeaders(outReq.Header, claims)
+	g.forwardClientCertificate(outReq.Header, req, g.ForwardClientCert)
 	g.server.ServeHTTP(rw, &outReq)
 }
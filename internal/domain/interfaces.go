@@ -4,8 +4,10 @@ import (
 	"crypto/tls"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/janmbaco/go-infrastructure/v2/logs"
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
 )
 
 // Logger interface for logging
@@ -22,15 +24,32 @@ type Logger interface {
 // CertificateManager interface for managing certificates
 type CertificateManager interface {
 	AddCertificate(host string, cert *tls.Certificate)
-	AddAutoCertificate(host string)
+	AddCertificateFiles(host string, certFile string, keyFile string) error
+	AddKeyPair(host string, source certs.KeyPairSource) error
+	AddAutoCertificate(host string) error
+	AddUpstreamCertificate(host string, source certs.KeyPairSource)
 	HasCertificateFor(host string) bool
 	GetTLSConfig() *tls.Config
-	AddClientCA(cas []string)
+	HTTPHandler(fallback http.Handler) http.Handler
+	SetClientAuth(host string, mode certs.ClientAuthMode, cas []string)
+	SetDefaultTLSPolicy(policy *certs.TLSPolicy)
+	SetTLSPolicy(host string, policy *certs.TLSPolicy)
+	WatchFiles(interval time.Duration, onChange func(changed []string))
+	StartOCSPStapling(cacheDir string, logger certs.Logger)
+	StartExpiryMonitor(warnBefore time.Duration, logger certs.Logger)
+	StartSessionTicketRotation(config *certs.SessionTickets, logger certs.Logger)
+	SetECHKeys(echKeys *certs.ECHKeys)
+	StartECHKeyRotation(logger certs.Logger)
+	SetDNS01Manager(manager *certs.DNS01Manager)
+	StartDNS01()
+	SetLocalCA(localCA *certs.LocalCA)
+	Stop()
 }
 
 // CertificateProvider interface for certificate definitions
 type CertificateProvider interface {
 	GetCertificate() (*tls.Certificate, error)
+	Files() []string
 	GetTLSConfig() (*tls.Config, error)
 	GetAuthorizedCAs() []string
 }
@@ -45,11 +64,20 @@ type IVirtualHost interface {
 	GetURLToReplace() string
 	GetURL() string
 	GetAuthorizedCAs() []string
+	GetClientAuth() certs.ClientAuthMode
+	GetTLSPolicy() *certs.TLSPolicy
+	ReloadClientCAs(changed []string)
 	GetServerCertificate() CertificateProvider
 	GetHostName() string
 	EnsureID()
 }
 
+// UpstreamCertificateHost is implemented by the virtual hosts that can present a client
+// certificate to their upstream server.
+type UpstreamCertificateHost interface {
+	GetClientCertificate() CertificateProvider
+}
+
 // VirtualHostResolver interface for resolving virtual hosts
 type VirtualHostResolver interface {
 	Resolve(config *Config) ([]IVirtualHost, error)
@@ -58,6 +86,7 @@ type VirtualHostResolver interface {
 // HTTPRedirector interface for managing HTTP to HTTPS redirects
 type HTTPRedirector interface {
 	UpdateRedirectRules(hosts []IVirtualHost)
+	UpdateCertManager(certMgr CertificateManager)
 	Start() error
 }
 
@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
@@ -9,8 +11,14 @@ import (
 
 	"github.com/google/uuid"
 	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/clientcert"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/ipfilter"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/metrics"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/revocation"
 )
 
+var deniedRequests = metrics.Default.NewCounterVec("reverseproxy_denied_requests_total", "Requests rejected by the access rules of a virtual host.", "host", "reason")
+
 // VirtualHostBase is used to configure a virtual host.
 type VirtualHostBase struct {
 	ID                string                 `json:"id,omitempty"`
@@ -20,10 +28,19 @@ type VirtualHostBase struct {
 	Port              uint                   `json:"port"`
 	Path              string                 `json:"path"`
 	ServerCertificate *certs.CertificateDefs `json:"server_certificate"`
+	ClientAuth        certs.ClientAuthMode   `json:"client_auth,omitempty"`
+	ClientCertRules   *clientcert.Rules      `json:"client_certificate_rules,omitempty"`
+	Revocation        *revocation.Config     `json:"revocation,omitempty"`
+	IPRules           *ipfilter.Rules        `json:"ip_rules,omitempty"`
+	TLSPolicy         *certs.TLSPolicy       `json:"tls_policy,omitempty"`
 	urlToReplace      string
 	pathToDelete      string
 	hostToReplace     string
 	logger            Logger
+	ipFilter          *ipfilter.Filter
+	clientCAs         *certs.ClientCAPool
+	clientCertPolicy  *clientcert.Policy
+	revocationChecker *revocation.Checker
 }
 
 // EnsureID ensures the virtual host has a unique ID
@@ -49,16 +66,12 @@ func (virtualHost *VirtualHostBase) SetURLToReplace() {
 	if !strings.HasSuffix(virtualHost.urlToReplace, "/") {
 		virtualHost.urlToReplace += "/"
 	}
-	paths := strings.SplitAfterN(virtualHost.From, "/", 2)
-	virtualHost.hostToReplace = strings.ReplaceAll(paths[0], "/", "")
-	if len(paths) == 2 && len(paths[1]) > 0 {
-		var b strings.Builder
-		b.WriteString("/")
-		b.WriteString(paths[1])
-		if !strings.HasSuffix(paths[1], "/") {
-			b.WriteString("/")
+	virtualHost.hostToReplace = ServerNameOf(virtualHost.From)
+	if path := PathOf(virtualHost.From); len(path) > 1 {
+		if !strings.HasSuffix(path, "/") {
+			path += "/"
 		}
-		virtualHost.pathToDelete = b.String()
+		virtualHost.pathToDelete = path
 	}
 }
 
@@ -91,6 +104,16 @@ func (virtualHost *VirtualHostBase) GetAuthorizedCAs() []string {
 	return CAs
 }
 
+// GetClientAuth gets the client certificate policy of the virtual host.
+func (virtualHost *VirtualHostBase) GetClientAuth() certs.ClientAuthMode {
+	return virtualHost.ClientAuth
+}
+
+// GetTLSPolicy gets the TLS policy of the server name of the virtual host.
+func (virtualHost *VirtualHostBase) GetTLSPolicy() *certs.TLSPolicy {
+	return virtualHost.TLSPolicy
+}
+
 // GetHostName gets the host name
 func (virtualHost *VirtualHostBase) GetHostName() string {
 	var b strings.Builder
@@ -100,6 +123,195 @@ func (virtualHost *VirtualHostBase) GetHostName() string {
 	return b.String()
 }
 
+func (virtualHost *VirtualHostBase) setUpIPRules() {
+	if virtualHost.IPRules.IsEmpty() {
+		return
+	}
+
+	filter, err := virtualHost.IPRules.Compile()
+	if err != nil {
+		virtualHost.logger.Error(fmt.Sprintf("Failed to configure IP rules for %v: %v", virtualHost.From, err))
+		return
+	}
+	virtualHost.ipFilter = filter
+}
+
+// allowClient checks the IP rules against the client address. It returns false when the response was already written.
+func (virtualHost *VirtualHostBase) allowClient(rw http.ResponseWriter, req *http.Request) bool {
+	if virtualHost.IPRules.IsEmpty() {
+		return true
+	}
+	if virtualHost.ipFilter == nil {
+		http.Error(rw, "Access control is not available", http.StatusServiceUnavailable)
+		return false
+	}
+
+	addr := ipfilter.RemoteAddr(req)
+	if virtualHost.ipFilter.Allowed(addr, req.URL.Path) {
+		return true
+	}
+
+	deniedRequests.Inc(virtualHost.From, "ip")
+	virtualHost.logger.Info(fmt.Sprintf("access from '%v' to '%v%v' denied by IP rules", addr, virtualHost.From, req.URL.Path))
+	http.Error(rw, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+func (virtualHost *VirtualHostBase) setUpClientAuth(authorizedCAs []string) {
+	if len(authorizedCAs) == 0 {
+		return
+	}
+
+	clientCAs, err := certs.LoadClientCAPool(authorizedCAs...)
+	if err != nil {
+		virtualHost.logger.Error(fmt.Sprintf("Failed to load client CAs for %v: %v", virtualHost.From, err))
+		return
+	}
+	virtualHost.clientCAs = clientCAs
+}
+
+// ReloadClientCAs loads the client CAs again when any of the changed files is one of them.
+func (virtualHost *VirtualHostBase) ReloadClientCAs(changed []string) {
+	if virtualHost.clientCAs == nil {
+		return
+	}
+	if reloaded, err := virtualHost.clientCAs.Reload(changed); err != nil {
+		virtualHost.logger.Error(fmt.Sprintf("Failed to reload client CAs for %v, keeping the previous ones: %v", virtualHost.From, err))
+	} else if reloaded {
+		virtualHost.logger.Info(fmt.Sprintf("client CAs of '%v' reloaded", virtualHost.From))
+	}
+}
+
+// checkClientCertificate enforces the client certificate policy of the virtual host. The TLS
+// handshake is shared by the virtual hosts of a server name, so the certificate is verified
+// again against the CAs of this virtual host. It returns false when the response was already written.
+func (virtualHost *VirtualHostBase) checkClientCertificate(rw http.ResponseWriter, req *http.Request) bool {
+	var chain []*x509.Certificate
+	if req.TLS != nil {
+		chain = req.TLS.PeerCertificates
+	}
+
+	switch virtualHost.ClientAuth {
+	case certs.ClientAuthNone, certs.ClientAuthRequest:
+		return true
+	case certs.ClientAuthRequire:
+		if len(chain) == 0 {
+			http.Error(rw, "Client certificate required", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	case certs.ClientAuthVerify:
+		if len(chain) == 0 {
+			http.Error(rw, "Client certificate required", http.StatusUnauthorized)
+			return false
+		}
+	default:
+		if len(chain) == 0 || virtualHost.clientCAs == nil {
+			return true
+		}
+	}
+
+	if virtualHost.clientCAs == nil {
+		http.Error(rw, "Client certificate validation is not available", http.StatusServiceUnavailable)
+		return false
+	}
+	verified, err := certs.VerifyClientCertificate(virtualHost.clientCAs.Pool(), chain)
+	if err != nil {
+		virtualHost.logger.Info(fmt.Sprintf("client certificate '%v' rejected by '%v': %v", chain[0].Subject, virtualHost.From, err))
+		http.Error(rw, "Client certificate not authorized", http.StatusForbidden)
+		return false
+	}
+	return virtualHost.checkRevocation(rw, verified)
+}
+
+func (virtualHost *VirtualHostBase) setUpRevocation() {
+	if virtualHost.Revocation == nil {
+		return
+	}
+
+	checker, err := revocation.NewChecker(virtualHost.Revocation, virtualHost.logger)
+	if err != nil {
+		virtualHost.logger.Error(fmt.Sprintf("Failed to configure revocation checking for %v: %v", virtualHost.From, err))
+		return
+	}
+	virtualHost.revocationChecker = checker
+}
+
+// checkRevocation checks the revocation status of a verified client certificate chain, if
+// configured. It returns false when the response was already written.
+func (virtualHost *VirtualHostBase) checkRevocation(rw http.ResponseWriter, chain []*x509.Certificate) bool {
+	if virtualHost.Revocation == nil {
+		return true
+	}
+	if virtualHost.revocationChecker == nil {
+		http.Error(rw, "Client certificate validation is not available", http.StatusServiceUnavailable)
+		return false
+	}
+
+	err := virtualHost.revocationChecker.Check(chain)
+	if err == nil {
+		return true
+	}
+
+	deniedRequests.Inc(virtualHost.From, "revoked")
+	virtualHost.logger.Info(fmt.Sprintf("client certificate '%v' rejected by '%v': %v", chain[0].Subject, virtualHost.From, err))
+	var revokedErr *revocation.RevokedError
+	if errors.As(err, &revokedErr) {
+		http.Error(rw, "Client certificate revoked", http.StatusForbidden)
+	} else {
+		http.Error(rw, "Client certificate status unavailable", http.StatusForbidden)
+	}
+	return false
+}
+
+func (virtualHost *VirtualHostBase) setUpClientCertRules() {
+	if virtualHost.ClientCertRules.IsEmpty() {
+		return
+	}
+
+	policy, err := virtualHost.ClientCertRules.Compile()
+	if err != nil {
+		virtualHost.logger.Error(fmt.Sprintf("Failed to configure client certificate rules for %v: %v", virtualHost.From, err))
+		return
+	}
+	virtualHost.clientCertPolicy = policy
+}
+
+// authorizeClientCertificate checks the client certificate rules against the identity of the
+// client. Every denial is written to the log for auditing. It returns false when the response
+// was already written.
+func (virtualHost *VirtualHostBase) authorizeClientCertificate(rw http.ResponseWriter, req *http.Request) bool {
+	if virtualHost.ClientCertRules.IsEmpty() {
+		return true
+	}
+	if virtualHost.clientCertPolicy == nil {
+		http.Error(rw, "Access control is not available", http.StatusServiceUnavailable)
+		return false
+	}
+
+	var certificate *x509.Certificate
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		certificate = req.TLS.PeerCertificates[0]
+	}
+	if certificate == nil && virtualHost.clientCertPolicy.RequiresCertificate(req.URL.Path) {
+		deniedRequests.Inc(virtualHost.From, "client_certificate")
+		virtualHost.logger.Info(fmt.Sprintf("access from '%v' to '%v%v' denied: client certificate required", req.RemoteAddr, virtualHost.From, req.URL.Path))
+		http.Error(rw, "Client certificate required", http.StatusUnauthorized)
+		return false
+	}
+
+	decision := virtualHost.clientCertPolicy.Evaluate(certificate, req.URL.Path)
+	if decision.Allowed {
+		return true
+	}
+
+	deniedRequests.Inc(virtualHost.From, "client_certificate")
+	virtualHost.logger.Info(fmt.Sprintf("access from '%v' (subject '%v', fingerprint %v) to '%v%v' denied by client certificate rule %v",
+		req.RemoteAddr, certificate.Subject, clientcert.Fingerprint(certificate), virtualHost.From, req.URL.Path, decision.Rule))
+	http.Error(rw, "Forbidden", http.StatusForbidden)
+	return false
+}
+
 func (virtualHost *VirtualHostBase) serve(rw http.ResponseWriter, req *http.Request, directorFunc func(outReq *http.Request), transport http.RoundTripper) {
 	(&httputil.ReverseProxy{
 		Director:  directorFunc,
@@ -1,10 +1,26 @@
 package domain
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/clientcert"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/ipfilter"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/revocation"
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -551,3 +567,174 @@ func TestVirtualHostBase_PathNormalization_EdgeCases_ThenHandlesCorrectly(t *tes
 		})
 	}
 }
+
+func TestVirtualHostBase_allowClient_WhenIPIsDenied_ThenWritesForbiddenAndCountsIt(t *testing.T) {
+	// Arrange
+	mockLogger := &mocks.MockLogger{}
+	mockLogger.On("Info", mock.Anything).Maybe()
+	vh := &VirtualHostBase{
+		From:    "denied.example.com",
+		IPRules: &ipfilter.Rules{Allow: []string{"10.0.0.0/8"}},
+		logger:  mockLogger,
+	}
+	vh.setUpIPRules()
+	req := httptest.NewRequest(http.MethodGet, "https://denied.example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rw := httptest.NewRecorder()
+	before := deniedRequests.Value("denied.example.com", "ip")
+
+	// Act
+	allowed := vh.allowClient(rw, req)
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, before+1, deniedRequests.Value("denied.example.com", "ip"))
+}
+
+func TestVirtualHostBase_allowClient_WhenIPIsAllowed_ThenReturnsTrue(t *testing.T) {
+	// Arrange
+	vh := &VirtualHostBase{
+		From:    "allowed.example.com",
+		IPRules: &ipfilter.Rules{Allow: []string{"10.0.0.0/8"}},
+		logger:  &mocks.MockLogger{},
+	}
+	vh.setUpIPRules()
+	req := httptest.NewRequest(http.MethodGet, "https://allowed.example.com/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+
+	// Act
+	allowed := vh.allowClient(httptest.NewRecorder(), req)
+
+	// Assert
+	assert.True(t, allowed)
+}
+
+func newSelfSignedCertificate(t *testing.T, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return certificate
+}
+
+func loadClientCAs(t *testing.T, certificate *x509.Certificate) *certs.ClientCAPool {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), 0o600))
+	clientCAs, err := certs.LoadClientCAPool(path)
+	assert.NoError(t, err)
+	return clientCAs
+}
+
+func TestVirtualHostBase_checkClientCertificate_WhenRequiredAndMissing_ThenWritesUnauthorized(t *testing.T) {
+	// Arrange
+	vh := &VirtualHostBase{From: "mtls.example.com", ClientAuth: certs.ClientAuthRequire, logger: &mocks.MockLogger{}}
+	req := httptest.NewRequest(http.MethodGet, "https://mtls.example.com/", nil)
+	rw := httptest.NewRecorder()
+
+	// Act
+	allowed := vh.checkClientCertificate(rw, req)
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestVirtualHostBase_checkClientCertificate_WhenIssuedByOtherHostCA_ThenWritesForbidden(t *testing.T) {
+	// Arrange
+	mockLogger := &mocks.MockLogger{}
+	mockLogger.On("Info", mock.Anything).Maybe()
+	clientCAs := loadClientCAs(t, newSelfSignedCertificate(t, "host-a-ca"))
+	vh := &VirtualHostBase{From: "b.example.com", ClientAuth: certs.ClientAuthVerify, clientCAs: clientCAs, logger: mockLogger}
+	req := httptest.NewRequest(http.MethodGet, "https://b.example.com/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newSelfSignedCertificate(t, "host-b-client")}}
+	rw := httptest.NewRecorder()
+
+	// Act
+	allowed := vh.checkClientCertificate(rw, req)
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestVirtualHostBase_checkClientCertificate_WhenIssuedByHostCA_ThenReturnsTrue(t *testing.T) {
+	// Arrange
+	certificate := newSelfSignedCertificate(t, "trusted")
+	vh := &VirtualHostBase{From: "a.example.com", ClientAuth: certs.ClientAuthVerify, clientCAs: loadClientCAs(t, certificate), logger: &mocks.MockLogger{}}
+	req := httptest.NewRequest(http.MethodGet, "https://a.example.com/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+
+	// Act
+	allowed := vh.checkClientCertificate(httptest.NewRecorder(), req)
+
+	// Assert
+	assert.True(t, allowed)
+}
+
+func TestVirtualHostBase_authorizeClientCertificate_WhenRuleDenies_ThenWritesForbiddenAndCountsIt(t *testing.T) {
+	// Arrange
+	mockLogger := &mocks.MockLogger{}
+	mockLogger.On("Info", mock.Anything).Once()
+	vh := &VirtualHostBase{
+		From:            "rules.example.com",
+		ClientCertRules: &clientcert.Rules{Paths: []*clientcert.PathRules{{Path: "/admin", Allow: []*clientcert.Match{{CommonName: "admin"}}}}},
+		logger:          mockLogger,
+	}
+	vh.setUpClientCertRules()
+	req := httptest.NewRequest(http.MethodGet, "https://rules.example.com/admin/users", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{newSelfSignedCertificate(t, "guest")}}
+	rw := httptest.NewRecorder()
+	before := deniedRequests.Value("rules.example.com", "client_certificate")
+
+	// Act
+	allowed := vh.authorizeClientCertificate(rw, req)
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, before+1, deniedRequests.Value("rules.example.com", "client_certificate"))
+	mockLogger.AssertExpectations(t)
+}
+
+func TestVirtualHostBase_authorizeClientCertificate_WhenPathIsNotRestricted_ThenReturnsTrue(t *testing.T) {
+	// Arrange
+	vh := &VirtualHostBase{
+		From:            "rules.example.com",
+		ClientCertRules: &clientcert.Rules{Paths: []*clientcert.PathRules{{Path: "/admin", Allow: []*clientcert.Match{{CommonName: "admin"}}}}},
+		logger:          &mocks.MockLogger{},
+	}
+	vh.setUpClientCertRules()
+	req := httptest.NewRequest(http.MethodGet, "https://rules.example.com/public", nil)
+
+	// Act
+	allowed := vh.authorizeClientCertificate(httptest.NewRecorder(), req)
+
+	// Assert
+	assert.True(t, allowed)
+}
+
+func TestVirtualHostBase_checkRevocation_WhenCheckerIsNotAvailable_ThenWritesServiceUnavailable(t *testing.T) {
+	// Arrange
+	vh := &VirtualHostBase{From: "crl.example.com", Revocation: &revocation.Config{OCSP: true}, logger: &mocks.MockLogger{}}
+	rw := httptest.NewRecorder()
+
+	// Act
+	allowed := vh.checkRevocation(rw, []*x509.Certificate{newSelfSignedCertificate(t, "client")})
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+}
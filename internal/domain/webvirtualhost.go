@@ -1,45 +1,170 @@
 package domain
 
 import (
-	"encoding/base64"
+	"fmt"
 	"net/http"
+	"slices"
+	"sync"
+
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/clientcert"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/jwt"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/oidc"
 )
 
 // WebVirtualHost is used to configure a virtual host by web.
 type WebVirtualHost struct {
 	ClientCertificateHost
-	ResponseHeaders  map[string]string `json:"response_headers"`
-	NeedPkFromClient bool              `json:"need_pk_from_client"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+	// Deprecated: use client_auth, client_certificate_rules and forward_client_cert. When set
+	// a client certificate is required and its public key is sent in X-Forwarded-PrivateKey;
+	// when those are empty it is forwarded in the xfcc format too, if it is verified.
+	NeedPkFromClient bool         `json:"need_pk_from_client"`
+	OIDC             *oidc.Config `json:"oidc,omitempty"`
+	oidcGateway      *oidc.Gateway
+	upstream         *upstreamTransport
+}
+
+// upstreamTransport keeps the transport to the upstream server, so its connections are reused,
+// until the files of the client certificate change.
+type upstreamTransport struct {
+	mu        sync.Mutex
+	transport *http.Transport
 }
 
 // WebVirtualHostProvider provides a IVirtualHost
 func WebVirtualHostProvider(host *WebVirtualHost, logger Logger) IVirtualHost {
 	host.logger = logger
+	host.setUpIPRules()
+	host.setUpClientAuth(host.GetAuthorizedCAs())
+	host.setUpRevocation()
+	host.setUpClientCertRules()
+	host.setUpForwardAuth()
+	host.setUpJWT()
+	host.upstream = &upstreamTransport{}
+	if host.OIDC != nil {
+		gateway, err := oidc.NewGateway(host.OIDC, host.From, PathOf(host.From), logger)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to configure OIDC for %v: %v", host.From, err))
+		}
+		host.oidcGateway = gateway
+	}
 	return host
 }
 
+// GetClientAuth obtains the client certificate policy, taking into account the deprecated NeedPkFromClient flag.
+func (webVirtualHost *WebVirtualHost) GetClientAuth() certs.ClientAuthMode {
+	if webVirtualHost.NeedPkFromClient && webVirtualHost.ClientAuth == "" {
+		return certs.ClientAuthRequire
+	}
+	return webVirtualHost.ClientAuth
+}
+
+// clientCertForwarding obtains the client certificate forwarding, taking into account the deprecated NeedPkFromClient flag.
+func (webVirtualHost *WebVirtualHost) clientCertForwarding() *clientcert.ForwardConfig {
+	if webVirtualHost.NeedPkFromClient && webVirtualHost.ForwardClientCert == nil {
+		return &clientcert.ForwardConfig{Format: clientcert.ForwardXFCC}
+	}
+	return webVirtualHost.ForwardClientCert
+}
+
 func (webVirtualHost *WebVirtualHost) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if webVirtualHost.NeedPkFromClient && req.TLS.PeerCertificates == nil {
+	if !webVirtualHost.allowClient(rw, req) || !webVirtualHost.checkClientCertificate(rw, req) || !webVirtualHost.authorizeClientCertificate(rw, req) {
+		return
+	}
+
+	if webVirtualHost.NeedPkFromClient && (req.TLS == nil || len(req.TLS.PeerCertificates) == 0) {
 		http.Error(rw, "Not authorized", http.StatusUnauthorized)
 		return
 	}
 
-	transport := http.DefaultTransport.(*http.Transport)
-	if webVirtualHost.ClientCertificate != nil {
-		tlsConfig, err := webVirtualHost.ClientCertificate.GetTLSConfig()
-		if err != nil {
-			webVirtualHost.logger.Error("Failed to get TLS config: " + err.Error())
-			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+	// with OIDC, browsers have a session instead of a bearer token: the token is only checked when sent
+	var claims jwt.Claims
+	if webVirtualHost.OIDC == nil || req.Header.Get("Authorization") != "" {
+		var valid bool
+		if claims, valid = webVirtualHost.validateToken(rw, req, false); !valid {
+			return
+		}
+	}
+
+	var identity *oidc.Identity
+	if webVirtualHost.OIDC != nil && claims == nil {
+		if webVirtualHost.oidcGateway == nil {
+			http.Error(rw, "Authentication is not available", http.StatusServiceUnavailable)
+			return
+		}
+		if identity = webVirtualHost.oidcGateway.Authenticate(rw, req); identity == nil {
 			return
 		}
-		transport.TLSClientConfig = tlsConfig
+	}
+
+	authHeaders, allowed := webVirtualHost.authorize(rw, req)
+	if !allowed {
+		return
+	}
+
+	transport, err := webVirtualHost.getTransport()
+	if err != nil {
+		webVirtualHost.logger.Error("Failed to get TLS config: " + err.Error())
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
 	webVirtualHost.serve(rw, req, func(outReq *http.Request) {
 		webVirtualHost.redirectRequest(outReq, req, true)
+		webVirtualHost.applyAuthHeaders(outReq.Header, authHeaders)
+		webVirtualHost.applyClaimHeaders(outReq.Header, claims)
+		if webVirtualHost.oidcGateway != nil {
+			webVirtualHost.oidcGateway.ForwardIdentity(outReq.Header, identity)
+		}
+		webVirtualHost.forwardClientCertificate(outReq.Header, req, webVirtualHost.clientCertForwarding())
 		if webVirtualHost.NeedPkFromClient {
-			pubKey := base64.URLEncoding.EncodeToString(req.TLS.PeerCertificates[0].RawSubjectPublicKeyInfo)
-			outReq.Header.Set("X-Forwarded-PrivateKey", pubKey)
+			clientcert.SetLegacyHeader(outReq.Header, req.TLS.PeerCertificates[0])
 		}
 	}, transport)
 }
+
+// getTransport gets the transport to the upstream server. Virtual hosts with a client
+// certificate get their own transport, with the TLS settings of the certificate.
+func (webVirtualHost *WebVirtualHost) getTransport() (http.RoundTripper, error) {
+	if webVirtualHost.ClientCertificate == nil {
+		return http.DefaultTransport, nil
+	}
+	if webVirtualHost.upstream != nil {
+		webVirtualHost.upstream.mu.Lock()
+		defer webVirtualHost.upstream.mu.Unlock()
+		if webVirtualHost.upstream.transport != nil {
+			return webVirtualHost.upstream.transport, nil
+		}
+	}
+
+	tlsConfig, err := webVirtualHost.ClientCertificate.GetTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if webVirtualHost.upstream != nil {
+		webVirtualHost.upstream.transport = transport
+	}
+	return transport, nil
+}
+
+// ReloadClientCAs loads the client CAs again and, when any file of the client certificate
+// changed, builds a new transport to the upstream server.
+func (webVirtualHost *WebVirtualHost) ReloadClientCAs(changed []string) {
+	webVirtualHost.VirtualHostBase.ReloadClientCAs(changed)
+	if webVirtualHost.upstream == nil || webVirtualHost.ClientCertificate == nil {
+		return
+	}
+	files := append(webVirtualHost.ClientCertificate.Files(), webVirtualHost.ClientCertificate.CaPem...)
+	if !slices.ContainsFunc(files, func(file string) bool { return slices.Contains(changed, file) }) {
+		return
+	}
+	webVirtualHost.upstream.mu.Lock()
+	defer webVirtualHost.upstream.mu.Unlock()
+	if webVirtualHost.upstream.transport != nil {
+		webVirtualHost.upstream.transport.CloseIdleConnections()
+		webVirtualHost.upstream.transport = nil
+	}
+}
@@ -1,9 +1,19 @@
 package domain
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/clientcert"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/jwtauth"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/oidc"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWebVirtualHost_WebVirtualHostProvider_WhenCalled_ThenReturnsConfiguredVirtualHost(t *testing.T) {
@@ -27,3 +37,75 @@ func TestWebVirtualHost_WebVirtualHostProvider_WhenCalled_ThenReturnsConfiguredV
 	assert.Equal(t, host, vh)
 	assert.Equal(t, mockLogger, host.logger)
 }
+
+func TestWebVirtualHost_clientCertForwarding_WhenNeedPkFromClient_ThenUsesXFCC(t *testing.T) {
+	// Arrange
+	host := &WebVirtualHost{NeedPkFromClient: true}
+
+	// Act
+	config := host.clientCertForwarding()
+
+	// Assert
+	assert.Equal(t, clientcert.ForwardXFCC, config.Format)
+	assert.Equal(t, certs.ClientAuthRequire, host.GetClientAuth())
+}
+
+func TestWebVirtualHost_ServeHTTP_WhenJWTAndOIDCAreConfigured_ThenOnlyChecksTokenWhenSent(t *testing.T) {
+	// Arrange
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		base := "http://" + req.Host
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(`{"issuer":"` + base + `","authorization_endpoint":"` + base + `/authorize","token_endpoint":"` + base + `/token","jwks_uri":"` + base + `/jwks"}`))
+	}))
+	t.Cleanup(provider.Close)
+	logger := &MockLogger{}
+	logger.On("Info", mock.Anything).Maybe()
+	logger.On("Error", mock.Anything).Maybe()
+	host := WebVirtualHostProvider(&WebVirtualHost{
+		ClientCertificateHost: ClientCertificateHost{
+			VirtualHostBase: VirtualHostBase{From: "dashboard.example.com"},
+			JWT:             &jwtauth.Config{Issuer: provider.URL, JWKSURL: provider.URL + "/jwks"},
+		},
+		OIDC: &oidc.Config{Issuer: provider.URL, ClientID: "dashboard", CookieSecret: "0123456789abcdef"},
+	}, logger)
+	withToken := httptest.NewRequest(http.MethodGet, "https://dashboard.example.com/", nil)
+	withToken.Header.Set("Authorization", "Bearer not-a-token")
+	browser := httptest.NewRecorder()
+	client := httptest.NewRecorder()
+
+	// Act
+	host.ServeHTTP(browser, httptest.NewRequest(http.MethodGet, "https://dashboard.example.com/", nil))
+	host.ServeHTTP(client, withToken)
+
+	// Assert
+	assert.Equal(t, http.StatusFound, browser.Code)
+	assert.Contains(t, browser.Header().Get("Location"), provider.URL+"/authorize")
+	assert.Equal(t, http.StatusUnauthorized, client.Code)
+}
+
+func TestWebVirtualHost_getTransport_WhenClientCertificateFilesChange_ThenBuildsNewTransport(t *testing.T) {
+	// Arrange
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, nil, 0o600))
+	host := &WebVirtualHost{
+		ClientCertificateHost: ClientCertificateHost{
+			ClientCertificate: &certs.CertificateDefs{ServerName: "backend.internal", CaPem: []string{caFile}},
+		},
+		upstream: &upstreamTransport{},
+	}
+	first, err := host.getTransport()
+	require.NoError(t, err)
+
+	// Act
+	host.ReloadClientCAs([]string{"other.pem"})
+	kept, _ := host.getTransport()
+	require.NoError(t, os.Remove(caFile))
+	host.ReloadClientCAs([]string{caFile})
+	_, rebuildErr := host.getTransport()
+
+	// Assert
+	assert.Same(t, first, kept)
+	assert.NotSame(t, http.DefaultTransport, first)
+	assert.Equal(t, "backend.internal", first.(*http.Transport).TLSClientConfig.ServerName)
+	assert.Error(t, rebuildErr)
+}
@@ -0,0 +1,271 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Well-known ACME directories that can be used by name in directory_url.
+var acmeDirectories = map[string]string{
+	"letsencrypt":         autocert.DefaultACMEDirectory,
+	"letsencrypt-staging": "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"zerossl":             "https://acme.zerossl.com/v2/DV90",
+}
+
+// ACMEKeyType is the type of the key of the ACME account or of a DNS-01 certificate.
+type ACMEKeyType string
+
+// ACME key types. An empty type is ecdsa-p256.
+const (
+	ACMEKeyECDSAP256 ACMEKeyType = "ecdsa-p256"
+	ACMEKeyECDSAP384 ACMEKeyType = "ecdsa-p384"
+	ACMEKeyRSA2048   ACMEKeyType = "rsa-2048"
+	ACMEKeyRSA4096   ACMEKeyType = "rsa-4096"
+)
+
+const acmeClientTimeout = 30 * time.Second
+
+// ACMEConfig is the configuration of the automatic certificates obtained from an ACME CA.
+type ACMEConfig struct {
+	DirectoryURL           string                      `json:"directory_url,omitempty"`
+	Email                  string                      `json:"email,omitempty"`
+	CacheDir               string                      `json:"cache_dir,omitempty"`
+	ExternalAccountBinding *ExternalAccountBindingDefs `json:"external_account_binding,omitempty"`
+	KeyType                ACMEKeyType                 `json:"key_type,omitempty"`
+	CACertificates         []string                    `json:"ca_certificates,omitempty"`
+	DNS01                  *DNS01Config                `json:"dns01,omitempty"`
+	Storage                *CacheStorageConfig         `json:"storage,omitempty"`
+}
+
+// ExternalAccountBindingDefs binds the ACME account to an account of the CA, as required by
+// ZeroSSL and most commercial CAs. The HMAC key is base64url encoded, as the CAs provide it.
+type ExternalAccountBindingDefs struct {
+	KeyID   string `json:"key_id"`
+	HMACKey string `json:"hmac_key"`
+}
+
+// Validate checks the directory URL, email, key type, external account binding, DNS-01 and
+// storage settings.
+func (config *ACMEConfig) Validate() error {
+	if config.DirectoryURL != "" {
+		if _, isContained := acmeDirectories[config.DirectoryURL]; !isContained {
+			parsed, err := url.Parse(config.DirectoryURL)
+			if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+				return fmt.Errorf("directory_url: '%s' must be an http or https URL or one of letsencrypt, letsencrypt-staging or zerossl", config.DirectoryURL)
+			}
+		}
+	}
+	if config.Email != "" && !strings.Contains(config.Email, "@") {
+		return fmt.Errorf("email: '%s' is not a valid email address", config.Email)
+	}
+	if err := config.KeyType.validate(); err != nil {
+		return errors.New("key_type: " + err.Error())
+	}
+	if binding := config.ExternalAccountBinding; binding != nil {
+		if strings.TrimSpace(binding.KeyID) == "" {
+			return errors.New("external_account_binding: 'key_id' is required")
+		}
+		if _, err := binding.key(); err != nil {
+			return errors.New("external_account_binding: 'hmac_key' must be base64url encoded")
+		}
+	}
+	if config.DNS01 != nil {
+		if err := config.DNS01.Validate(); err != nil {
+			return errors.New("dns01." + err.Error())
+		}
+	}
+	if config.Storage != nil {
+		if err := config.Storage.Validate(); err != nil {
+			return errors.New("storage." + err.Error())
+		}
+	}
+	return nil
+}
+
+func (keyType ACMEKeyType) validate() error {
+	switch keyType {
+	case "", ACMEKeyECDSAP256, ACMEKeyECDSAP384, ACMEKeyRSA2048, ACMEKeyRSA4096:
+		return nil
+	default:
+		return fmt.Errorf("unknown key type '%s' (expected ecdsa-p256, ecdsa-p384, rsa-2048 or rsa-4096)", keyType)
+	}
+}
+
+// GetDirectoryURL gets the URL of the ACME directory, Let's Encrypt by default.
+func (config *ACMEConfig) GetDirectoryURL() string {
+	if config == nil || config.DirectoryURL == "" {
+		return autocert.DefaultACMEDirectory
+	}
+	if directory, isContained := acmeDirectories[config.DirectoryURL]; isContained {
+		return directory
+	}
+	return config.DirectoryURL
+}
+
+func (binding *ExternalAccountBindingDefs) key() ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(binding.HMACKey, "="))
+}
+
+// NewACMEManager returns the manager of the automatic certificates. The certificates and the
+// account key are kept in the storage of the config, by default the cache directory of the
+// config, or defaultCacheDir. When the storage cannot be opened the directory is used, and when
+// the CA certificates cannot be read no connection to the directory is trusted; in both cases the
+// error is returned with the manager. The account key is not loaded until the first host needs
+// it, see loadAccountKey.
+func NewACMEManager(config *ACMEConfig, defaultCacheDir string) (*autocert.Manager, error) {
+	if config == nil {
+		config = &ACMEConfig{}
+	}
+	cacheDir := config.CacheDir
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir
+	}
+
+	var errs []error
+	store, err := config.Storage.NewCacheStore(cacheDir)
+	if err != nil {
+		errs = append(errs, err)
+		store = NewDirCacheStore(cacheDir)
+	}
+	cache := &lockingCache{
+		Cache:   &encryptedCache{Cache: store},
+		store:   store,
+		owner:   cacheLockOwner,
+		ttl:     config.Storage.GetLockTTL(),
+		keyType: config.KeyType,
+	}
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  cache,
+		Email:  config.Email,
+	}
+	cache.manager = manager
+	client := &acme.Client{DirectoryURL: config.GetDirectoryURL()}
+	manager.Client = client
+
+	if binding := config.ExternalAccountBinding; binding != nil {
+		key, err := binding.key()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			manager.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: binding.KeyID, Key: key}
+		}
+	}
+
+	if len(config.CACertificates) > 0 {
+		pool, err := NewClientCAPool(config.CACertificates...)
+		if err != nil {
+			// fail closed: the directory cannot be trusted with unreadable CAs
+			errs = append(errs, err)
+			pool = x509.NewCertPool()
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		client.HTTPClient = &http.Client{Transport: transport, Timeout: acmeClientTimeout}
+	}
+
+	return manager, errors.Join(errs...)
+}
+
+// loadAccountKey loads the account key of a manager returned by NewACMEManager, generating it
+// the first time, unless it is already loaded. The key is loaded here, instead of by autocert,
+// so it has the configured type and the DNS-01 issuer uses the same account.
+func loadAccountKey(manager *autocert.Manager) error {
+	cache, isLockingCache := manager.Cache.(*lockingCache)
+	if !isLockingCache || manager.Client == nil || manager.Client.Key != nil {
+		return nil
+	}
+	key, err := accountKey(cache, cache.keyType)
+	if err != nil {
+		return fmt.Errorf("failed to load the ACME account key: %w", err)
+	}
+	manager.Client.Key = key
+	return nil
+}
+
+// accountKey loads the account key of the type from the cache, generating it the first time.
+// ecdsa-p256 keys are kept under the name and format used by autocert.
+func accountKey(cache autocert.Cache, keyType ACMEKeyType) (crypto.Signer, error) {
+	ctx := context.Background()
+	name := "acme_account+key"
+	if keyType != "" && keyType != ACMEKeyECDSAP256 {
+		name = "acme_account_" + string(keyType) + "+key"
+	}
+	if data, err := cache.Get(ctx, name); err == nil {
+		return parseAccountKey(data, name)
+	} else if !errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, err
+	}
+
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{Type: "PRIVATE KEY"}
+	if ecKey, isECDSA := key.(*ecdsa.PrivateKey); isECDSA && ecKey.Curve == elliptic.P256() {
+		block.Type = "EC PRIVATE KEY"
+		block.Bytes, err = x509.MarshalECPrivateKey(ecKey)
+	} else {
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Put(ctx, name, pem.EncodeToMemory(block)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// generateKey generates a key of the type, ecdsa-p256 when the type is empty.
+func generateKey(keyType ACMEKeyType) (crypto.Signer, error) {
+	switch keyType {
+	case ACMEKeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case ACMEKeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case ACMEKeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+}
+
+func parseAccountKey(data []byte, name string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid ACME account key in cache '%s'", name)
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, isSigner := key.(crypto.Signer)
+	if !isSigner {
+		return nil, fmt.Errorf("invalid ACME account key in cache '%s'", name)
+	}
+	return signer, nil
+}
@@ -0,0 +1,368 @@
+package infrastructure
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeStandIn is a minimal ACME server, in the style of Pebble, that issues the certificates
+// with a test CA. Orders are authorized without challenges unless verifyDNS01 or verifyHTTP01 is
+// set, in which case a dns-01 or http-01 challenge is offered and the function decides if it is
+// satisfied.
+type acmeStandIn struct {
+	server       *httptest.Server
+	ca           *testCA
+	caFile       string
+	verifyDNS01  func(domain string, token string) bool
+	verifyHTTP01 func(domain string, token string) bool
+	mu           sync.Mutex
+	nonce        int
+	accounts     []map[string]any
+	domain       string
+	authorized   bool
+	failed       bool
+	issued       bool
+	chain        []byte
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+	_, ca := writeTestCA(t)
+	standIn := &acmeStandIn{ca: ca}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", standIn.directory)
+	mux.HandleFunc("/new-nonce", func(rw http.ResponseWriter, req *http.Request) {})
+	mux.HandleFunc("/new-account", standIn.newAccount)
+	mux.HandleFunc("/new-order", standIn.newOrder)
+	mux.HandleFunc("/order/1", standIn.order(http.StatusOK))
+	mux.HandleFunc("/authz/1", standIn.authorization)
+	mux.HandleFunc("/chal/1", standIn.challenge("dns-01", "/chal/1"))
+	mux.HandleFunc("/chal/2", standIn.challenge("http-01", "/chal/2"))
+	mux.HandleFunc("/finalize/1", standIn.finalize(t))
+	mux.HandleFunc("/cert/1", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		standIn.mu.Lock()
+		defer standIn.mu.Unlock()
+		_, _ = rw.Write(standIn.chain)
+	})
+	standIn.server = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		standIn.mu.Lock()
+		standIn.nonce++
+		rw.Header().Set("Replay-Nonce", "nonce-"+strconv.Itoa(standIn.nonce))
+		standIn.mu.Unlock()
+		mux.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(standIn.server.Close)
+
+	standIn.caFile = filepath.Join(t.TempDir(), "acme-ca.pem")
+	require.NoError(t, os.WriteFile(standIn.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: standIn.server.Certificate().Raw}), 0o600))
+	return standIn
+}
+
+func (standIn *acmeStandIn) directoryURL() string {
+	return standIn.server.URL + "/directory"
+}
+
+func (standIn *acmeStandIn) directory(rw http.ResponseWriter, _ *http.Request) {
+	url := standIn.server.URL
+	_ = json.NewEncoder(rw).Encode(map[string]any{
+		"newNonce":   url + "/new-nonce",
+		"newAccount": url + "/new-account",
+		"newOrder":   url + "/new-order",
+		"revokeCert": url + "/revoke-cert",
+		"keyChange":  url + "/key-change",
+		"meta":       map[string]any{"termsOfService": url + "/terms"},
+	})
+}
+
+func (standIn *acmeStandIn) newAccount(rw http.ResponseWriter, req *http.Request) {
+	var account map[string]any
+	_ = json.Unmarshal(jwsPayload(req), &account)
+	standIn.mu.Lock()
+	standIn.accounts = append(standIn.accounts, account)
+	standIn.mu.Unlock()
+	rw.Header().Set("Location", standIn.server.URL+"/account/1")
+	rw.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(rw).Encode(map[string]any{"status": "valid"})
+}
+
+func (standIn *acmeStandIn) newOrder(rw http.ResponseWriter, req *http.Request) {
+	var order struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	_ = json.Unmarshal(jwsPayload(req), &order)
+	standIn.mu.Lock()
+	if len(order.Identifiers) > 0 {
+		standIn.domain = order.Identifiers[0].Value
+	}
+	standIn.authorized = !standIn.hasChallenges()
+	standIn.failed = false
+	standIn.issued = false
+	standIn.mu.Unlock()
+	standIn.order(http.StatusCreated)(rw, req)
+}
+
+func (standIn *acmeStandIn) order(status int) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		url := standIn.server.URL
+		standIn.mu.Lock()
+		orderStatus := "pending"
+		if standIn.issued {
+			orderStatus = "valid"
+		} else if standIn.authorized {
+			orderStatus = "ready"
+		} else if standIn.failed {
+			orderStatus = "invalid"
+		}
+		authorizations := []string{}
+		if standIn.hasChallenges() {
+			authorizations = append(authorizations, url+"/authz/1")
+		}
+		standIn.mu.Unlock()
+		rw.Header().Set("Location", url+"/order/1")
+		rw.WriteHeader(status)
+		_ = json.NewEncoder(rw).Encode(map[string]any{
+			"status":         orderStatus,
+			"authorizations": authorizations,
+			"finalize":       url + "/finalize/1",
+			"certificate":    url + "/cert/1",
+		})
+	}
+}
+
+func (standIn *acmeStandIn) authorization(rw http.ResponseWriter, _ *http.Request) {
+	standIn.mu.Lock()
+	status := "pending"
+	if standIn.authorized {
+		status = "valid"
+	} else if standIn.failed {
+		status = "invalid"
+	}
+	domain := standIn.domain
+	standIn.mu.Unlock()
+	challenges := []map[string]string{}
+	if standIn.verifyDNS01 != nil {
+		challenges = append(challenges, map[string]string{"type": "dns-01", "url": standIn.server.URL + "/chal/1", "token": "token-1", "status": status})
+	}
+	if standIn.verifyHTTP01 != nil {
+		challenges = append(challenges, map[string]string{"type": "http-01", "url": standIn.server.URL + "/chal/2", "token": "token-2", "status": status})
+	}
+	_ = json.NewEncoder(rw).Encode(map[string]any{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": strings.TrimPrefix(domain, "*.")},
+		"wildcard":   strings.HasPrefix(domain, "*."),
+		"challenges": challenges,
+	})
+}
+
+func (standIn *acmeStandIn) hasChallenges() bool {
+	return standIn.verifyDNS01 != nil || standIn.verifyHTTP01 != nil
+}
+
+func (standIn *acmeStandIn) challenge(challengeType string, path string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		standIn.mu.Lock()
+		domain := standIn.domain
+		standIn.mu.Unlock()
+		verify, token := standIn.verifyDNS01, "token-1"
+		if challengeType == "http-01" {
+			verify, token = standIn.verifyHTTP01, "token-2"
+		}
+		verified := verify(strings.TrimPrefix(domain, "*."), token)
+		standIn.mu.Lock()
+		standIn.authorized = verified
+		standIn.failed = !verified
+		standIn.mu.Unlock()
+		status := "invalid"
+		if verified {
+			status = "valid"
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]string{"type": challengeType, "url": standIn.server.URL + path, "token": token, "status": status})
+	}
+}
+
+func (standIn *acmeStandIn) finalize(t *testing.T) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var finalize struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(jwsPayload(req), &finalize)
+		der, err := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		require.NoError(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, template, standIn.ca.certificate, csr.PublicKey, standIn.ca.key)
+		require.NoError(t, err)
+		standIn.mu.Lock()
+		standIn.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: standIn.ca.certificate.Raw})...)
+		standIn.issued = true
+		standIn.mu.Unlock()
+		standIn.order(http.StatusOK)(rw, req)
+	}
+}
+
+func jwsPayload(req *http.Request) []byte {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	body, _ := io.ReadAll(req.Body)
+	_ = json.Unmarshal(body, &jws)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload
+}
+
+func TestNewACMEManager_WhenDirectoryIsConfigured_ThenObtainsCertificateFromIt(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	cacheDir := t.TempDir()
+	manager, err := NewACMEManager(&ACMEConfig{
+		DirectoryURL:           standIn.directoryURL(),
+		Email:                  "ops@example.com",
+		CacheDir:               cacheDir,
+		ExternalAccountBinding: &ExternalAccountBindingDefs{KeyID: "kid-1", HMACKey: base64.RawURLEncoding.EncodeToString([]byte("secret"))},
+		CACertificates:         []string{standIn.caFile},
+	}, "./certs")
+	require.NoError(t, err)
+	manager.HostPolicy = autocert.HostWhitelist("example.com")
+
+	// Act
+	certificate, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+
+	// Assert
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, leaf.DNSNames)
+	require.Len(t, standIn.accounts, 1)
+	assert.Equal(t, []any{"mailto:ops@example.com"}, standIn.accounts[0]["contact"])
+	assert.Contains(t, standIn.accounts[0], "externalAccountBinding")
+	cached, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	assert.NotEmpty(t, cached)
+}
+
+func TestNewACMEManager_WhenCACertificatesAreMissing_ThenDoesNotTrustDirectory(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	manager, err := NewACMEManager(&ACMEConfig{
+		DirectoryURL:   standIn.directoryURL(),
+		CACertificates: []string{filepath.Join(t.TempDir(), "missing.pem")},
+	}, t.TempDir())
+	require.Error(t, err)
+	manager.HostPolicy = autocert.HostWhitelist("example.com")
+
+	// Act
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+
+	// Assert
+	assert.Error(t, err)
+	assert.Empty(t, standIn.accounts)
+}
+
+func TestNewACMEManager_WhenKeyTypeIsSet_ThenReusesCachedAccountKey(t *testing.T) {
+	// Arrange
+	cacheDir := t.TempDir()
+	config := &ACMEConfig{KeyType: ACMEKeyECDSAP384}
+
+	// Act
+	first, err := NewACMEManager(config, cacheDir)
+	require.NoError(t, err)
+	require.NoError(t, NewCertManager(first).AddAutoCertificate("example.com"))
+	second, err := NewACMEManager(config, cacheDir)
+	require.NoError(t, err)
+	require.NoError(t, NewCertManager(second).AddAutoCertificate("example.com"))
+
+	// Assert
+	key, isECDSA := first.Client.Key.(*ecdsa.PrivateKey)
+	require.True(t, isECDSA)
+	assert.Equal(t, elliptic.P384(), key.Curve)
+	assert.True(t, key.Equal(second.Client.Key))
+	assert.Equal(t, autocert.DefaultACMEDirectory, first.Client.DirectoryURL)
+}
+
+func TestNewACMEManager_WhenNoHostIsAutomatic_ThenDoesNotWriteAccountKey(t *testing.T) {
+	// Arrange
+	cacheDir := t.TempDir()
+
+	// Act
+	manager, err := NewACMEManager(&ACMEConfig{}, cacheDir)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Nil(t, manager.Client.Key)
+	entries, err := os.ReadDir(cacheDir)
+	if err == nil {
+		assert.Empty(t, entries)
+	}
+}
+
+func TestACMEConfig_Validate_WhenConfigIsInvalid_ThenReturnsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *ACMEConfig
+		expected string
+	}{
+		{name: "relative directory", config: &ACMEConfig{DirectoryURL: "/directory"}, expected: "directory_url: '/directory' must be an http or https URL"},
+		{name: "invalid email", config: &ACMEConfig{Email: "ops"}, expected: "email: 'ops' is not a valid email address"},
+		{name: "unknown key type", config: &ACMEConfig{KeyType: "ed25519"}, expected: "key_type: unknown key type 'ed25519'"},
+		{name: "binding without key id", config: &ACMEConfig{ExternalAccountBinding: &ExternalAccountBindingDefs{HMACKey: "c2VjcmV0"}}, expected: "'key_id' is required"},
+		{name: "binding with invalid key", config: &ACMEConfig{ExternalAccountBinding: &ExternalAccountBindingDefs{KeyID: "kid", HMACKey: "not base64!"}}, expected: "'hmac_key' must be base64url encoded"},
+		{name: "unknown storage", config: &ACMEConfig{Storage: &CacheStorageConfig{Type: "redis"}}, expected: "storage.type: unknown storage 'redis' (expected dir, sqlite or http)"},
+		{name: "sqlite storage without file", config: &ACMEConfig{Storage: &CacheStorageConfig{Type: CacheStorageSQLite}}, expected: "storage.file: required by type 'sqlite'"},
+		{name: "http storage with relative url", config: &ACMEConfig{Storage: &CacheStorageConfig{Type: CacheStorageHTTP, URL: "kv.internal"}}, expected: "storage.url: 'kv.internal' must be an http or https URL"},
+		{name: "invalid lock ttl", config: &ACMEConfig{Storage: &CacheStorageConfig{Type: CacheStorageDir, LockTTL: "soon"}}, expected: "storage.lock_ttl: 'soon' is not a valid duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			err := tt.config.Validate()
+
+			// Assert
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestACMEConfig_GetDirectoryURL_WhenNameIsKnown_ThenReturnsItsURL(t *testing.T) {
+	// Arrange
+	config := &ACMEConfig{DirectoryURL: "letsencrypt-staging"}
+
+	// Act
+	directory := config.GetDirectoryURL()
+
+	// Assert
+	assert.Equal(t, "https://acme-staging-v02.api.letsencrypt.org/directory", directory)
+}
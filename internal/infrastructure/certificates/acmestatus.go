@@ -0,0 +1,248 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/metrics"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Issuance states of the ACME certificates.
+const (
+	ACMEStatePending  = "pending"
+	ACMEStateIssued   = "issued"
+	ACMEStateFailed   = "failed"
+	ACMEStateRenewing = "renewing"
+)
+
+// autocert renews the certificates 30 days before they expire unless RenewBefore is set.
+const defaultACMERenewBefore = 30 * 24 * time.Hour
+
+var acmeIssuances = metrics.Default.NewCounterVec("reverseproxy_acme_issuances_total", "Certificates obtained, or failed to obtain, from the ACME CA.", "host", "result")
+
+// Errors of RenewACMECertificate.
+var (
+	ErrUnknownACMEHost        = errors.New("host does not use an automatic certificate")
+	ErrACMERenewalInProgress  = errors.New("certificate is already being renewed")
+	errNoACMECertificateFound = errors.New("no certificate obtained")
+)
+
+// ACMEStatus is the issuance state of the automatic certificate of a host.
+type ACMEStatus struct {
+	Host        string    `json:"host"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitzero"`
+	NotAfter    time.Time `json:"not_after,omitzero"`
+	NextRenewal time.Time `json:"next_renewal,omitzero"`
+}
+
+// ACMEStatuses gets the issuance state of the automatic certificates, by host. Hosts without
+// any attempt yet are issued when their certificate is in the cache and pending otherwise.
+func (certManager *CertManager) ACMEStatuses() []ACMEStatus {
+	certManager.mu.RLock()
+	manager := certManager.manager
+	statuses := make([]ACMEStatus, 0, len(certManager.autoCertList))
+	missing := make([]string, 0)
+	for _, host := range certManager.autoCertList {
+		if status, isContained := certManager.acmeStatus[host]; isContained {
+			statuses = append(statuses, *status)
+		} else if !slices.Contains(missing, host) {
+			missing = append(missing, host)
+		}
+	}
+	certManager.mu.RUnlock()
+
+	for _, host := range missing {
+		status := ACMEStatus{Host: host, State: ACMEStatePending}
+		if manager != nil && manager.Cache != nil {
+			if data, err := manager.Cache.Get(withoutCacheLock(context.Background()), host); err == nil {
+				if leaf, err := parseCertificatePEM(data); err == nil {
+					status.State = ACMEStateIssued
+					status.NotAfter = leaf.NotAfter
+					status.NextRenewal = leaf.NotAfter.Add(-acmeRenewBefore(manager))
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+// RenewACMECertificate obtains a new certificate for an automatic host in the background, even
+// when the current one is not due for renewal. The current certificate is served until the new
+// one is obtained, and kept when it cannot be.
+func (certManager *CertManager) RenewACMECertificate(host string) error {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.manager == nil || !slices.Contains(certManager.autoCertList, host) {
+		return ErrUnknownACMEHost
+	}
+	status, isContained := certManager.acmeStatus[host]
+	if !isContained {
+		status = &ACMEStatus{Host: host}
+		certManager.acmeStatus[host] = status
+	} else if status.State == ACMEStateRenewing {
+		return ErrACMERenewalInProgress
+	}
+	status.State = ACMEStateRenewing
+	status.Error = ""
+	status.LastAttempt = time.Now()
+	go certManager.renewACME(host, certManager.manager, certManager.httpChallenges)
+	return nil
+}
+
+// renewACME orders the certificate with a manager that ignores the cached one and, once it is
+// in the cache, replaces the manager in use so the new certificate is served. The lock of the
+// certificate in the cache store is held meanwhile, as the cached certificate is never read, so
+// the instances sharing the store do not order it at the same time. When another instance
+// obtained a new certificate while the lock was awaited, that one is served instead.
+func (certManager *CertManager) renewACME(host string, manager *autocert.Manager, httpChallenges bool) {
+	cache, _ := manager.Cache.(*lockingCache)
+	previous := readCachedCertificate(manager.Cache, host)
+	if err := cache.lockWithin(host); err != nil {
+		certManager.recordACME(host, nil, fmt.Errorf("failed to take the lock of the certificate: %w", err), true)
+		return
+	}
+	defer cache.unlock(host)
+
+	renewer := newACMEManagerLike(manager, &renewalCache{Cache: manager.Cache, hidden: []string{host, host + "+rsa"}})
+	if current := readCachedCertificate(manager.Cache, host); current != nil && !bytes.Equal(current, previous) {
+		renewer = newACMEManagerLike(manager, manager.Cache)
+	}
+	renewer.HostPolicy = autocert.HostWhitelist(host)
+	if httpChallenges {
+		renewer.HTTPHandler(nil)
+	}
+	certificate, err := renewer.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:   host,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err == nil {
+		fresh := newACMEManagerLike(manager, manager.Cache)
+		if httpChallenges {
+			fresh.HTTPHandler(nil)
+		}
+		certManager.mu.Lock()
+		if certManager.manager == manager {
+			certManager.manager = fresh
+		}
+		certManager.mu.Unlock()
+	}
+	certManager.recordACME(host, certificate, err, true)
+}
+
+// readCachedCertificate reads the cached certificate of host without taking its lock, nil when
+// there is none.
+func readCachedCertificate(cache autocert.Cache, host string) []byte {
+	if cache == nil {
+		return nil
+	}
+	data, err := cache.Get(withoutCacheLock(context.Background()), host)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// recordACME records the result of obtaining the certificate of an automatic host. Handshakes
+// only record changes, to keep them from contending on the lock.
+func (certManager *CertManager) recordACME(host string, certificate *tls.Certificate, err error, renewal bool) {
+	if err == nil && (certificate == nil || certificate.Leaf == nil) {
+		err = errNoACMECertificateFound
+	}
+
+	certManager.mu.RLock()
+	status, isContained := certManager.acmeStatus[host]
+	// a failed renewal is kept until a new certificate is served
+	unchanged := isContained && !renewal && status.State != ACMEStateRenewing &&
+		((err == nil && status.NotAfter.Equal(certificate.Leaf.NotAfter)) ||
+			(err != nil && status.State == ACMEStateFailed && status.Error == err.Error()))
+	renewBefore := acmeRenewBefore(certManager.manager)
+	certManager.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	status, isContained = certManager.acmeStatus[host]
+	if !isContained {
+		status = &ACMEStatus{Host: host}
+		certManager.acmeStatus[host] = status
+	} else if status.State == ACMEStateRenewing && !renewal {
+		return
+	}
+	status.LastAttempt = time.Now()
+	if err != nil {
+		acmeIssuances.Inc(host, "failure")
+		status.State = ACMEStateFailed
+		status.Error = err.Error()
+		return
+	}
+	if !status.NotAfter.Equal(certificate.Leaf.NotAfter) {
+		acmeIssuances.Inc(host, "success")
+	}
+	status.State = ACMEStateIssued
+	status.Error = ""
+	status.NotAfter = certificate.Leaf.NotAfter
+	status.NextRenewal = certificate.Leaf.NotAfter.Add(-renewBefore)
+}
+
+func acmeRenewBefore(manager *autocert.Manager) time.Duration {
+	if manager == nil || manager.RenewBefore <= 0 {
+		return defaultACMERenewBefore
+	}
+	return manager.RenewBefore
+}
+
+// newACMEManagerLike returns a manager with the settings and account of manager but none of its
+// state, using cache.
+func newACMEManagerLike(manager *autocert.Manager, cache autocert.Cache) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:                 manager.Prompt,
+		Cache:                  cache,
+		HostPolicy:             manager.HostPolicy,
+		RenewBefore:            manager.RenewBefore,
+		Client:                 manager.Client,
+		Email:                  manager.Email,
+		ExtraExtensions:        manager.ExtraExtensions,
+		ExternalAccountBinding: manager.ExternalAccountBinding,
+	}
+}
+
+// renewalCache hides the cached certificates of a host, so a new one is obtained, and passes
+// through everything else, including the account key and the challenge tokens.
+type renewalCache struct {
+	autocert.Cache
+	hidden []string
+}
+
+func (cache *renewalCache) Get(ctx context.Context, name string) ([]byte, error) {
+	if cache.Cache == nil || slices.Contains(cache.hidden, name) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return cache.Cache.Get(ctx, name)
+}
+
+func (cache *renewalCache) Put(ctx context.Context, name string, data []byte) error {
+	if cache.Cache == nil {
+		return nil
+	}
+	return cache.Cache.Put(ctx, name, data)
+}
+
+func (cache *renewalCache) Delete(ctx context.Context, name string) error {
+	if cache.Cache == nil {
+		return nil
+	}
+	return cache.Cache.Delete(ctx, name)
+}
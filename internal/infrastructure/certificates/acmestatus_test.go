@@ -0,0 +1,147 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var ecdsaHello = &tls.ClientHelloInfo{ServerName: "example.com", CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+
+func newStandInCertManager(t *testing.T, standIn *acmeStandIn) *CertManager {
+	manager, err := NewACMEManager(&ACMEConfig{DirectoryURL: standIn.directoryURL(), CACertificates: []string{standIn.caFile}}, t.TempDir())
+	require.NoError(t, err)
+	certMgr := NewCertManager(manager)
+	certMgr.AddAutoCertificate("example.com")
+	return certMgr
+}
+
+func TestCertManager_ACMEStatuses_WhenHandshakeObtainsCertificate_ThenIsIssued(t *testing.T) {
+	// Arrange
+	certMgr := newStandInCertManager(t, newACMEStandIn(t))
+
+	// Act
+	certificate, err := certMgr.GetTLSConfig().GetCertificate(ecdsaHello)
+	statuses := certMgr.ACMEStatuses()
+
+	// Assert
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, ACMEStateIssued, statuses[0].State)
+	assert.Equal(t, certificate.Leaf.NotAfter, statuses[0].NotAfter)
+	assert.Equal(t, certificate.Leaf.NotAfter.Add(-30*24*time.Hour), statuses[0].NextRenewal)
+	assert.False(t, statuses[0].LastAttempt.IsZero())
+}
+
+func TestCertManager_ACMEStatuses_WhenCAIsUnreachable_ThenIsFailedWithError(t *testing.T) {
+	// Arrange
+	directory := httptest.NewServer(nil)
+	directory.Close()
+	manager, err := NewACMEManager(&ACMEConfig{DirectoryURL: directory.URL + "/directory"}, t.TempDir())
+	require.NoError(t, err)
+	certMgr := NewCertManager(manager)
+	certMgr.AddAutoCertificate("example.com")
+	failures := acmeIssuances.Value("example.com", "failure")
+
+	// Act
+	_, err = certMgr.GetTLSConfig().GetCertificate(ecdsaHello)
+	statuses := certMgr.ACMEStatuses()
+
+	// Assert
+	require.Error(t, err)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, ACMEStateFailed, statuses[0].State)
+	assert.Equal(t, err.Error(), statuses[0].Error)
+	assert.Equal(t, failures+1, acmeIssuances.Value("example.com", "failure"))
+}
+
+func TestCertManager_ACMEStatuses_WhenNoHandshakeYet_ThenReadsCache(t *testing.T) {
+	// Arrange
+	cacheDir := t.TempDir()
+	certMgr := NewCertManager(&autocert.Manager{Cache: autocert.DirCache(cacheDir)})
+	certMgr.AddAutoCertificate("cached.example.com")
+	certMgr.AddAutoCertificate("new.example.com")
+	certFile, _ := writeTestKeyPair(t, t.TempDir(), "cached.example.com", time.Now().Add(60*24*time.Hour))
+	data, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "cached.example.com"), data, 0o600))
+
+	// Act
+	statuses := certMgr.ACMEStatuses()
+
+	// Assert
+	require.Len(t, statuses, 2)
+	assert.Equal(t, ACMEStateIssued, statuses[0].State)
+	assert.False(t, statuses[0].NotAfter.IsZero())
+	assert.Equal(t, "new.example.com", statuses[1].Host)
+	assert.Equal(t, ACMEStatePending, statuses[1].State)
+}
+
+func TestCertManager_RenewACMECertificate_WhenCertificateIsValid_ThenServesNewOne(t *testing.T) {
+	// Arrange
+	certMgr := newStandInCertManager(t, newACMEStandIn(t))
+	previous, err := certMgr.GetTLSConfig().GetCertificate(ecdsaHello)
+	require.NoError(t, err)
+
+	// Act
+	err = certMgr.RenewACMECertificate("example.com")
+
+	// Assert
+	require.NoError(t, err)
+	assert.ErrorIs(t, certMgr.RenewACMECertificate("example.com"), ErrACMERenewalInProgress)
+	require.Eventually(t, func() bool { return certMgr.ACMEStatuses()[0].State == ACMEStateIssued }, 10*time.Second, 10*time.Millisecond)
+	renewed, err := certMgr.GetTLSConfig().GetCertificate(ecdsaHello)
+	require.NoError(t, err)
+	assert.NotEqual(t, previous.Leaf.SerialNumber, renewed.Leaf.SerialNumber)
+	assert.Equal(t, renewed.Leaf.NotAfter, certMgr.ACMEStatuses()[0].NotAfter)
+}
+
+func TestCertManager_RenewACMECertificate_WhenAnotherInstanceHoldsLock_ThenWaitsForIt(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	cacheDir := t.TempDir()
+	manager, err := NewACMEManager(&ACMEConfig{DirectoryURL: standIn.directoryURL(), CACertificates: []string{standIn.caFile}}, cacheDir)
+	require.NoError(t, err)
+	certMgr := NewCertManager(manager)
+	certMgr.AddAutoCertificate("example.com")
+	previous, err := certMgr.GetTLSConfig().GetCertificate(ecdsaHello)
+	require.NoError(t, err)
+	store := NewDirCacheStore(cacheDir)
+	isLocked, err := store.TryLock(context.Background(), "example.com", "instance-b", time.Minute)
+	require.NoError(t, err)
+	require.True(t, isLocked)
+
+	// Act
+	require.NoError(t, certMgr.RenewACMECertificate("example.com"))
+	time.Sleep(200 * time.Millisecond)
+	waiting, err := certMgr.GetTLSConfig().GetCertificate(ecdsaHello)
+	require.NoError(t, err)
+	require.NoError(t, store.Unlock(context.Background(), "example.com", "instance-b"))
+
+	// Assert
+	assert.Equal(t, previous.Leaf.SerialNumber, waiting.Leaf.SerialNumber)
+	require.Eventually(t, func() bool { return certMgr.ACMEStatuses()[0].State == ACMEStateIssued }, 10*time.Second, 10*time.Millisecond)
+	renewed, err := certMgr.GetTLSConfig().GetCertificate(ecdsaHello)
+	require.NoError(t, err)
+	assert.NotEqual(t, previous.Leaf.SerialNumber, renewed.Leaf.SerialNumber)
+}
+
+func TestCertManager_RenewACMECertificate_WhenHostIsNotAutomatic_ThenReturnsError(t *testing.T) {
+	// Arrange
+	certMgr := NewCertManager(&autocert.Manager{})
+	certMgr.AddAutoCertificate("example.com")
+
+	// Act
+	err := certMgr.RenewACMECertificate("other.example.com")
+
+	// Assert
+	assert.ErrorIs(t, err, ErrUnknownACMEHost)
+}
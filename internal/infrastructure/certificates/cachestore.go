@@ -0,0 +1,342 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Cache storages that can be used in the type field of the storage of the ACME configuration.
+const (
+	CacheStorageDir    = "dir"
+	CacheStorageSQLite = "sqlite"
+	CacheStorageHTTP   = "http"
+)
+
+const (
+	defaultCacheLockTTL    = 5 * time.Minute
+	cacheLockPollInterval  = time.Second
+	cacheLockUnlockTimeout = 10 * time.Second
+	cacheLockSuffix        = "+lock"
+	// autocertRenewJitter is how much earlier than its renew_before autocert may renew a certificate.
+	autocertRenewJitter = time.Hour
+)
+
+// CacheStore is where the ACME certificates, their keys, the account key and the HTTP-01
+// challenge tokens are kept. The instances sharing a store share the certificates, and its locks
+// let only one of them obtain each certificate.
+type CacheStore interface {
+	autocert.Cache
+	// TryLock takes the lock of name for owner until ttl elapses, and indicates whether it was
+	// taken. A lock held by another owner is taken once it expires; a lock held by owner is extended.
+	TryLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error)
+	// Unlock releases the lock of name when owner holds it.
+	Unlock(ctx context.Context, name string, owner string) error
+	// List gets the names of the entries, without the locks.
+	List(ctx context.Context) ([]string, error)
+}
+
+// CacheStorageConfig is the configuration of the store of the ACME cache. The directory store
+// suits a single instance, or the instances of one host; the sqlite and http stores let several
+// replicas share their certificates.
+type CacheStorageConfig struct {
+	Type     string `json:"type"`
+	File     string `json:"file,omitempty"`
+	URL      string `json:"url,omitempty"`
+	TokenEnv string `json:"token_env,omitempty"`
+	LockTTL  string `json:"lock_ttl,omitempty"`
+}
+
+// Validate checks the type of the store, its settings and the lock duration.
+func (config *CacheStorageConfig) Validate() error {
+	switch config.Type {
+	case CacheStorageDir:
+	case CacheStorageSQLite:
+		if strings.TrimSpace(config.File) == "" {
+			return errors.New("file: required by type 'sqlite'")
+		}
+	case CacheStorageHTTP:
+		parsed, err := url.Parse(config.URL)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return fmt.Errorf("url: '%s' must be an http or https URL", config.URL)
+		}
+	default:
+		return fmt.Errorf("type: unknown storage '%s' (expected dir, sqlite or http)", config.Type)
+	}
+	if err := validatePositiveDuration(config.LockTTL); err != nil {
+		return errors.New("lock_ttl: " + err.Error())
+	}
+	return nil
+}
+
+// GetLockTTL gets how long a lock is held when its owner does not release it.
+func (config *CacheStorageConfig) GetLockTTL() time.Duration {
+	if config == nil {
+		return defaultCacheLockTTL
+	}
+	return durationOrDefault(config.LockTTL, defaultCacheLockTTL)
+}
+
+// NewCacheStore returns the store of the configuration, the directory store of dir when there is
+// no configuration.
+func (config *CacheStorageConfig) NewCacheStore(dir string) (CacheStore, error) {
+	if config == nil {
+		return NewDirCacheStore(dir), nil
+	}
+	switch config.Type {
+	case CacheStorageSQLite:
+		return NewSQLiteCacheStore(config.File)
+	case CacheStorageHTTP:
+		return NewHTTPCacheStore(config.URL, os.Getenv(config.TokenEnv)), nil
+	default:
+		return NewDirCacheStore(dir), nil
+	}
+}
+
+// DirCacheStore is the store of the ACME cache in a directory, as autocert keeps it. A lock is a
+// file next to the cached one, created exclusively. Taking over an expired lock is not atomic,
+// so two instances may both obtain a certificate whose previous owner stopped while holding it.
+type DirCacheStore struct {
+	autocert.DirCache
+}
+
+// NewDirCacheStore returns a new object of DirCacheStore type.
+func NewDirCacheStore(dir string) *DirCacheStore {
+	return &DirCacheStore{DirCache: autocert.DirCache(dir)}
+}
+
+// TryLock takes the lock of name for owner until ttl elapses.
+func (store *DirCacheStore) TryLock(_ context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	if err := os.MkdirAll(string(store.DirCache), 0o700); err != nil {
+		return false, err
+	}
+	file := filepath.Join(string(store.DirCache), name+cacheLockSuffix)
+	value := formatCacheLock(owner, time.Now().Add(ttl))
+	lockFile, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err == nil {
+		_, err = lockFile.Write(value)
+		return err == nil, errors.Join(err, lockFile.Close())
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		return false, err
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		// released meanwhile, the next try takes it
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !isCacheLockFree(data, owner, time.Now()) {
+		return false, nil
+	}
+	return true, writeFileAtomic(file, value, 0o600)
+}
+
+// Unlock releases the lock of name when owner holds it.
+func (store *DirCacheStore) Unlock(_ context.Context, name string, owner string) error {
+	file := filepath.Join(string(store.DirCache), name+cacheLockSuffix)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if holder, _ := parseCacheLock(data); holder != owner {
+		return nil
+	}
+	if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List gets the names of the entries, without the locks.
+func (store *DirCacheStore) List(_ context.Context) ([]string, error) {
+	entries, err := os.ReadDir(string(store.DirCache))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), cacheLockSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// formatCacheLock gets the content of a lock: its owner and when it expires.
+func formatCacheLock(owner string, expires time.Time) []byte {
+	return []byte(owner + "\n" + expires.UTC().Format(time.RFC3339Nano) + "\n")
+}
+
+// parseCacheLock gets the owner of a lock and when it expires. A lock that cannot be parsed has
+// expired.
+func parseCacheLock(data []byte) (string, time.Time) {
+	owner, expiry, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	expires, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(expiry))
+	if err != nil {
+		return owner, time.Time{}
+	}
+	return owner, expires
+}
+
+// isCacheLockFree indicates whether owner can take a lock with the content data at now.
+func isCacheLockFree(data []byte, owner string, now time.Time) bool {
+	holder, expires := parseCacheLock(data)
+	return holder == owner || !now.Before(expires)
+}
+
+// cacheLockWait is how long a read of the cache waits for the lock of a certificate that another
+// instance is obtaining. The read usually comes from a TLS handshake, which must not hang until
+// the lock expires.
+var cacheLockWait = 5 * time.Second
+
+// cacheLockOwner identifies the process in the locks of the cache store.
+var cacheLockOwner = newCacheLockOwner()
+
+func newCacheLockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "reverseproxy"
+	}
+	suffix := make([]byte, 6)
+	_, _ = rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
+type cacheLockSkipped struct{}
+
+// withoutCacheLock marks the reads of the cache that only inspect the certificates, such as the
+// inventory, so they never take a lock.
+func withoutCacheLock(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheLockSkipped{}, true)
+}
+
+// lockingCache makes the instances sharing a cache store obtain each automatic certificate once.
+// autocert reads a certificate from the cache before obtaining or renewing it and writes it
+// afterwards, so a read that finds the certificate of an allowed host missing or due for renewal
+// takes the lock of its name, waiting up to cacheLockWait while another instance holds it, and the
+// write releases it. A lock left by a failed issuance expires after the lock TTL.
+type lockingCache struct {
+	autocert.Cache
+	store   CacheStore
+	owner   string
+	ttl     time.Duration
+	manager *autocert.Manager
+	// keyType is the type of the account key of the manager
+	keyType ACMEKeyType
+}
+
+func (cache *lockingCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := cache.Cache.Get(ctx, name)
+	if !cache.needsLock(ctx, name, data, err) {
+		return data, err
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, cacheLockWait)
+	defer cancel()
+	if err := cache.lock(lockCtx, name); err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("the certificate of '%s' is being obtained by another instance", name)
+		}
+		return nil, err
+	}
+	// the instance that held the lock may have obtained the certificate
+	data, err = cache.Cache.Get(ctx, name)
+	if !cache.needsLock(ctx, name, data, err) {
+		cache.unlock(name)
+	}
+	return data, err
+}
+
+func (cache *lockingCache) Put(ctx context.Context, name string, data []byte) error {
+	err := cache.Cache.Put(ctx, name, data)
+	if isAutocertCertificateName(name) {
+		cache.unlock(name)
+	}
+	return err
+}
+
+// needsLock indicates whether the result of reading name is a certificate that autocert is about
+// to obtain.
+func (cache *lockingCache) needsLock(ctx context.Context, name string, data []byte, err error) bool {
+	if ctx.Value(cacheLockSkipped{}) != nil || !isAutocertCertificateName(name) {
+		return false
+	}
+	if cache.manager != nil && cache.manager.HostPolicy != nil && cache.manager.HostPolicy(ctx, strings.TrimSuffix(name, "+rsa")) != nil {
+		return false
+	}
+	if err != nil {
+		return errors.Is(err, autocert.ErrCacheMiss)
+	}
+	leaf, err := parseCertificatePEM(data)
+	if err != nil {
+		// autocert does not replace a certificate it cannot read
+		return false
+	}
+	return !time.Now().Add(acmeRenewBefore(cache.manager) + autocertRenewJitter).Before(leaf.NotAfter)
+}
+
+// lock waits until the lock of name is taken, or ctx is done.
+func (cache *lockingCache) lock(ctx context.Context, name string) error {
+	for {
+		isLocked, err := cache.tryLock(ctx, name)
+		if err != nil || isLocked {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cacheLockPollInterval):
+		}
+	}
+}
+
+// lockWithin waits until the lock of name is taken, for up to the lock TTL, as a lock held by
+// another instance is taken once it expires.
+func (cache *lockingCache) lockWithin(name string) error {
+	if cache == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cache.ttl+cacheLockPollInterval)
+	defer cancel()
+	return cache.lock(ctx, name)
+}
+
+// tryLock takes the lock of name, always when there is no cache.
+func (cache *lockingCache) tryLock(ctx context.Context, name string) (bool, error) {
+	if cache == nil {
+		return true, nil
+	}
+	return cache.store.TryLock(ctx, name, cache.owner, cache.ttl)
+}
+
+// unlock releases the lock of name. An error is ignored, as the lock expires anyway.
+func (cache *lockingCache) unlock(name string) {
+	if cache == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheLockUnlockTimeout)
+	defer cancel()
+	_ = cache.store.Unlock(ctx, name, cache.owner)
+}
+
+// isAutocertCertificateName indicates whether name is the cache name of a certificate of autocert,
+// the host name with a +rsa suffix for RSA keys, rather than the account key or a challenge token.
+func isAutocertCertificateName(name string) bool {
+	return name != "" && !strings.Contains(strings.TrimSuffix(name, "+rsa"), "+")
+}
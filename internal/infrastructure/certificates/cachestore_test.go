@@ -0,0 +1,268 @@
+package infrastructure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// kvStandIn is a key/value HTTP service with the conditional requests of HTTPCacheStore.
+type kvStandIn struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	etags   map[string]string
+	version int
+}
+
+func newKVStandIn(t *testing.T, token string) *httptest.Server {
+	standIn := &kvStandIn{entries: make(map[string][]byte), etags: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer "+token {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		standIn.serve(rw, req)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (standIn *kvStandIn) serve(rw http.ResponseWriter, req *http.Request) {
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	name := strings.TrimPrefix(req.URL.Path, "/cache/")
+	data, isContained := standIn.entries[name]
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && ifMatch != standIn.etags[name] {
+		rw.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		if name == "" {
+			names := make([]string, 0, len(standIn.entries))
+			for entryName := range standIn.entries {
+				names = append(names, entryName)
+			}
+			_, _ = rw.Write([]byte(strings.Join(names, "\n")))
+			return
+		}
+		if !isContained {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("ETag", standIn.etags[name])
+		_, _ = rw.Write(data)
+	case http.MethodPut:
+		if req.Header.Get("If-None-Match") == "*" && isContained {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		standIn.version++
+		standIn.entries[name] = body
+		standIn.etags[name] = `"` + strconv.Itoa(standIn.version) + `"`
+		rw.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(standIn.entries, name)
+		delete(standIn.etags, name)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testCacheStores(t *testing.T) map[string]CacheStore {
+	t.Setenv("TEST_CACHE_TOKEN", "secret")
+	server := newKVStandIn(t, "secret")
+	sqliteStore, err := (&CacheStorageConfig{Type: CacheStorageSQLite, File: filepath.Join(t.TempDir(), "acme.db")}).NewCacheStore("")
+	require.NoError(t, err)
+	httpStore, err := (&CacheStorageConfig{Type: CacheStorageHTTP, URL: server.URL + "/cache/", TokenEnv: "TEST_CACHE_TOKEN"}).NewCacheStore("")
+	require.NoError(t, err)
+	return map[string]CacheStore{
+		CacheStorageDir:    NewDirCacheStore(t.TempDir()),
+		CacheStorageSQLite: sqliteStore,
+		CacheStorageHTTP:   httpStore,
+	}
+}
+
+func TestCacheStore_Get_WhenDataIsPutAndDeleted_ThenReturnsItAndThenCacheMiss(t *testing.T) {
+	for storage, store := range testCacheStores(t) {
+		t.Run(storage, func(t *testing.T) {
+			// Arrange
+			ctx := context.Background()
+			_, missErr := store.Get(ctx, "example.com")
+			require.NoError(t, store.Put(ctx, "example.com", []byte("first")))
+			require.NoError(t, store.Put(ctx, "example.com", []byte("certificate and key")))
+
+			// Act
+			data, err := store.Get(ctx, "example.com")
+			require.NoError(t, store.Delete(ctx, "example.com"))
+			_, deletedErr := store.Get(ctx, "example.com")
+
+			// Assert
+			assert.ErrorIs(t, missErr, autocert.ErrCacheMiss)
+			require.NoError(t, err)
+			assert.Equal(t, "certificate and key", string(data))
+			assert.ErrorIs(t, deletedErr, autocert.ErrCacheMiss)
+		})
+	}
+}
+
+func TestCacheStore_TryLock_WhenAnotherOwnerHoldsLock_ThenWaitsUntilReleasedOrExpired(t *testing.T) {
+	for storage, store := range testCacheStores(t) {
+		t.Run(storage, func(t *testing.T) {
+			// Arrange
+			ctx := context.Background()
+			isLocked, err := store.TryLock(ctx, "example.com", "instance-a", time.Minute)
+			require.NoError(t, err)
+			require.True(t, isLocked)
+
+			// Act
+			isTakenByB, err := store.TryLock(ctx, "example.com", "instance-b", time.Minute)
+			require.NoError(t, err)
+			isExtendedByA, err := store.TryLock(ctx, "example.com", "instance-a", time.Nanosecond)
+			require.NoError(t, err)
+			time.Sleep(time.Millisecond)
+			isExpiredTakenByB, err := store.TryLock(ctx, "example.com", "instance-b", time.Minute)
+			require.NoError(t, err)
+			require.NoError(t, store.Unlock(ctx, "example.com", "instance-a"))
+			isKeptByB, err := store.TryLock(ctx, "example.com", "instance-a", time.Minute)
+			require.NoError(t, err)
+			require.NoError(t, store.Unlock(ctx, "example.com", "instance-b"))
+			isReleasedTakenByA, err := store.TryLock(ctx, "example.com", "instance-a", time.Minute)
+			require.NoError(t, err)
+
+			// Assert
+			assert.False(t, isTakenByB)
+			assert.True(t, isExtendedByA)
+			assert.True(t, isExpiredTakenByB)
+			assert.False(t, isKeptByB)
+			assert.True(t, isReleasedTakenByA)
+		})
+	}
+}
+
+func TestLockingCache_Get_WhenAnotherInstanceIsObtainingCertificate_ThenWaitsAndReturnsIt(t *testing.T) {
+	// Arrange
+	store := NewDirCacheStore(t.TempDir())
+	first := &lockingCache{Cache: store, store: store, owner: "instance-a", ttl: time.Minute}
+	second := &lockingCache{Cache: store, store: store, owner: "instance-b", ttl: time.Minute}
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(90*24*time.Hour))
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	keyPEM, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	ctx := context.Background()
+	_, err = first.Get(ctx, "example.com")
+	require.ErrorIs(t, err, autocert.ErrCacheMiss)
+	result := make(chan []byte, 1)
+
+	// Act
+	go func() {
+		data, _ := second.Get(ctx, "example.com")
+		result <- data
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, first.Put(ctx, "example.com", append(keyPEM, certPEM...)))
+
+	// Assert
+	select {
+	case data := <-result:
+		assert.Equal(t, string(append(keyPEM, certPEM...)), string(data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second instance did not get the certificate")
+	}
+	isLocked, err := store.TryLock(ctx, "example.com", "instance-c", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, isLocked)
+}
+
+func TestLockingCache_Get_WhenLockIsHeldLongerThanWait_ThenReturnsErrorWithoutCertificate(t *testing.T) {
+	// Arrange
+	wait := cacheLockWait
+	cacheLockWait = 100 * time.Millisecond
+	defer func() { cacheLockWait = wait }()
+	store := NewDirCacheStore(t.TempDir())
+	first := &lockingCache{Cache: store, store: store, owner: "instance-a", ttl: time.Minute}
+	second := &lockingCache{Cache: store, store: store, owner: "instance-b", ttl: time.Minute}
+	ctx := context.Background()
+	_, err := first.Get(ctx, "example.com")
+	require.ErrorIs(t, err, autocert.ErrCacheMiss)
+	start := time.Now()
+
+	// Act
+	data, err := second.Get(ctx, "example.com")
+
+	// Assert
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, autocert.ErrCacheMiss)
+	assert.Contains(t, err.Error(), "another instance")
+	assert.Nil(t, data)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestLockingCache_Get_WhenNameIsNotCertificateOrReadIsInspection_ThenTakesNoLock(t *testing.T) {
+	// Arrange
+	store := NewDirCacheStore(t.TempDir())
+	cache := &lockingCache{Cache: store, store: store, owner: "instance-a", ttl: time.Minute}
+	ctx := context.Background()
+
+	// Act
+	_, _ = cache.Get(ctx, "acme_account+key")
+	_, _ = cache.Get(ctx, "token+http-01")
+	_, _ = cache.Get(withoutCacheLock(ctx), "example.com")
+
+	// Assert
+	entries, err := os.ReadDir(string(store.DirCache))
+	if !os.IsNotExist(err) {
+		require.NoError(t, err)
+	}
+	assert.Empty(t, entries)
+}
+
+func TestCacheStore_List_WhenEntriesAndLocksAreStored_ThenReturnsEntryNames(t *testing.T) {
+	for storage, store := range testCacheStores(t) {
+		t.Run(storage, func(t *testing.T) {
+			// Arrange
+			ctx := context.Background()
+			require.NoError(t, store.Put(ctx, "example.com", []byte("certificate and key")))
+			require.NoError(t, store.Put(ctx, "acme_account+key", []byte("account key")))
+			_, err := store.TryLock(ctx, "other.example.com", "instance-a", time.Minute)
+			require.NoError(t, err)
+
+			// Act
+			names, err := store.List(ctx)
+
+			// Assert
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"example.com", "acme_account+key"}, names)
+		})
+	}
+}
+
+func TestNewSQLiteCacheStore_WhenFileIsOpenedTwice_ThenReusesStoreOfOwnerOnlyFile(t *testing.T) {
+	// Arrange
+	file := filepath.Join(t.TempDir(), "acme", "cache.db")
+	first, err := NewSQLiteCacheStore(file)
+	require.NoError(t, err)
+
+	// Act
+	second, err := NewSQLiteCacheStore(file)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
@@ -1,52 +1,219 @@
 package infrastructure
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 )
 
+const publicKeyPinPrefix = "sha256/"
+
 // CertificateDefs is the structure that contains the
 // public and private key of the certificate and the
 // public key of the certificate authority to establish
 // secure communication between reverse proxy and virtual host.
+// As client certificate it also sets how the identity of the upstream server is checked.
+// Keys and certificates are files or inline PEM, and the pair can also be a PKCS#12 bundle.
+// The password of encrypted keys and bundles is read from an environment variable or a file.
+// As server certificate it can list more key pairs for the same host, such as an RSA certificate
+// for the clients that do not support the ECDSA one.
 type CertificateDefs struct {
-	CaPem      []string `json:"ca_pems"`
-	PublicKey  string   `json:"public_key"`
-	PrivateKey string   `json:"private_key"`
+	CaPem              []string           `json:"ca_pems"`
+	PublicKey          string             `json:"public_key"`
+	PrivateKey         string             `json:"private_key"`
+	PKCS12             string             `json:"pkcs12,omitempty"`
+	PasswordEnv        string             `json:"password_env,omitempty"`
+	PasswordFile       string             `json:"password_file,omitempty"`
+	KeyPairs           []*CertificateDefs `json:"key_pairs,omitempty"`
+	ServerName         string             `json:"server_name,omitempty"`
+	InsecureSkipVerify bool               `json:"insecure_skip_verify,omitempty"`
+	PinnedPublicKeys   []string           `json:"pinned_public_keys,omitempty"`
+	SPIFFEIDs          []string           `json:"spiffe_ids,omitempty"`
+}
+
+// Validate checks the key formats, the additional key pairs, the public key pins and the SPIFFE IDs.
+func (certificateDefs *CertificateDefs) Validate() error {
+	if certificateDefs.PKCS12 != "" && (certificateDefs.PublicKey != "" || certificateDefs.PrivateKey != "") {
+		return errors.New("pkcs12: cannot be used with public_key and private_key")
+	}
+	if certificateDefs.PasswordEnv != "" && certificateDefs.PasswordFile != "" {
+		return errors.New("password_env: cannot be used with password_file")
+	}
+	for i, keyPair := range certificateDefs.KeyPairs {
+		if keyPair == nil || keyPair.PKCS12 == "" && (keyPair.PublicKey == "" || keyPair.PrivateKey == "") {
+			return fmt.Errorf("key_pairs[%d]: public_key and private_key, or pkcs12, are required", i)
+		}
+		if len(keyPair.KeyPairs) > 0 {
+			return fmt.Errorf("key_pairs[%d].key_pairs: key pairs cannot be nested", i)
+		}
+		if err := keyPair.Validate(); err != nil {
+			return fmt.Errorf("key_pairs[%d].%s", i, err.Error())
+		}
+	}
+	for i, pin := range certificateDefs.PinnedPublicKeys {
+		if digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, publicKeyPinPrefix)); err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("pinned_public_keys[%d]: '%s' is not a base64 SHA-256 digest", i, pin)
+		}
+	}
+	for i, id := range certificateDefs.SPIFFEIDs {
+		if parsed, err := url.Parse(id); err != nil || parsed.Scheme != "spiffe" || parsed.Host == "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+			return fmt.Errorf("spiffe_ids[%d]: '%s' is not a SPIFFE ID", i, id)
+		}
+	}
+	if len(certificateDefs.SPIFFEIDs) > 0 && len(certificateDefs.CaPem) == 0 {
+		return errors.New("spiffe_ids: ca_pems is required to verify the chain of the upstream server")
+	}
+	return nil
 }
 
-// GetCertificate gets the TLS certificate using the public and private key.
+// GetCertificate gets the TLS certificate using the public and private key, or the PKCS#12 bundle.
 func (certificateDefs *CertificateDefs) GetCertificate() (*tls.Certificate, error) {
 	if certificateDefs == nil {
 		return nil, fmt.Errorf("certificate definitions is nil")
 	}
+	if certificateDefs.PKCS12 != "" {
+		data, err := readSecretFile(certificateDefs.PKCS12)
+		if err != nil {
+			return nil, err
+		}
+		password, err := certificateDefs.password()
+		if err != nil {
+			return nil, err
+		}
+		certificate, err := parsePKCS12(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", certificateDefs.PKCS12, err)
+		}
+		return certificate, nil
+	}
 	if certificateDefs.PublicKey == "" || certificateDefs.PrivateKey == "" {
 		return nil, fmt.Errorf("certificate public key or private key is empty")
 	}
-	result, err := tls.LoadX509KeyPair(certificateDefs.PublicKey, certificateDefs.PrivateKey)
+	certPEM, err := readPEM(certificateDefs.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readPEM(certificateDefs.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(keyPEM, []byte("ENCRYPTED")) {
+		result, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+
+	password, err := certificateDefs.password()
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyPEM(keyPEM, password)
 	if err != nil {
 		return nil, err
 	}
-	return &result, nil
+	certificates := make([]*x509.Certificate, 0)
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return keyPairOf(key, certificates)
 }
 
-// GetTLSConfig gets the config structure to configure a TSL client.
-func (certificateDefs *CertificateDefs) GetTLSConfig() (*tls.Config, error) {
+// LoadKeyPair loads and validates the certificate. The certificate must match the key and be
+// currently valid.
+func (certificateDefs *CertificateDefs) LoadKeyPair() (*tls.Certificate, error) {
+	certificate, err := certificateDefs.GetCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return validateKeyPair(certificate)
+}
+
+// GetCertificates gets the TLS certificate followed by the ones of the additional key pairs.
+func (certificateDefs *CertificateDefs) GetCertificates() ([]*tls.Certificate, error) {
+	certificate, err := certificateDefs.GetCertificate()
+	if err != nil {
+		return nil, err
+	}
+	certificates := []*tls.Certificate{certificate}
+	for i, keyPair := range certificateDefs.KeyPairs {
+		certificate, err := keyPair.GetCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("key_pairs[%d]: %w", i, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// Files gets the files of the certificate, the key or the bundle and the password, including the
+// ones of the additional key pairs, without the values given inline.
+func (certificateDefs *CertificateDefs) Files() []string {
+	if certificateDefs == nil {
+		return nil
+	}
+	files := make([]string, 0, 3)
+	for _, file := range []string{certificateDefs.PublicKey, certificateDefs.PrivateKey, certificateDefs.PKCS12, certificateDefs.PasswordFile} {
+		if file != "" && !isInlinePEM(file) {
+			files = append(files, file)
+		}
+	}
+	for _, keyPair := range certificateDefs.KeyPairs {
+		files = append(files, keyPair.Files()...)
+	}
+	return files
+}
+
+// password reads the password of the key or the bundle, which is empty when none is configured.
+func (certificateDefs *CertificateDefs) password() (string, error) {
+	if certificateDefs.PasswordEnv != "" {
+		password, isSet := os.LookupEnv(certificateDefs.PasswordEnv)
+		if !isSet {
+			return "", fmt.Errorf("password environment variable %s is not set", certificateDefs.PasswordEnv)
+		}
+		return password, nil
+	}
+	if certificateDefs.PasswordFile != "" {
+		data, err := readSecretFile(certificateDefs.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", nil
+}
+
+// GetClientTLSConfig gets the config of a TLS client with only the client key pair and the CAs,
+// without the server name, the pins and the SPIFFE IDs of the upstream server, so it can call
+// other services such as the forward auth.
+func (certificateDefs *CertificateDefs) GetClientTLSConfig() (*tls.Config, error) {
 	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
 	if len(certificateDefs.CaPem) > 0 {
 		rootCAs, err := getCertPool(certificateDefs.CaPem...)
 		if err != nil {
 			return nil, err
 		}
-		tlsConfig = &tls.Config{
-			RootCAs:    rootCAs,
-			MinVersion: tls.VersionTLS12,
-		}
+		tlsConfig.RootCAs = rootCAs
 	}
 	// add client certificates
-	if len(certificateDefs.PrivateKey) > 0 && len(certificateDefs.PublicKey) > 0 {
+	if len(certificateDefs.PrivateKey) > 0 && len(certificateDefs.PublicKey) > 0 || len(certificateDefs.PKCS12) > 0 {
 		cert, err := certificateDefs.GetCertificate()
 		if err != nil {
 			return nil, err
@@ -56,18 +223,112 @@ func (certificateDefs *CertificateDefs) GetTLSConfig() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// GetTLSConfig gets the config structure to configure a TSL client. Public key pins are checked
+// even when the verification of the chain is skipped. With SPIFFE IDs the chain is always verified
+// against the CAs of ca_pems only, and the SPIFFE IDs replace the check of the host name.
+func (certificateDefs *CertificateDefs) GetTLSConfig() (*tls.Config, error) {
+	tlsConfig, err := certificateDefs.GetClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = certificateDefs.ServerName
+	tlsConfig.InsecureSkipVerify = certificateDefs.InsecureSkipVerify
+	var spiffeCAs *x509.CertPool
+	if len(certificateDefs.SPIFFEIDs) > 0 {
+		if len(certificateDefs.CaPem) == 0 {
+			return nil, errors.New("spiffe_ids: ca_pems is required to verify the chain of the upstream server")
+		}
+		// only the configured CAs issue SPIFFE IDs, not the ones of the system
+		pool, err := NewClientCAPool(certificateDefs.CaPem...)
+		if err != nil {
+			return nil, err
+		}
+		spiffeCAs = pool
+		// the chain is verified by verifyUpstream, without the host name
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if len(certificateDefs.PinnedPublicKeys) > 0 || len(certificateDefs.SPIFFEIDs) > 0 {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return certificateDefs.verifyUpstream(state, spiffeCAs)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyUpstream checks the certificate of the upstream server against the public key pins and
+// the SPIFFE IDs. With SPIFFE IDs the chain must be issued by spiffeCAs.
+func (certificateDefs *CertificateDefs) verifyUpstream(state tls.ConnectionState, spiffeCAs *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("the upstream server presented no certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	if len(certificateDefs.SPIFFEIDs) > 0 {
+		intermediates := x509.NewCertPool()
+		for _, certificate := range state.PeerCertificates[1:] {
+			intermediates.AddCert(certificate)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         spiffeCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}); err != nil {
+			return fmt.Errorf("the certificate of the upstream server is not trusted: %w", err)
+		}
+	}
+	if len(certificateDefs.PinnedPublicKeys) > 0 {
+		pin := PublicKeyPin(leaf)
+		if !slices.ContainsFunc(certificateDefs.PinnedPublicKeys, func(pinned string) bool {
+			return strings.TrimPrefix(pinned, publicKeyPinPrefix) == pin
+		}) {
+			return fmt.Errorf("the public key of the upstream server (%s%s) is not pinned", publicKeyPinPrefix, pin)
+		}
+	}
+	if len(certificateDefs.SPIFFEIDs) > 0 && !slices.ContainsFunc(leaf.URIs, certificateDefs.isAllowedSPIFFEID) {
+		return errors.New("the upstream server has none of the allowed SPIFFE IDs")
+	}
+	return nil
+}
+
+// isAllowedSPIFFEID indicates that the URI is one of the SPIFFE IDs, or belongs to a trust domain
+// given without path.
+func (certificateDefs *CertificateDefs) isAllowedSPIFFEID(uri *url.URL) bool {
+	if uri.Scheme != "spiffe" {
+		return false
+	}
+	for _, id := range certificateDefs.SPIFFEIDs {
+		allowed, err := url.Parse(id)
+		if err != nil || !strings.EqualFold(allowed.Host, uri.Host) {
+			continue
+		}
+		if allowed.Path == "" || allowed.Path == "/" || allowed.Path == uri.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicKeyPin gets the base64 SHA-256 digest of the public key of the certificate, as used in
+// pinned_public_keys.
+func PublicKeyPin(certificate *x509.Certificate) string {
+	digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
 // GetAuthorizedCAs gets the certificate authorities public keys.
 func (certificateDefs *CertificateDefs) GetAuthorizedCAs() []string {
 	return certificateDefs.CaPem
 }
 
+// systemCertPool gets the CAs of the system, which the ca_pems extend.
+var systemCertPool = x509.SystemCertPool
+
 func getCertPool(caPems ...string) (*x509.CertPool, error) {
-	rootCAs, err := x509.SystemCertPool()
+	rootCAs, err := systemCertPool()
 	if err != nil {
 		return nil, err
 	}
 	for _, caPem := range caPems {
-		pem, err := os.ReadFile(caPem)
+		pem, err := readPEM(caPem)
 		if err != nil {
 			return nil, err
 		}
@@ -75,3 +336,16 @@ func getCertPool(caPems ...string) (*x509.CertPool, error) {
 	}
 	return rootCAs, nil
 }
+
+// isInlinePEM indicates that a value is PEM data instead of the name of a file.
+func isInlinePEM(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN")
+}
+
+// readPEM gets the PEM data of a value given inline or as a file, which may be encrypted.
+func readPEM(value string) ([]byte, error) {
+	if isInlinePEM(value) {
+		return []byte(value), nil
+	}
+	return readSecretFile(value)
+}
@@ -1,9 +1,26 @@
 package infrastructure
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCertificateDefs_GetAuthorizedCAs_WhenCalled_ThenReturnsCaPem(t *testing.T) {
@@ -61,3 +78,262 @@ func TestCertificateDefs_GetTLSConfig_WhenHasCaPems_ThenReturnsConfigWithRootCAs
 	assert.Error(t, err) // Because file doesn't exist
 	assert.Nil(t, config)
 }
+
+// startUpstreamServer starts a TLS server for upstream.test with a self-signed certificate
+// with the URI SAN uri, returning the file of the certificate.
+func startUpstreamServer(t *testing.T, uri string) (*httptest.Server, *x509.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	spiffeID, err := url.Parse(uri)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "upstream.test"},
+		DNSNames:     []string{"upstream.test"},
+		URIs:         []*url.URL{spiffeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	certFile := filepath.Join(t.TempDir(), "upstream.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, leaf, certFile
+}
+
+func getUpstream(t *testing.T, certDefs *CertificateDefs, server *httptest.Server) error {
+	tlsConfig, err := certDefs.GetTLSConfig()
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	response, err := client.Get(server.URL)
+	if err == nil {
+		_ = response.Body.Close()
+	}
+	return err
+}
+
+func TestCertificateDefs_Validate_WhenPinOrSPIFFEIDIsInvalid_ThenReturnsError(t *testing.T) {
+	// Arrange
+	withInvalidPin := &CertificateDefs{PinnedPublicKeys: []string{"sha256/not-a-digest"}}
+	withInvalidID := &CertificateDefs{SPIFFEIDs: []string{"https://example.org/backend"}}
+
+	// Act
+	pinErr := withInvalidPin.Validate()
+	idErr := withInvalidID.Validate()
+
+	// Assert
+	assert.EqualError(t, pinErr, "pinned_public_keys[0]: 'sha256/not-a-digest' is not a base64 SHA-256 digest")
+	assert.EqualError(t, idErr, "spiffe_ids[0]: 'https://example.org/backend' is not a SPIFFE ID")
+}
+
+func TestCertificateDefs_GetTLSConfig_WhenPublicKeyIsPinned_ThenChecksItEvenWithoutVerification(t *testing.T) {
+	// Arrange
+	server, leaf, _ := startUpstreamServer(t, "spiffe://example.org/backend")
+	pinned := &CertificateDefs{InsecureSkipVerify: true, PinnedPublicKeys: []string{"sha256/" + PublicKeyPin(leaf)}}
+	other := &CertificateDefs{InsecureSkipVerify: true, PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}}
+
+	// Act
+	pinnedErr := getUpstream(t, pinned, server)
+	otherErr := getUpstream(t, other, server)
+
+	// Assert
+	assert.NoError(t, pinnedErr)
+	require.Error(t, otherErr)
+	assert.Contains(t, otherErr.Error(), "is not pinned")
+}
+
+func TestCertificateDefs_GetTLSConfig_WhenSPIFFEIDsAreSet_ThenChecksURISAN(t *testing.T) {
+	// Arrange
+	server, _, certFile := startUpstreamServer(t, "spiffe://example.org/ns/prod/backend")
+	trustDomain := &CertificateDefs{CaPem: []string{certFile}, ServerName: "upstream.test", SPIFFEIDs: []string{"spiffe://example.org"}}
+	exact := &CertificateDefs{CaPem: []string{certFile}, ServerName: "upstream.test", SPIFFEIDs: []string{"spiffe://example.org/ns/prod/backend"}}
+	other := &CertificateDefs{CaPem: []string{certFile}, ServerName: "upstream.test", SPIFFEIDs: []string{"spiffe://example.org/ns/prod/frontend"}}
+
+	// Act
+	trustDomainErr := getUpstream(t, trustDomain, server)
+	exactErr := getUpstream(t, exact, server)
+	otherErr := getUpstream(t, other, server)
+
+	// Assert
+	assert.NoError(t, trustDomainErr)
+	assert.NoError(t, exactErr)
+	require.Error(t, otherErr)
+	assert.Contains(t, otherErr.Error(), "none of the allowed SPIFFE IDs")
+}
+
+func TestCertificateDefs_GetTLSConfig_WhenSPIFFEIDsAreSet_ThenVerifiesChainWithoutHostName(t *testing.T) {
+	// Arrange
+	server, _, certFile := startUpstreamServer(t, "spiffe://example.org/ns/prod/backend")
+	_, _, otherCAFile := startUpstreamServer(t, "spiffe://example.org/ns/prod/backend")
+	trusted := &CertificateDefs{CaPem: []string{certFile}, ServerName: "other.test", SPIFFEIDs: []string{"spiffe://example.org"}}
+	untrusted := &CertificateDefs{CaPem: []string{otherCAFile}, InsecureSkipVerify: true, SPIFFEIDs: []string{"spiffe://example.org"}}
+	withoutCAs := &CertificateDefs{InsecureSkipVerify: true, SPIFFEIDs: []string{"spiffe://example.org"}}
+
+	// Act
+	trustedErr := getUpstream(t, trusted, server)
+	untrustedErr := getUpstream(t, untrusted, server)
+	_, withoutCAsErr := withoutCAs.GetTLSConfig()
+
+	// Assert
+	assert.NoError(t, trustedErr)
+	require.Error(t, untrustedErr)
+	assert.Contains(t, untrustedErr.Error(), "is not trusted")
+	assert.EqualError(t, withoutCAsErr, "spiffe_ids: ca_pems is required to verify the chain of the upstream server")
+	assert.EqualError(t, withoutCAs.Validate(), "spiffe_ids: ca_pems is required to verify the chain of the upstream server")
+}
+
+func TestCertificateDefs_GetTLSConfig_WhenSPIFFEChainIsOnlyTrustedBySystem_ThenRejectsIt(t *testing.T) {
+	// Arrange
+	server, leaf, _ := startUpstreamServer(t, "spiffe://example.org/ns/prod/backend")
+	_, _, otherCAFile := startUpstreamServer(t, "spiffe://example.org/ns/prod/backend")
+	previous := systemCertPool
+	systemCertPool = func() (*x509.CertPool, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(leaf)
+		return pool, nil
+	}
+	t.Cleanup(func() { systemCertPool = previous })
+	certDefs := &CertificateDefs{CaPem: []string{otherCAFile}, SPIFFEIDs: []string{"spiffe://example.org"}}
+
+	// Act
+	err := getUpstream(t, certDefs, server)
+
+	// Assert
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not trusted")
+}
+
+func TestCertificateDefs_GetClientTLSConfig_WhenUpstreamIdentityIsSet_ThenOnlyKeepsKeyPairAndCAs(t *testing.T) {
+	// Arrange
+	_, leaf, certFile := startUpstreamServer(t, "spiffe://example.org/ns/prod/backend")
+	clientCertFile, clientKeyFile := writeTestKeyPair(t, t.TempDir(), "client.test", time.Now().Add(time.Hour))
+	certDefs := &CertificateDefs{
+		CaPem:            []string{certFile},
+		PublicKey:        clientCertFile,
+		PrivateKey:       clientKeyFile,
+		ServerName:       "backend.test",
+		PinnedPublicKeys: []string{"sha256/" + PublicKeyPin(leaf)},
+		SPIFFEIDs:        []string{"spiffe://example.org"},
+	}
+
+	// Act
+	tlsConfig, err := certDefs.GetClientTLSConfig()
+
+	// Assert
+	require.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Empty(t, tlsConfig.ServerName)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.VerifyConnection)
+}
+
+func TestCertificateDefs_LoadKeyPair_WhenKeyIsEncrypted_ThenDecryptsItWithPasswordFromEnv(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_KEY_PASSWORD", "changeit")
+	certDefs := &CertificateDefs{PublicKey: "testdata/cert.pem", PrivateKey: "testdata/key-encrypted.pem", PasswordEnv: "TEST_KEY_PASSWORD"}
+
+	// Act
+	certificate, err := certDefs.LoadKeyPair()
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", certificate.Leaf.Subject.CommonName)
+	assert.Equal(t, []string{"testdata/cert.pem", "testdata/key-encrypted.pem"}, certDefs.Files())
+}
+
+func TestCertificateDefs_LoadKeyPair_WhenPKCS12Bundle_ThenLeafComesFirst(t *testing.T) {
+	for _, bundle := range []string{"testdata/bundle.p12", "testdata/bundle-3des.p12", "testdata/bundle-legacy.p12"} {
+		t.Run(filepath.Base(bundle), func(t *testing.T) {
+			// Arrange
+			passwordFile := filepath.Join(t.TempDir(), "password")
+			require.NoError(t, os.WriteFile(passwordFile, []byte("changeit\n"), 0o600))
+			certDefs := &CertificateDefs{PKCS12: bundle, PasswordFile: passwordFile}
+
+			// Act
+			certificate, err := certDefs.LoadKeyPair()
+
+			// Assert
+			require.NoError(t, err)
+			assert.Equal(t, "example.com", certificate.Leaf.Subject.CommonName)
+			require.Len(t, certificate.Certificate, 2)
+			ca, err := x509.ParseCertificate(certificate.Certificate[1])
+			require.NoError(t, err)
+			assert.Equal(t, "Test Key Formats CA", ca.Subject.CommonName)
+			assert.Equal(t, []string{bundle, passwordFile}, certDefs.Files())
+		})
+	}
+}
+
+func TestCertificateDefs_GetCertificate_WhenPasswordIsWrong_ThenReturnsError(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_KEY_PASSWORD", "wrong")
+	encryptedKey := &CertificateDefs{PublicKey: "testdata/cert.pem", PrivateKey: "testdata/key-encrypted.pem", PasswordEnv: "TEST_KEY_PASSWORD"}
+	bundle := &CertificateDefs{PKCS12: "testdata/bundle.p12", PasswordEnv: "TEST_KEY_PASSWORD"}
+	unsetPassword := &CertificateDefs{PKCS12: "testdata/bundle.p12", PasswordEnv: "TEST_MISSING_PASSWORD"}
+
+	// Act
+	_, keyErr := encryptedKey.GetCertificate()
+	_, bundleErr := bundle.GetCertificate()
+	_, unsetErr := unsetPassword.GetCertificate()
+
+	// Assert
+	assert.ErrorContains(t, keyErr, "failed to decrypt private key")
+	assert.EqualError(t, bundleErr, "testdata/bundle.p12: incorrect password")
+	assert.EqualError(t, unsetErr, "password environment variable TEST_MISSING_PASSWORD is not set")
+}
+
+func TestCertificateDefs_GetCertificate_WhenValuesAreInlinePEM_ThenHasNoFiles(t *testing.T) {
+	// Arrange
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "inline.example.com", time.Now().Add(time.Hour))
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	keyPEM, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	certDefs := &CertificateDefs{PublicKey: string(certPEM), PrivateKey: string(keyPEM), CaPem: []string{string(certPEM)}}
+
+	// Act
+	certificate, err := certDefs.LoadKeyPair()
+	tlsConfig, configErr := certDefs.GetTLSConfig()
+
+	// Assert
+	require.NoError(t, err)
+	require.NoError(t, configErr)
+	assert.Equal(t, "inline.example.com", certificate.Leaf.Subject.CommonName)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Empty(t, certDefs.Files())
+}
+
+func TestCertificateDefs_Validate_WhenPKCS12HasKeyFiles_ThenReturnsError(t *testing.T) {
+	// Arrange
+	certDefs := &CertificateDefs{PKCS12: "bundle.p12", PrivateKey: "key.pem"}
+
+	// Act
+	err := certDefs.Validate()
+
+	// Assert
+	assert.EqualError(t, err, "pkcs12: cannot be used with public_key and private_key")
+}
+
+func TestCertificateDefs_Validate_WhenKeyPairIsInvalid_ThenReturnsError(t *testing.T) {
+	// Arrange
+	empty := &CertificateDefs{PublicKey: "cert.pem", PrivateKey: "key.pem", KeyPairs: []*CertificateDefs{{}}}
+	nested := &CertificateDefs{PublicKey: "cert.pem", PrivateKey: "key.pem", KeyPairs: []*CertificateDefs{
+		{PublicKey: "rsa.pem", PrivateKey: "rsa-key.pem", KeyPairs: []*CertificateDefs{{PublicKey: "other.pem", PrivateKey: "other-key.pem"}}},
+	}}
+
+	// Act
+	emptyErr := empty.Validate()
+	nestedErr := nested.Validate()
+
+	// Assert
+	assert.EqualError(t, emptyErr, "key_pairs[0]: public_key and private_key, or pkcs12, are required")
+	assert.EqualError(t, nestedErr, "key_pairs[0].key_pairs: key pairs cannot be nested")
+}
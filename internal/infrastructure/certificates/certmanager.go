@@ -2,7 +2,12 @@ package infrastructure
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
@@ -13,40 +18,199 @@ import (
 type CertManager struct {
 	manager      *autocert.Manager
 	autoCertList []string
-	clientCAs    []string
-	certificates map[string]*tls.Certificate
+	clientAuth   map[string]*clientAuthPolicy
+	tlsPolicy    *TLSPolicy
+	tlsPolicies  map[string]*TLSPolicy
+	certificates map[string][]*tls.Certificate
+	keyPairs     map[string]KeyPairSource
+	upstreams    map[string]KeyPairSource
+	hostConfigs  map[string]*tls.Config
+	watcher      *FileWatcher
+	dns01        *DNS01Manager
+	localCA      *LocalCA
+	echKeys      *ECHKeys
+	stopStapling chan struct{}
+	stopExpiry   chan struct{}
+	stopTickets  chan struct{}
+	stopECH      chan struct{}
+	acmeStatus   map[string]*ACMEStatus
+	// serverConfig is the TLS config returned by GetTLSConfig, which gets the session ticket keys
+	serverConfig *tls.Config
+	ticketKeys   [][ticketKeySize]byte
+	// httpChallenges indicates that HTTP-01 challenges are served for the automatic certificates
+	httpChallenges bool
+	mu             sync.RWMutex
+}
+
+type clientAuthPolicy struct {
+	clientAuth tls.ClientAuthType
+	cas        []string
+}
+
+// KeyPairSource is the definition of a certificate that is loaded again when any of its files
+// changes.
+type KeyPairSource interface {
+	GetCertificate() (*tls.Certificate, error)
+	Files() []string
+}
+
+// multiKeyPairSource is a KeyPairSource with additional key pairs for the same host, such as an
+// RSA certificate for the clients that do not support the ECDSA one.
+type multiKeyPairSource interface {
+	GetCertificates() ([]*tls.Certificate, error)
 }
 
 // NewCertManager returns a new object of CertManager type
 func NewCertManager(manager *autocert.Manager) *CertManager {
-	return &CertManager{manager: manager, autoCertList: make([]string, 0), clientCAs: make([]string, 0), certificates: make(map[string]*tls.Certificate)}
+	return &CertManager{
+		manager:      manager,
+		autoCertList: make([]string, 0),
+		clientAuth:   make(map[string]*clientAuthPolicy),
+		tlsPolicies:  make(map[string]*TLSPolicy),
+		certificates: make(map[string][]*tls.Certificate),
+		keyPairs:     make(map[string]KeyPairSource),
+		upstreams:    make(map[string]KeyPairSource),
+		hostConfigs:  make(map[string]*tls.Config),
+		acmeStatus:   make(map[string]*ACMEStatus),
+	}
 }
 
 // AddCertificate adds a certificate to use on a virtual host
 func (certManager *CertManager) AddCertificate(vhostName string, certificate *tls.Certificate) {
-	certManager.certificates[vhostName] = certificate
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.certificates[vhostName] = []*tls.Certificate{certificate}
+}
+
+// AddCertificateFiles loads the certificate of a virtual host from its files and keeps them
+// to reload the certificate when they change.
+func (certManager *CertManager) AddCertificateFiles(vhostName string, certFile string, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("certificate public key or private key is empty")
+	}
+	return certManager.AddKeyPair(vhostName, &CertificateDefs{PublicKey: certFile, PrivateKey: keyFile})
+}
+
+// AddKeyPair loads the certificates of a virtual host from its source and keeps the source to
+// reload the certificates when its files change.
+func (certManager *CertManager) AddKeyPair(vhostName string, source KeyPairSource) error {
+	certificates, err := loadKeyPairs(source)
+	if err != nil {
+		return err
+	}
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.certificates[vhostName] = certificates
+	certManager.keyPairs[vhostName] = source
+	return nil
 }
 
 // HasCertificateFor indicates if already exists a certificate for de vhostname
 func (certManager *CertManager) HasCertificateFor(vhostName string) bool {
-	if _, isContained := certManager.certificates[vhostName]; isContained {
-		return true
-	}
-	return false
+	certManager.mu.RLock()
+	defer certManager.mu.RUnlock()
+	_, isContained := certManager.certificates[vhostName]
+	return isContained
 }
 
-// AddAutoCertificate registers a virtual host to obtain an automatic Let's encrypt certificate
-func (certManager *CertManager) AddAutoCertificate(vhostName string) {
+// AddAutoCertificate registers a virtual host to obtain an automatic Let's encrypt certificate.
+// Hosts covered by the local CA get their certificate from it instead. The ACME account key is
+// loaded with the first host; when it cannot be loaded the host is not registered.
+func (certManager *CertManager) AddAutoCertificate(vhostName string) error {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.localCA != nil && certManager.localCA.Covers(vhostName) {
+		return nil
+	}
+	if err := loadAccountKey(certManager.manager); err != nil {
+		return err
+	}
 	certManager.autoCertList = append(certManager.autoCertList, vhostName)
 	certManager.manager.HostPolicy = autocert.HostWhitelist(certManager.autoCertList...)
+	return nil
 }
 
-// AddClientCA registers a list of certificate authorities to use with the reverse proxy
-func (certManager *CertManager) AddClientCA(authorizedCA []string) {
-	certManager.clientCAs = append(certManager.clientCAs, authorizedCA...)
+// HTTPHandler returns the handler of the ACME HTTP-01 challenges of the automatic certificates.
+// Any other request is passed to fallback.
+func (certManager *CertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.manager == nil {
+		return fallback
+	}
+	certManager.httpChallenges = true
+	certManager.manager.HTTPHandler(nil)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the manager is replaced after a forced renewal
+		certManager.mu.RLock()
+		manager := certManager.manager
+		certManager.mu.RUnlock()
+		manager.HTTPHandler(fallback).ServeHTTP(rw, req)
+	})
+}
+
+// SetDNS01Manager sets the manager of the certificates obtained with DNS-01 challenges.
+func (certManager *CertManager) SetDNS01Manager(manager *DNS01Manager) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.dns01 = manager
 }
 
-// GetTLSConfig gets the config structure to configure a TSL server
+// SetLocalCA sets the CA that issues the certificates of the hosts that cannot use ACME. It must
+// be set before the automatic certificates are added.
+func (certManager *CertManager) SetLocalCA(localCA *LocalCA) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.localCA = localCA
+}
+
+// StartDNS01 starts obtaining and renewing the DNS-01 certificates, if there are any.
+func (certManager *CertManager) StartDNS01() {
+	certManager.mu.RLock()
+	defer certManager.mu.RUnlock()
+	if certManager.dns01 != nil {
+		certManager.dns01.Start()
+	}
+}
+
+// SetClientAuth registers the client certificate policy and the authorized CAs of a server name.
+// When virtual hosts sharing a server name have different policies the certificate is only
+// requested in the handshake and each virtual host checks it by itself.
+func (certManager *CertManager) SetClientAuth(vhostName string, mode ClientAuthMode, authorizedCAs []string) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	clientAuth := mode.TLSClientAuth(len(authorizedCAs) > 0)
+	policy, isContained := certManager.clientAuth[vhostName]
+	if !isContained {
+		certManager.clientAuth[vhostName] = &clientAuthPolicy{clientAuth: clientAuth, cas: append([]string(nil), authorizedCAs...)}
+		return
+	}
+	policy.cas = append(policy.cas, authorizedCAs...)
+	if policy.clientAuth != clientAuth {
+		policy.clientAuth = tls.RequestClientCert
+	}
+}
+
+// SetDefaultTLSPolicy sets the TLS policy of the server names without their own policy.
+func (certManager *CertManager) SetDefaultTLSPolicy(policy *TLSPolicy) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.tlsPolicy = policy
+}
+
+// SetTLSPolicy sets the TLS policy of a server name. A nil policy keeps the default one.
+func (certManager *CertManager) SetTLSPolicy(vhostName string, policy *TLSPolicy) {
+	if policy == nil {
+		return
+	}
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.tlsPolicies[vhostName] = policy
+}
+
+// GetTLSConfig gets the config structure to configure a TSL server. Each server name with a
+// client certificate policy or a TLS policy gets its own config, with only its CAs, through
+// GetConfigForClient.
 func (certManager *CertManager) GetTLSConfig() *tls.Config {
 	ret := &tls.Config{
 		MinVersion:     tls.VersionTLS12,
@@ -55,25 +219,313 @@ func (certManager *CertManager) GetTLSConfig() *tls.Config {
 			"h2", "http/1.1", // enable HTTP/2
 			acme.ALPNProto, // enable tls-alpn ACME challenges
 		},
+		ClientAuth: tls.NoClientCert,
 	}
-	ret.ClientAuth = tls.VerifyClientCertIfGiven
-	pool, err := getCertPool(certManager.clientCAs...)
-	if err != nil {
-		return nil
+
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.tlsPolicy.Apply(ret)
+	if certManager.echKeys != nil {
+		// the keys are read on each handshake, so a rotation applies to the running servers
+		ret.GetEncryptedClientHelloKeys = certManager.echKeys.encryptedClientHelloKeys
+	}
+
+	configs := make(map[string]*tls.Config)
+	for vhostName, policy := range certManager.tlsPolicies {
+		hostConfig := ret.Clone()
+		policy.Apply(hostConfig)
+		configs[vhostName] = hostConfig
+	}
+	for vhostName, policy := range certManager.clientAuth {
+		if policy.clientAuth == tls.NoClientCert {
+			continue
+		}
+		hostConfig, isContained := configs[vhostName]
+		if !isContained {
+			hostConfig = ret.Clone()
+		}
+		hostConfig.ClientAuth = policy.clientAuth
+		pool, err := NewClientCAPool(policy.cas...)
+		if err != nil {
+			// fail closed: no client certificate can be verified with unreadable CAs
+			hostConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			pool = x509.NewCertPool()
+		}
+		hostConfig.ClientCAs = pool
+		configs[vhostName] = hostConfig
+	}
+
+	certManager.hostConfigs = configs
+	certManager.serverConfig = ret
+	certManager.applySessionTicketKeys()
+
+	ret.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		certManager.mu.RLock()
+		defer certManager.mu.RUnlock()
+		return certManager.hostConfigs[hello.ServerName], nil
 	}
-	ret.ClientCAs = pool
 	return ret
 }
 
+// WatchFiles polls the certificate, key and CA files every interval. Changed certificates are
+// validated before replacing the ones in use; when validation fails the previous ones are kept.
+// onChange, when not nil, is called with the changed files after they are reloaded.
+func (certManager *CertManager) WatchFiles(interval time.Duration, onChange func(changed []string)) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.watcher != nil || interval <= 0 {
+		return
+	}
+
+	files := make([]string, 0)
+	for _, source := range certManager.keyPairs {
+		files = append(files, source.Files()...)
+	}
+	// the upstream client certificates are only reported to onChange
+	for _, source := range certManager.upstreams {
+		files = append(files, source.Files()...)
+	}
+	for _, policy := range certManager.clientAuth {
+		for _, ca := range policy.cas {
+			if !isInlinePEM(ca) {
+				files = append(files, ca)
+			}
+		}
+	}
+	certManager.watcher = NewFileWatcher(files, interval, func(changed []string) {
+		certManager.ReloadFiles(changed)
+		if onChange != nil {
+			onChange(changed)
+		}
+	})
+	certManager.watcher.Start()
+}
+
+// StartOCSPStapling staples OCSP responses to the certificates added with AddCertificate or
+// AddCertificateFiles, refreshing them in the background before they expire. ACME certificates
+// are not stapled.
+func (certManager *CertManager) StartOCSPStapling(cacheDir string, logger Logger) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.stopStapling != nil {
+		return
+	}
+
+	stapler := NewOCSPStapler(cacheDir, logger)
+	stop := make(chan struct{})
+	certManager.stopStapling = stop
+	go func() {
+		ticker := time.NewTicker(staplingCheckInterval)
+		defer ticker.Stop()
+		for {
+			certManager.StapleOCSP(stapler)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StapleOCSP refreshes the OCSP responses of the certificates that are due.
+func (certManager *CertManager) StapleOCSP(stapler *OCSPStapler) {
+	certManager.mu.RLock()
+	certificates := make(map[string][]*tls.Certificate, len(certManager.certificates))
+	for vhostName, hostCertificates := range certManager.certificates {
+		certificates[vhostName] = hostCertificates
+	}
+	certManager.mu.RUnlock()
+
+	for vhostName, hostCertificates := range certificates {
+		for i, certificate := range hostCertificates {
+			stapled := stapler.Staple(vhostName, certificate)
+			if stapled == nil {
+				continue
+			}
+			certManager.mu.Lock()
+			// the certificates may have been reloaded meanwhile
+			if current := certManager.certificates[vhostName]; i < len(current) && current[i] == certificate {
+				current = slices.Clone(current)
+				current[i] = stapled
+				certManager.certificates[vhostName] = current
+			}
+			certManager.mu.Unlock()
+		}
+	}
+}
+
+// Stop ends the background work started by WatchFiles, StartOCSPStapling, StartExpiryMonitor,
+// StartSessionTicketRotation, StartECHKeyRotation and StartDNS01.
+func (certManager *CertManager) Stop() {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.watcher != nil {
+		certManager.watcher.Stop()
+		certManager.watcher = nil
+	}
+	if certManager.stopStapling != nil {
+		close(certManager.stopStapling)
+		certManager.stopStapling = nil
+	}
+	if certManager.stopExpiry != nil {
+		close(certManager.stopExpiry)
+		certManager.stopExpiry = nil
+	}
+	if certManager.stopTickets != nil {
+		close(certManager.stopTickets)
+		certManager.stopTickets = nil
+	}
+	if certManager.stopECH != nil {
+		close(certManager.stopECH)
+		certManager.stopECH = nil
+	}
+	if certManager.dns01 != nil {
+		certManager.dns01.Stop()
+	}
+}
+
+// ReloadFiles reloads the certificates and client CAs that use any of the changed files and
+// records the result in Reloads.
+func (certManager *CertManager) ReloadFiles(changed []string) {
+	isChanged := toSet(changed)
+
+	certManager.mu.RLock()
+	sources := make(map[string]KeyPairSource)
+	for vhostName, source := range certManager.keyPairs {
+		if usesAny(source.Files(), isChanged) {
+			sources[vhostName] = source
+		}
+	}
+	policies := make(map[string]clientAuthPolicy)
+	for vhostName, policy := range certManager.clientAuth {
+		if usesAny(policy.cas, isChanged) {
+			policies[vhostName] = *policy
+		}
+	}
+	certManager.mu.RUnlock()
+
+	for vhostName, source := range sources {
+		event := ReloadEvent{Time: time.Now(), Host: vhostName, Files: source.Files()}
+		certificates, err := loadKeyPairs(source)
+		if err != nil {
+			event.Error = err.Error()
+		} else {
+			certManager.mu.Lock()
+			certManager.certificates[vhostName] = certificates
+			certManager.mu.Unlock()
+		}
+		Reloads.Record(event)
+	}
+
+	for vhostName, policy := range policies {
+		event := ReloadEvent{Time: time.Now(), Host: vhostName, Files: policy.cas}
+		pool, err := NewClientCAPool(policy.cas...)
+		if err != nil {
+			event.Error = err.Error()
+		} else {
+			certManager.mu.Lock()
+			if hostConfig := certManager.hostConfigs[vhostName]; hostConfig != nil {
+				hostConfig = hostConfig.Clone()
+				hostConfig.ClientAuth = policy.clientAuth
+				hostConfig.ClientCAs = pool
+				certManager.hostConfigs[vhostName] = hostConfig
+			}
+			certManager.mu.Unlock()
+		}
+		Reloads.Record(event)
+	}
+}
+
+// loadKeyPairs gets the certificates of a source, checking that they are currently valid.
+func loadKeyPairs(source KeyPairSource) ([]*tls.Certificate, error) {
+	var certificates []*tls.Certificate
+	var err error
+	if multiSource, isMulti := source.(multiKeyPairSource); isMulti {
+		certificates, err = multiSource.GetCertificates()
+	} else {
+		var certificate *tls.Certificate
+		certificate, err = source.GetCertificate()
+		certificates = []*tls.Certificate{certificate}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, certificate := range certificates {
+		if certificates[i], err = validateKeyPair(certificate); err != nil {
+			return nil, err
+		}
+	}
+	return certificates, nil
+}
+
+// selectCertificate gets the first certificate supported by the client, or the first one when
+// the client supports none, so the handshake fails with the usual error.
+func selectCertificate(hello *tls.ClientHelloInfo, certificates []*tls.Certificate) *tls.Certificate {
+	for _, certificate := range certificates {
+		if hello.SupportsCertificate(certificate) == nil {
+			return certificate
+		}
+	}
+	return certificates[0]
+}
+
+func toSet(files []string) map[string]bool {
+	set := make(map[string]bool, len(files))
+	for _, file := range files {
+		set[file] = true
+	}
+	return set
+}
+
+func usesAny(files []string, isChanged map[string]bool) bool {
+	for _, file := range files {
+		if isChanged[file] {
+			return true
+		}
+	}
+	return false
+}
+
 func (certManager *CertManager) certificateGetter(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	// Si tenemos certificado personalizado para este host, usarlo
-	if certManager.certificates[hello.ServerName] != nil {
-		return certManager.certificates[hello.ServerName], nil
+	// Si tenemos certificados personalizados para este host, usar el que admita el cliente
+	certManager.mu.RLock()
+	certificates := certManager.certificates[hello.ServerName]
+	dns01 := certManager.dns01
+	localCA := certManager.localCA
+	manager := certManager.manager
+	autoCertList := certManager.autoCertList
+	certManager.mu.RUnlock()
+	if len(certificates) > 0 {
+		return selectCertificate(hello, certificates), nil
+	}
+
+	// Los hosts de la CA local reciben un certificado emitido por ella
+	if localCA != nil {
+		if certificate, handled, err := localCA.GetCertificate(hello.ServerName); handled {
+			return certificate, err
+		}
+	}
+
+	// Los dominios DNS-01 (incluidos los comodines) se sirven desde su propio manager, salvo
+	// los retos tls-alpn de ACME
+	if dns01 != nil && !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		if certificates, handled := dns01.GetCertificates(hello.ServerName); handled {
+			if len(certificates) == 0 {
+				return nil, fmt.Errorf("certificate for server name %s is being obtained with DNS-01", hello.ServerName)
+			}
+			return selectCertificate(hello, certificates), nil
+		}
 	}
 
-	// Si hay hosts configurados para ACME/Let's Encrypt, usar el manager
-	if len(certManager.autoCertList) > 0 {
-		return certManager.manager.GetCertificate(hello)
+	// Si hay hosts configurados para ACME/Let's Encrypt, usar el manager y registrar el
+	// resultado de los hosts automáticos
+	if len(autoCertList) > 0 {
+		certificate, err := manager.GetCertificate(hello)
+		if slices.Contains(autoCertList, hello.ServerName) && !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			certManager.recordACME(hello.ServerName, certificate, err, false)
+		}
+		return certificate, err
 	}
 
 	// No hay certificado para este host y no está configurado ACME
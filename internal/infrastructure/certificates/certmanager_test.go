@@ -1,10 +1,19 @@
 package infrastructure
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -19,7 +28,7 @@ func TestNewCertManager_WhenCalled_ThenReturnsManager(t *testing.T) {
 	assert.NotNil(t, certMgr)
 	assert.Equal(t, manager, certMgr.manager)
 	assert.Empty(t, certMgr.autoCertList)
-	assert.Empty(t, certMgr.clientCAs)
+	assert.Empty(t, certMgr.clientAuth)
 	assert.Empty(t, certMgr.certificates)
 }
 
@@ -60,16 +69,40 @@ func TestCertManager_AddAutoCertificate_WhenCalled_ThenAddsToList(t *testing.T)
 	assert.Contains(t, certMgr.autoCertList, "example.com")
 }
 
-func TestCertManager_AddClientCA_WhenCalled_ThenAddsToList(t *testing.T) {
+func TestCertManager_SetClientAuth_WhenHostsShareServerName_ThenMergesPolicies(t *testing.T) {
 	// Arrange
 	certMgr := NewCertManager(&autocert.Manager{})
 
 	// Act
-	certMgr.AddClientCA([]string{"ca1.pem", "ca2.pem"})
+	certMgr.SetClientAuth("example.com", ClientAuthVerify, []string{"ca1.pem"})
+	certMgr.SetClientAuth("example.com", ClientAuthNone, []string{"ca2.pem"})
+	certMgr.SetClientAuth("other.com", ClientAuthRequire, nil)
 
 	// Assert
-	assert.Contains(t, certMgr.clientCAs, "ca1.pem")
-	assert.Contains(t, certMgr.clientCAs, "ca2.pem")
+	assert.Equal(t, tls.RequestClientCert, certMgr.clientAuth["example.com"].clientAuth)
+	assert.Equal(t, []string{"ca1.pem", "ca2.pem"}, certMgr.clientAuth["example.com"].cas)
+	assert.Equal(t, tls.RequireAnyClientCert, certMgr.clientAuth["other.com"].clientAuth)
+}
+
+func TestCertManager_GetTLSConfig_WhenHostVerifiesClients_ThenUsesHostConfigForServerName(t *testing.T) {
+	// Arrange
+	caPath, _ := writeTestCA(t)
+	certMgr := NewCertManager(&autocert.Manager{})
+	certMgr.SetClientAuth("secure.example.com", ClientAuthVerify, []string{caPath})
+	certMgr.SetClientAuth("public.example.com", "", nil)
+
+	// Act
+	config := certMgr.GetTLSConfig()
+	secure, secureErr := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "secure.example.com"})
+	public, publicErr := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "public.example.com"})
+
+	// Assert
+	require.NoError(t, secureErr)
+	require.NoError(t, publicErr)
+	require.NotNil(t, secure)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, secure.ClientAuth)
+	assert.Len(t, secure.ClientCAs.Subjects(), 1) //nolint:staticcheck // only the host CA, no system roots
+	assert.Nil(t, public)
 }
 
 func TestCertManager_GetTLSConfig_WhenCalled_ThenReturnsConfig(t *testing.T) {
@@ -82,8 +115,85 @@ func TestCertManager_GetTLSConfig_WhenCalled_ThenReturnsConfig(t *testing.T) {
 	// Assert
 	assert.NotNil(t, config)
 	assert.Equal(t, uint16(771), config.MinVersion) // tls.VersionTLS12
-	assert.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
 	assert.Contains(t, config.NextProtos, "h2")
 	assert.Contains(t, config.NextProtos, "http/1.1")
 	assert.Contains(t, config.NextProtos, "acme-tls/1")
 }
+
+func TestCertManager_HTTPHandler_WhenCAOffersHTTP01_ThenAnswersChallengeAndObtainsCertificate(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	manager, err := NewACMEManager(&ACMEConfig{DirectoryURL: standIn.directoryURL(), CACertificates: []string{standIn.caFile}}, t.TempDir())
+	require.NoError(t, err)
+	certMgr := NewCertManager(manager)
+	certMgr.AddAutoCertificate("example.com")
+	server := httptest.NewServer(certMgr.HTTPHandler(http.NotFoundHandler()))
+	defer server.Close()
+	var answered string
+	standIn.verifyHTTP01 = func(domain string, token string) bool {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/.well-known/acme-challenge/"+token, nil)
+		require.NoError(t, err)
+		req.Host = domain
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		answered = string(body)
+		expected, err := manager.Client.HTTP01ChallengeResponse(token)
+		require.NoError(t, err)
+		return res.StatusCode == http.StatusOK && answered == expected
+	}
+
+	// Act
+	certificate, err := certMgr.GetTLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+
+	// Assert
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, leaf.DNSNames)
+	assert.NotEmpty(t, answered)
+}
+
+func TestCertManager_HTTPHandler_WhenRequestIsNotAChallenge_ThenUsesFallback(t *testing.T) {
+	// Arrange
+	certMgr := NewCertManager(&autocert.Manager{})
+	fallback := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) { rw.WriteHeader(http.StatusTeapot) })
+	rec := httptest.NewRecorder()
+
+	// Act
+	certMgr.HTTPHandler(fallback).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/path", nil))
+
+	// Assert
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+}
+
+func TestCertManager_CertificateGetter_WhenHostHasSeveralKeyPairs_ThenSelectsOneSupportedByClient(t *testing.T) {
+	// Arrange
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaCert, ecdsaKey := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(time.Hour))
+	rsaCert, rsaKeyFile := writeTestKeyPairWithKey(t, t.TempDir(), "example.com", time.Now().Add(time.Hour), rsaKey)
+	certDefs := &CertificateDefs{
+		PublicKey:  ecdsaCert,
+		PrivateKey: ecdsaKey,
+		KeyPairs:   []*CertificateDefs{{PublicKey: rsaCert, PrivateKey: rsaKeyFile}},
+	}
+	require.NoError(t, certDefs.Validate())
+	certMgr := NewCertManager(nil)
+	require.NoError(t, certMgr.AddKeyPair("example.com", certDefs))
+	hello := func(schemes ...tls.SignatureScheme) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{ServerName: "example.com", SupportedVersions: []uint16{tls.VersionTLS13}, SignatureSchemes: schemes}
+	}
+
+	// Act
+	modern, modernErr := certMgr.certificateGetter(hello(tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256))
+	rsaOnly, rsaOnlyErr := certMgr.certificateGetter(hello(tls.PSSWithSHA256))
+
+	// Assert
+	require.NoError(t, modernErr)
+	require.NoError(t, rsaOnlyErr)
+	assert.IsType(t, &ecdsa.PrivateKey{}, modern.PrivateKey)
+	assert.IsType(t, &rsa.PrivateKey{}, rsaOnly.PrivateKey)
+}
@@ -0,0 +1,130 @@
+package infrastructure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ClientAuthMode is the client certificate policy of a virtual host.
+type ClientAuthMode string
+
+// Client certificate policies. An empty mode keeps the legacy behavior: a certificate is
+// verified if the client sends one and the host has CA certificates.
+const (
+	ClientAuthNone    ClientAuthMode = "none"
+	ClientAuthRequest ClientAuthMode = "request"
+	ClientAuthRequire ClientAuthMode = "require"
+	ClientAuthVerify  ClientAuthMode = "verify"
+)
+
+// Validate checks that the mode is known.
+func (mode ClientAuthMode) Validate() error {
+	switch mode {
+	case "", ClientAuthNone, ClientAuthRequest, ClientAuthRequire, ClientAuthVerify:
+		return nil
+	default:
+		return fmt.Errorf("unknown client_auth mode '%s' (expected none, request, require or verify)", mode)
+	}
+}
+
+// TLSClientAuth gets the TLS handshake policy for the mode.
+func (mode ClientAuthMode) TLSClientAuth(hasCAs bool) tls.ClientAuthType {
+	switch mode {
+	case ClientAuthRequest:
+		return tls.RequestClientCert
+	case ClientAuthRequire:
+		return tls.RequireAnyClientCert
+	case ClientAuthVerify:
+		return tls.RequireAndVerifyClientCert
+	case ClientAuthNone:
+		return tls.NoClientCert
+	default:
+		if hasCAs {
+			return tls.VerifyClientCertIfGiven
+		}
+		return tls.NoClientCert
+	}
+}
+
+// NewClientCAPool builds a pool with only the given CA certificate files or inline PEM. Unlike
+// the pool used to trust backends, the system roots are not included.
+func NewClientCAPool(caPems ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, caPem := range caPems {
+		pem, err := readPEM(caPem)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			if isInlinePEM(caPem) {
+				return nil, errors.New("no certificates found in inline PEM")
+			}
+			return nil, fmt.Errorf("no certificates found in %s", caPem)
+		}
+	}
+	return pool, nil
+}
+
+// VerifyClientCertificate checks that the certificate chain presented by a client is
+// issued by one of the CAs of the pool for client authentication, and returns the
+// verified chain from the leaf to the CA.
+func VerifyClientCertificate(pool *x509.CertPool, chain []*x509.Certificate) ([]*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		intermediates.AddCert(certificate)
+	}
+	chains, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+// ClientCAPool is a client CA pool that can be reloaded when its files change.
+type ClientCAPool struct {
+	files []string
+	mu    sync.RWMutex
+	pool  *x509.CertPool
+}
+
+// LoadClientCAPool returns a new object of ClientCAPool type loaded from the CA files.
+func LoadClientCAPool(caPems ...string) (*ClientCAPool, error) {
+	pool, err := NewClientCAPool(caPems...)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientCAPool{files: caPems, pool: pool}, nil
+}
+
+// Pool gets the pool in use.
+func (clientCAPool *ClientCAPool) Pool() *x509.CertPool {
+	clientCAPool.mu.RLock()
+	defer clientCAPool.mu.RUnlock()
+	return clientCAPool.pool
+}
+
+// Reload loads the pool again when any of the changed files is one of its files. The
+// previous pool is kept when the files can not be loaded.
+func (clientCAPool *ClientCAPool) Reload(changed []string) (bool, error) {
+	if !usesAny(clientCAPool.files, toSet(changed)) {
+		return false, nil
+	}
+	pool, err := NewClientCAPool(clientCAPool.files...)
+	if err != nil {
+		return true, err
+	}
+	clientCAPool.mu.Lock()
+	defer clientCAPool.mu.Unlock()
+	clientCAPool.pool = pool
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package infrastructure
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+func writeTestCA(t *testing.T) (string, *testCA) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return path, &testCA{certificate: certificate, key: key}
+}
+
+func (ca *testCA) issueClient(t *testing.T, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certificate
+}
+
+func TestVerifyClientCertificate_WhenIssuedByPoolCA_ThenReturnsNil(t *testing.T) {
+	// Arrange
+	caPath, ca := writeTestCA(t)
+	pool, err := NewClientCAPool(caPath)
+	require.NoError(t, err)
+
+	// Act
+	_, err = VerifyClientCertificate(pool, []*x509.Certificate{ca.issueClient(t, "alice")})
+
+	// Assert
+	assert.NoError(t, err)
+}
+
+func TestVerifyClientCertificate_WhenIssuedByOtherCA_ThenReturnsError(t *testing.T) {
+	// Arrange
+	caPath, _ := writeTestCA(t)
+	_, other := writeTestCA(t)
+	pool, err := NewClientCAPool(caPath)
+	require.NoError(t, err)
+
+	// Act
+	_, err = VerifyClientCertificate(pool, []*x509.Certificate{other.issueClient(t, "mallory")})
+
+	// Assert
+	assert.Error(t, err)
+}
+
+func TestClientAuthMode_Validate_WhenModeIsUnknown_ThenReturnsError(t *testing.T) {
+	// Act
+	err := ClientAuthMode("optional").Validate()
+
+	// Assert
+	assert.Error(t, err)
+	assert.NoError(t, ClientAuthVerify.Validate())
+	assert.NoError(t, ClientAuthMode("").Validate())
+}
@@ -0,0 +1,535 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	dns01CheckInterval           = time.Hour
+	dns01IssueTimeout            = 10 * time.Minute
+	defaultPropagationTimeout    = 2 * time.Minute
+	dns01PropagationPollInterval = 2 * time.Second
+	defaultDNS01RenewBefore      = 30 * 24 * time.Hour
+)
+
+var dns01Issuances = metrics.Default.NewCounterVec("reverseproxy_acme_dns01_issuances_total", "Certificates obtained with ACME DNS-01 challenges.", "domain", "result")
+
+// DNS01Config is the configuration of the certificates obtained with DNS-01 challenges, which
+// allow wildcard certificates and certificates for hosts not reachable from the internet.
+type DNS01Config struct {
+	Domains            []string       `json:"domains"`
+	Provider           string         `json:"provider"`
+	RFC2136            *RFC2136Config `json:"rfc2136,omitempty"`
+	Exec               *ExecDNSConfig `json:"exec,omitempty"`
+	Resolvers          []string       `json:"resolvers,omitempty"`
+	PropagationTimeout string         `json:"propagation_timeout,omitempty"`
+	RenewBefore        string         `json:"renew_before,omitempty"`
+	KeyTypes           []ACMEKeyType  `json:"key_types,omitempty"`
+}
+
+// Validate checks the domains, the provider and the durations.
+func (config *DNS01Config) Validate() error {
+	if len(config.Domains) == 0 {
+		return errors.New("'domains' is required")
+	}
+	for i, domain := range config.Domains {
+		name := strings.TrimPrefix(domain, "*.")
+		if _, isDomain := dns.IsDomainName(name); !isDomain || !strings.Contains(name, ".") || strings.Contains(name, "*") {
+			return fmt.Errorf("domains[%d]: '%s' is not a valid domain name", i, domain)
+		}
+	}
+	switch config.Provider {
+	case DNSProviderRFC2136:
+		if config.RFC2136 == nil {
+			return errors.New("rfc2136: required by provider 'rfc2136'")
+		}
+		if err := config.RFC2136.Validate(); err != nil {
+			return errors.New("rfc2136: " + err.Error())
+		}
+	case DNSProviderExec:
+		if config.Exec == nil {
+			return errors.New("exec: required by provider 'exec'")
+		}
+		if err := config.Exec.Validate(); err != nil {
+			return errors.New("exec: " + err.Error())
+		}
+	default:
+		return fmt.Errorf("provider: unknown provider '%s' (expected rfc2136 or exec)", config.Provider)
+	}
+	for i, resolver := range config.Resolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return fmt.Errorf("resolvers[%d]: '%s' must be a host:port address", i, resolver)
+		}
+	}
+	if err := validatePositiveDuration(config.PropagationTimeout); err != nil {
+		return errors.New("propagation_timeout: " + err.Error())
+	}
+	if err := validatePositiveDuration(config.RenewBefore); err != nil {
+		return errors.New("renew_before: " + err.Error())
+	}
+	for i, keyType := range config.KeyTypes {
+		if err := keyType.validate(); err != nil {
+			return fmt.Errorf("key_types[%d]: %w", i, err)
+		}
+		if slices.Index(config.KeyTypes, keyType) != i {
+			return fmt.Errorf("key_types[%d]: '%s' is repeated", i, keyType)
+		}
+	}
+	return nil
+}
+
+func validatePositiveDuration(value string) error {
+	if value == "" {
+		return nil
+	}
+	if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+		return fmt.Errorf("'%s' is not a valid duration", value)
+	}
+	return nil
+}
+
+// NewDNSProvider returns the provider of the configuration.
+func (config *DNS01Config) NewDNSProvider() (DNSProvider, error) {
+	switch {
+	case config.Provider == DNSProviderRFC2136 && config.RFC2136 != nil:
+		return NewRFC2136Provider(*config.RFC2136), nil
+	case config.Provider == DNSProviderExec && config.Exec != nil:
+		return NewExecDNSProvider(*config.Exec), nil
+	default:
+		return nil, fmt.Errorf("unknown DNS provider '%s'", config.Provider)
+	}
+}
+
+func durationOrDefault(value string, defaultValue time.Duration) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return defaultValue
+	}
+	return duration
+}
+
+// DNS01Manager is the object responsible to obtain and renew the certificates of the domains
+// configured for DNS-01 challenges. It shares the account of the autocert manager. Each domain
+// gets a certificate of every key type, so the clients without ECDSA support get an RSA one.
+type DNS01Manager struct {
+	domains            []string
+	keyTypes           []ACMEKeyType
+	client             *acme.Client
+	account            *acme.Account
+	cache              autocert.Cache
+	provider           DNSProvider
+	resolvers          []string
+	logger             Logger
+	propagationTimeout time.Duration
+	renewBefore        time.Duration
+	now                func() time.Time
+	mu                 sync.RWMutex
+	registerMu         sync.Mutex
+	registered         bool
+	locks              *lockingCache
+	// certificates are the certificates of each domain, in the order of keyTypes, nil while
+	// missing
+	certificates map[string][]*tls.Certificate
+	stop         chan struct{}
+}
+
+// NewDNS01Manager returns a new object of DNS01Manager type, or nil when the configuration has
+// no DNS-01 section. The certificates already in the cache are loaded.
+func NewDNS01Manager(config *ACMEConfig, manager *autocert.Manager, logger Logger) (*DNS01Manager, error) {
+	if config == nil || config.DNS01 == nil {
+		return nil, nil
+	}
+	if err := loadAccountKey(manager); err != nil {
+		return nil, err
+	}
+	if manager.Client == nil || manager.Client.Key == nil {
+		return nil, errors.New("the ACME account key is not available")
+	}
+	provider, err := config.DNS01.NewDNSProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	var contact []string
+	if manager.Email != "" {
+		contact = []string{"mailto:" + manager.Email}
+	}
+	keyTypes := slices.Clone(config.DNS01.KeyTypes)
+	if len(keyTypes) == 0 {
+		keyTypes = []ACMEKeyType{ACMEKeyECDSAP256}
+	}
+	domains := make([]string, 0, len(config.DNS01.Domains))
+	for _, domain := range config.DNS01.Domains {
+		domains = append(domains, strings.ToLower(domain))
+	}
+	dns01Manager := &DNS01Manager{
+		domains:  domains,
+		keyTypes: keyTypes,
+		client: &acme.Client{
+			Key:          manager.Client.Key,
+			DirectoryURL: manager.Client.DirectoryURL,
+			HTTPClient:   manager.Client.HTTPClient,
+		},
+		account:            &acme.Account{Contact: contact, ExternalAccountBinding: manager.ExternalAccountBinding},
+		cache:              manager.Cache,
+		provider:           provider,
+		resolvers:          slices.Clone(config.DNS01.Resolvers),
+		logger:             logger,
+		propagationTimeout: durationOrDefault(config.DNS01.PropagationTimeout, defaultPropagationTimeout),
+		renewBefore:        durationOrDefault(config.DNS01.RenewBefore, defaultDNS01RenewBefore),
+		now:                time.Now,
+		certificates:       make(map[string][]*tls.Certificate),
+	}
+	dns01Manager.locks, _ = manager.Cache.(*lockingCache)
+	for _, domain := range dns01Manager.domains {
+		certificates := make([]*tls.Certificate, len(keyTypes))
+		for i, keyType := range keyTypes {
+			if certificate, err := dns01Manager.loadCertificate(context.Background(), domain, keyType); err == nil {
+				certificates[i] = certificate
+			}
+		}
+		dns01Manager.certificates[domain] = certificates
+	}
+	return dns01Manager, nil
+}
+
+// GetCertificate gets the certificate of the first key type for a server name. handled is false
+// when the server name is not covered by the DNS-01 domains; the certificate is nil while it is
+// being obtained.
+func (manager *DNS01Manager) GetCertificate(serverName string) (certificate *tls.Certificate, handled bool) {
+	certificates, handled := manager.GetCertificates(serverName)
+	if len(certificates) == 0 {
+		return nil, handled
+	}
+	return certificates[0], handled
+}
+
+// GetCertificates gets the certificates obtained so far for a server name, in the order of the
+// key types. handled is false when the server name is not covered by the DNS-01 domains.
+func (manager *DNS01Manager) GetCertificates(serverName string) (certificates []*tls.Certificate, handled bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	wildcard := ""
+	if labels := strings.SplitN(serverName, ".", 2); len(labels) == 2 {
+		wildcard = "*." + labels[1]
+	}
+
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	for _, name := range []string{serverName, wildcard} {
+		if slices.Contains(manager.domains, name) {
+			for _, certificate := range manager.certificates[name] {
+				if certificate != nil {
+					certificates = append(certificates, certificate)
+				}
+			}
+			return certificates, true
+		}
+	}
+	return nil, false
+}
+
+// Certificates gets the certificates obtained so far by domain.
+func (manager *DNS01Manager) Certificates() map[string][]*tls.Certificate {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	certificates := make(map[string][]*tls.Certificate, len(manager.certificates))
+	for domain, domainCertificates := range manager.certificates {
+		for _, certificate := range domainCertificates {
+			if certificate != nil {
+				certificates[domain] = append(certificates[domain], certificate)
+			}
+		}
+	}
+	return certificates
+}
+
+// Start obtains the missing certificates and renews them before they expire, checking them
+// every hour.
+func (manager *DNS01Manager) Start() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if manager.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	manager.stop = stop
+	go func() {
+		ticker := time.NewTicker(dns01CheckInterval)
+		defer ticker.Stop()
+		for {
+			manager.renewDue()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the renewals started by Start.
+func (manager *DNS01Manager) Stop() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if manager.stop != nil {
+		close(manager.stop)
+		manager.stop = nil
+	}
+}
+
+// renewDue obtains the certificates that are missing or due for renewal.
+func (manager *DNS01Manager) renewDue() {
+	for _, domain := range manager.domains {
+		for i, keyType := range manager.keyTypes {
+			manager.mu.RLock()
+			certificate := manager.certificates[domain][i]
+			manager.mu.RUnlock()
+			if certificate != nil && !manager.isDue(certificate) {
+				continue
+			}
+			if certificate = manager.renew(domain, keyType); certificate == nil {
+				continue
+			}
+			manager.mu.Lock()
+			certificates := slices.Clone(manager.certificates[domain])
+			certificates[i] = certificate
+			manager.certificates[domain] = certificates
+			manager.mu.Unlock()
+		}
+	}
+}
+
+// renew gets a new certificate of the domain with a key of the type, or nil when there is none.
+// The instances sharing the cache take turns: the certificate obtained by another one is loaded
+// from the cache, and while another one is obtaining it the current certificate is kept until the
+// next check.
+func (manager *DNS01Manager) renew(domain string, keyType ACMEKeyType) *tls.Certificate {
+	ctx, cancel := context.WithTimeout(context.Background(), dns01IssueTimeout)
+	defer cancel()
+	key := dns01CacheKey(domain, keyType)
+	isLocked, err := manager.locks.tryLock(ctx, key)
+	if err != nil {
+		manager.logger.Error(fmt.Sprintf("Failed to lock certificate for '%v' (%v) in the ACME cache: %v", domain, keyType, err))
+		return nil
+	}
+	if !isLocked {
+		return nil
+	}
+	defer manager.locks.unlock(key)
+	if certificate, err := manager.loadCertificate(ctx, domain, keyType); err == nil && !manager.isDue(certificate) {
+		return certificate
+	}
+
+	certificate, err := manager.obtain(ctx, domain, keyType)
+	if err != nil {
+		dns01Issuances.Inc(domain, "failure")
+		manager.logger.Error(fmt.Sprintf("Failed to obtain certificate for '%v' (%v) with DNS-01: %v", domain, keyType, err))
+		return nil
+	}
+	dns01Issuances.Inc(domain, "success")
+	manager.logger.Info(fmt.Sprintf("obtained certificate for '%v' (%v) with DNS-01, valid until %v", domain, keyType, certificate.Leaf.NotAfter))
+	return certificate
+}
+
+func (manager *DNS01Manager) isDue(certificate *tls.Certificate) bool {
+	return !manager.now().Before(certificate.Leaf.NotAfter.Add(-manager.renewBefore))
+}
+
+// obtain orders a certificate with a key of the type for the domain, satisfying its
+// authorizations with DNS-01 challenges.
+func (manager *DNS01Manager) obtain(ctx context.Context, domain string, keyType ACMEKeyType) (*tls.Certificate, error) {
+	if err := manager.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := manager.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == acme.StatusPending {
+		for _, authzURL := range order.AuthzURLs {
+			if err := manager.authorize(ctx, authzURL); err != nil {
+				return nil, err
+			}
+		}
+		if order, err = manager.client.WaitOrder(ctx, order.URI); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := manager.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var data bytes.Buffer
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	_ = pem.Encode(&data, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		_ = pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	certificate, err := parseCachedCertificate(data.Bytes(), domain)
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.cache.Put(ctx, dns01CacheKey(domain, keyType), data.Bytes()); err != nil {
+		manager.logger.Error(fmt.Sprintf("Failed to cache certificate for '%v': %v", domain, err))
+	}
+	return certificate, nil
+}
+
+func (manager *DNS01Manager) register(ctx context.Context) error {
+	manager.registerMu.Lock()
+	defer manager.registerMu.Unlock()
+	if manager.registered {
+		return nil
+	}
+	if _, err := manager.client.Register(ctx, manager.account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+	manager.registered = true
+	return nil
+}
+
+// authorize satisfies a pending authorization with its DNS-01 challenge.
+func (manager *DNS01Manager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := manager.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status != acme.StatusPending {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, candidate := range authz.Challenges {
+		if candidate.Type == "dns-01" {
+			challenge = candidate
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("the CA offers no dns-01 challenge for '%s'", authz.Identifier.Value)
+	}
+
+	value, err := manager.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + dns.Fqdn(authz.Identifier.Value)
+	if err := manager.provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := manager.provider.CleanUp(context.Background(), fqdn, value); err != nil {
+			manager.logger.Error(fmt.Sprintf("Failed to remove DNS-01 record '%v': %v", fqdn, err))
+		}
+	}()
+	if err := manager.waitPropagation(ctx, fqdn, value); err != nil {
+		return err
+	}
+	if _, err := manager.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = manager.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// waitPropagation waits until the record is visible in every resolver, or in the system
+// resolver when none is configured.
+func (manager *DNS01Manager) waitPropagation(ctx context.Context, fqdn string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, manager.propagationTimeout)
+	defer cancel()
+	for {
+		if manager.isPropagated(ctx, fqdn, value) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the DNS-01 record '%s' is not visible after %v", fqdn, manager.propagationTimeout)
+		case <-time.After(dns01PropagationPollInterval):
+		}
+	}
+}
+
+func (manager *DNS01Manager) isPropagated(ctx context.Context, fqdn string, value string) bool {
+	if len(manager.resolvers) == 0 {
+		records, err := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		return err == nil && slices.Contains(records, value)
+	}
+
+	client := &dns.Client{Timeout: 5 * time.Second}
+	for _, resolver := range manager.resolvers {
+		query := new(dns.Msg)
+		query.SetQuestion(fqdn, dns.TypeTXT)
+		reply, _, err := client.ExchangeContext(ctx, query, resolver)
+		if err != nil || !hasTXT(reply, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTXT(reply *dns.Msg, value string) bool {
+	for _, answer := range reply.Answer {
+		if txt, isTXT := answer.(*dns.TXT); isTXT && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (manager *DNS01Manager) loadCertificate(ctx context.Context, domain string, keyType ACMEKeyType) (*tls.Certificate, error) {
+	data, err := manager.cache.Get(ctx, dns01CacheKey(domain, keyType))
+	if err != nil {
+		return nil, err
+	}
+	return parseCachedCertificate(data, domain)
+}
+
+// parseCachedCertificate parses the private key and certificate chain kept in the cache.
+func parseCachedCertificate(data []byte, domain string) (*tls.Certificate, error) {
+	certificate, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := certificate.Leaf.VerifyHostname(strings.Replace(domain, "*", "wildcard", 1)); err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// dns01CacheKey gets the cache name of the certificate of a domain with a key of the type,
+// separate from the autocert ones. The ecdsa-p256 ones keep the name without the key type.
+func dns01CacheKey(domain string, keyType ACMEKeyType) string {
+	key := "dns01+" + strings.Replace(domain, "*", "_wildcard", 1)
+	if keyType != ACMEKeyECDSAP256 && keyType != "" {
+		key += "+" + string(keyType)
+	}
+	return key
+}
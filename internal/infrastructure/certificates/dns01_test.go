@@ -0,0 +1,333 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const testTSIGKey = "acme-update."
+
+var testTSIGSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+// testDNSServer is an authoritative server that accepts TSIG signed dynamic updates over TCP
+// and answers TXT queries over UDP.
+type testDNSServer struct {
+	tcpAddr string
+	udpAddr string
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	server := &testDNSServer{records: make(map[string][]string)}
+	handler := dns.HandlerFunc(server.serveDNS)
+	secret := map[string]string{testTSIGKey: testTSIGSecret}
+
+	tcpStarted := make(chan struct{})
+	tcp := &dns.Server{Addr: "127.0.0.1:0", Net: "tcp", Handler: handler, TsigSecret: secret, NotifyStartedFunc: func() { close(tcpStarted) },
+		// updates are rejected as not implemented by default
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }}
+	udpStarted := make(chan struct{})
+	udp := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: handler, NotifyStartedFunc: func() { close(udpStarted) }}
+	go func() { _ = tcp.ListenAndServe() }()
+	go func() { _ = udp.ListenAndServe() }()
+	<-tcpStarted
+	<-udpStarted
+	t.Cleanup(func() {
+		_ = tcp.Shutdown()
+		_ = udp.Shutdown()
+	})
+	server.tcpAddr = tcp.Listener.Addr().String()
+	server.udpAddr = udp.PacketConn.LocalAddr().String()
+	return server
+}
+
+func (server *testDNSServer) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if req.Opcode == dns.OpcodeUpdate {
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			reply.Rcode = dns.RcodeNotAuth
+			_ = w.WriteMsg(reply)
+			return
+		}
+		for _, record := range req.Ns {
+			txt, isTXT := record.(*dns.TXT)
+			if !isTXT {
+				continue
+			}
+			name, value := txt.Hdr.Name, txt.Txt[0]
+			if txt.Hdr.Class == dns.ClassNONE {
+				server.records[name] = slices.DeleteFunc(server.records[name], func(existing string) bool { return existing == value })
+			} else {
+				server.records[name] = append(server.records[name], value)
+			}
+		}
+		reply.SetTsig(testTSIGKey, dns.HmacSHA256, 300, time.Now().Unix())
+		_ = w.WriteMsg(reply)
+		return
+	}
+
+	for _, question := range req.Question {
+		for _, value := range server.records[question.Name] {
+			reply.Answer = append(reply.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{value},
+			})
+		}
+	}
+	_ = w.WriteMsg(reply)
+}
+
+func (server *testDNSServer) txt(name string) []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return slices.Clone(server.records[name])
+}
+
+func (server *testDNSServer) dns01Config(domains ...string) *DNS01Config {
+	return &DNS01Config{
+		Domains:  domains,
+		Provider: DNSProviderRFC2136,
+		RFC2136: &RFC2136Config{
+			Nameserver: server.tcpAddr,
+			Zone:       "example.com.",
+			TSIGKey:    testTSIGKey,
+			TSIGSecret: testTSIGSecret,
+		},
+		Resolvers:          []string{server.udpAddr},
+		PropagationTimeout: "5s",
+	}
+}
+
+func newTestDNS01Manager(t *testing.T, standIn *acmeStandIn, dnsServer *testDNSServer, cacheDir string, keyTypes ...ACMEKeyType) *DNS01Manager {
+	config := &ACMEConfig{
+		DirectoryURL:   standIn.directoryURL(),
+		CacheDir:       cacheDir,
+		CACertificates: []string{standIn.caFile},
+		DNS01:          dnsServer.dns01Config("*.example.com"),
+	}
+	config.DNS01.KeyTypes = keyTypes
+	require.NoError(t, config.Validate())
+	acmeManager, err := NewACMEManager(config, "./certs")
+	require.NoError(t, err)
+	manager, err := NewDNS01Manager(config, acmeManager, &testLogger{})
+	require.NoError(t, err)
+	require.NotNil(t, manager)
+	return manager
+}
+
+func TestRFC2136Provider_Present_WhenTSIGIsValid_ThenPublishesAndRemovesRecord(t *testing.T) {
+	// Arrange
+	dnsServer := newTestDNSServer(t)
+	provider := NewRFC2136Provider(*dnsServer.dns01Config("example.com").RFC2136)
+	manager := &DNS01Manager{resolvers: []string{dnsServer.udpAddr}}
+	ctx := context.Background()
+
+	// Act
+	require.NoError(t, provider.Present(ctx, "_acme-challenge.example.com.", "value-1"))
+	published := manager.isPropagated(ctx, "_acme-challenge.example.com.", "value-1")
+	require.NoError(t, provider.CleanUp(ctx, "_acme-challenge.example.com.", "value-1"))
+
+	// Assert
+	assert.True(t, published)
+	assert.Empty(t, dnsServer.txt("_acme-challenge.example.com."))
+}
+
+func TestRFC2136Provider_Present_WhenTSIGSecretIsWrong_ThenReturnsError(t *testing.T) {
+	// Arrange
+	dnsServer := newTestDNSServer(t)
+	config := *dnsServer.dns01Config("example.com").RFC2136
+	config.TSIGSecret = base64.StdEncoding.EncodeToString([]byte("wrong"))
+	provider := NewRFC2136Provider(config)
+
+	// Act
+	err := provider.Present(context.Background(), "_acme-challenge.example.com.", "value-1")
+
+	// Assert
+	assert.Error(t, err)
+	assert.Empty(t, dnsServer.txt("_acme-challenge.example.com."))
+}
+
+func TestExecDNSProvider_Present_WhenCommandSucceeds_ThenPassesActionAndRecord(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	output := filepath.Join(dir, "calls")
+	hook := filepath.Join(dir, "hook.sh")
+	require.NoError(t, os.WriteFile(hook, []byte("#!/bin/sh\necho \"$1 $2 $3\" >> "+output+"\n"), 0o700))
+	provider := NewExecDNSProvider(ExecDNSConfig{Command: hook})
+
+	// Act
+	require.NoError(t, provider.Present(context.Background(), "_acme-challenge.example.com.", "value-1"))
+	require.NoError(t, provider.CleanUp(context.Background(), "_acme-challenge.example.com.", "value-1"))
+
+	// Assert
+	calls, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "present _acme-challenge.example.com. value-1\ncleanup _acme-challenge.example.com. value-1\n", string(calls))
+}
+
+func TestDNS01Manager_RenewDue_WhenCertificateIsMissing_ThenObtainsWildcardWithDNS01(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	dnsServer := newTestDNSServer(t)
+	manager := newTestDNS01Manager(t, standIn, dnsServer, t.TempDir())
+	var published []string
+	standIn.verifyDNS01 = func(domain string, token string) bool {
+		expected, err := manager.client.DNS01ChallengeRecord(token)
+		require.NoError(t, err)
+		published = dnsServer.txt("_acme-challenge." + domain + ".")
+		return slices.Contains(published, expected)
+	}
+	_, handled := manager.GetCertificate("app.example.com")
+	require.True(t, handled)
+
+	// Act
+	manager.renewDue()
+
+	// Assert
+	assert.NotEmpty(t, published)
+	certificate, handled := manager.GetCertificate("app.example.com")
+	assert.True(t, handled)
+	require.NotNil(t, certificate)
+	assert.Equal(t, []string{"*.example.com"}, certificate.Leaf.DNSNames)
+	assert.Empty(t, dnsServer.txt("_acme-challenge.example.com."))
+	_, handled = manager.GetCertificate("example.org")
+	assert.False(t, handled)
+}
+
+func TestDNS01Manager_RenewDue_WhenChallengeFails_ThenKeepsNoCertificate(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	dnsServer := newTestDNSServer(t)
+	manager := newTestDNS01Manager(t, standIn, dnsServer, t.TempDir())
+	logger := &testLogger{}
+	manager.logger = logger
+	standIn.verifyDNS01 = func(string, string) bool { return false }
+
+	// Act
+	manager.renewDue()
+
+	// Assert
+	certificate, handled := manager.GetCertificate("app.example.com")
+	assert.True(t, handled)
+	assert.Nil(t, certificate)
+	require.Len(t, logger.errors, 1)
+	assert.Contains(t, logger.errors[0], "Failed to obtain certificate for '*.example.com'")
+}
+
+func TestNewDNS01Manager_WhenCertificateIsCached_ThenLoadsItWithoutRenewing(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	dnsServer := newTestDNSServer(t)
+	cacheDir := t.TempDir()
+	first := newTestDNS01Manager(t, standIn, dnsServer, cacheDir)
+	standIn.verifyDNS01 = func(string, string) bool { return true }
+	first.renewDue()
+	standIn.verifyDNS01 = func(string, string) bool {
+		t.Error("the cached certificate must not be renewed")
+		return false
+	}
+
+	// Act
+	second := newTestDNS01Manager(t, standIn, dnsServer, cacheDir)
+	second.renewDue()
+
+	// Assert
+	certificate, _ := second.GetCertificate("www.example.com")
+	require.NotNil(t, certificate)
+	assert.Equal(t, []string{"*.example.com"}, certificate.Leaf.DNSNames)
+}
+
+func TestDNS01Manager_RenewDue_WhenKeyTypesAreSet_ThenObtainsCertificateOfEachType(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	dnsServer := newTestDNSServer(t)
+	cacheDir := t.TempDir()
+	manager := newTestDNS01Manager(t, standIn, dnsServer, cacheDir, ACMEKeyECDSAP256, ACMEKeyRSA2048)
+	standIn.verifyDNS01 = func(string, string) bool { return true }
+
+	// Act
+	manager.renewDue()
+
+	// Assert
+	certificates, handled := manager.GetCertificates("app.example.com")
+	assert.True(t, handled)
+	require.Len(t, certificates, 2)
+	assert.IsType(t, &ecdsa.PrivateKey{}, certificates[0].PrivateKey)
+	assert.IsType(t, &rsa.PrivateKey{}, certificates[1].PrivateKey)
+	assert.FileExists(t, filepath.Join(cacheDir, dns01CacheKey("*.example.com", ACMEKeyRSA2048)))
+	assert.Len(t, manager.Certificates()["*.example.com"], 2)
+}
+
+func TestCertManager_CertificateGetter_WhenServerNameIsDNS01Domain_ThenServesDNS01Certificate(t *testing.T) {
+	// Arrange
+	standIn := newACMEStandIn(t)
+	dnsServer := newTestDNSServer(t)
+	manager := newTestDNS01Manager(t, standIn, dnsServer, t.TempDir())
+	certMgr := NewCertManager(&autocert.Manager{})
+	certMgr.AddAutoCertificate("app.example.com")
+	certMgr.SetDNS01Manager(manager)
+
+	// Act
+	_, pendingErr := certMgr.certificateGetter(&tls.ClientHelloInfo{ServerName: "app.example.com"})
+	standIn.verifyDNS01 = func(string, string) bool { return true }
+	manager.renewDue()
+	certificate, err := certMgr.certificateGetter(&tls.ClientHelloInfo{ServerName: "app.example.com"})
+
+	// Assert
+	assert.ErrorContains(t, pendingErr, "is being obtained with DNS-01")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.example.com"}, certificate.Leaf.DNSNames)
+}
+
+func TestDNS01Config_Validate_WhenConfigIsInvalid_ThenReturnsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *DNS01Config
+		expected string
+	}{
+		{name: "no domains", config: &DNS01Config{Provider: DNSProviderExec}, expected: "'domains' is required"},
+		{name: "invalid wildcard", config: &DNS01Config{Domains: []string{"app.*.example.com"}, Provider: DNSProviderExec}, expected: "domains[0]: 'app.*.example.com' is not a valid domain name"},
+		{name: "unknown provider", config: &DNS01Config{Domains: []string{"example.com"}, Provider: "route53"}, expected: "provider: unknown provider 'route53'"},
+		{name: "provider without settings", config: &DNS01Config{Domains: []string{"example.com"}, Provider: DNSProviderRFC2136}, expected: "rfc2136: required by provider 'rfc2136'"},
+		{
+			name:     "tsig key without secret",
+			config:   &DNS01Config{Domains: []string{"example.com"}, Provider: DNSProviderRFC2136, RFC2136: &RFC2136Config{Nameserver: "ns1:53", Zone: "example.com.", TSIGKey: "key."}},
+			expected: "rfc2136: 'tsig_key' and 'tsig_secret' must be set together",
+		},
+		{
+			name:     "invalid resolver",
+			config:   &DNS01Config{Domains: []string{"example.com"}, Provider: DNSProviderExec, Exec: &ExecDNSConfig{Command: "hook"}, Resolvers: []string{"8.8.8.8"}},
+			expected: "resolvers[0]: '8.8.8.8' must be a host:port address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			err := tt.config.Validate()
+
+			// Assert
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
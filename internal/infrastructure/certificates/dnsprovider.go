@@ -0,0 +1,179 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS providers that can be used in the provider field of the DNS-01 configuration.
+const (
+	DNSProviderRFC2136 = "rfc2136"
+	DNSProviderExec    = "exec"
+)
+
+const (
+	defaultDNSRecordTTL = 60
+	dnsProviderTimeout  = 30 * time.Second
+)
+
+// DNSProvider publishes the TXT records of the ACME DNS-01 challenges. fqdn is the fully
+// qualified record name, such as _acme-challenge.example.com., and value the record content.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn string, value string) error
+	CleanUp(ctx context.Context, fqdn string, value string) error
+}
+
+// RFC2136Config is the configuration of the dynamic updates (RFC 2136) of a DNS server.
+type RFC2136Config struct {
+	Nameserver    string `json:"nameserver"`
+	Zone          string `json:"zone"`
+	TSIGKey       string `json:"tsig_key,omitempty"`
+	TSIGSecret    string `json:"tsig_secret,omitempty"`
+	TSIGAlgorithm string `json:"tsig_algorithm,omitempty"`
+	TTL           uint32 `json:"ttl,omitempty"`
+}
+
+// Validate checks the nameserver, zone and TSIG settings.
+func (config *RFC2136Config) Validate() error {
+	if _, _, err := net.SplitHostPort(config.Nameserver); err != nil {
+		return fmt.Errorf("'nameserver' must be a host:port address")
+	}
+	if strings.TrimSpace(config.Zone) == "" {
+		return errors.New("'zone' is required")
+	}
+	if (config.TSIGKey == "") != (config.TSIGSecret == "") {
+		return errors.New("'tsig_key' and 'tsig_secret' must be set together")
+	}
+	if config.TSIGSecret != "" {
+		if _, err := base64.StdEncoding.DecodeString(config.TSIGSecret); err != nil {
+			return errors.New("'tsig_secret' must be base64 encoded")
+		}
+	}
+	switch dns.Fqdn(strings.ToLower(config.TSIGAlgorithm)) {
+	case ".", dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return fmt.Errorf("unknown tsig_algorithm '%s' (expected hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512)", config.TSIGAlgorithm)
+	}
+	return nil
+}
+
+// RFC2136Provider publishes the challenge records with dynamic updates.
+type RFC2136Provider struct {
+	config RFC2136Config
+	client *dns.Client
+}
+
+// NewRFC2136Provider returns a new object of RFC2136Provider type.
+func NewRFC2136Provider(config RFC2136Config) *RFC2136Provider {
+	client := &dns.Client{Net: "tcp", Timeout: dnsProviderTimeout}
+	if config.TSIGKey != "" {
+		config.TSIGKey = dns.CanonicalName(config.TSIGKey)
+		client.TsigSecret = map[string]string{config.TSIGKey: config.TSIGSecret}
+	}
+	if config.TSIGAlgorithm == "" {
+		config.TSIGAlgorithm = dns.HmacSHA256
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultDNSRecordTTL
+	}
+	return &RFC2136Provider{config: config, client: client}
+}
+
+// Present adds the TXT record.
+func (provider *RFC2136Provider) Present(ctx context.Context, fqdn string, value string) error {
+	return provider.update(ctx, fqdn, value, true)
+}
+
+// CleanUp removes the TXT record.
+func (provider *RFC2136Provider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return provider.update(ctx, fqdn, value, false)
+}
+
+func (provider *RFC2136Provider) update(ctx context.Context, fqdn string, value string, insert bool) error {
+	record := &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(fqdn), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: provider.config.TTL},
+		Txt: []string{value},
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(provider.config.Zone))
+	if insert {
+		msg.Insert([]dns.RR{record})
+	} else {
+		msg.Remove([]dns.RR{record})
+	}
+	if provider.config.TSIGKey != "" {
+		msg.SetTsig(provider.config.TSIGKey, dns.Fqdn(strings.ToLower(provider.config.TSIGAlgorithm)), 300, time.Now().Unix())
+	}
+
+	reply, _, err := provider.client.ExchangeContext(ctx, msg, provider.config.Nameserver)
+	if err != nil {
+		return fmt.Errorf("DNS update of '%s' failed: %w", fqdn, err)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update of '%s' failed: %s", fqdn, dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// ExecDNSConfig is the configuration of a program that publishes the challenge records. It is
+// called as `command present <fqdn> <value>` and `command cleanup <fqdn> <value>`.
+type ExecDNSConfig struct {
+	Command string `json:"command"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Validate checks the command and timeout.
+func (config *ExecDNSConfig) Validate() error {
+	if strings.TrimSpace(config.Command) == "" {
+		return errors.New("'command' is required")
+	}
+	if config.Timeout != "" {
+		if timeout, err := time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("'timeout': '%s' is not a valid duration", config.Timeout)
+		}
+	}
+	return nil
+}
+
+// ExecDNSProvider publishes the challenge records with an external program.
+type ExecDNSProvider struct {
+	command string
+	timeout time.Duration
+}
+
+// NewExecDNSProvider returns a new object of ExecDNSProvider type.
+func NewExecDNSProvider(config ExecDNSConfig) *ExecDNSProvider {
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = dnsProviderTimeout
+	}
+	return &ExecDNSProvider{command: config.Command, timeout: timeout}
+}
+
+// Present runs the command with the present action.
+func (provider *ExecDNSProvider) Present(ctx context.Context, fqdn string, value string) error {
+	return provider.run(ctx, "present", fqdn, value)
+}
+
+// CleanUp runs the command with the cleanup action.
+func (provider *ExecDNSProvider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return provider.run(ctx, "cleanup", fqdn, value)
+}
+
+func (provider *ExecDNSProvider) run(ctx context.Context, action string, fqdn string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, provider.timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, provider.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("'%s %s %s' failed: %w: %s", provider.command, action, fqdn, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package infrastructure
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	defaultECHRotationInterval = 30 * 24 * time.Hour
+	defaultECHOldKeys          = 1
+	maxECHOldKeys              = 8
+	echCheckInterval           = time.Hour
+	echKeyBlockType            = "ECH KEY"
+	echConfigIDHeader          = "Config-Id"
+	echCreatedHeader           = "Created"
+
+	// ECHConfig version of RFC 9849 and the HPKE algorithms of the keys: DHKEM(X25519,
+	// HKDF-SHA256) with HKDF-SHA256 and AES-128-GCM, AES-256-GCM or ChaCha20Poly1305.
+	echConfigVersion     = 0xfe0d
+	hpkeKEMX25519        = 0x0020
+	hpkeKDFHKDFSHA256    = 0x0001
+	hpkeAEADAES128GCM    = 0x0001
+	hpkeAEADAES256GCM    = 0x0002
+	hpkeAEADChaCha20Poly = 0x0003
+)
+
+// ECHConfig is the configuration of Encrypted Client Hello, which hides the server name of the
+// handshake from the network. Clients only see the public name, and learn the keys from the
+// ECHConfigList published in the HTTPS DNS records of the hidden hosts.
+type ECHConfig struct {
+	PublicName       string `json:"public_name"`
+	RotationInterval string `json:"rotation_interval,omitempty"`
+	OldKeys          int    `json:"old_keys,omitempty"`
+	File             string `json:"file,omitempty"`
+}
+
+// Validate checks the public name, the rotation interval and the number of old keys.
+func (config *ECHConfig) Validate() error {
+	if _, isDomain := dns.IsDomainName(config.PublicName); !isDomain || config.PublicName == "" || strings.ContainsFunc(config.PublicName, isInvalidHostNameRune) {
+		return fmt.Errorf("public_name: '%s' is not a valid host name", config.PublicName)
+	}
+	if err := validatePositiveDuration(config.RotationInterval); err != nil {
+		return errors.New("rotation_interval: " + err.Error())
+	}
+	if config.OldKeys < 0 || config.OldKeys > maxECHOldKeys {
+		return fmt.Errorf("old_keys: must be between 0 and %d", maxECHOldKeys)
+	}
+	return nil
+}
+
+// ECHStatus is the ECH config published for the clients.
+type ECHStatus struct {
+	PublicName string `json:"public_name"`
+	ConfigID   uint8  `json:"config_id"`
+	// ConfigList is the ECHConfigList of the current key, in base64 as in the ech parameter of
+	// the HTTPS DNS records.
+	ConfigList   []byte    `json:"config_list"`
+	Created      time.Time `json:"created"`
+	NextRotation time.Time `json:"next_rotation"`
+	OldKeys      int       `json:"old_keys"`
+}
+
+type echKey struct {
+	configID   uint8
+	privateKey *ecdh.PrivateKey
+	created    time.Time
+}
+
+// ECHKeys is the object responsible for the HPKE key pairs of Encrypted Client Hello. The keys
+// are kept in a file, so the published config stays valid across restarts, and rotated
+// periodically. The previous keys are kept for the clients that have not seen the new config
+// yet; the clients using an unknown config are sent the current one to retry.
+type ECHKeys struct {
+	publicName string
+	interval   time.Duration
+	oldKeys    int
+	file       string
+	mu         sync.RWMutex
+	// keys are the key pairs, newest first
+	keys    []*echKey
+	tlsKeys []tls.EncryptedClientHelloKey
+}
+
+// NewECHKeys returns a new object of ECHKeys type, or nil when there is no configuration. The
+// keys are read from defaultFile, or from the file of the configuration when it is set, and
+// generated there when it does not exist.
+func NewECHKeys(config *ECHConfig, defaultFile string) (*ECHKeys, error) {
+	if config == nil {
+		return nil, nil
+	}
+	file := config.File
+	if file == "" {
+		file = defaultFile
+	}
+	oldKeys := config.OldKeys
+	if oldKeys == 0 {
+		oldKeys = defaultECHOldKeys
+	}
+	echKeys := &ECHKeys{
+		publicName: strings.ToLower(config.PublicName),
+		interval:   durationOrDefault(config.RotationInterval, defaultECHRotationInterval),
+		oldKeys:    oldKeys,
+		file:       file,
+	}
+	if _, err := echKeys.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return echKeys, nil
+}
+
+// Rotate generates a new key when the current one is older than the rotation interval, and
+// indicates whether it did. The keys are read from the file first, as another instance sharing
+// it may have rotated them.
+func (echKeys *ECHKeys) Rotate(now time.Time) (bool, error) {
+	echKeys.mu.Lock()
+	defer echKeys.mu.Unlock()
+
+	keys, err := readECHKeys(echKeys.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	isRotated := false
+	if len(keys) == 0 || now.Sub(keys[0].created) >= echKeys.interval {
+		key, err := newECHKey(keys, now)
+		if err != nil {
+			return false, err
+		}
+		keys = append([]*echKey{key}, keys...)
+		isRotated = true
+	}
+	if len(keys) > echKeys.oldKeys+1 {
+		keys = keys[:echKeys.oldKeys+1]
+	}
+	if isRotated {
+		if err := writeECHKeys(echKeys.file, keys); err != nil {
+			return false, err
+		}
+	}
+
+	tlsKeys := make([]tls.EncryptedClientHelloKey, 0, len(keys))
+	for i, key := range keys {
+		tlsKeys = append(tlsKeys, tls.EncryptedClientHelloKey{
+			Config:      marshalECHConfig(key, echKeys.publicName),
+			PrivateKey:  key.privateKey.Bytes(),
+			SendAsRetry: i == 0,
+		})
+	}
+	echKeys.keys, echKeys.tlsKeys = keys, tlsKeys
+	return isRotated, nil
+}
+
+// ConfigList gets the ECHConfigList of the current key, to be published in the HTTPS DNS
+// records of the hosts.
+func (echKeys *ECHKeys) ConfigList() []byte {
+	echKeys.mu.RLock()
+	defer echKeys.mu.RUnlock()
+	var builder cryptobyte.Builder
+	builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(echKeys.tlsKeys[0].Config)
+	})
+	return builder.BytesOrPanic()
+}
+
+// Status gets the ECH config published for the clients.
+func (echKeys *ECHKeys) Status() ECHStatus {
+	configList := echKeys.ConfigList()
+	echKeys.mu.RLock()
+	defer echKeys.mu.RUnlock()
+	current := echKeys.keys[0]
+	return ECHStatus{
+		PublicName:   echKeys.publicName,
+		ConfigID:     current.configID,
+		ConfigList:   configList,
+		Created:      current.created,
+		NextRotation: current.created.Add(echKeys.interval),
+		OldKeys:      len(echKeys.keys) - 1,
+	}
+}
+
+// encryptedClientHelloKeys gets the keys for GetEncryptedClientHelloKeys.
+func (echKeys *ECHKeys) encryptedClientHelloKeys(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+	echKeys.mu.RLock()
+	defer echKeys.mu.RUnlock()
+	return echKeys.tlsKeys, nil
+}
+
+// newECHKey generates a key pair with a config id that none of keys uses.
+func newECHKey(keys []*echKey, now time.Time) (*echKey, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var configID [1]byte
+	isUsed := func(key *echKey) bool { return key.configID == configID[0] }
+	for {
+		if _, err := rand.Read(configID[:]); err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(keys, isUsed) {
+			break
+		}
+	}
+	return &echKey{configID: configID[0], privateKey: privateKey, created: now}, nil
+}
+
+// marshalECHConfig serializes the ECHConfig of a key as defined in RFC 9849.
+func marshalECHConfig(key *echKey, publicName string) []byte {
+	var builder cryptobyte.Builder
+	builder.AddUint16(echConfigVersion)
+	builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(key.configID)
+		b.AddUint16(hpkeKEMX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(key.privateKey.PublicKey().Bytes())
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range []uint16{hpkeAEADAES128GCM, hpkeAEADAES256GCM, hpkeAEADChaCha20Poly} {
+				b.AddUint16(hpkeKDFHKDFSHA256)
+				b.AddUint16(aead)
+			}
+		})
+		// maximum_name_length 0 lets the clients pad the names with their default policy
+		b.AddUint8(0)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	return builder.BytesOrPanic()
+}
+
+func readECHKeys(file string) ([]*echKey, error) {
+	data, err := readSecretFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*echKey, 0)
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != echKeyBlockType {
+			continue
+		}
+		privateKey, err := ecdh.X25519().NewPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		configID, err := strconv.ParseUint(block.Headers[echConfigIDHeader], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid config id: %w", file, err)
+		}
+		created, err := time.Parse(time.RFC3339, block.Headers[echCreatedHeader])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid creation time: %w", file, err)
+		}
+		keys = append(keys, &echKey{configID: uint8(configID), privateKey: privateKey, created: created})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no ECH keys found", file)
+	}
+	return keys, nil
+}
+
+func writeECHKeys(file string, keys []*echKey) error {
+	data := make([]byte, 0)
+	for _, key := range keys {
+		data = append(data, pem.EncodeToMemory(&pem.Block{
+			Type: echKeyBlockType,
+			Headers: map[string]string{
+				echConfigIDHeader: strconv.Itoa(int(key.configID)),
+				echCreatedHeader:  key.created.UTC().Format(time.RFC3339),
+			},
+			Bytes: key.privateKey.Bytes(),
+		})...)
+	}
+	encrypted, err := encrypt(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, encrypted, 0o600)
+}
+
+// SetECHKeys sets the keys of Encrypted Client Hello. It must be set before GetTLSConfig.
+func (certManager *CertManager) SetECHKeys(echKeys *ECHKeys) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.echKeys = echKeys
+}
+
+// StartECHKeyRotation rotates the keys of Encrypted Client Hello in the background, if there
+// are any.
+func (certManager *CertManager) StartECHKeyRotation(logger Logger) {
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.echKeys == nil || certManager.stopECH != nil {
+		return
+	}
+	echKeys := certManager.echKeys
+	stop := make(chan struct{})
+	certManager.stopECH = stop
+	go func() {
+		ticker := time.NewTicker(min(echCheckInterval, echKeys.interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				isRotated, err := echKeys.Rotate(time.Now())
+				if err != nil {
+					logger.Error(fmt.Sprintf("Failed to rotate the ECH keys: %v", err))
+				} else if isRotated {
+					logger.Info("ECH keys rotated, publish the new ECH config in the HTTPS DNS records")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+package infrastructure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewECHKeys_WhenFileExists_ThenReusesKeys(t *testing.T) {
+	// Arrange
+	file := filepath.Join(t.TempDir(), "ech-keys.pem")
+	config := &ECHConfig{PublicName: "public.example.com"}
+	first, err := NewECHKeys(config, file)
+	require.NoError(t, err)
+
+	// Act
+	second, err := NewECHKeys(config, file)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, first.ConfigList(), second.ConfigList())
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestECHKeys_Rotate_WhenIntervalElapses_ThenPublishesNewKeyAndKeepsOldOne(t *testing.T) {
+	// Arrange
+	echKeys, err := NewECHKeys(&ECHConfig{PublicName: "public.example.com", RotationInterval: "1h"}, filepath.Join(t.TempDir(), "ech-keys.pem"))
+	require.NoError(t, err)
+	previous := echKeys.Status()
+
+	// Act
+	isRotated, err := echKeys.Rotate(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = echKeys.Rotate(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+
+	// Assert
+	assert.True(t, isRotated)
+	status := echKeys.Status()
+	assert.NotEqual(t, previous.ConfigList, status.ConfigList)
+	assert.Equal(t, 1, status.OldKeys)
+	keys, err := echKeys.encryptedClientHelloKeys(nil)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.True(t, keys[0].SendAsRetry)
+	assert.False(t, keys[1].SendAsRetry)
+}
+
+func TestECHConfig_Validate_WhenPublicNameIsEmpty_ThenReturnsError(t *testing.T) {
+	// Arrange
+	config := &ECHConfig{}
+
+	// Act
+	err := config.Validate()
+
+	// Assert
+	assert.EqualError(t, err, "public_name: '' is not a valid host name")
+}
+
+func TestCertManager_GetTLSConfig_WhenECHKeysAreSet_ThenAcceptsEncryptedClientHello(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, "example.com", time.Now().Add(time.Hour))
+	echKeys, err := NewECHKeys(&ECHConfig{PublicName: "public.example.com"}, filepath.Join(dir, "ech-keys.pem"))
+	require.NoError(t, err)
+	certMgr := NewCertManager(nil)
+	require.NoError(t, certMgr.AddCertificateFiles("example.com", certFile, keyFile))
+	certMgr.SetECHKeys(echKeys)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", certMgr.GetTLSConfig())
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(certPEM))
+
+	// Act
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(), &tls.Config{
+		ServerName:                     "example.com",
+		RootCAs:                        roots,
+		MinVersion:                     tls.VersionTLS13,
+		EncryptedClientHelloConfigList: echKeys.ConfigList(),
+	})
+
+	// Assert
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	assert.True(t, conn.ConnectionState().ECHAccepted)
+}
@@ -0,0 +1,176 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	httpCacheTimeout  = 30 * time.Second
+	maxHTTPCacheEntry = 1 << 20
+)
+
+// HTTPCacheStore is the store of the ACME cache in a key/value HTTP service, such as a small
+// service in front of etcd, Consul or a database. Each name is the last segment of a URL under the
+// base URL: GET returns the data or 404, PUT stores the request body and DELETE removes it. A GET
+// of the base URL with a trailing slash returns the names of the entries, one per line. Locks
+// are entries too, taken with conditional requests: the service must answer 412 to a PUT with
+// If-None-Match: * when the entry exists, and to a PUT or DELETE with an If-Match that differs
+// from the ETag it returns.
+type HTTPCacheStore struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewHTTPCacheStore returns a new object of HTTPCacheStore type. The token, when set, is sent as
+// a bearer token.
+func NewHTTPCacheStore(baseURL string, token string) *HTTPCacheStore {
+	return &HTTPCacheStore{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: httpCacheTimeout},
+	}
+}
+
+// Get gets the data of name, or autocert.ErrCacheMiss.
+func (store *HTTPCacheStore) Get(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := store.get(ctx, name)
+	return data, err
+}
+
+// Put stores the data of name.
+func (store *HTTPCacheStore) Put(ctx context.Context, name string, data []byte) error {
+	_, err := store.do(ctx, http.MethodPut, name, data, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+// Delete removes the data of name.
+func (store *HTTPCacheStore) Delete(ctx context.Context, name string) error {
+	_, err := store.do(ctx, http.MethodDelete, name, nil, nil, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	return err
+}
+
+// List gets the names of the entries, without the locks.
+func (store *HTTPCacheStore) List(ctx context.Context) ([]string, error) {
+	data, _, err := store.get(ctx, "")
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(data), "\n") {
+		name = strings.TrimSpace(name)
+		if name != "" && !strings.HasSuffix(name, cacheLockSuffix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// TryLock takes the lock of name for owner until ttl elapses.
+func (store *HTTPCacheStore) TryLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	lockName := name + cacheLockSuffix
+	value := formatCacheLock(owner, time.Now().Add(ttl))
+	status, err := store.do(ctx, http.MethodPut, lockName, value, map[string]string{"If-None-Match": "*"},
+		http.StatusOK, http.StatusCreated, http.StatusNoContent, http.StatusPreconditionFailed)
+	if err != nil || status != http.StatusPreconditionFailed {
+		return err == nil, err
+	}
+
+	data, etag, err := store.get(ctx, lockName)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		// released meanwhile, the next try takes it
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !isCacheLockFree(data, owner, time.Now()) {
+		return false, nil
+	}
+	status, err = store.do(ctx, http.MethodPut, lockName, value, map[string]string{"If-Match": etag},
+		http.StatusOK, http.StatusCreated, http.StatusNoContent, http.StatusPreconditionFailed)
+	return err == nil && status != http.StatusPreconditionFailed, err
+}
+
+// Unlock releases the lock of name when owner holds it.
+func (store *HTTPCacheStore) Unlock(ctx context.Context, name string, owner string) error {
+	lockName := name + cacheLockSuffix
+	data, etag, err := store.get(ctx, lockName)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if holder, _ := parseCacheLock(data); holder != owner {
+		return nil
+	}
+	_, err = store.do(ctx, http.MethodDelete, lockName, nil, map[string]string{"If-Match": etag},
+		http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusPreconditionFailed)
+	return err
+}
+
+// get gets the data of name and its ETag.
+func (store *HTTPCacheStore) get(ctx context.Context, name string) ([]byte, string, error) {
+	resp, err := store.request(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPCacheEntry))
+		return data, resp.Header.Get("ETag"), err
+	case http.StatusNotFound:
+		return nil, "", autocert.ErrCacheMiss
+	default:
+		return nil, "", fmt.Errorf("GET %s: %s", name, resp.Status)
+	}
+}
+
+// do sends a request for name and gets its status, an error when it is not one of expected.
+func (store *HTTPCacheStore) do(ctx context.Context, method string, name string, body []byte, header map[string]string, expected ...int) (int, error) {
+	resp, err := store.request(ctx, method, name, body, header)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxHTTPCacheEntry))
+	_ = resp.Body.Close()
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return status, nil
+		}
+	}
+	return resp.StatusCode, fmt.Errorf("%s %s: %s", method, name, resp.Status)
+}
+
+func (store *HTTPCacheStore) request(ctx context.Context, method string, name string, body []byte, header map[string]string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, store.baseURL+"/"+url.PathEscape(name), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if store.token != "" {
+		req.Header.Set("Authorization", "Bearer "+store.token)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	return store.client.Do(req)
+}
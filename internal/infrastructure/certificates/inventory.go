@@ -0,0 +1,389 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/metrics"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Sources of the certificates of the inventory.
+const (
+	CertificateSourceFile     = "file"
+	CertificateSourceACME     = "acme"
+	CertificateSourceDNS01    = "dns01"
+	CertificateSourceUpstream = "upstream"
+	CertificateSourceLocalCA  = "local-ca"
+)
+
+const expiryCheckInterval = time.Hour
+
+var (
+	certificateExpiry    = metrics.Default.NewGaugeVec("reverseproxy_certificate_expiry_timestamp_seconds", "Expiry time of the certificates in use, in seconds since the epoch.", "source", "subject", "serial")
+	certificatesExpiring = metrics.Default.NewGaugeVec("reverseproxy_certificates_expiring", "Certificates in use that expire within the warning period.")
+)
+
+// Inventory is the inventory of the certificates of the active certificate manager.
+var Inventory = &CertificateInventory{}
+
+// CertificateInfo describes a certificate in use by the reverse proxy.
+type CertificateInfo struct {
+	Source       string    `json:"source"`
+	Subject      string    `json:"subject"`
+	SANs         []string  `json:"sans"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	Hosts        []string  `json:"hosts"`
+	Files        []string  `json:"files,omitempty"`
+	Expiring     bool      `json:"expiring"`
+	Error        string    `json:"error,omitempty"`
+	fingerprint  string
+	// rotated certificates are replaced automatically long before they expire
+	rotated bool
+}
+
+// DaysLeft gets the whole days until the certificate expires, negative when it has expired.
+func (info CertificateInfo) DaysLeft() int {
+	return int(time.Until(info.NotAfter).Hours() / 24)
+}
+
+// Expired indicates that the certificate is no longer valid.
+func (info CertificateInfo) Expired() bool {
+	return !info.NotAfter.IsZero() && time.Now().After(info.NotAfter)
+}
+
+func newCertificateInfo(source string, leaf *x509.Certificate) CertificateInfo {
+	fingerprint := sha256.Sum256(leaf.Raw)
+	return CertificateInfo{
+		Source:       source,
+		Subject:      leaf.Subject.String(),
+		SANs:         certificateNames(leaf),
+		Issuer:       leaf.Issuer.String(),
+		SerialNumber: leaf.SerialNumber.Text(16),
+		NotBefore:    leaf.NotBefore,
+		NotAfter:     leaf.NotAfter,
+		fingerprint:  hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+func certificateNames(leaf *x509.Certificate) []string {
+	names := slices.Clone(leaf.DNSNames)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		names = append(names, uri.String())
+	}
+	return append(names, leaf.EmailAddresses...)
+}
+
+// CertificateInventory gives the certificates of the certificate manager started last.
+type CertificateInventory struct {
+	mu         sync.RWMutex
+	manager    *CertManager
+	warnBefore time.Duration
+}
+
+func (inventory *CertificateInventory) set(manager *CertManager, warnBefore time.Duration) {
+	inventory.mu.Lock()
+	defer inventory.mu.Unlock()
+	inventory.manager = manager
+	inventory.warnBefore = warnBefore
+}
+
+// ACMEStatuses gets the issuance state of the automatic certificates.
+func (inventory *CertificateInventory) ACMEStatuses() []ACMEStatus {
+	inventory.mu.RLock()
+	manager := inventory.manager
+	inventory.mu.RUnlock()
+	if manager == nil {
+		return []ACMEStatus{}
+	}
+	return manager.ACMEStatuses()
+}
+
+// RenewACMECertificate forces the renewal of the automatic certificate of a host.
+func (inventory *CertificateInventory) RenewACMECertificate(host string) error {
+	inventory.mu.RLock()
+	manager := inventory.manager
+	inventory.mu.RUnlock()
+	if manager == nil {
+		return ErrUnknownACMEHost
+	}
+	return manager.RenewACMECertificate(host)
+}
+
+// LocalCARoot gets the root certificate of the local CA in PEM format, or nil when there is no local CA.
+func (inventory *CertificateInventory) LocalCARoot() []byte {
+	inventory.mu.RLock()
+	manager := inventory.manager
+	inventory.mu.RUnlock()
+	if manager == nil {
+		return nil
+	}
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	if manager.localCA == nil {
+		return nil
+	}
+	return manager.localCA.RootPEM()
+}
+
+// ECHStatus gets the ECH config published for the clients, or nil when ECH is not configured.
+func (inventory *CertificateInventory) ECHStatus() *ECHStatus {
+	inventory.mu.RLock()
+	manager := inventory.manager
+	inventory.mu.RUnlock()
+	if manager == nil {
+		return nil
+	}
+	manager.mu.RLock()
+	echKeys := manager.echKeys
+	manager.mu.RUnlock()
+	if echKeys == nil {
+		return nil
+	}
+	status := echKeys.Status()
+	return &status
+}
+
+// Certificates gets the certificates in use, the first to expire first.
+func (inventory *CertificateInventory) Certificates() []CertificateInfo {
+	inventory.mu.RLock()
+	manager, warnBefore := inventory.manager, inventory.warnBefore
+	inventory.mu.RUnlock()
+	if manager == nil {
+		return []CertificateInfo{}
+	}
+	return manager.Inventory(warnBefore)
+}
+
+// AddUpstreamCertificate registers the client certificate that a virtual host presents to its
+// upstream server, so it is listed in the inventory.
+func (certManager *CertManager) AddUpstreamCertificate(vhostName string, source KeyPairSource) {
+	if len(source.Files()) == 0 {
+		return
+	}
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	certManager.upstreams[vhostName] = source
+}
+
+// Inventory lists the custom, ACME, DNS-01, local CA and upstream client certificates with the hosts using
+// them, the first to expire first. Certificates expiring within warnBefore are marked as expiring.
+func (certManager *CertManager) Inventory(warnBefore time.Duration) []CertificateInfo {
+	certManager.mu.RLock()
+	entries := make([]CertificateInfo, 0, len(certManager.certificates))
+	for vhostName, certificates := range certManager.certificates {
+		for _, certificate := range certificates {
+			leaf, err := certificateLeaf(certificate.Certificate)
+			if err != nil {
+				continue
+			}
+			info := newCertificateInfo(CertificateSourceFile, leaf)
+			info.Hosts = []string{vhostName}
+			if source, isContained := certManager.keyPairs[vhostName]; isContained {
+				info.Files = source.Files()
+			}
+			entries = append(entries, info)
+		}
+	}
+	upstreams := make(map[string]KeyPairSource, len(certManager.upstreams))
+	for vhostName, source := range certManager.upstreams {
+		upstreams[vhostName] = source
+	}
+	autoCertList := slices.Clone(certManager.autoCertList)
+	manager := certManager.manager
+	dns01 := certManager.dns01
+	localCA := certManager.localCA
+	certManager.mu.RUnlock()
+
+	entries = append(entries, acmeInventory(manager, autoCertList)...)
+	if dns01 != nil {
+		for domain, certificates := range dns01.Certificates() {
+			for _, certificate := range certificates {
+				info := newCertificateInfo(CertificateSourceDNS01, certificate.Leaf)
+				info.Hosts = []string{domain}
+				entries = append(entries, info)
+			}
+		}
+	}
+	if localCA != nil {
+		info := newCertificateInfo(CertificateSourceLocalCA, localCA.Root())
+		info.Hosts = slices.Clone(localCA.hosts)
+		entries = append(entries, info)
+		for serverName, certificate := range localCA.Certificates() {
+			info := newCertificateInfo(CertificateSourceLocalCA, certificate.Leaf)
+			info.Hosts = []string{serverName}
+			info.rotated = true
+			entries = append(entries, info)
+		}
+	}
+	for vhostName, source := range upstreams {
+		info := CertificateInfo{Source: CertificateSourceUpstream, Files: source.Files(), fingerprint: "file:" + source.Files()[0]}
+		if leaf, err := readSourceLeaf(source); err != nil {
+			info.Error = err.Error()
+		} else {
+			info = newCertificateInfo(CertificateSourceUpstream, leaf)
+			info.Files = source.Files()
+		}
+		info.Hosts = []string{vhostName}
+		entries = append(entries, info)
+	}
+
+	return mergeCertificateInfos(entries, warnBefore)
+}
+
+// acmeInventory reads the certificates of the automatic hosts from the autocert cache.
+func acmeInventory(manager *autocert.Manager, hosts []string) []CertificateInfo {
+	if manager == nil || manager.Cache == nil {
+		return nil
+	}
+	entries := make([]CertificateInfo, 0, len(hosts))
+	for _, host := range hosts {
+		for _, name := range []string{host, host + "+rsa"} {
+			data, err := manager.Cache.Get(withoutCacheLock(context.Background()), name)
+			if err != nil {
+				continue
+			}
+			leaf, err := parseCertificatePEM(data)
+			if err != nil {
+				continue
+			}
+			info := newCertificateInfo(CertificateSourceACME, leaf)
+			info.Hosts = []string{host}
+			entries = append(entries, info)
+		}
+	}
+	return entries
+}
+
+// mergeCertificateInfos joins the entries of the same certificate used by several hosts.
+func mergeCertificateInfos(entries []CertificateInfo, warnBefore time.Duration) []CertificateInfo {
+	merged := make([]CertificateInfo, 0, len(entries))
+	indexes := make(map[string]int)
+	for _, entry := range entries {
+		key := entry.Source + "/" + entry.fingerprint
+		if index, isContained := indexes[key]; isContained {
+			merged[index].Hosts = append(merged[index].Hosts, entry.Hosts...)
+			for _, file := range entry.Files {
+				if !slices.Contains(merged[index].Files, file) {
+					merged[index].Files = append(merged[index].Files, file)
+				}
+			}
+			continue
+		}
+		indexes[key] = len(merged)
+		merged = append(merged, entry)
+	}
+
+	deadline := time.Now().Add(warnBefore)
+	for i := range merged {
+		sort.Strings(merged[i].Hosts)
+		merged[i].Expiring = !merged[i].rotated && !merged[i].NotAfter.IsZero() && merged[i].NotAfter.Before(deadline)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].NotAfter.Equal(merged[j].NotAfter) {
+			return strings.Join(merged[i].Hosts, ",") < strings.Join(merged[j].Hosts, ",")
+		}
+		return merged[i].NotAfter.Before(merged[j].NotAfter)
+	})
+	return merged
+}
+
+// StartExpiryMonitor makes the certificates of the manager the ones of Inventory and checks them
+// every hour, updating the expiry metrics and logging a warning once for each certificate that
+// expires within warnBefore.
+func (certManager *CertManager) StartExpiryMonitor(warnBefore time.Duration, logger Logger) {
+	Inventory.set(certManager, warnBefore)
+
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if certManager.stopExpiry != nil {
+		return
+	}
+	stop := make(chan struct{})
+	certManager.stopExpiry = stop
+	warned := make(map[string]bool)
+	go func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			certManager.checkExpiry(warnBefore, logger, warned)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (certManager *CertManager) checkExpiry(warnBefore time.Duration, logger Logger, warned map[string]bool) {
+	entries := certManager.Inventory(warnBefore)
+	certificateExpiry.Reset()
+	expiring := 0
+	for _, entry := range entries {
+		key := entry.Source + "/" + entry.fingerprint
+		if entry.Error != "" {
+			if !warned[key] {
+				warned[key] = true
+				logger.Error(fmt.Sprintf("Failed to read certificate of %v: %v", entry.Hosts, entry.Error))
+			}
+			continue
+		}
+		certificateExpiry.Set(float64(entry.NotAfter.Unix()), entry.Source, entry.Subject, entry.SerialNumber)
+		if !entry.Expiring {
+			continue
+		}
+		expiring++
+		if !warned[key] {
+			warned[key] = true
+			logger.Error(fmt.Sprintf("certificate '%v' of %v expires at %v", entry.Subject, entry.Hosts, entry.NotAfter))
+		}
+	}
+	certificatesExpiring.Set(float64(expiring))
+}
+
+func certificateLeaf(chain [][]byte) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return x509.ParseCertificate(chain[0])
+}
+
+// readSourceLeaf gets the certificate of a source, even when it is expired.
+func readSourceLeaf(source KeyPairSource) (*x509.Certificate, error) {
+	certificate, err := source.GetCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return certificateLeaf(certificate.Certificate)
+}
+
+// parseCertificatePEM parses the first certificate of PEM data, skipping any private key.
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
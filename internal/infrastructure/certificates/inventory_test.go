@@ -0,0 +1,85 @@
+package infrastructure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestCertManager_Inventory_WhenCertificatesAreInUse_ThenListsThemByExpiry(t *testing.T) {
+	// Arrange
+	cacheDir := t.TempDir()
+	certMgr := NewCertManager(&autocert.Manager{Cache: autocert.DirCache(cacheDir)})
+	customCert, customKey := writeTestKeyPair(t, t.TempDir(), "shared.example.com", time.Now().Add(90*24*time.Hour))
+	require.NoError(t, certMgr.AddCertificateFiles("a.example.com", customCert, customKey))
+	require.NoError(t, certMgr.AddCertificateFiles("b.example.com", customCert, customKey))
+	acmeCert, acmeKey := writeTestKeyPair(t, t.TempDir(), "auto.example.com", time.Now().Add(5*24*time.Hour))
+	certPEM, err := os.ReadFile(acmeCert)
+	require.NoError(t, err)
+	keyPEM, err := os.ReadFile(acmeKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "auto.example.com"), append(keyPEM, certPEM...), 0o600))
+	certMgr.AddAutoCertificate("auto.example.com")
+	certMgr.AddAutoCertificate("pending.example.com")
+	certMgr.AddUpstreamCertificate("a.example.com", &CertificateDefs{PublicKey: filepath.Join(t.TempDir(), "missing.pem"), PrivateKey: "missing-key.pem"})
+
+	// Act
+	inventory := certMgr.Inventory(14 * 24 * time.Hour)
+
+	// Assert
+	require.Len(t, inventory, 3)
+	assert.Equal(t, CertificateSourceUpstream, inventory[0].Source)
+	assert.NotEmpty(t, inventory[0].Error)
+	assert.Equal(t, CertificateSourceACME, inventory[1].Source)
+	assert.Equal(t, []string{"auto.example.com"}, inventory[1].Hosts)
+	assert.True(t, inventory[1].Expiring)
+	assert.Equal(t, 4, inventory[1].DaysLeft())
+	assert.Equal(t, CertificateSourceFile, inventory[2].Source)
+	assert.Equal(t, "CN=shared.example.com", inventory[2].Subject)
+	assert.Equal(t, []string{"shared.example.com"}, inventory[2].SANs)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, inventory[2].Hosts)
+	assert.Equal(t, []string{customCert, customKey}, inventory[2].Files)
+	assert.False(t, inventory[2].Expiring)
+}
+
+func TestCertManager_StartExpiryMonitor_WhenCertificateExpiresSoon_ThenWarnsOnceAndSetsMetrics(t *testing.T) {
+	// Arrange
+	certMgr := NewCertManager(&autocert.Manager{})
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "soon.example.com", time.Now().Add(3*24*time.Hour))
+	require.NoError(t, certMgr.AddCertificateFiles("soon.example.com", certFile, keyFile))
+	logger := &testLogger{}
+	warned := make(map[string]bool)
+
+	// Act
+	certMgr.checkExpiry(7*24*time.Hour, logger, warned)
+	certMgr.checkExpiry(7*24*time.Hour, logger, warned)
+
+	// Assert
+	require.Len(t, logger.errors, 1)
+	assert.Contains(t, logger.errors[0], "CN=soon.example.com")
+	assert.Equal(t, float64(1), certificatesExpiring.Value())
+	info := certMgr.Inventory(0)[0]
+	assert.Equal(t, float64(info.NotAfter.Unix()), certificateExpiry.Value(CertificateSourceFile, info.Subject, info.SerialNumber))
+}
+
+func TestCertificateInventory_Certificates_WhenMonitorStarted_ThenListsCertificatesOfManager(t *testing.T) {
+	// Arrange
+	certMgr := NewCertManager(&autocert.Manager{})
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(30*24*time.Hour))
+	require.NoError(t, certMgr.AddCertificateFiles("example.com", certFile, keyFile))
+
+	// Act
+	certMgr.StartExpiryMonitor(60*24*time.Hour, &testLogger{})
+	defer certMgr.Stop()
+	certificates := Inventory.Certificates()
+
+	// Assert
+	require.Len(t, certificates, 1)
+	assert.Equal(t, []string{"example.com"}, certificates[0].Hosts)
+	assert.True(t, certificates[0].Expiring)
+}
@@ -0,0 +1,219 @@
+package infrastructure
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/youmark/pkcs8"
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	// maxKDFIterations bounds the iterations of the key derivations of encrypted keys and
+	// bundles, which can be uploaded through the ConfigUI, so a crafted file cannot keep the CPU
+	// busy. Tools use a few thousand, OWASP recommends 600000 for PBKDF2-HMAC-SHA256.
+	maxKDFIterations = 1_000_000
+	// maxScryptCost bounds N * r * p of scrypt protected keys, which use 128 * N * r bytes.
+	maxScryptCost = 1 << 20
+	// maxDERDepth bounds the nesting followed when looking for key derivation parameters.
+	maxDERDepth = 32
+)
+
+var (
+	oidPBKDF2    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidPKCS12PBE = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1}
+)
+
+// algorithmIdentifier is an AlgorithmIdentifier with parameters.
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue
+}
+
+// iterationParams are the leading fields of the PBKDF2 and the PKCS#12 PBE parameters.
+type iterationParams struct {
+	Salt       asn1.RawValue
+	Iterations int
+}
+
+type scryptParams struct {
+	Salt            []byte
+	CostParameter   int
+	BlockSize       int
+	Parallelization int
+}
+
+// macData is the integrity check of a PKCS#12 bundle.
+type macData struct {
+	Mac        asn1.RawValue
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe asn1.RawValue
+	MacData  macData `asn1:"optional"`
+}
+
+// parsePrivateKeyPEM parses the first private key of PEM data. Encrypted PKCS#8 keys are
+// decrypted with password.
+func parsePrivateKeyPEM(data []byte, password string) (crypto.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+		switch {
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			if err := checkKeyDerivations(block.Bytes, 0); err != nil {
+				return nil, err
+			}
+			key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+			}
+			return key, nil
+		case block.Headers["Proc-Type"] == "4,ENCRYPTED":
+			return nil, errors.New("legacy encrypted PEM keys are not supported, convert the key to encrypted PKCS#8 with 'openssl pkcs8 -topk8'")
+		case block.Type == "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(block.Bytes)
+		case block.Type == "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case block.Type == "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+}
+
+// parsePKCS12 reads the private key and the certificates of a PKCS#12 bundle. The certificate of
+// the key comes first in the chain.
+func parsePKCS12(data []byte, password string) (*tls.Certificate, error) {
+	var pfx pfxPdu
+	if _, err := asn1.Unmarshal(data, &pfx); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#12 bundle: %w", err)
+	}
+	if pfx.MacData.Iterations > maxKDFIterations {
+		return nil, fmt.Errorf("the integrity check uses %d iterations, more than %d", pfx.MacData.Iterations, maxKDFIterations)
+	}
+	if err := checkKeyDerivations(pfx.AuthSafe.FullBytes, 0); err != nil {
+		return nil, err
+	}
+
+	key, certificate, chain, err := gopkcs12.DecodeChain(data, password)
+	if errors.Is(err, gopkcs12.ErrIncorrectPassword) {
+		return nil, errors.New("incorrect password")
+	} else if err != nil {
+		return nil, err
+	}
+	return keyPairOf(key, append([]*x509.Certificate{certificate}, chain...))
+}
+
+// checkKeyDerivations checks the costs of the key derivations in DER data before a decoder runs
+// them. Octet strings holding DER, like the contents of a PKCS#12 bundle, are followed; encrypted
+// contents cannot be looked into.
+func checkKeyDerivations(der []byte, depth int) error {
+	if depth > maxDERDepth {
+		return errors.New("the DER data is nested too deeply")
+	}
+	for len(der) > 0 {
+		var value asn1.RawValue
+		rest, err := asn1.Unmarshal(der, &value)
+		if err != nil {
+			// not DER, such as salts and encrypted data
+			return nil
+		}
+		der = rest
+		if value.Class == asn1.ClassUniversal && value.Tag == asn1.TagSequence {
+			if err := checkKeyDerivation(value.FullBytes); err != nil {
+				return err
+			}
+		}
+		if value.IsCompound || value.Class == asn1.ClassUniversal && value.Tag == asn1.TagOctetString {
+			if err := checkKeyDerivations(value.Bytes, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkKeyDerivation checks the cost of the algorithm identifier of a key derivation. Other
+// sequences are ignored.
+func checkKeyDerivation(der []byte) error {
+	var algorithm algorithmIdentifier
+	if _, err := asn1.Unmarshal(der, &algorithm); err != nil {
+		return nil
+	}
+	isPKCS12PBE := len(algorithm.Algorithm) == len(oidPKCS12PBE)+1 && algorithm.Algorithm[:len(oidPKCS12PBE)].Equal(oidPKCS12PBE)
+	switch {
+	case algorithm.Algorithm.Equal(oidPBKDF2) || isPKCS12PBE:
+		var params iterationParams
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return fmt.Errorf("invalid key derivation parameters: %w", err)
+		}
+		if params.Iterations > maxKDFIterations {
+			return fmt.Errorf("the key derivation uses %d iterations, more than %d", params.Iterations, maxKDFIterations)
+		}
+	case algorithm.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return fmt.Errorf("invalid key derivation parameters: %w", err)
+		}
+		if params.CostParameter > maxScryptCost || params.BlockSize > maxScryptCost || params.Parallelization > maxScryptCost ||
+			params.CostParameter*params.BlockSize*params.Parallelization > maxScryptCost {
+			return fmt.Errorf("the scrypt key derivation costs more than %d", maxScryptCost)
+		}
+	}
+	return nil
+}
+
+// keyPairOf builds the key pair of a private key, putting the certificate of the key first.
+func keyPairOf(key crypto.PrivateKey, certificates []*x509.Certificate) (*tls.Certificate, error) {
+	signer, isSigner := key.(interface{ Public() crypto.PublicKey })
+	if !isSigner {
+		return nil, errors.New("unsupported private key type")
+	}
+	leafIndex := -1
+	for i, certificate := range certificates {
+		if publicKeyEqual(certificate.PublicKey, signer.Public()) {
+			leafIndex = i
+			break
+		}
+	}
+	if leafIndex < 0 {
+		return nil, errors.New("no certificate matches the private key")
+	}
+
+	keyPair := &tls.Certificate{PrivateKey: key, Leaf: certificates[leafIndex]}
+	keyPair.Certificate = append(keyPair.Certificate, certificates[leafIndex].Raw)
+	for i, certificate := range certificates {
+		if i != leafIndex {
+			keyPair.Certificate = append(keyPair.Certificate, certificate.Raw)
+		}
+	}
+	return keyPair, nil
+}
+
+func publicKeyEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	switch key := a.(type) {
+	case *rsa.PublicKey:
+		return key.Equal(b)
+	case *ecdsa.PublicKey:
+		return key.Equal(b)
+	case ed25519.PublicKey:
+		return key.Equal(b)
+	default:
+		return false
+	}
+}
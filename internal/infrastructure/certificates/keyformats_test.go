@@ -0,0 +1,75 @@
+package infrastructure
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePKCS12_WhenIntegrityCheckIterationsAreTooMany_ThenRejectsItBeforeDecoding(t *testing.T) {
+	// Arrange
+	data, err := os.ReadFile("testdata/bundle.p12")
+	require.NoError(t, err)
+	var pfx pfxPdu
+	_, err = asn1.Unmarshal(data, &pfx)
+	require.NoError(t, err)
+	pfx.MacData.Iterations = maxKDFIterations + 1
+	crafted, err := asn1.Marshal(pfx)
+	require.NoError(t, err)
+
+	// Act
+	_, err = parsePKCS12(crafted, "changeit")
+
+	// Assert
+	assert.EqualError(t, err, "the integrity check uses 1000001 iterations, more than 1000000")
+}
+
+func TestParsePrivateKeyPEM_WhenKeyDerivationIsTooCostly_ThenRejectsItBeforeDecrypting(t *testing.T) {
+	// Arrange
+	encryptedKey := func(kdf algorithmIdentifier) []byte {
+		pbes2Params, err := asn1.Marshal(struct {
+			KeyDerivationFunc algorithmIdentifier
+			EncryptionScheme  algorithmIdentifier
+		}{
+			KeyDerivationFunc: kdf,
+			EncryptionScheme:  algorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}, Parameters: asn1.RawValue{Tag: asn1.TagOctetString, Bytes: make([]byte, 16)}},
+		})
+		require.NoError(t, err)
+		der, err := asn1.Marshal(struct {
+			Algorithm algorithmIdentifier
+			Data      []byte
+		}{
+			Algorithm: algorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}, Parameters: asn1.RawValue{FullBytes: pbes2Params}},
+			Data:      make([]byte, 32),
+		})
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der})
+	}
+	params := func(value interface{}) asn1.RawValue {
+		der, err := asn1.Marshal(value)
+		require.NoError(t, err)
+		return asn1.RawValue{FullBytes: der}
+	}
+	pbkdf2Key := encryptedKey(algorithmIdentifier{Algorithm: oidPBKDF2, Parameters: params(iterationParams{
+		Salt:       asn1.RawValue{Tag: asn1.TagOctetString, Bytes: make([]byte, 8)},
+		Iterations: 50_000_000,
+	})})
+	scryptKey := encryptedKey(algorithmIdentifier{Algorithm: oidScrypt, Parameters: params(scryptParams{
+		Salt:            make([]byte, 8),
+		CostParameter:   1 << 20,
+		BlockSize:       8,
+		Parallelization: 1,
+	})})
+
+	// Act
+	_, pbkdf2Err := parsePrivateKeyPEM(pbkdf2Key, "changeit")
+	_, scryptErr := parsePrivateKeyPEM(scryptKey, "changeit")
+
+	// Assert
+	assert.EqualError(t, pbkdf2Err, "the key derivation uses 50000000 iterations, more than 1000000")
+	assert.EqualError(t, scryptErr, "the scrypt key derivation costs more than 1048576")
+}
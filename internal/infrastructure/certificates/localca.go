@@ -0,0 +1,287 @@
+package infrastructure
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultLocalCAName         = "go-reverseproxy-ssl Local CA"
+	defaultLocalCALeafLifetime = 24 * time.Hour
+	localCARootLifetime        = 10 * 365 * 24 * time.Hour
+	// leaves are backdated to tolerate clocks of the clients that are slightly behind
+	localCAClockSkew    = time.Hour
+	localCARootFile     = "root.pem"
+	localCARootKeyFile  = "root-key.pem"
+	localCASerialLength = 128
+)
+
+// LocalCAConfig is the configuration of the internal CA that issues the certificates of hosts
+// that cannot use ACME, such as localhost or private names.
+type LocalCAConfig struct {
+	Hosts        []string `json:"hosts"`
+	Dir          string   `json:"dir,omitempty"`
+	Name         string   `json:"name,omitempty"`
+	LeafLifetime string   `json:"leaf_lifetime,omitempty"`
+}
+
+// Validate checks the hosts and the leaf lifetime.
+func (config *LocalCAConfig) Validate() error {
+	if len(config.Hosts) == 0 {
+		return errors.New("hosts: at least one host is required")
+	}
+	for i, host := range config.Hosts {
+		name := strings.TrimPrefix(host, "*.")
+		if _, isDomain := dns.IsDomainName(name); !isDomain || name == "" || strings.ContainsFunc(name, isInvalidHostNameRune) {
+			return fmt.Errorf("hosts[%d]: '%s' is not a valid host name", i, host)
+		}
+	}
+	if err := validatePositiveDuration(config.LeafLifetime); err != nil {
+		return errors.New("leaf_lifetime: " + err.Error())
+	}
+	return nil
+}
+
+func isInvalidHostNameRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.')
+}
+
+// LocalCA is the object responsible for issuing short-lived certificates for the configured hosts
+// with a root that is generated once and kept in its directory. Certificates are issued on the
+// first handshake of each server name and issued again when two thirds of their lifetime passed.
+type LocalCA struct {
+	hosts        []string
+	root         *x509.Certificate
+	rootKey      *ecdsa.PrivateKey
+	rootPEM      []byte
+	leafLifetime time.Duration
+	now          func() time.Time
+	mu           sync.Mutex
+	certificates map[string]*tls.Certificate
+}
+
+// NewLocalCA returns a new object of LocalCA type, or nil when there is no configuration. The
+// root is read from dir, or from the directory of the configuration when it is set, and
+// generated there when it does not exist.
+func NewLocalCA(config *LocalCAConfig, dir string) (*LocalCA, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.Dir != "" {
+		dir = config.Dir
+	}
+	name := config.Name
+	if name == "" {
+		name = defaultLocalCAName
+	}
+	root, rootKey, rootPEM, err := loadOrCreateLocalCARoot(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0, len(config.Hosts))
+	for _, host := range config.Hosts {
+		hosts = append(hosts, strings.ToLower(host))
+	}
+	return &LocalCA{
+		hosts:        hosts,
+		root:         root,
+		rootKey:      rootKey,
+		rootPEM:      rootPEM,
+		leafLifetime: durationOrDefault(config.LeafLifetime, defaultLocalCALeafLifetime),
+		now:          time.Now,
+		certificates: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Covers indicates that the server name is one of the hosts, or a subdomain of a `*.` host.
+func (localCA *LocalCA) Covers(serverName string) bool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return false
+	}
+	for _, host := range localCA.hosts {
+		if suffix, isWildcard := strings.CutPrefix(host, "*"); isWildcard {
+			if strings.HasSuffix(serverName, suffix) {
+				return true
+			}
+		} else if serverName == host {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate gets the certificate of a server name, issuing it when it is missing or due.
+// handled is false when the server name is not covered by the hosts.
+func (localCA *LocalCA) GetCertificate(serverName string) (certificate *tls.Certificate, handled bool, err error) {
+	if !localCA.Covers(serverName) {
+		return nil, false, nil
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	localCA.mu.Lock()
+	defer localCA.mu.Unlock()
+	now := localCA.now()
+	if certificate := localCA.certificates[serverName]; certificate != nil && now.Before(certificate.Leaf.NotAfter.Add(-localCA.leafLifetime/3)) {
+		return certificate, true, nil
+	}
+	certificate, err = localCA.issue(serverName, now)
+	if err != nil {
+		return nil, true, err
+	}
+	localCA.certificates[serverName] = certificate
+	return certificate, true, nil
+}
+
+// Certificates gets the certificates issued so far by server name.
+func (localCA *LocalCA) Certificates() map[string]*tls.Certificate {
+	localCA.mu.Lock()
+	defer localCA.mu.Unlock()
+	certificates := make(map[string]*tls.Certificate, len(localCA.certificates))
+	for serverName, certificate := range localCA.certificates {
+		certificates[serverName] = certificate
+	}
+	return certificates
+}
+
+// Root gets the root certificate.
+func (localCA *LocalCA) Root() *x509.Certificate {
+	return localCA.root
+}
+
+// RootPEM gets the root certificate in PEM format, to be installed in the trust stores of the clients.
+func (localCA *LocalCA) RootPEM() []byte {
+	return localCA.rootPEM
+}
+
+func (localCA *LocalCA) issue(serverName string, now time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(localCA.leafLifetime)
+	if notAfter.After(localCA.root.NotAfter) {
+		notAfter = localCA.root.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    now.Add(-localCAClockSkew),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, localCA.root, &key.PublicKey, localCA.rootKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// loadOrCreateLocalCARoot reads the root and its key from dir, generating them when the
+// directory has none.
+func loadOrCreateLocalCARoot(dir string, name string) (*x509.Certificate, *ecdsa.PrivateKey, []byte, error) {
+	rootFile, keyFile := filepath.Join(dir, localCARootFile), filepath.Join(dir, localCARootKeyFile)
+	rootPEM, err := os.ReadFile(rootFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return createLocalCARoot(dir, name)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	root, err := parseCertificatePEM(rootPEM)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", rootFile, err)
+	}
+	keyPEM, err := readSecretFile(keyFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, nil, fmt.Errorf("%s: no private key found", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	if !key.PublicKey.Equal(root.PublicKey) {
+		return nil, nil, nil, fmt.Errorf("%s does not match %s", keyFile, rootFile)
+	}
+	return root, key, rootPEM, nil
+}
+
+func createLocalCARoot(dir string, name string) (*x509.Certificate, *ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-localCAClockSkew),
+		NotAfter:              now.Add(localCARootLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, nil, err
+	}
+	// the key is written first, so a root file always has its key
+	if err := writeSecretFile(filepath.Join(dir, localCARootKeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, nil, nil, err
+	}
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, localCARootFile), rootPEM, 0o644); err != nil {
+		return nil, nil, nil, err
+	}
+	return root, key, rootPEM, nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), localCASerialLength))
+}
@@ -0,0 +1,107 @@
+package infrastructure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestLocalCAConfig_Validate_WhenHostIsInvalid_ThenReturnsError(t *testing.T) {
+	// Arrange
+	config := &LocalCAConfig{Hosts: []string{"localhost", "*.internal", "bad host"}}
+
+	// Act
+	err := config.Validate()
+
+	// Assert
+	assert.EqualError(t, err, "hosts[2]: 'bad host' is not a valid host name")
+}
+
+func TestNewLocalCA_WhenRootExists_ThenReusesIt(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	first, err := NewLocalCA(&LocalCAConfig{Hosts: []string{"localhost"}}, dir)
+	require.NoError(t, err)
+
+	// Act
+	second, err := NewLocalCA(&LocalCAConfig{Hosts: []string{"localhost"}}, dir)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, first.RootPEM(), second.RootPEM())
+	assert.Equal(t, defaultLocalCAName, second.Root().Subject.CommonName)
+	info, err := os.Stat(filepath.Join(dir, localCARootKeyFile))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestLocalCA_GetCertificate_WhenHostIsCovered_ThenIssuesCertificateTrustedByRoot(t *testing.T) {
+	// Arrange
+	localCA, err := NewLocalCA(&LocalCAConfig{Hosts: []string{"localhost", "*.internal"}, LeafLifetime: "1h"}, t.TempDir())
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(localCA.Root())
+
+	// Act
+	certificate, handled, err := localCA.GetCertificate("App.Corp.Internal")
+	_, otherHandled, _ := localCA.GetCertificate("example.com")
+
+	// Assert
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.False(t, otherHandled)
+	_, err = certificate.Leaf.Verify(x509.VerifyOptions{DNSName: "app.corp.internal", Roots: roots})
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), certificate.Leaf.NotAfter, time.Minute)
+}
+
+func TestLocalCA_GetCertificate_WhenCertificateIsDue_ThenIssuesNewOne(t *testing.T) {
+	// Arrange
+	localCA, err := NewLocalCA(&LocalCAConfig{Hosts: []string{"localhost"}, LeafLifetime: "3h"}, t.TempDir())
+	require.NoError(t, err)
+	now := time.Now()
+	localCA.now = func() time.Time { return now }
+	first, _, err := localCA.GetCertificate("localhost")
+	require.NoError(t, err)
+	cached, _, _ := localCA.GetCertificate("localhost")
+
+	// Act
+	now = now.Add(2*time.Hour + time.Minute)
+	rotated, _, err := localCA.GetCertificate("localhost")
+
+	// Assert
+	require.NoError(t, err)
+	assert.Same(t, first, cached)
+	assert.NotEqual(t, first.Leaf.SerialNumber, rotated.Leaf.SerialNumber)
+	assert.True(t, rotated.Leaf.NotAfter.After(first.Leaf.NotAfter))
+}
+
+func TestCertManager_GetCertificate_WhenHostIsCoveredByLocalCA_ThenServesLocalCertificate(t *testing.T) {
+	// Arrange
+	localCA, err := NewLocalCA(&LocalCAConfig{Hosts: []string{"*.internal"}}, t.TempDir())
+	require.NoError(t, err)
+	certMgr := NewCertManager(&autocert.Manager{Cache: autocert.DirCache(t.TempDir())})
+	certMgr.SetLocalCA(localCA)
+	certMgr.AddAutoCertificate("app.internal")
+	certMgr.AddAutoCertificate("example.com")
+
+	// Act
+	certificate, err := certMgr.GetTLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "app.internal"})
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, localCA.Root().Subject.String(), certificate.Leaf.Issuer.String())
+	assert.Equal(t, []string{"example.com"}, certMgr.autoCertList)
+	inventory := certMgr.Inventory(14 * 24 * time.Hour)
+	require.Len(t, inventory, 2)
+	assert.Equal(t, CertificateSourceLocalCA, inventory[0].Source)
+	assert.Equal(t, []string{"app.internal"}, inventory[0].Hosts)
+	assert.False(t, inventory[0].Expiring)
+}
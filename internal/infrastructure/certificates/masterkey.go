@@ -0,0 +1,380 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	masterKeySize      = 32
+	encryptedBlockType = "REVERSEPROXY ENCRYPTED DATA"
+	keyIDHeader        = "Key-Id"
+)
+
+// KeyEncryption sets where the master key that encrypts the stored private keys is read from.
+// The key is 32 random bytes in base64, as generated by `openssl rand -base64 32`.
+type KeyEncryption struct {
+	File string `json:"master_key_file,omitempty"`
+	Env  string `json:"master_key_env,omitempty"`
+}
+
+// Validate checks that the key is read from either a file or an environment variable.
+func (config *KeyEncryption) Validate() error {
+	if config.File == "" && config.Env == "" {
+		return errors.New("master_key_file: either 'master_key_file' or 'master_key_env' is required")
+	}
+	if config.File != "" && config.Env != "" {
+		return errors.New("master_key_file: cannot be used with master_key_env")
+	}
+	return nil
+}
+
+// MasterKey is the object responsible for encrypting the files of the private keys with
+// AES-256-GCM. Encrypted files are PEM blocks that carry the id of the key they were encrypted
+// with, so a file encrypted with another key is reported as such.
+type MasterKey struct {
+	aead cipher.AEAD
+	id   string
+}
+
+// masterKey is the key used to read and write the stored private keys, nil when they are not
+// encrypted.
+var masterKey atomic.Pointer[MasterKey]
+
+// masterKeyErr is the error of the configured master key while it cannot be loaded. No file is
+// written meanwhile, so the private keys are never stored unencrypted by mistake.
+var masterKeyErr atomic.Pointer[error]
+
+// SetMasterKey sets the key that encrypts the private keys written from now on and decrypts the
+// encrypted files that are read. A nil key leaves the new files unencrypted.
+func SetMasterKey(key *MasterKey) {
+	masterKey.Store(key)
+	masterKeyErr.Store(nil)
+}
+
+// LoadMasterKey loads and sets the master key of the config. When the key cannot be loaded, the
+// key in use is kept to read the encrypted files and writing fails until a key is loaded.
+func LoadMasterKey(config *KeyEncryption) error {
+	key, err := NewMasterKey(config)
+	if err != nil {
+		err = fmt.Errorf("the master key of key_encryption cannot be loaded: %w", err)
+		masterKeyErr.Store(&err)
+		return err
+	}
+	SetMasterKey(key)
+	return nil
+}
+
+// NewMasterKey reads the master key of the config, or returns nil when there is no config.
+func NewMasterKey(config *KeyEncryption) (*MasterKey, error) {
+	if config == nil {
+		return nil, nil
+	}
+	var encoded string
+	if config.Env != "" {
+		value, isSet := os.LookupEnv(config.Env)
+		if !isSet {
+			return nil, fmt.Errorf("master key environment variable %s is not set", config.Env)
+		}
+		encoded = value
+	} else {
+		data, err := os.ReadFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != masterKeySize {
+		return nil, fmt.Errorf("the master key must be %d bytes in base64", masterKeySize)
+	}
+	return newMasterKey(key)
+}
+
+func newMasterKey(key []byte) (*MasterKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(key)
+	return &MasterKey{aead: aead, id: hex.EncodeToString(digest[:8])}, nil
+}
+
+// ID gets the id of the key written in the encrypted files, which does not reveal the key.
+func (key *MasterKey) ID() string {
+	return key.id
+}
+
+// Seal encrypts data.
+func (key *MasterKey) Seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	block := &pem.Block{
+		Type:    encryptedBlockType,
+		Headers: map[string]string{keyIDHeader: key.id},
+		Bytes:   key.aead.Seal(nonce, nonce, data, []byte(key.id)),
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// Open decrypts data encrypted by Seal.
+func (key *MasterKey) Open(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedBlockType {
+		return nil, errors.New("the data is not encrypted")
+	}
+	if id := block.Headers[keyIDHeader]; id != key.id {
+		return nil, fmt.Errorf("the data is encrypted with another master key (key id %s)", id)
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(block.Bytes) < nonceSize {
+		return nil, errors.New("the encrypted data is truncated")
+	}
+	decrypted, err := key.aead.Open(nil, block.Bytes[:nonceSize], block.Bytes[nonceSize:], []byte(key.id))
+	if err != nil {
+		return nil, errors.New("the encrypted data is corrupted")
+	}
+	return decrypted, nil
+}
+
+// isEncrypted indicates that data was encrypted by a master key.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN "+encryptedBlockType+"-----"))
+}
+
+// decrypt decrypts data with the master key in use. Unencrypted data is returned as it is, so
+// the files written before the encryption was enabled are still read.
+func decrypt(data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	key := masterKey.Load()
+	if key == nil {
+		return nil, errors.New("the data is encrypted and no key_encryption is configured")
+	}
+	return key.Open(data)
+}
+
+// encrypt encrypts data with the master key in use, if any. It fails while the configured master
+// key cannot be loaded.
+func encrypt(data []byte) ([]byte, error) {
+	if err := masterKeyErr.Load(); err != nil {
+		return nil, *err
+	}
+	key := masterKey.Load()
+	if key == nil {
+		return data, nil
+	}
+	return key.Seal(data)
+}
+
+// readSecretFile reads a file that may be encrypted.
+func readSecretFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := decrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return decrypted, nil
+}
+
+// writeSecretFile writes a file, encrypted when a master key is in use.
+func writeSecretFile(name string, data []byte, perm os.FileMode) error {
+	encrypted, err := encrypt(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, encrypted, perm)
+}
+
+// EncryptFile encrypts a file in place when a master key is in use. Files already encrypted are
+// left as they are.
+func EncryptFile(name string) error {
+	if err := masterKeyErr.Load(); err != nil {
+		return *err
+	}
+	key := masterKey.Load()
+	if key == nil {
+		return nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil || isEncrypted(data) {
+		return err
+	}
+	encrypted, err := key.Seal(data)
+	if err != nil {
+		return err
+	}
+	return replaceFile(name, encrypted)
+}
+
+// RotateMasterKey encrypts again with next the files under paths that are encrypted with
+// current, and returns how many files were rotated. Files already encrypted with next are
+// skipped, so an interrupted rotation can be run again.
+func RotateMasterKey(paths []string, current *MasterKey, next *MasterKey) (int, error) {
+	rotated := 0
+	visited := make(map[string]bool)
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			absolute, err := filepath.Abs(name)
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() || visited[absolute] {
+				return nil
+			}
+			visited[absolute] = true
+
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			encrypted, err := reencrypt(data, current, next)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if encrypted == nil {
+				return nil
+			}
+			if err := replaceFile(name, encrypted); err != nil {
+				return err
+			}
+			rotated++
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+	}
+	return rotated, nil
+}
+
+// RotateCacheMasterKey encrypts again with next the entries of the ACME cache store that are
+// encrypted with current, and returns how many entries were rotated, as RotateMasterKey does
+// with files.
+func RotateCacheMasterKey(ctx context.Context, store CacheStore, current *MasterKey, next *MasterKey) (int, error) {
+	names, err := store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, name := range names {
+		data, err := store.Get(ctx, name)
+		if errors.Is(err, autocert.ErrCacheMiss) {
+			continue
+		} else if err != nil {
+			return rotated, err
+		}
+		encrypted, err := reencrypt(data, current, next)
+		if err != nil {
+			return rotated, fmt.Errorf("%s: %w", name, err)
+		}
+		if encrypted == nil {
+			continue
+		}
+		if err := store.Put(ctx, name, encrypted); err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// reencrypt encrypts again with next the data encrypted with current. It returns nil when the
+// data is not encrypted or is already encrypted with next.
+func reencrypt(data []byte, current *MasterKey, next *MasterKey) ([]byte, error) {
+	if !isEncrypted(data) {
+		return nil, nil
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Headers[keyIDHeader] == next.id {
+		return nil, nil
+	}
+	decrypted, err := current.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	return next.Seal(decrypted)
+}
+
+// replaceFile writes the new content of a file keeping its mode.
+func replaceFile(name string, data []byte) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, data, info.Mode().Perm())
+}
+
+// writeFileAtomic writes the content of a file to a temporary file that is renamed over it, so
+// the file is never left half written.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	temp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), name)
+}
+
+// encryptedCache is an autocert cache that encrypts the certificates, the keys and the account
+// key with the master key in use.
+type encryptedCache struct {
+	autocert.Cache
+}
+
+func (cache *encryptedCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := cache.Cache.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(data)
+}
+
+func (cache *encryptedCache) Put(ctx context.Context, name string, data []byte) error {
+	encrypted, err := encrypt(data)
+	if err != nil {
+		return err
+	}
+	return cache.Cache.Put(ctx, name, encrypted)
+}
@@ -0,0 +1,188 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func newTestMasterKey(t *testing.T, seed byte) *MasterKey {
+	key, err := newMasterKey(bytes.Repeat([]byte{seed}, masterKeySize))
+	require.NoError(t, err)
+	return key
+}
+
+func useTestMasterKey(t *testing.T, key *MasterKey) {
+	SetMasterKey(key)
+	t.Cleanup(func() { SetMasterKey(nil) })
+}
+
+func TestNewMasterKey_WhenEnvHoldsKey_ThenSealedDataIsOpened(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_MASTER_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, masterKeySize)))
+	key, err := NewMasterKey(&KeyEncryption{Env: "TEST_MASTER_KEY"})
+	require.NoError(t, err)
+
+	// Act
+	sealed, err := key.Seal([]byte("secret"))
+	require.NoError(t, err)
+	opened, err := key.Open(sealed)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(opened))
+	assert.NotContains(t, string(sealed), "secret")
+	assert.Equal(t, newTestMasterKey(t, 1).ID(), key.ID())
+}
+
+func TestNewMasterKey_WhenKeyIsShort_ThenReturnsError(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_MASTER_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+
+	// Act
+	key, err := NewMasterKey(&KeyEncryption{Env: "TEST_MASTER_KEY"})
+
+	// Assert
+	assert.Nil(t, key)
+	assert.EqualError(t, err, "the master key must be 32 bytes in base64")
+}
+
+func TestMasterKey_Open_WhenSealedWithAnotherKey_ThenReturnsError(t *testing.T) {
+	// Arrange
+	sealed, err := newTestMasterKey(t, 1).Seal([]byte("secret"))
+	require.NoError(t, err)
+
+	// Act
+	_, err = newTestMasterKey(t, 2).Open(sealed)
+
+	// Assert
+	assert.ErrorContains(t, err, "the data is encrypted with another master key")
+}
+
+func TestCertificateDefs_GetCertificate_WhenKeyIsEncrypted_ThenDecryptsIt(t *testing.T) {
+	// Arrange
+	useTestMasterKey(t, newTestMasterKey(t, 1))
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(time.Hour))
+	require.NoError(t, EncryptFile(keyFile))
+	data, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	require.True(t, isEncrypted(data))
+
+	// Act
+	certificate, err := (&CertificateDefs{PublicKey: certFile, PrivateKey: keyFile}).GetCertificate()
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", certificate.Leaf.Subject.CommonName)
+}
+
+func TestCertificateDefs_GetCertificate_WhenKeyIsEncryptedWithoutMasterKey_ThenReturnsError(t *testing.T) {
+	// Arrange
+	useTestMasterKey(t, newTestMasterKey(t, 1))
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(time.Hour))
+	require.NoError(t, EncryptFile(keyFile))
+	SetMasterKey(nil)
+
+	// Act
+	_, err := (&CertificateDefs{PublicKey: certFile, PrivateKey: keyFile}).GetCertificate()
+
+	// Assert
+	assert.EqualError(t, err, keyFile+": the data is encrypted and no key_encryption is configured")
+}
+
+func TestEncryptedCache_Put_WhenMasterKeyIsSet_ThenStoresEncryptedData(t *testing.T) {
+	// Arrange
+	useTestMasterKey(t, newTestMasterKey(t, 1))
+	dir := t.TempDir()
+	cache := &encryptedCache{Cache: autocert.DirCache(dir)}
+
+	// Act
+	require.NoError(t, cache.Put(context.Background(), "example.com", []byte("certificate and key")))
+	data, err := cache.Get(context.Background(), "example.com")
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "certificate and key", string(data))
+	stored, err := os.ReadFile(filepath.Join(dir, "example.com"))
+	require.NoError(t, err)
+	assert.True(t, isEncrypted(stored))
+}
+
+func TestRotateMasterKey_WhenFilesAreEncrypted_ThenEncryptsThemWithNextKey(t *testing.T) {
+	// Arrange
+	current, next := newTestMasterKey(t, 1), newTestMasterKey(t, 2)
+	useTestMasterKey(t, current)
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, "example.com", time.Now().Add(time.Hour))
+	require.NoError(t, EncryptFile(keyFile))
+
+	// Act
+	rotated, err := RotateMasterKey([]string{dir, keyFile, filepath.Join(dir, "missing")}, current, next)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, 1, rotated)
+	SetMasterKey(next)
+	_, err = (&CertificateDefs{PublicKey: certFile, PrivateKey: keyFile}).GetCertificate()
+	assert.NoError(t, err)
+	rotated, err = RotateMasterKey([]string{dir}, current, next)
+	require.NoError(t, err)
+	assert.Equal(t, 0, rotated)
+}
+
+func TestRotateCacheMasterKey_WhenEntriesAreEncrypted_ThenEncryptsThemWithNextKey(t *testing.T) {
+	for storage, store := range testCacheStores(t) {
+		t.Run(storage, func(t *testing.T) {
+			// Arrange
+			current, next := newTestMasterKey(t, 1), newTestMasterKey(t, 2)
+			useTestMasterKey(t, current)
+			ctx := context.Background()
+			cache := &encryptedCache{Cache: store}
+			require.NoError(t, cache.Put(ctx, "example.com", []byte("certificate and key")))
+			require.NoError(t, store.Put(ctx, "plain.example.com", []byte("plain")))
+
+			// Act
+			rotated, err := RotateCacheMasterKey(ctx, store, current, next)
+
+			// Assert
+			require.NoError(t, err)
+			assert.Equal(t, 1, rotated)
+			SetMasterKey(next)
+			data, err := cache.Get(ctx, "example.com")
+			require.NoError(t, err)
+			assert.Equal(t, "certificate and key", string(data))
+			rotated, err = RotateCacheMasterKey(ctx, store, current, next)
+			require.NoError(t, err)
+			assert.Equal(t, 0, rotated)
+		})
+	}
+}
+
+func TestLoadMasterKey_WhenKeyCannotBeLoaded_ThenKeepsPreviousKeyAndRefusesToWrite(t *testing.T) {
+	// Arrange
+	useTestMasterKey(t, newTestMasterKey(t, 1))
+	sealed, err := encrypt([]byte("secret"))
+	require.NoError(t, err)
+	name := filepath.Join(t.TempDir(), "key.pem")
+
+	// Act
+	loadErr := LoadMasterKey(&KeyEncryption{Env: "TEST_MISSING_MASTER_KEY"})
+
+	// Assert
+	require.Error(t, loadErr)
+	opened, err := decrypt(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(opened))
+	assert.ErrorIs(t, writeSecretFile(name, []byte("secret"), 0o600), loadErr)
+	assert.NoFileExists(t, name)
+	require.NoError(t, LoadMasterKey(nil))
+	assert.NoError(t, writeSecretFile(name, []byte("secret"), 0o600))
+}
@@ -0,0 +1,99 @@
+package infrastructure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/metrics"
+)
+
+var certificateReloads = metrics.Default.NewCounterVec("reverseproxy_certificate_reloads_total", "Reloads of certificate files changed on disk.", "result")
+
+// Reloads is the history of the certificate reloads of the reverse proxy.
+var Reloads = NewReloadHistory(50)
+
+// ReloadEvent describes a reload of a certificate or CA file.
+type ReloadEvent struct {
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host"`
+	Files []string  `json:"files"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Succeeded indicates that the new files are in use.
+func (event ReloadEvent) Succeeded() bool {
+	return event.Error == ""
+}
+
+// ReloadHistory keeps the most recent reload events.
+type ReloadHistory struct {
+	mu     sync.RWMutex
+	size   int
+	events []ReloadEvent
+}
+
+// NewReloadHistory returns a new object of ReloadHistory type keeping up to size events.
+func NewReloadHistory(size int) *ReloadHistory {
+	return &ReloadHistory{size: size}
+}
+
+// Record adds an event to the history.
+func (history *ReloadHistory) Record(event ReloadEvent) {
+	result := "success"
+	if !event.Succeeded() {
+		result = "failure"
+	}
+	certificateReloads.Inc(result)
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	history.events = append(history.events, event)
+	if len(history.events) > history.size {
+		history.events = history.events[len(history.events)-history.size:]
+	}
+}
+
+// Events returns the recorded events, the most recent first.
+func (history *ReloadHistory) Events() []ReloadEvent {
+	history.mu.RLock()
+	defer history.mu.RUnlock()
+	events := make([]ReloadEvent, len(history.events))
+	for i, event := range history.events {
+		events[len(history.events)-1-i] = event
+	}
+	return events
+}
+
+// LoadKeyPair loads and validates a certificate and its private key. The certificate must
+// match the key and be currently valid.
+func LoadKeyPair(certFile string, keyFile string) (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return validateKeyPair(&certificate)
+}
+
+// validateKeyPair parses the leaf of a certificate, checking that it is currently valid.
+func validateKeyPair(certificate *tls.Certificate) (*tls.Certificate, error) {
+	if len(certificate.Certificate) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid until %v", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %v", leaf.NotAfter)
+	}
+	certificate.Leaf = leaf
+	return certificate, nil
+}
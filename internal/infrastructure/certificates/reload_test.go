@@ -0,0 +1,96 @@
+package infrastructure
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func writeTestKeyPair(t *testing.T, dir string, commonName string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return writeTestKeyPairWithKey(t, dir, commonName, notAfter, key)
+}
+
+func writeTestKeyPairWithKey(t *testing.T, dir string, commonName string, notAfter time.Time, key crypto.Signer) (string, string) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestCertManager_ReloadFiles_WhenCertificateChanged_ThenSwapsCertificate(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, "example.com", time.Now().Add(time.Hour))
+	certMgr := NewCertManager(&autocert.Manager{})
+	require.NoError(t, certMgr.AddCertificateFiles("example.com", certFile, keyFile))
+	writeTestKeyPair(t, dir, "renewed.example.com", time.Now().Add(48*time.Hour))
+
+	// Act
+	certMgr.ReloadFiles([]string{certFile})
+
+	// Assert
+	assert.Equal(t, "renewed.example.com", certMgr.certificates["example.com"][0].Leaf.Subject.CommonName)
+	assert.True(t, Reloads.Events()[0].Succeeded())
+}
+
+func TestCertManager_ReloadFiles_WhenNewCertificateIsExpired_ThenKeepsPrevious(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, "example.com", time.Now().Add(time.Hour))
+	certMgr := NewCertManager(&autocert.Manager{})
+	require.NoError(t, certMgr.AddCertificateFiles("example.com", certFile, keyFile))
+	writeTestKeyPair(t, dir, "expired.example.com", time.Now().Add(-time.Hour))
+
+	// Act
+	certMgr.ReloadFiles([]string{keyFile})
+
+	// Assert
+	assert.Equal(t, "example.com", certMgr.certificates["example.com"][0].Leaf.Subject.CommonName)
+	event := Reloads.Events()[0]
+	assert.Equal(t, "example.com", event.Host)
+	assert.Contains(t, event.Error, "certificate expired")
+}
+
+func TestFileWatcher_Poll_WhenFileChanges_ThenReportsIt(t *testing.T) {
+	// Arrange
+	file := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(file, []byte("old"), 0o600))
+	watcher := NewFileWatcher([]string{file}, time.Second, nil)
+	require.NoError(t, os.WriteFile(file, []byte("renewed"), 0o600))
+
+	// Act
+	first := watcher.Poll()
+	second := watcher.Poll()
+
+	// Assert
+	assert.Equal(t, []string{file}, first)
+	assert.Empty(t, second)
+}
@@ -0,0 +1,261 @@
+package infrastructure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTicketRotationInterval = 24 * time.Hour
+	defaultTicketOldKeys          = 2
+	maxTicketOldKeys              = 32
+	ticketCheckInterval           = time.Minute
+	ticketKeySize                 = 32
+	ticketKeysBlockType           = "SESSION TICKET KEYS"
+	ticketRotatedHeader           = "Rotated"
+	// ticketLockTTL is how long the lock of the file is kept by an instance that stops while
+	// rotating the keys.
+	ticketLockTTL = time.Minute
+)
+
+// SessionTickets is the configuration of the keys that encrypt the TLS session tickets, which
+// let the clients resume their sessions without a full handshake. The keys are kept across
+// configuration reloads and, with a file, across restarts and between the instances sharing it.
+type SessionTickets struct {
+	RotationInterval string `json:"rotation_interval,omitempty"`
+	OldKeys          int    `json:"old_keys,omitempty"`
+	File             string `json:"file,omitempty"`
+}
+
+// Validate checks the rotation interval and the number of old keys.
+func (config *SessionTickets) Validate() error {
+	if err := validatePositiveDuration(config.RotationInterval); err != nil {
+		return errors.New("rotation_interval: " + err.Error())
+	}
+	if config.OldKeys < 0 || config.OldKeys > maxTicketOldKeys {
+		return fmt.Errorf("old_keys: must be between 0 and %d", maxTicketOldKeys)
+	}
+	return nil
+}
+
+// GetRotationInterval gets how often a new key is generated.
+func (config *SessionTickets) GetRotationInterval() time.Duration {
+	if config == nil {
+		return defaultTicketRotationInterval
+	}
+	return durationOrDefault(config.RotationInterval, defaultTicketRotationInterval)
+}
+
+// GetOldKeys gets how many previous keys are kept to resume the sessions of their tickets.
+func (config *SessionTickets) GetOldKeys() int {
+	if config == nil || config.OldKeys == 0 {
+		return defaultTicketOldKeys
+	}
+	return config.OldKeys
+}
+
+// GetFile gets the file where the keys are shared, empty when they are only kept in memory.
+func (config *SessionTickets) GetFile() string {
+	if config == nil {
+		return ""
+	}
+	return config.File
+}
+
+// sessionTicketKeys holds the session ticket keys, newest first.
+type sessionTicketKeys struct {
+	mu      sync.Mutex
+	keys    [][ticketKeySize]byte
+	rotated time.Time
+}
+
+// ticketKeys are the session ticket keys of the process, kept across configuration reloads.
+var ticketKeys = &sessionTicketKeys{}
+
+// current gets the keys to use at now. A new key is generated when the newest one is older than
+// the rotation interval. With a file the keys are read from it, as another instance may have
+// rotated them, and a rotation is done holding the lock of the file, reading it again first, so
+// only one of the instances sharing it writes a new key.
+func (store *sessionTicketKeys) current(config *SessionTickets, now time.Time) ([][ticketKeySize]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	file := config.GetFile()
+	if err := store.load(file); err != nil {
+		return nil, err
+	}
+	if !store.needsRotation(config, now) {
+		return store.kept(config), nil
+	}
+
+	if file != "" {
+		locks := &lockingCache{store: NewDirCacheStore(filepath.Dir(file)), owner: cacheLockOwner, ttl: ticketLockTTL}
+		name := filepath.Base(file)
+		if err := locks.lockWithin(name); err != nil {
+			return nil, fmt.Errorf("failed to lock %s: %w", file, err)
+		}
+		defer locks.unlock(name)
+		if err := store.load(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.needsRotation(config, now) {
+		var key [ticketKeySize]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, err
+		}
+		store.keys = append([][ticketKeySize]byte{key}, store.keys...)
+		store.rotated = now
+		keys := store.kept(config)
+		if file != "" {
+			if err := writeTicketKeys(file, keys, store.rotated); err != nil {
+				return nil, err
+			}
+		}
+		return keys, nil
+	}
+	return store.kept(config), nil
+}
+
+// kept drops the keys beyond the old keys to keep and returns a copy of the rest.
+func (store *sessionTicketKeys) kept(config *SessionTickets) [][ticketKeySize]byte {
+	if len(store.keys) > config.GetOldKeys()+1 {
+		store.keys = store.keys[:config.GetOldKeys()+1]
+	}
+	return slices.Clone(store.keys)
+}
+
+// load reads the keys of the file, when there is one and it exists.
+func (store *sessionTicketKeys) load(file string) error {
+	if file == "" {
+		return nil
+	}
+	keys, rotated, err := readTicketKeys(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	store.keys, store.rotated = keys, rotated
+	return nil
+}
+
+// needsRotation indicates whether there is no key or the newest one is older than the rotation
+// interval.
+func (store *sessionTicketKeys) needsRotation(config *SessionTickets, now time.Time) bool {
+	return len(store.keys) == 0 || now.Sub(store.rotated) >= config.GetRotationInterval()
+}
+
+func readTicketKeys(file string) ([][ticketKeySize]byte, time.Time, error) {
+	data, err := readSecretFile(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != ticketKeysBlockType || len(block.Bytes) == 0 || len(block.Bytes)%ticketKeySize != 0 {
+		return nil, time.Time{}, fmt.Errorf("%s: no session ticket keys found", file)
+	}
+	rotated, err := time.Parse(time.RFC3339, block.Headers[ticketRotatedHeader])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: invalid rotation time: %w", file, err)
+	}
+	keys := make([][ticketKeySize]byte, len(block.Bytes)/ticketKeySize)
+	for i := range keys {
+		copy(keys[i][:], block.Bytes[i*ticketKeySize:])
+	}
+	return keys, rotated, nil
+}
+
+func writeTicketKeys(file string, keys [][ticketKeySize]byte, rotated time.Time) error {
+	data := make([]byte, 0, len(keys)*ticketKeySize)
+	for _, key := range keys {
+		data = append(data, key[:]...)
+	}
+	encrypted, err := encrypt(pem.EncodeToMemory(&pem.Block{
+		Type:    ticketKeysBlockType,
+		Headers: map[string]string{ticketRotatedHeader: rotated.UTC().Format(time.RFC3339)},
+		Bytes:   data,
+	}))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, encrypted, 0o600)
+}
+
+// StartSessionTicketRotation sets the session ticket keys of the TLS configs of the manager and
+// keeps them rotated in the background.
+func (certManager *CertManager) StartSessionTicketRotation(config *SessionTickets, logger Logger) {
+	certManager.mu.Lock()
+	if certManager.stopTickets != nil {
+		certManager.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	certManager.stopTickets = stop
+	certManager.mu.Unlock()
+
+	certManager.rotateSessionTicketKeys(config, logger)
+	go func() {
+		ticker := time.NewTicker(min(ticketCheckInterval, config.GetRotationInterval()))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				certManager.rotateSessionTicketKeys(config, logger)
+			}
+		}
+	}()
+}
+
+// rotateSessionTicketKeys sets the current session ticket keys when they change.
+func (certManager *CertManager) rotateSessionTicketKeys(config *SessionTickets, logger Logger) {
+	keys, err := ticketKeys.current(config, time.Now())
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to rotate the session ticket keys: %v", err))
+		return
+	}
+
+	certManager.mu.Lock()
+	defer certManager.mu.Unlock()
+	if slices.Equal(keys, certManager.ticketKeys) {
+		return
+	}
+	certManager.ticketKeys = keys
+	certManager.applySessionTicketKeys()
+}
+
+// applySessionTicketKeys sets the session ticket keys in the TLS configs. The server names with
+// their own config, such as the ones requiring client certificates, get keys derived for them, so
+// a session resumed on a server name was established with its own policy.
+func (certManager *CertManager) applySessionTicketKeys() {
+	if len(certManager.ticketKeys) == 0 || certManager.serverConfig == nil {
+		return
+	}
+	certManager.serverConfig.SetSessionTicketKeys(certManager.ticketKeys)
+	for vhostName, hostConfig := range certManager.hostConfigs {
+		hostConfig.SetSessionTicketKeys(hostTicketKeys(certManager.ticketKeys, vhostName))
+	}
+}
+
+// hostTicketKeys derives from the session ticket keys the keys of a server name.
+func hostTicketKeys(keys [][ticketKeySize]byte, vhostName string) [][ticketKeySize]byte {
+	hostKeys := make([][ticketKeySize]byte, len(keys))
+	for i, key := range keys {
+		mac := hmac.New(sha256.New, key[:])
+		mac.Write([]byte("session ticket key " + vhostName))
+		copy(hostKeys[i][:], mac.Sum(nil))
+	}
+	return hostKeys
+}
@@ -0,0 +1,263 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTicketKeys_Current_WhenIntervalElapses_ThenRotatesAndKeepsOldKeys(t *testing.T) {
+	// Arrange
+	store := &sessionTicketKeys{}
+	config := &SessionTickets{RotationInterval: "1h", OldKeys: 1}
+	now := time.Now()
+	first, err := store.current(config, now)
+	require.NoError(t, err)
+
+	// Act
+	unchanged, err := store.current(config, now.Add(30*time.Minute))
+	require.NoError(t, err)
+	second, err := store.current(config, now.Add(time.Hour))
+	require.NoError(t, err)
+	third, err := store.current(config, now.Add(2*time.Hour))
+	require.NoError(t, err)
+
+	// Assert
+	assert.Equal(t, first, unchanged)
+	require.Len(t, second, 2)
+	assert.Equal(t, first[0], second[1])
+	require.Len(t, third, 2)
+	assert.Equal(t, second[0], third[1])
+}
+
+func TestSessionTicketKeys_Current_WhenFileIsShared_ThenInstancesUseSameKeys(t *testing.T) {
+	// Arrange
+	config := &SessionTickets{File: filepath.Join(t.TempDir(), "tickets.pem")}
+	now := time.Now()
+	first, err := (&sessionTicketKeys{}).current(config, now)
+	require.NoError(t, err)
+
+	// Act
+	second, err := (&sessionTicketKeys{}).current(config, now.Add(time.Minute))
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	info, err := os.Stat(config.File)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestSessionTicketKeys_Current_WhenAnotherInstanceIsRotatingFile_ThenWaitsAndUsesItsKeys(t *testing.T) {
+	// Arrange
+	config := &SessionTickets{File: filepath.Join(t.TempDir(), "tickets.pem")}
+	now := time.Now()
+	var stale, rotated [ticketKeySize]byte
+	_, _ = rand.Read(stale[:])
+	_, _ = rand.Read(rotated[:])
+	require.NoError(t, writeTicketKeys(config.File, [][ticketKeySize]byte{stale}, now.Add(-25*time.Hour)))
+	other := NewDirCacheStore(filepath.Dir(config.File))
+	isLocked, err := other.TryLock(context.Background(), filepath.Base(config.File), "instance-b", time.Minute)
+	require.NoError(t, err)
+	require.True(t, isLocked)
+	result := make(chan [][ticketKeySize]byte, 1)
+
+	// Act
+	go func() {
+		keys, _ := (&sessionTicketKeys{}).current(config, now)
+		result <- keys
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, writeTicketKeys(config.File, [][ticketKeySize]byte{rotated, stale}, now))
+	require.NoError(t, other.Unlock(context.Background(), filepath.Base(config.File), "instance-b"))
+
+	// Assert
+	select {
+	case keys := <-result:
+		assert.Equal(t, [][ticketKeySize]byte{rotated, stale}, keys)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the keys were not rotated")
+	}
+	keys, _, err := readTicketKeys(config.File)
+	require.NoError(t, err)
+	assert.Equal(t, [][ticketKeySize]byte{rotated, stale}, keys)
+}
+
+func TestSessionTickets_Validate_WhenOldKeysIsNegative_ThenReturnsError(t *testing.T) {
+	// Arrange
+	config := &SessionTickets{OldKeys: -1}
+
+	// Act
+	err := config.Validate()
+
+	// Assert
+	assert.EqualError(t, err, "old_keys: must be between 0 and 32")
+}
+
+func startTicketServer(t *testing.T, certFile string, keyFile string, config *SessionTickets) string {
+	logger := &mocks.MockLogger{}
+	logger.On("Info", mock.Anything).Maybe()
+	logger.On("Error", mock.Anything).Maybe()
+	certMgr := NewCertManager(nil)
+	require.NoError(t, certMgr.AddCertificateFiles("example.com", certFile, keyFile))
+	tlsConfig := certMgr.GetTLSConfig()
+	certMgr.StartSessionTicketRotation(config, logger)
+	t.Cleanup(certMgr.Stop)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("x"))
+			_ = conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func connectTicketClient(t *testing.T, addr string, clientConfig *tls.Config) bool {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, clientConfig)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	// reading lets the client receive the session ticket sent after the handshake
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	return conn.ConnectionState().DidResume
+}
+
+func TestCertManager_StartSessionTicketRotation_WhenManagersShareFile_ThenSessionIsResumed(t *testing.T) {
+	// Arrange
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir, "example.com", time.Now().Add(time.Hour))
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(certPEM))
+	clientConfig := &tls.Config{ServerName: "example.com", RootCAs: roots, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	config := &SessionTickets{File: filepath.Join(dir, "tickets.pem")}
+	require.False(t, connectTicketClient(t, startTicketServer(t, certFile, keyFile, config), clientConfig))
+	// a restarted process starts without the keys in memory
+	previous := ticketKeys
+	ticketKeys = &sessionTicketKeys{}
+	t.Cleanup(func() { ticketKeys = previous })
+
+	// Act
+	didResume := connectTicketClient(t, startTicketServer(t, certFile, keyFile, config), clientConfig)
+
+	// Assert
+	assert.True(t, didResume)
+}
+
+func TestHostTicketKeys_WhenServerNamesDiffer_ThenKeysDiffer(t *testing.T) {
+	// Arrange
+	keys := [][ticketKeySize]byte{{1}, {2}}
+
+	// Act
+	partnerKeys := hostTicketKeys(keys, "partners.example.com")
+	staffKeys := hostTicketKeys(keys, "staff.example.com")
+
+	// Assert
+	assert.Len(t, partnerKeys, 2)
+	assert.Equal(t, partnerKeys, hostTicketKeys(keys, "partners.example.com"))
+	assert.NotEqual(t, partnerKeys, staffKeys)
+	assert.NotContains(t, partnerKeys, keys[0])
+	assert.NotContains(t, staffKeys, keys[0])
+}
+
+// anyNameSessionCache offers the last session to every server name.
+type anyNameSessionCache struct {
+	session *tls.ClientSessionState
+}
+
+func (cache *anyNameSessionCache) Get(string) (*tls.ClientSessionState, bool) {
+	return cache.session, cache.session != nil
+}
+
+func (cache *anyNameSessionCache) Put(_ string, session *tls.ClientSessionState) {
+	if session != nil {
+		cache.session = session
+	}
+}
+
+func TestCertManager_StartSessionTicketRotation_WhenTicketIsFromAnotherServerName_ThenClientIsVerifiedAgain(t *testing.T) {
+	// Arrange
+	previous := ticketKeys
+	ticketKeys = &sessionTicketKeys{}
+	t.Cleanup(func() { ticketKeys = previous })
+	logger := &mocks.MockLogger{}
+	logger.On("Info", mock.Anything).Maybe()
+	logger.On("Error", mock.Anything).Maybe()
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(time.Hour))
+	partnerCAFile, partnerCA := writeTestCA(t)
+	staffCAFile, _ := writeTestCA(t)
+	certMgr := NewCertManager(nil)
+	require.NoError(t, certMgr.AddCertificateFiles("partners.example.com", certFile, keyFile))
+	require.NoError(t, certMgr.AddCertificateFiles("staff.example.com", certFile, keyFile))
+	certMgr.SetClientAuth("partners.example.com", ClientAuthVerify, []string{partnerCAFile})
+	certMgr.SetClientAuth("staff.example.com", ClientAuthVerify, []string{staffCAFile})
+	tlsConfig := certMgr.GetTLSConfig()
+	certMgr.StartSessionTicketRotation(&SessionTickets{}, logger)
+	t.Cleanup(certMgr.Stop)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("x"))
+			_ = conn.Close()
+		}
+	}()
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, partnerCA.certificate, &clientKey.PublicKey, partnerCA.key)
+	require.NoError(t, err)
+	clientConfig := &tls.Config{
+		ServerName:         "partners.example.com",
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}},
+		ClientSessionCache: &anyNameSessionCache{},
+	}
+	require.False(t, connectTicketClient(t, listener.Addr().String(), clientConfig))
+	require.True(t, connectTicketClient(t, listener.Addr().String(), clientConfig))
+
+	// Act
+	staffConfig := clientConfig.Clone()
+	staffConfig.ServerName = "staff.example.com"
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(), staffConfig)
+	if err == nil {
+		_, err = io.ReadAll(conn)
+		_ = conn.Close()
+	}
+
+	// Assert
+	assert.Error(t, err)
+}
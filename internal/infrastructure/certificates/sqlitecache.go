@@ -0,0 +1,128 @@
+package infrastructure
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	// registers the pure Go driver, so the binary still builds without cgo
+	_ "modernc.org/sqlite"
+)
+
+const sqliteCacheSchema = `
+CREATE TABLE IF NOT EXISTS acme_cache (name TEXT PRIMARY KEY, data BLOB NOT NULL);
+CREATE TABLE IF NOT EXISTS acme_locks (name TEXT PRIMARY KEY, owner TEXT NOT NULL, expires INTEGER NOT NULL);`
+
+// SQLiteCacheStore is the store of the ACME cache in an SQLite database, which the instances of a
+// host, or of hosts sharing a file system with working locks, can share.
+type SQLiteCacheStore struct {
+	db *sql.DB
+}
+
+var (
+	sqliteCacheStoresMu sync.Mutex
+	// sqliteCacheStores are the stores opened by file, kept across configuration reloads.
+	sqliteCacheStores = make(map[string]*SQLiteCacheStore)
+)
+
+// NewSQLiteCacheStore returns the store of the database file, creating it when it does not
+// exist. The file is only readable by its owner.
+func NewSQLiteCacheStore(file string) (*SQLiteCacheStore, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	sqliteCacheStoresMu.Lock()
+	defer sqliteCacheStoresMu.Unlock()
+	if store, isContained := sqliteCacheStores[path]; isContained {
+		return store, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// SQLite creates the journal files with the permissions of the database
+	dbFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbFile.Close(); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteCacheSchema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	store := &SQLiteCacheStore{db: db}
+	sqliteCacheStores[path] = store
+	return store, nil
+}
+
+// Get gets the data of name, or autocert.ErrCacheMiss.
+func (store *SQLiteCacheStore) Get(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := store.db.QueryRowContext(ctx, "SELECT data FROM acme_cache WHERE name = ?", name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+// Put stores the data of name.
+func (store *SQLiteCacheStore) Put(ctx context.Context, name string, data []byte) error {
+	_, err := store.db.ExecContext(ctx, "INSERT INTO acme_cache (name, data) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET data = excluded.data", name, data)
+	return err
+}
+
+// Delete removes the data of name.
+func (store *SQLiteCacheStore) Delete(ctx context.Context, name string) error {
+	_, err := store.db.ExecContext(ctx, "DELETE FROM acme_cache WHERE name = ?", name)
+	return err
+}
+
+// List gets the names of the entries, without the locks.
+func (store *SQLiteCacheStore) List(ctx context.Context) ([]string, error) {
+	rows, err := store.db.QueryContext(ctx, "SELECT name FROM acme_cache ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// TryLock takes the lock of name for owner until ttl elapses.
+func (store *SQLiteCacheStore) TryLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	result, err := store.db.ExecContext(ctx, `INSERT INTO acme_locks (name, owner, expires) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET owner = excluded.owner, expires = excluded.expires
+		WHERE acme_locks.owner = excluded.owner OR acme_locks.expires <= ?`,
+		name, owner, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// Unlock releases the lock of name when owner holds it.
+func (store *SQLiteCacheStore) Unlock(ctx context.Context, name string, owner string) error {
+	_, err := store.db.ExecContext(ctx, "DELETE FROM acme_locks WHERE name = ? AND owner = ?", name, owner)
+	return err
+}
@@ -0,0 +1,249 @@
+package infrastructure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/metrics"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	staplingCheckInterval = time.Minute
+	staplingRetryInterval = 5 * time.Minute
+	staplingTimeout       = 10 * time.Second
+	maxOCSPResponseSize   = 1 << 20
+)
+
+var ocspStapleRefreshes = metrics.Default.NewCounterVec("reverseproxy_ocsp_staple_refreshes_total", "Refreshes of the OCSP responses stapled to the served certificates.", "host", "result")
+
+// errNoOCSPServer is returned for certificates without an OCSP responder.
+var errNoOCSPServer = errors.New("certificate has no OCSP responder")
+
+// revokedError is returned when the responder reports the certificate as revoked. Revocation
+// is final, so the certificate must be replaced.
+type revokedError struct {
+	responder string
+	revokedAt time.Time
+}
+
+func (err *revokedError) Error() string {
+	return fmt.Sprintf("OCSP responder '%s' reports the certificate as revoked at %v", err.responder, err.revokedAt.UTC().Format(time.RFC3339))
+}
+
+// Logger is the logging contract used by the certificate manager.
+type Logger interface {
+	Info(msg string)
+	Error(msg string)
+}
+
+// OCSPStapler is the object responsible to obtain the OCSP responses stapled to the
+// certificates served by the reverse proxy. Responses are kept in a directory so they
+// survive restarts.
+type OCSPStapler struct {
+	cacheDir string
+	client   *http.Client
+	logger   Logger
+	now      func() time.Time
+	mu       sync.Mutex
+	next     map[string]time.Time
+}
+
+// NewOCSPStapler returns a new object of OCSPStapler type that caches the responses in cacheDir.
+func NewOCSPStapler(cacheDir string, logger Logger) *OCSPStapler {
+	return &OCSPStapler{
+		cacheDir: cacheDir,
+		client:   &http.Client{Timeout: staplingTimeout},
+		logger:   logger,
+		now:      time.Now,
+		next:     make(map[string]time.Time),
+	}
+}
+
+// Staple returns a copy of the certificate with a current OCSP response when it is due for a
+// refresh, or nil when the certificate does not need to change. Failures are logged and the
+// certificate keeps its previous response while it is still valid. A revoked certificate loses
+// its response at once.
+func (stapler *OCSPStapler) Staple(host string, certificate *tls.Certificate) *tls.Certificate {
+	if len(certificate.Certificate) == 0 {
+		return nil
+	}
+	key := certificateKey(certificate.Certificate[0])
+	now := stapler.now()
+	stapler.mu.Lock()
+	next, known := stapler.next[key]
+	stapler.mu.Unlock()
+	if known && now.Before(next) {
+		return nil
+	}
+
+	staple, response, err := stapler.fetch(certificate, key)
+	if errors.Is(err, errNoOCSPServer) {
+		stapler.schedule(key, now.Add(24*time.Hour))
+		return nil
+	}
+	var revokedErr *revokedError
+	if errors.As(err, &revokedErr) {
+		ocspStapleRefreshes.Inc(host, "revoked")
+		stapler.logger.Error(fmt.Sprintf("The certificate of '%v' has been revoked, it must be replaced: %v", host, err))
+		stapler.schedule(key, now.Add(staplingRetryInterval))
+		if certificate.OCSPStaple != nil {
+			revoked := *certificate
+			revoked.OCSPStaple = nil
+			return &revoked
+		}
+		return nil
+	}
+	if err != nil {
+		ocspStapleRefreshes.Inc(host, "failure")
+		stapler.logger.Error(fmt.Sprintf("OCSP stapling for '%v' failed: %v", host, err))
+		stapler.schedule(key, now.Add(staplingRetryInterval))
+		if certificate.OCSPStaple != nil && !stapleIsValid(certificate, now) {
+			expired := *certificate
+			expired.OCSPStaple = nil
+			return &expired
+		}
+		return nil
+	}
+
+	ocspStapleRefreshes.Inc(host, "success")
+	next = refreshTime(response, now)
+	if !next.After(now) {
+		next = now.Add(staplingRetryInterval)
+	}
+	stapler.schedule(key, next)
+	stapled := *certificate
+	stapled.OCSPStaple = staple
+	return &stapled
+}
+
+func (stapler *OCSPStapler) schedule(key string, next time.Time) {
+	stapler.mu.Lock()
+	defer stapler.mu.Unlock()
+	stapler.next[key] = next
+}
+
+// fetch gets the response from the cache directory while it is fresh, or from the responder.
+func (stapler *OCSPStapler) fetch(certificate *tls.Certificate, key string) ([]byte, *ocsp.Response, error) {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errNoOCSPServer
+	}
+	if len(certificate.Certificate) < 2 {
+		return nil, nil, errors.New("the issuer certificate is not included in the certificate file")
+	}
+	issuer, err := x509.ParseCertificate(certificate.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cacheFile := filepath.Join(stapler.cacheDir, key+".ocsp")
+	var cached []byte
+	var cachedResponse *ocsp.Response
+	if data, err := os.ReadFile(cacheFile); err == nil {
+		if response, err := ocsp.ParseResponseForCert(data, leaf, issuer); err == nil && response.Status == ocsp.Good &&
+			(response.NextUpdate.IsZero() || stapler.now().Before(response.NextUpdate)) {
+			cached, cachedResponse = data, response
+			if stapler.now().Before(refreshTime(response, response.ThisUpdate)) {
+				return cached, cachedResponse, nil
+			}
+		}
+	}
+
+	staple, response, err := stapler.query(leaf.OCSPServer[0], leaf, issuer)
+	var revokedErr *revokedError
+	if errors.As(err, &revokedErr) {
+		if err := os.Remove(cacheFile); err != nil && !os.IsNotExist(err) {
+			stapler.logger.Error(fmt.Sprintf("Failed to remove cached OCSP response: %v", err))
+		}
+		return nil, nil, err
+	}
+	if err != nil {
+		if cached != nil {
+			// The cached response is still valid, so it is stapled until the responder answers.
+			stapler.logger.Error(fmt.Sprintf("OCSP responder '%s' failed, using the cached response: %v", leaf.OCSPServer[0], err))
+			return cached, cachedResponse, nil
+		}
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(stapler.cacheDir, 0o700); err == nil {
+		if err := os.WriteFile(cacheFile, staple, 0o600); err != nil {
+			stapler.logger.Error(fmt.Sprintf("Failed to cache OCSP response: %v", err))
+		}
+	}
+	return staple, response, nil
+}
+
+func (stapler *OCSPStapler) query(responder string, leaf *x509.Certificate, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := stapler.client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder '%s' returned status %d", responder, resp.StatusCode)
+	}
+	staple, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := ocsp.ParseResponseForCert(staple, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.Status == ocsp.Revoked {
+		return nil, nil, &revokedError{responder: responder, revokedAt: response.RevokedAt}
+	}
+	if response.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("OCSP responder '%s' reports the certificate as %s", responder, statusName(response.Status))
+	}
+	return staple, response, nil
+}
+
+// refreshTime is halfway through the validity of the response, so there is time to retry
+// before the stapled response expires.
+func refreshTime(response *ocsp.Response, now time.Time) time.Time {
+	if response.NextUpdate.IsZero() {
+		return now.Add(time.Hour)
+	}
+	return response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+}
+
+func stapleIsValid(certificate *tls.Certificate, now time.Time) bool {
+	response, err := ocsp.ParseResponse(certificate.OCSPStaple, nil)
+	return err == nil && (response.NextUpdate.IsZero() || now.Before(response.NextUpdate))
+}
+
+func statusName(status int) string {
+	switch status {
+	case ocsp.Revoked:
+		return "revoked"
+	case ocsp.Unknown:
+		return "unknown"
+	default:
+		return "good"
+	}
+}
+
+func certificateKey(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,170 @@
+package infrastructure
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testLogger struct {
+	errors []string
+}
+
+func (l *testLogger) Info(string) {}
+
+func (l *testLogger) Error(msg string) { l.errors = append(l.errors, msg) }
+
+func newOCSPTestResponder(t *testing.T, ca *testCA, status int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		request, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+		response, err := ocsp.CreateResponse(ca.certificate, ca.certificate, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, ca.key)
+		require.NoError(t, err)
+		_, _ = rw.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (ca *testCA) issueServer(t *testing.T, commonName string, responder string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{responder},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der, ca.certificate.Raw}, PrivateKey: key}
+}
+
+func TestOCSPStapler_Staple_WhenResponderAnswersGood_ThenStaplesAndCachesResponse(t *testing.T) {
+	// Arrange
+	_, ca := writeTestCA(t)
+	responder := newOCSPTestResponder(t, ca, ocsp.Good)
+	certificate := ca.issueServer(t, "example.com", responder.URL)
+	cacheDir := t.TempDir()
+	stapler := NewOCSPStapler(cacheDir, &testLogger{})
+
+	// Act
+	stapled := stapler.Staple("example.com", certificate)
+
+	// Assert
+	require.NotNil(t, stapled)
+	assert.NotEmpty(t, stapled.OCSPStaple)
+	assert.Nil(t, certificate.OCSPStaple)
+	cached, err := os.ReadFile(filepath.Join(cacheDir, certificateKey(certificate.Certificate[0])+".ocsp"))
+	require.NoError(t, err)
+	assert.Equal(t, stapled.OCSPStaple, cached)
+	assert.Nil(t, stapler.Staple("example.com", stapled))
+}
+
+func TestOCSPStapler_Staple_WhenResponseIsCached_ThenUsesCacheAfterRestart(t *testing.T) {
+	// Arrange
+	_, ca := writeTestCA(t)
+	responder := newOCSPTestResponder(t, ca, ocsp.Good)
+	certificate := ca.issueServer(t, "example.com", responder.URL)
+	cacheDir := t.TempDir()
+	first := NewOCSPStapler(cacheDir, &testLogger{}).Staple("example.com", certificate)
+	require.NotNil(t, first)
+	responder.Close()
+
+	// Act
+	stapled := NewOCSPStapler(cacheDir, &testLogger{}).Staple("example.com", certificate)
+
+	// Assert
+	require.NotNil(t, stapled)
+	assert.Equal(t, first.OCSPStaple, stapled.OCSPStaple)
+}
+
+func TestOCSPStapler_Staple_WhenCertificateIsRevoked_ThenReportsFailure(t *testing.T) {
+	// Arrange
+	_, ca := writeTestCA(t)
+	responder := newOCSPTestResponder(t, ca, ocsp.Revoked)
+	certificate := ca.issueServer(t, "example.com", responder.URL)
+	logger := &testLogger{}
+
+	// Act
+	stapled := NewOCSPStapler(t.TempDir(), logger).Staple("example.com", certificate)
+
+	// Assert
+	assert.Nil(t, stapled)
+	require.Len(t, logger.errors, 1)
+	assert.Contains(t, logger.errors[0], "revoked")
+}
+
+func TestOCSPStapler_Staple_WhenStapledCertificateIsRevoked_ThenDropsStapleAndCachedResponse(t *testing.T) {
+	// Arrange
+	_, ca := writeTestCA(t)
+	responder := newOCSPTestResponder(t, ca, ocsp.Revoked)
+	certificate := ca.issueServer(t, "example.com", responder.URL)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	good, err := ocsp.CreateResponse(ca.certificate, ca.certificate, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-50 * time.Minute),
+		NextUpdate:   time.Now().Add(10 * time.Minute),
+	}, ca.key)
+	require.NoError(t, err)
+	cacheDir := t.TempDir()
+	cacheFile := filepath.Join(cacheDir, certificateKey(certificate.Certificate[0])+".ocsp")
+	require.NoError(t, os.WriteFile(cacheFile, good, 0o600))
+	certificate.OCSPStaple = good
+	logger := &testLogger{}
+
+	// Act
+	stapled := NewOCSPStapler(cacheDir, logger).Staple("example.com", certificate)
+
+	// Assert
+	require.NotNil(t, stapled)
+	assert.Nil(t, stapled.OCSPStaple)
+	assert.NoFileExists(t, cacheFile)
+	require.Len(t, logger.errors, 1)
+	assert.Contains(t, logger.errors[0], "has been revoked")
+}
+
+func TestCertManager_StapleOCSP_WhenCertificateHasResponder_ThenServesStaple(t *testing.T) {
+	// Arrange
+	_, ca := writeTestCA(t)
+	responder := newOCSPTestResponder(t, ca, ocsp.Good)
+	certMgr := NewCertManager(&autocert.Manager{})
+	certMgr.AddCertificate("example.com", ca.issueServer(t, "example.com", responder.URL))
+
+	// Act
+	certMgr.StapleOCSP(NewOCSPStapler(t.TempDir(), &testLogger{}))
+
+	// Assert
+	served, err := certMgr.GetTLSConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, served.OCSPStaple)
+}
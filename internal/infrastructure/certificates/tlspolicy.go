@@ -0,0 +1,209 @@
+package infrastructure
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+// TLSPreset is a named set of TLS settings following the Mozilla server side TLS profiles.
+type TLSPreset string
+
+// TLS presets. Modern only accepts TLS 1.3, intermediate accepts TLS 1.2 with AEAD cipher
+// suites and legacy accepts TLS 1.0 clients with CBC cipher suites.
+const (
+	TLSPresetModern       TLSPreset = "modern"
+	TLSPresetIntermediate TLSPreset = "intermediate"
+	TLSPresetLegacy       TLSPreset = "legacy"
+)
+
+// defaultALPN is announced when a policy does not set its own protocols.
+var defaultALPN = []string{"h2", "http/1.1"}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+var intermediateCipherSuites = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+var presets = map[TLSPreset]TLSPolicy{
+	TLSPresetModern: {
+		MinVersion: "1.3",
+		Curves:     []string{"X25519MLKEM768", "X25519", "P-256", "P-384"},
+	},
+	TLSPresetIntermediate: {
+		MinVersion:   "1.2",
+		CipherSuites: intermediateCipherSuites,
+		Curves:       []string{"X25519MLKEM768", "X25519", "P-256", "P-384"},
+	},
+	TLSPresetLegacy: {
+		MinVersion: "1.0",
+		CipherSuites: append(slices.Clone(intermediateCipherSuites),
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+			"TLS_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_RSA_WITH_AES_256_CBC_SHA",
+			"TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+		),
+		Curves: []string{"X25519", "P-256", "P-384"},
+	},
+}
+
+// TLSPolicy is the TLS configuration of the handshake of a server name. The fields set
+// override the ones of the preset. Cipher suites only apply to TLS 1.0-1.2, TLS 1.3 suites
+// are not configurable.
+type TLSPolicy struct {
+	Preset       TLSPreset `json:"preset,omitempty"`
+	MinVersion   string    `json:"min_version,omitempty"`
+	MaxVersion   string    `json:"max_version,omitempty"`
+	CipherSuites []string  `json:"cipher_suites,omitempty"`
+	Curves       []string  `json:"curves,omitempty"`
+	ALPN         []string  `json:"alpn,omitempty"`
+}
+
+// Validate checks that the preset, versions, cipher suites and curves are known.
+func (policy *TLSPolicy) Validate() error {
+	if policy.Preset != "" {
+		if _, isContained := presets[policy.Preset]; !isContained {
+			return fmt.Errorf("preset: unknown preset '%s' (expected modern, intermediate or legacy)", policy.Preset)
+		}
+	}
+	if err := validateTLSVersion(policy.MinVersion); err != nil {
+		return fmt.Errorf("min_version: %w", err)
+	}
+	if err := validateTLSVersion(policy.MaxVersion); err != nil {
+		return fmt.Errorf("max_version: %w", err)
+	}
+	for i, name := range policy.CipherSuites {
+		if _, err := cipherSuiteID(name); err != nil {
+			return fmt.Errorf("cipher_suites[%d]: %w", i, err)
+		}
+	}
+	for i, name := range policy.Curves {
+		if _, isContained := tlsCurves[name]; !isContained {
+			return fmt.Errorf("curves[%d]: unknown curve '%s' (expected X25519MLKEM768, X25519, P-256, P-384 or P-521)", i, name)
+		}
+	}
+	for i, protocol := range policy.ALPN {
+		if strings.TrimSpace(protocol) == "" {
+			return fmt.Errorf("alpn[%d]: protocol cannot be empty", i)
+		}
+	}
+
+	resolved := policy.resolve()
+	if resolved.MinVersion != "" && resolved.MaxVersion != "" && tlsVersions[resolved.MinVersion] > tlsVersions[resolved.MaxVersion] {
+		return fmt.Errorf("min_version '%s' is greater than max_version '%s'", resolved.MinVersion, resolved.MaxVersion)
+	}
+	// net/http refuses to serve HTTP/2 with TLS 1.2 cipher suites that do not include the one required by RFC 7540.
+	if len(resolved.CipherSuites) > 0 && tlsVersions[resolved.MinVersion] < tls.VersionTLS13 && slices.Contains(resolved.alpn(), "h2") &&
+		!slices.Contains(resolved.CipherSuites, "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") &&
+		!slices.Contains(resolved.CipherSuites, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256") {
+		return fmt.Errorf("cipher_suites: HTTP/2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	}
+	return nil
+}
+
+// Apply sets the policy on a TLS config. A nil policy leaves the config unchanged. The ACME
+// tls-alpn protocol is always announced so certificates can still be obtained.
+func (policy *TLSPolicy) Apply(config *tls.Config) {
+	if policy == nil {
+		return
+	}
+	resolved := policy.resolve()
+	if version, isContained := tlsVersions[resolved.MinVersion]; isContained {
+		config.MinVersion = version
+	}
+	if version, isContained := tlsVersions[resolved.MaxVersion]; isContained {
+		config.MaxVersion = version
+	}
+	if len(resolved.CipherSuites) > 0 {
+		config.CipherSuites = make([]uint16, 0, len(resolved.CipherSuites))
+		for _, name := range resolved.CipherSuites {
+			if id, err := cipherSuiteID(name); err == nil {
+				config.CipherSuites = append(config.CipherSuites, id)
+			}
+		}
+	}
+	if len(resolved.Curves) > 0 {
+		config.CurvePreferences = make([]tls.CurveID, 0, len(resolved.Curves))
+		for _, name := range resolved.Curves {
+			config.CurvePreferences = append(config.CurvePreferences, tlsCurves[name])
+		}
+	}
+	config.NextProtos = append(slices.Clone(resolved.alpn()), acme.ALPNProto)
+}
+
+// resolve gets the settings of the preset overridden by the fields set in the policy.
+func (policy *TLSPolicy) resolve() TLSPolicy {
+	resolved := presets[policy.Preset]
+	if policy.MinVersion != "" {
+		resolved.MinVersion = policy.MinVersion
+	}
+	if policy.MaxVersion != "" {
+		resolved.MaxVersion = policy.MaxVersion
+	}
+	if len(policy.CipherSuites) > 0 {
+		resolved.CipherSuites = policy.CipherSuites
+	}
+	if len(policy.Curves) > 0 {
+		resolved.Curves = policy.Curves
+	}
+	if len(policy.ALPN) > 0 {
+		resolved.ALPN = policy.ALPN
+	}
+	return resolved
+}
+
+func (policy *TLSPolicy) alpn() []string {
+	if len(policy.ALPN) == 0 {
+		return defaultALPN
+	}
+	return policy.ALPN
+}
+
+func validateTLSVersion(version string) error {
+	if _, isContained := tlsVersions[version]; version != "" && !isContained {
+		return fmt.Errorf("unknown TLS version '%s' (expected 1.0, 1.1, 1.2 or 1.3)", version)
+	}
+	return nil
+}
+
+func cipherSuiteID(name string) (uint16, error) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			if slices.Equal(suite.SupportedVersions, []uint16{tls.VersionTLS13}) {
+				return 0, fmt.Errorf("cipher suite '%s' is a TLS 1.3 suite, which cannot be configured", name)
+			}
+			return suite.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite '%s'", name)
+}
@@ -0,0 +1,88 @@
+package infrastructure
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestTLSPolicy_Validate_WhenPolicyIsInvalid_ThenReturnsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *TLSPolicy
+		expected string
+	}{
+		{name: "unknown version", policy: &TLSPolicy{MinVersion: "1.4"}, expected: "min_version: unknown TLS version '1.4'"},
+		{name: "unknown cipher suite", policy: &TLSPolicy{CipherSuites: []string{"TLS_FOO"}}, expected: "cipher_suites[0]: unknown cipher suite 'TLS_FOO'"},
+		{name: "TLS 1.3 cipher suite", policy: &TLSPolicy{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, expected: "is a TLS 1.3 suite"},
+		{name: "unknown curve", policy: &TLSPolicy{Curves: []string{"P-224"}}, expected: "curves[0]: unknown curve 'P-224'"},
+		{name: "min greater than max", policy: &TLSPolicy{Preset: TLSPresetModern, MaxVersion: "1.2"}, expected: "min_version '1.3' is greater than max_version '1.2'"},
+		{
+			name:     "HTTP/2 without required cipher suite",
+			policy:   &TLSPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+			expected: "HTTP/2 requires",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			err := tt.policy.Validate()
+
+			// Assert
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestTLSPolicy_Validate_WhenPresetsAreUsed_ThenReturnsNil(t *testing.T) {
+	for _, preset := range []TLSPreset{TLSPresetModern, TLSPresetIntermediate, TLSPresetLegacy} {
+		// Act
+		err := (&TLSPolicy{Preset: preset}).Validate()
+
+		// Assert
+		assert.NoError(t, err, preset)
+	}
+}
+
+func TestTLSPolicy_Apply_WhenFieldsOverridePreset_ThenUsesFields(t *testing.T) {
+	// Arrange
+	policy := &TLSPolicy{Preset: TLSPresetIntermediate, Curves: []string{"X25519MLKEM768", "X25519"}, ALPN: []string{"http/1.1"}}
+	config := &tls.Config{}
+
+	// Act
+	policy.Apply(config)
+
+	// Assert
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Contains(t, config.CipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	assert.NotContains(t, config.CipherSuites, tls.TLS_RSA_WITH_AES_128_CBC_SHA)
+	assert.Equal(t, []tls.CurveID{tls.X25519MLKEM768, tls.X25519}, config.CurvePreferences)
+	assert.Equal(t, []string{"http/1.1", acme.ALPNProto}, config.NextProtos)
+}
+
+func TestCertManager_GetTLSConfig_WhenHostHasTLSPolicy_ThenServesItsOwnConfig(t *testing.T) {
+	// Arrange
+	certMgr := NewCertManager(&autocert.Manager{})
+	certMgr.SetDefaultTLSPolicy(&TLSPolicy{Preset: TLSPresetIntermediate})
+	certMgr.SetTLSPolicy("modern.example.com", &TLSPolicy{Preset: TLSPresetModern})
+	certMgr.SetTLSPolicy("other.example.com", nil)
+
+	// Act
+	config := certMgr.GetTLSConfig()
+
+	// Assert
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	hostConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "modern.example.com"})
+	require.NoError(t, err)
+	require.NotNil(t, hostConfig)
+	assert.Equal(t, uint16(tls.VersionTLS13), hostConfig.MinVersion)
+	otherConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	require.NoError(t, err)
+	assert.Nil(t, otherConfig)
+}
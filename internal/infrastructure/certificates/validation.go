@@ -0,0 +1,101 @@
+package infrastructure
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CheckServerCertificate loads the certificate and checks that it can be served for serverName:
+// the key matches the certificate, the certificate is currently valid, the chain reaches a self
+// signed certificate, one of the CAs or a system root, and the certificate covers the server name.
+// The server name is not checked when it is empty. The additional key pairs are checked the same
+// way, with the same CAs.
+func (certificateDefs *CertificateDefs) CheckServerCertificate(serverName string) error {
+	if err := checkServerKeyPair(certificateDefs, certificateDefs.CaPem, serverName); err != nil {
+		return err
+	}
+	for i, keyPair := range certificateDefs.KeyPairs {
+		if err := checkServerKeyPair(keyPair, certificateDefs.CaPem, serverName); err != nil {
+			return fmt.Errorf("key_pairs[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func checkServerKeyPair(keyPair *CertificateDefs, caPems []string, serverName string) error {
+	certificate, err := keyPair.LoadKeyPair()
+	if err != nil {
+		return err
+	}
+	chain := make([]*x509.Certificate, 0, len(certificate.Certificate))
+	for _, der := range certificate.Certificate {
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, parsed)
+	}
+	if err := checkChain(chain, caPems); err != nil {
+		return err
+	}
+
+	leaf := chain[0]
+	if serverName != "" && leaf.VerifyHostname(serverName) != nil {
+		if len(leaf.DNSNames) == 0 {
+			return fmt.Errorf("certificate does not cover '%s', it has no DNS names", serverName)
+		}
+		return fmt.Errorf("certificate does not cover '%s', it covers %s", serverName, strings.Join(leaf.DNSNames, ", "))
+	}
+	return nil
+}
+
+// checkChain checks that each certificate of the chain is issued by the next one and that the
+// last one is self signed or issued by one of the CAs or a system root.
+func checkChain(chain []*x509.Certificate, caPems []string) error {
+	for i := 0; i < len(chain)-1; i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return fmt.Errorf("certificate chain is broken: '%s' is not issued by '%s'", certificateName(chain[i]), certificateName(chain[i+1]))
+		}
+	}
+
+	roots, err := getCertPool(caPems...)
+	if err != nil {
+		return err
+	}
+	last := chain[len(chain)-1]
+	if isSelfSigned(last) {
+		roots.AddCert(last)
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return fmt.Errorf("certificate chain is incomplete: the issuer '%s' of '%s' is not in the certificate file, the CAs or the system roots", last.Issuer.String(), certificateName(last))
+	}
+	if err != nil {
+		return fmt.Errorf("certificate chain is invalid: %w", err)
+	}
+	return nil
+}
+
+func isSelfSigned(certificate *x509.Certificate) bool {
+	return bytes.Equal(certificate.RawIssuer, certificate.RawSubject) &&
+		certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature) == nil
+}
+
+func certificateName(certificate *x509.Certificate) string {
+	if certificate.Subject.CommonName != "" {
+		return certificate.Subject.CommonName
+	}
+	return certificate.Subject.String()
+}
@@ -0,0 +1,85 @@
+package infrastructure
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateDefs_CheckServerCertificate_WhenChainReachesCA_ThenSucceeds(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_KEY_PASSWORD", "changeit")
+	bundle := &CertificateDefs{PKCS12: "testdata/bundle.p12", PasswordEnv: "TEST_KEY_PASSWORD"}
+	withCA := &CertificateDefs{PublicKey: "testdata/cert.pem", PrivateKey: "testdata/key-encrypted.pem", PasswordEnv: "TEST_KEY_PASSWORD", CaPem: []string{"testdata/ca.pem"}}
+
+	// Act
+	bundleErr := bundle.CheckServerCertificate("example.com")
+	withCAErr := withCA.CheckServerCertificate("example.com")
+
+	// Assert
+	assert.NoError(t, bundleErr)
+	assert.NoError(t, withCAErr)
+}
+
+func TestCertificateDefs_CheckServerCertificate_WhenIssuerIsMissing_ThenReturnsError(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_KEY_PASSWORD", "changeit")
+	certDefs := &CertificateDefs{PublicKey: "testdata/cert.pem", PrivateKey: "testdata/key-encrypted.pem", PasswordEnv: "TEST_KEY_PASSWORD"}
+
+	// Act
+	err := certDefs.CheckServerCertificate("example.com")
+
+	// Assert
+	assert.EqualError(t, err, "certificate chain is incomplete: the issuer 'CN=Test Key Formats CA' of 'example.com' is not in the certificate file, the CAs or the system roots")
+}
+
+func TestCertificateDefs_CheckServerCertificate_WhenChainIsBroken_ThenReturnsError(t *testing.T) {
+	// Arrange
+	t.Setenv("TEST_KEY_PASSWORD", "changeit")
+	otherCert, _ := writeTestKeyPair(t, t.TempDir(), "other.example.com", time.Now().Add(time.Hour))
+	leafPEM, err := os.ReadFile("testdata/cert.pem")
+	require.NoError(t, err)
+	otherPEM, err := os.ReadFile(otherCert)
+	require.NoError(t, err)
+	certDefs := &CertificateDefs{PublicKey: string(leafPEM) + string(otherPEM), PrivateKey: "testdata/key-encrypted.pem", PasswordEnv: "TEST_KEY_PASSWORD"}
+
+	// Act
+	err = certDefs.CheckServerCertificate("example.com")
+
+	// Assert
+	assert.EqualError(t, err, "certificate chain is broken: 'example.com' is not issued by 'other.example.com'")
+}
+
+func TestCertificateDefs_CheckServerCertificate_WhenHostIsNotCovered_ThenReturnsError(t *testing.T) {
+	// Arrange
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(time.Hour))
+	certDefs := &CertificateDefs{PublicKey: certFile, PrivateKey: keyFile}
+
+	// Act
+	coveredErr := certDefs.CheckServerCertificate("example.com")
+	err := certDefs.CheckServerCertificate("www.example.com")
+
+	// Assert
+	assert.NoError(t, coveredErr)
+	assert.EqualError(t, err, "certificate does not cover 'www.example.com', it covers example.com")
+}
+
+func TestCertificateDefs_CheckServerCertificate_WhenKeyDoesNotMatchOrIsExpired_ThenReturnsError(t *testing.T) {
+	// Arrange
+	certFile, _ := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(time.Hour))
+	_, otherKeyFile := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(time.Hour))
+	expiredCert, expiredKey := writeTestKeyPair(t, t.TempDir(), "example.com", time.Now().Add(-time.Hour))
+	mismatched := &CertificateDefs{PublicKey: certFile, PrivateKey: otherKeyFile}
+	expired := &CertificateDefs{PublicKey: expiredCert, PrivateKey: expiredKey}
+
+	// Act
+	mismatchedErr := mismatched.CheckServerCertificate("example.com")
+	expiredErr := expired.CheckServerCertificate("example.com")
+
+	// Assert
+	assert.EqualError(t, mismatchedErr, "tls: private key does not match public key")
+	assert.ErrorContains(t, expiredErr, "certificate expired at")
+}
@@ -0,0 +1,88 @@
+package infrastructure
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileWatcher is the object responsible to poll a set of files and report the ones
+// whose modification time or size changed. Polling also detects files replaced by a
+// rename or a symbolic link swap, as renewal tools and Kubernetes secrets do.
+type FileWatcher struct {
+	interval time.Duration
+	onChange func(changed []string)
+	states   map[string]fileState
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+// NewFileWatcher returns a new object of FileWatcher type, taking the current state of the files.
+func NewFileWatcher(files []string, interval time.Duration, onChange func(changed []string)) *FileWatcher {
+	watcher := &FileWatcher{
+		interval: interval,
+		onChange: onChange,
+		states:   make(map[string]fileState, len(files)),
+		stop:     make(chan struct{}),
+	}
+	for _, file := range files {
+		watcher.states[file] = statFile(file)
+	}
+	return watcher
+}
+
+// Start polls the files in the background until Stop is called.
+func (watcher *FileWatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(watcher.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watcher.stop:
+				return
+			case <-ticker.C:
+				if changed := watcher.Poll(); len(changed) > 0 {
+					watcher.onChange(changed)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the polling.
+func (watcher *FileWatcher) Stop() {
+	watcher.stopOnce.Do(func() { close(watcher.stop) })
+}
+
+// Poll returns the files that changed since the previous poll, sorted by name. Files that
+// disappear are not reported, so a file being replaced is only reloaded once it is back.
+func (watcher *FileWatcher) Poll() []string {
+	changed := make([]string, 0)
+	for file, previous := range watcher.states {
+		current := statFile(file)
+		if current == previous {
+			continue
+		}
+		watcher.states[file] = current
+		if current.exists {
+			changed = append(changed, file)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func statFile(file string) fileState {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
@@ -0,0 +1,143 @@
+package clientcert
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ForwardFormat is the way the client certificate is sent to the backend.
+type ForwardFormat string
+
+const (
+	// ForwardXFCC sends an Envoy compatible X-Forwarded-Client-Cert header.
+	ForwardXFCC ForwardFormat = "xfcc"
+	// ForwardHeaders sends one X-Client-Cert-* header per certificate detail.
+	ForwardHeaders ForwardFormat = "headers"
+)
+
+// XFCCHeader is the header used by the xfcc format.
+const XFCCHeader = "X-Forwarded-Client-Cert"
+
+// headerPrefix is the prefix of the headers used by the headers format.
+const headerPrefix = "X-Client-Cert-"
+
+// LegacyHeader is sent with the public key of the client for the deprecated need_pk_from_client option.
+const LegacyHeader = "X-Forwarded-PrivateKey"
+
+// ForwardConfig defines how the client certificate is forwarded to the backend.
+type ForwardConfig struct {
+	Format ForwardFormat `json:"format"`
+}
+
+// Validate checks that the format is known.
+func (config *ForwardConfig) Validate() error {
+	switch config.Format {
+	case ForwardXFCC, ForwardHeaders:
+		return nil
+	default:
+		return fmt.Errorf("unknown format '%s' (expected xfcc or headers)", config.Format)
+	}
+}
+
+// StripHeaders removes every client certificate header from the header, so clients can not
+// forge them.
+func StripHeaders(header http.Header) {
+	header.Del(XFCCHeader)
+	header.Del(LegacyHeader)
+	for name := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), headerPrefix) {
+			delete(header, name)
+		}
+	}
+}
+
+// Apply removes the client supplied certificate headers and, when the chain is not empty,
+// sets the headers describing its leaf certificate.
+func (config *ForwardConfig) Apply(header http.Header, chain []*x509.Certificate) {
+	StripHeaders(header)
+	if config == nil || len(chain) == 0 {
+		return
+	}
+
+	switch config.Format {
+	case ForwardXFCC:
+		header.Set(XFCCHeader, xfccElement(chain))
+	case ForwardHeaders:
+		setDetailHeaders(header, chain)
+	}
+}
+
+// SetLegacyHeader sets the header of the deprecated need_pk_from_client option with the URL
+// encoded public key of the certificate, as previous versions did.
+func SetLegacyHeader(header http.Header, certificate *x509.Certificate) {
+	header.Set(LegacyHeader, base64.URLEncoding.EncodeToString(certificate.RawSubjectPublicKeyInfo))
+}
+
+// xfccElement builds the element of the X-Forwarded-Client-Cert header for the chain, with
+// the Hash, Cert, Chain, Subject, URI and DNS keys.
+func xfccElement(chain []*x509.Certificate) string {
+	leaf := chain[0]
+	pairs := []string{
+		"Hash=" + Fingerprint(leaf),
+		"Cert=" + escapePEM(chain[:1]),
+		"Chain=" + escapePEM(chain),
+		"Subject=" + quoteXFCC(leaf.Subject.String()),
+	}
+	for _, uri := range leaf.URIs {
+		pairs = append(pairs, "URI="+quoteXFCC(uri.String()))
+	}
+	for _, dnsName := range leaf.DNSNames {
+		pairs = append(pairs, "DNS="+quoteXFCC(dnsName))
+	}
+	return strings.Join(pairs, ";")
+}
+
+func setDetailHeaders(header http.Header, chain []*x509.Certificate) {
+	leaf := chain[0]
+	uris := make([]string, 0, len(leaf.URIs))
+	for _, uri := range leaf.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	details := map[string]string{
+		"Subject":     leaf.Subject.String(),
+		"Issuer":      leaf.Issuer.String(),
+		"Serial":      hex.EncodeToString(leaf.SerialNumber.Bytes()),
+		"Not-Before":  leaf.NotBefore.UTC().Format(time.RFC3339),
+		"Not-After":   leaf.NotAfter.UTC().Format(time.RFC3339),
+		"Fingerprint": Fingerprint(leaf),
+		"SAN-DNS":     strings.Join(leaf.DNSNames, ","),
+		"SAN-URI":     strings.Join(uris, ","),
+		"SAN-Email":   strings.Join(leaf.EmailAddresses, ","),
+		"Chain":       escapePEM(chain),
+	}
+	for name, value := range details {
+		if value != "" {
+			header.Set(headerPrefix+name, value)
+		}
+	}
+}
+
+// escapePEM encodes the chain as URL encoded PEM, so it fits in a single header value.
+func escapePEM(chain []*x509.Certificate) string {
+	var builder strings.Builder
+	for _, certificate := range chain {
+		_ = pem.Encode(&builder, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	}
+	return strings.ReplaceAll(url.QueryEscape(builder.String()), "+", "%20")
+}
+
+// quoteXFCC quotes the value when it contains characters with meaning in the header.
+func quoteXFCC(value string) string {
+	if !strings.ContainsAny(value, ",;=\"") {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
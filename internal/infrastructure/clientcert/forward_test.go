@@ -0,0 +1,99 @@
+package clientcert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newForwardedCertificate() *x509.Certificate {
+	uri, _ := url.Parse("spiffe://example.org/ns/default/sa/web")
+	return &x509.Certificate{
+		Raw:          []byte("leaf"),
+		SerialNumber: big.NewInt(0x1a2b),
+		Subject:      pkix.Name{CommonName: "web", Organization: []string{"Example, Inc"}},
+		Issuer:       pkix.Name{CommonName: "Example CA"},
+		NotBefore:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		DNSNames:     []string{"web.example.org"},
+		URIs:         []*url.URL{uri},
+	}
+}
+
+func TestForwardConfig_Apply_WhenFormatIsXFCC_ThenSetsEnvoyHeader(t *testing.T) {
+	// Arrange
+	config := &ForwardConfig{Format: ForwardXFCC}
+	header := http.Header{}
+	certificate := newForwardedCertificate()
+
+	// Act
+	config.Apply(header, []*x509.Certificate{certificate})
+
+	// Assert
+	xfcc := header.Get(XFCCHeader)
+	assert.True(t, strings.HasPrefix(xfcc, "Hash="+Fingerprint(certificate)+";Cert=-----BEGIN%20CERTIFICATE-----%0A"))
+	assert.Contains(t, xfcc, `;Subject="CN=web,O=Example\, Inc"`)
+	assert.Contains(t, xfcc, ";URI=spiffe://example.org/ns/default/sa/web;DNS=web.example.org")
+}
+
+func TestForwardConfig_Apply_WhenFormatIsHeaders_ThenSetsDetailHeaders(t *testing.T) {
+	// Arrange
+	config := &ForwardConfig{Format: ForwardHeaders}
+	header := http.Header{}
+
+	// Act
+	config.Apply(header, []*x509.Certificate{newForwardedCertificate()})
+
+	// Assert
+	assert.Equal(t, "CN=Example CA", header.Get("X-Client-Cert-Issuer"))
+	assert.Equal(t, "1a2b", header.Get("X-Client-Cert-Serial"))
+	assert.Equal(t, "2027-01-01T00:00:00Z", header.Get("X-Client-Cert-Not-After"))
+	assert.Equal(t, "web.example.org", header.Get("X-Client-Cert-SAN-DNS"))
+	assert.Empty(t, header.Get("X-Client-Cert-SAN-Email"))
+	assert.NotEmpty(t, header.Get("X-Client-Cert-Chain"))
+}
+
+func TestForwardConfig_Apply_WhenClientSentCertificateHeaders_ThenStripsThem(t *testing.T) {
+	// Arrange
+	var config *ForwardConfig
+	header := http.Header{
+		"X-Forwarded-Client-Cert": {"Hash=forged"},
+		"X-Client-Cert-Subject":   {"CN=admin"},
+		"X-Forwarded-Privatekey":  {"forged"},
+		"X-Other":                 {"kept"},
+	}
+
+	// Act
+	config.Apply(header, []*x509.Certificate{newForwardedCertificate()})
+
+	// Assert
+	assert.Equal(t, http.Header{"X-Other": {"kept"}}, header)
+}
+
+func TestForwardConfig_Validate_WhenFormatIsUnknown_ThenReturnsError(t *testing.T) {
+	// Act
+	err := (&ForwardConfig{Format: "pem"}).Validate()
+
+	// Assert
+	assert.EqualError(t, err, "unknown format 'pem' (expected xfcc or headers)")
+}
+
+func TestSetLegacyHeader_WhenCalled_ThenSetsURLEncodedPublicKey(t *testing.T) {
+	// Arrange
+	header := http.Header{}
+	certificate := newForwardedCertificate()
+	certificate.RawSubjectPublicKeyInfo = []byte{0xfb, 0xff, 0x01}
+
+	// Act
+	SetLegacyHeader(header, certificate)
+
+	// Assert
+	assert.Equal(t, "-_8B", header.Get(LegacyHeader))
+}
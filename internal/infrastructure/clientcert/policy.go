@@ -0,0 +1,146 @@
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Policy is the compiled form of Rules.
+type Policy struct {
+	host  ruleSet
+	paths []ruleSet
+}
+
+type ruleSet struct {
+	path  string
+	allow []*Match
+	deny  []*Match
+}
+
+// Decision is the result of evaluating a client certificate against a Policy.
+type Decision struct {
+	// Allowed indicates that the certificate may access the path.
+	Allowed bool
+	// Rule describes the rule that decided, for audit purposes.
+	Rule string
+}
+
+// Evaluate checks the certificate against the rules that apply to the path. The host
+// rules and the rules of the most specific matching path must both accept it. A nil
+// certificate is only accepted by rules without allow entries.
+func (policy *Policy) Evaluate(certificate *x509.Certificate, requestPath string) Decision {
+	identity := newIdentity(certificate)
+	if decision := policy.host.evaluate(identity, "host"); !decision.Allowed {
+		return decision
+	}
+	for _, set := range policy.paths {
+		if hasPathPrefix(requestPath, set.path) {
+			return set.evaluate(identity, "path '"+set.path+"'")
+		}
+	}
+	return Decision{Allowed: true, Rule: "host"}
+}
+
+// RequiresCertificate indicates if a request to the path can only be accepted with a certificate.
+func (policy *Policy) RequiresCertificate(requestPath string) bool {
+	if len(policy.host.allow) > 0 {
+		return true
+	}
+	for _, set := range policy.paths {
+		if hasPathPrefix(requestPath, set.path) {
+			return len(set.allow) > 0
+		}
+	}
+	return false
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate in hexadecimal.
+func Fingerprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (set ruleSet) evaluate(identity *identity, scope string) Decision {
+	if identity != nil {
+		for i, match := range set.deny {
+			if identity.matches(match) {
+				return Decision{Allowed: false, Rule: fmt.Sprintf("%s deny[%d]", scope, i)}
+			}
+		}
+	}
+	if len(set.allow) == 0 {
+		return Decision{Allowed: true, Rule: scope}
+	}
+	if identity != nil {
+		for i, match := range set.allow {
+			if identity.matches(match) {
+				return Decision{Allowed: true, Rule: fmt.Sprintf("%s allow[%d]", scope, i)}
+			}
+		}
+	}
+	return Decision{Allowed: false, Rule: scope + " no allow rule matched"}
+}
+
+type identity struct {
+	commonName          string
+	organizationalUnits []string
+	dnsNames            []string
+	uris                []string
+	emails              []string
+	fingerprint         string
+}
+
+func newIdentity(certificate *x509.Certificate) *identity {
+	if certificate == nil {
+		return nil
+	}
+	uris := make([]string, 0, len(certificate.URIs))
+	for _, uri := range certificate.URIs {
+		uris = append(uris, uri.String())
+	}
+	return &identity{
+		commonName:          certificate.Subject.CommonName,
+		organizationalUnits: certificate.Subject.OrganizationalUnit,
+		dnsNames:            certificate.DNSNames,
+		uris:                uris,
+		emails:              certificate.EmailAddresses,
+		fingerprint:         Fingerprint(certificate),
+	}
+}
+
+func (identity *identity) matches(match *Match) bool {
+	return (match.CommonName == "" || matchesAny(match.CommonName, identity.commonName)) &&
+		(match.OrganizationalUnit == "" || matchesAny(match.OrganizationalUnit, identity.organizationalUnits...)) &&
+		(match.DNSName == "" || matchesAny(strings.ToLower(match.DNSName), lower(identity.dnsNames)...)) &&
+		(match.URI == "" || matchesAny(match.URI, identity.uris...)) &&
+		(match.Email == "" || matchesAny(strings.ToLower(match.Email), lower(identity.emails)...)) &&
+		(match.Fingerprint == "" || match.Fingerprint == identity.fingerprint)
+}
+
+func matchesAny(pattern string, values ...string) bool {
+	for _, value := range values {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func lower(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, value := range values {
+		lowered[i] = strings.ToLower(value)
+	}
+	return lowered
+}
+
+func hasPathPrefix(requestPath string, prefix string) bool {
+	if prefix == "/" || requestPath == prefix {
+		return true
+	}
+	return strings.HasPrefix(requestPath, strings.TrimSuffix(prefix, "/")+"/")
+}
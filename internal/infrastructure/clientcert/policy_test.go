@@ -0,0 +1,101 @@
+package clientcert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCertificate(commonName string, organizationalUnit string, dnsName string) *x509.Certificate {
+	uri, _ := url.Parse("spiffe://example.org/" + commonName)
+	return &x509.Certificate{
+		Raw:            []byte(commonName + organizationalUnit + dnsName),
+		Subject:        pkix.Name{CommonName: commonName, OrganizationalUnit: []string{organizationalUnit}},
+		DNSNames:       []string{dnsName},
+		URIs:           []*url.URL{uri},
+		EmailAddresses: []string{commonName + "@Example.org"},
+	}
+}
+
+func TestPolicy_Evaluate_WhenRulesApply_ThenReturnsDecision(t *testing.T) {
+	alice := newCertificate("alice", "ops", "alice.clients.example.org")
+	bob := newCertificate("bob", "dev", "bob.clients.example.org")
+	rules := &Rules{
+		Allow: []*Match{{DNSName: "*.clients.example.org"}},
+		Deny:  []*Match{{Fingerprint: Fingerprint(bob)}},
+		Paths: []*PathRules{
+			{Path: "/admin", Allow: []*Match{{OrganizationalUnit: "ops", Email: "*@example.org"}}},
+			{Path: "/admin/public"},
+		},
+	}
+	tests := []struct {
+		name        string
+		certificate *x509.Certificate
+		path        string
+		allowed     bool
+		rule        string
+	}{
+		{name: "host allow", certificate: alice, path: "/", allowed: true, rule: "host"},
+		{name: "host deny wins", certificate: bob, path: "/", allowed: false, rule: "host deny[0]"},
+		{name: "path allow", certificate: alice, path: "/admin/users", allowed: true, rule: "path '/admin' allow[0]"},
+		{name: "path without match", certificate: newCertificate("carol", "dev", "carol.clients.example.org"), path: "/admin", allowed: false, rule: "path '/admin' no allow rule matched"},
+		{name: "most specific path", certificate: newCertificate("carol", "dev", "carol.clients.example.org"), path: "/admin/public/docs", allowed: true, rule: "path '/admin/public'"},
+		{name: "no certificate", certificate: nil, path: "/", allowed: false, rule: "host no allow rule matched"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			policy, err := rules.Compile()
+			require.NoError(t, err)
+
+			// Act
+			decision := policy.Evaluate(tt.certificate, tt.path)
+
+			// Assert
+			assert.Equal(t, tt.allowed, decision.Allowed)
+			assert.Equal(t, tt.rule, decision.Rule)
+		})
+	}
+}
+
+func TestPolicy_RequiresCertificate_WhenOnlyPathHasAllowRules_ThenDependsOnPath(t *testing.T) {
+	// Arrange
+	policy, err := (&Rules{Paths: []*PathRules{{Path: "/admin", Allow: []*Match{{CommonName: "admin"}}}}}).Compile()
+	require.NoError(t, err)
+
+	// Act
+	admin := policy.RequiresCertificate("/admin/users")
+	public := policy.RequiresCertificate("/public")
+
+	// Assert
+	assert.True(t, admin)
+	assert.False(t, public)
+}
+
+func TestRules_Validate_WhenMatchIsInvalid_ThenReturnsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    *Rules
+		expected string
+	}{
+		{name: "empty match", rules: &Rules{Allow: []*Match{{}}}, expected: "allow[0]: at least one field is required"},
+		{name: "bad pattern", rules: &Rules{Deny: []*Match{{CommonName: "["}}}, expected: "deny[0].common_name: invalid pattern '['"},
+		{name: "bad fingerprint", rules: &Rules{Allow: []*Match{{Fingerprint: "abc"}}}, expected: "allow[0].fingerprint: must be a SHA-256 hexadecimal digest"},
+		{name: "relative path", rules: &Rules{Paths: []*PathRules{{Path: "admin"}}}, expected: "paths[0]: 'path' must start with '/'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			err := tt.rules.Validate()
+
+			// Assert
+			assert.EqualError(t, err, tt.expected)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package clientcert
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Rules are the client certificate access rules of a virtual host. Deny entries
+// win over allow entries, and when allow entries exist only matching certificates
+// are accepted.
+type Rules struct {
+	Allow []*Match     `json:"allow,omitempty"`
+	Deny  []*Match     `json:"deny,omitempty"`
+	Paths []*PathRules `json:"paths,omitempty"`
+}
+
+// PathRules are additional client certificate rules for requests under a path prefix.
+type PathRules struct {
+	Path  string   `json:"path"`
+	Allow []*Match `json:"allow,omitempty"`
+	Deny  []*Match `json:"deny,omitempty"`
+}
+
+// Match selects certificates by their identity. Every field set must match. Names
+// accept shell patterns such as '*.example.com'; the fingerprint is the SHA-256 of
+// the certificate in hexadecimal, with or without colons.
+type Match struct {
+	CommonName         string `json:"common_name,omitempty"`
+	OrganizationalUnit string `json:"organizational_unit,omitempty"`
+	DNSName            string `json:"dns_name,omitempty"`
+	URI                string `json:"uri,omitempty"`
+	Email              string `json:"email,omitempty"`
+	Fingerprint        string `json:"fingerprint,omitempty"`
+}
+
+// IsEmpty indicates that the rules do not restrict any certificate.
+func (rules *Rules) IsEmpty() bool {
+	return rules == nil || (len(rules.Allow) == 0 && len(rules.Deny) == 0 && len(rules.Paths) == 0)
+}
+
+// Validate checks that all the matches are well formed.
+func (rules *Rules) Validate() error {
+	_, err := rules.Compile()
+	return err
+}
+
+// Compile builds the Policy for the rules.
+func (rules *Rules) Compile() (*Policy, error) {
+	host, err := compileSet(rules.Allow, rules.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{host: host}
+	seen := make(map[string]bool)
+	for i, pathRules := range rules.Paths {
+		if pathRules == nil || !strings.HasPrefix(pathRules.Path, "/") {
+			return nil, fmt.Errorf("paths[%d]: 'path' must start with '/'", i)
+		}
+		if seen[pathRules.Path] {
+			return nil, fmt.Errorf("paths[%d]: path '%s' is duplicated", i, pathRules.Path)
+		}
+		seen[pathRules.Path] = true
+		set, err := compileSet(pathRules.Allow, pathRules.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("paths[%d]: %w", i, err)
+		}
+		set.path = pathRules.Path
+		policy.paths = append(policy.paths, set)
+	}
+
+	// The most specific path is checked first.
+	sort.SliceStable(policy.paths, func(i, j int) bool {
+		return len(policy.paths[i].path) > len(policy.paths[j].path)
+	})
+	return policy, nil
+}
+
+func compileSet(allow []*Match, deny []*Match) (ruleSet, error) {
+	allowed, err := compileMatches(allow)
+	if err != nil {
+		return ruleSet{}, fmt.Errorf("allow%w", err)
+	}
+	denied, err := compileMatches(deny)
+	if err != nil {
+		return ruleSet{}, fmt.Errorf("deny%w", err)
+	}
+	return ruleSet{allow: allowed, deny: denied}, nil
+}
+
+func compileMatches(matches []*Match) ([]*Match, error) {
+	compiled := make([]*Match, 0, len(matches))
+	for i, match := range matches {
+		if match == nil || *match == (Match{}) {
+			return nil, fmt.Errorf("[%d]: at least one field is required", i)
+		}
+		patterns := [][2]string{
+			{"common_name", match.CommonName},
+			{"organizational_unit", match.OrganizationalUnit},
+			{"dns_name", match.DNSName},
+			{"uri", match.URI},
+			{"email", match.Email},
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern[1], ""); err != nil {
+				return nil, fmt.Errorf("[%d].%s: invalid pattern '%s'", i, pattern[0], pattern[1])
+			}
+		}
+		normalized := *match
+		if match.Fingerprint != "" {
+			fingerprint, err := normalizeFingerprint(match.Fingerprint)
+			if err != nil {
+				return nil, fmt.Errorf("[%d].fingerprint: %w", i, err)
+			}
+			normalized.Fingerprint = fingerprint
+		}
+		compiled = append(compiled, &normalized)
+	}
+	return compiled, nil
+}
+
+func normalizeFingerprint(fingerprint string) (string, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != 32 {
+		return "", errors.New("must be a SHA-256 hexadecimal digest")
+	}
+	return normalized, nil
+}
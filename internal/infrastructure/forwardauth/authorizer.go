@@ -0,0 +1,212 @@
+package forwardauth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hopHeaders are not sent to the authorization service nor copied from its answer.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// Logger is the logging contract used by the authorizer.
+type Logger interface {
+	Error(msg string)
+}
+
+// Authorizer is the object responsible to ask an external authorization
+// service whether a request may be proxied, in the manner of nginx
+// auth_request or Traefik ForwardAuth.
+type Authorizer struct {
+	config *Config
+	logger Logger
+	client *http.Client
+	cache  *decisionCache
+	now    func() time.Time
+}
+
+// NewAuthorizer returns a new object of Authorizer type. When tlsConfig is not nil it
+// is used for the calls to the authorization service.
+func NewAuthorizer(config *Config, tlsConfig *tls.Config, logger Logger) (*Authorizer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Authorizer{
+		config: config,
+		logger: logger,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.timeout(),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache: newDecisionCache(),
+		now:   time.Now,
+	}, nil
+}
+
+// Authorize asks the authorization service about the request. When the request is
+// allowed the headers to add to the upstream request are returned; otherwise the
+// answer of the authorization service is written to rw and false is returned.
+func (authorizer *Authorizer) Authorize(rw http.ResponseWriter, req *http.Request) (http.Header, bool) {
+	authReq, err := authorizer.newAuthRequest(req)
+	if err != nil {
+		authorizer.logger.Error(fmt.Sprintf("forward auth: failed to create request: %v", err))
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	ttl := authorizer.config.cacheTTL()
+	key := ""
+	var result *decision
+	if ttl > 0 {
+		key = cacheKey(authReq)
+		result = authorizer.cache.get(key, authorizer.now())
+	}
+
+	if result == nil {
+		result, err = authorizer.call(authReq)
+		if err != nil {
+			authorizer.logger.Error(fmt.Sprintf("forward auth: %v", err))
+			http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+			return nil, false
+		}
+		if ttl > 0 && isCacheable(result.status) {
+			result.expiresAt = authorizer.now().Add(ttl)
+			authorizer.cache.put(key, result, authorizer.now())
+		}
+	}
+
+	if result.status >= 200 && result.status < 300 {
+		upstream := make(http.Header)
+		for _, name := range authorizer.config.AuthResponseHeaders {
+			if values := result.header.Values(name); len(values) > 0 {
+				upstream[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		return upstream, true
+	}
+
+	for name, values := range withoutHopHeaders(result.header) {
+		rw.Header()[name] = values
+	}
+	rw.WriteHeader(result.status)
+	_, _ = rw.Write(result.body)
+	return nil, false
+}
+
+// ApplyHeaders sets the headers returned by Authorize on the upstream request,
+// removing any client supplied copy of the configured response headers.
+func (authorizer *Authorizer) ApplyHeaders(header http.Header, upstream http.Header) {
+	for _, name := range authorizer.config.AuthResponseHeaders {
+		header.Del(name)
+	}
+	for name, values := range upstream {
+		header[name] = values
+	}
+}
+
+func (authorizer *Authorizer) newAuthRequest(req *http.Request) (*http.Request, error) {
+	authReq, err := http.NewRequest(req.Method, authorizer.config.Address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(authorizer.config.AuthRequestHeaders) > 0 {
+		for _, name := range authorizer.config.AuthRequestHeaders {
+			if values := req.Header.Values(name); len(values) > 0 {
+				authReq.Header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	} else {
+		authReq.Header = req.Header.Clone()
+		for _, name := range hopHeaders {
+			authReq.Header.Del(name)
+		}
+	}
+
+	proto := "https"
+	if req.TLS == nil {
+		proto = "http"
+	}
+	authReq.Header.Set("X-Forwarded-Method", req.Method)
+	authReq.Header.Set("X-Forwarded-Proto", proto)
+	authReq.Header.Set("X-Forwarded-Host", req.Host)
+	authReq.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	authReq.Header.Set("X-Original-Uri", req.URL.RequestURI())
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		authReq.Header.Set("X-Forwarded-For", ip)
+	}
+	return authReq, nil
+}
+
+func (authorizer *Authorizer) call(authReq *http.Request) (*decision, error) {
+	resp, err := authorizer.client.Do(authReq)
+	if err != nil {
+		return nil, fmt.Errorf("authorization service unavailable: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("authorization service returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	return &decision{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// withoutHopHeaders returns a copy of header without the hop-by-hop headers, including
+// the ones listed in Connection, as httputil.ReverseProxy does.
+func withoutHopHeaders(header http.Header) http.Header {
+	result := header.Clone()
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				result.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		result.Del(name)
+	}
+	return result
+}
+
+func isCacheable(status int) bool {
+	return (status >= 200 && status < 300) || status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+func cacheKey(authReq *http.Request) string {
+	names := make([]string, 0, len(authReq.Header))
+	for name := range authReq.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	_, _ = io.WriteString(hash, authReq.Method+"\n")
+	for _, name := range names {
+		_, _ = io.WriteString(hash, name+":"+strings.Join(authReq.Header.Values(name), ",")+"\n")
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
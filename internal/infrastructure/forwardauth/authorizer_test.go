@@ -0,0 +1,151 @@
+package forwardauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuthorizer(t *testing.T, config *Config) *Authorizer {
+	logger := &mocks.MockLogger{}
+	logger.On("Error", mock.Anything).Maybe()
+	authorizer, err := NewAuthorizer(config, nil, logger)
+	require.NoError(t, err)
+	return authorizer
+}
+
+func TestAuthorizer_Authorize_WhenServiceAllows_ThenReturnsSelectedHeaders(t *testing.T) {
+	// Arrange
+	var received *http.Request
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.Header().Set("X-Auth-User", "alice")
+		w.Header().Set("X-Internal", "secret")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer authService.Close()
+	authorizer := newTestAuthorizer(t, &Config{Address: authService.URL + "/verify", AuthResponseHeaders: []string{"X-Auth-User"}})
+	req := httptest.NewRequest(http.MethodDelete, "https://app.example.com/items/1?force=true", nil)
+	req.Header.Set("Authorization", "Bearer token")
+
+	// Act
+	upstream, allowed := authorizer.Authorize(httptest.NewRecorder(), req)
+
+	// Assert
+	assert.True(t, allowed)
+	assert.Equal(t, "alice", upstream.Get("X-Auth-User"))
+	assert.Empty(t, upstream.Get("X-Internal"))
+	require.NotNil(t, received)
+	assert.Equal(t, http.MethodDelete, received.Method)
+	assert.Equal(t, "Bearer token", received.Header.Get("Authorization"))
+	assert.Equal(t, "/items/1?force=true", received.Header.Get("X-Forwarded-Uri"))
+	assert.Equal(t, "app.example.com", received.Header.Get("X-Forwarded-Host"))
+}
+
+func TestAuthorizer_Authorize_WhenServiceDenies_ThenWritesAuthResponse(t *testing.T) {
+	// Arrange
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="app"`)
+		http.Error(w, "token expired", http.StatusUnauthorized)
+	}))
+	defer authService.Close()
+	authorizer := newTestAuthorizer(t, &Config{Address: authService.URL})
+	rw := httptest.NewRecorder()
+
+	// Act
+	_, allowed := authorizer.Authorize(rw, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, `Bearer realm="app"`, rw.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, rw.Body.String(), "token expired")
+}
+
+func TestAuthorizer_Authorize_WhenDenialHasHopByHopHeaders_ThenDoesNotCopyThem(t *testing.T) {
+	// Arrange
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="app"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer authService.Close()
+	authorizer := newTestAuthorizer(t, &Config{Address: authService.URL})
+	rw := httptest.NewRecorder()
+
+	// Act
+	_, allowed := authorizer.Authorize(rw, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, `Bearer realm="app"`, rw.Header().Get("WWW-Authenticate"))
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Upgrade", "Trailer", "Transfer-Encoding"} {
+		assert.Empty(t, rw.Header().Values(name), name)
+	}
+}
+
+func TestAuthorizer_Authorize_WhenServiceFails_ThenReturnsBadGateway(t *testing.T) {
+	// Arrange
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer authService.Close()
+	authorizer := newTestAuthorizer(t, &Config{Address: authService.URL})
+	rw := httptest.NewRecorder()
+
+	// Act
+	_, allowed := authorizer.Authorize(rw, httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil))
+
+	// Assert
+	assert.False(t, allowed)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestAuthorizer_Authorize_WhenCacheTTLSet_ThenReusesDecision(t *testing.T) {
+	// Arrange
+	var calls int32
+	authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authService.Close()
+	authorizer := newTestAuthorizer(t, &Config{Address: authService.URL, CacheTTL: "30s"})
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.com/", nil)
+		req.Header.Set("Authorization", token)
+		return req
+	}
+
+	// Act
+	_, first := authorizer.Authorize(httptest.NewRecorder(), newRequest("a"))
+	_, second := authorizer.Authorize(httptest.NewRecorder(), newRequest("a"))
+	_, third := authorizer.Authorize(httptest.NewRecorder(), newRequest("b"))
+
+	// Assert
+	assert.True(t, first && second && third)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestAuthorizer_ApplyHeaders_WhenClientSentAuthHeader_ThenReplacesIt(t *testing.T) {
+	// Arrange
+	authorizer := newTestAuthorizer(t, &Config{Address: "http://auth", AuthResponseHeaders: []string{"X-Auth-User", "X-Auth-Role"}})
+	header := http.Header{"X-Auth-User": {"spoofed"}, "X-Auth-Role": {"admin"}}
+
+	// Act
+	authorizer.ApplyHeaders(header, http.Header{"X-Auth-User": {"alice"}})
+
+	// Assert
+	assert.Equal(t, "alice", header.Get("X-Auth-User"))
+	assert.Empty(t, header.Get("X-Auth-Role"))
+}
@@ -0,0 +1,58 @@
+package forwardauth
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxCacheEntries = 10000
+
+type decision struct {
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// decisionCache keeps the answers of the authorization service for a short time.
+type decisionCache struct {
+	entries map[string]*decision
+	mutex   sync.Mutex
+}
+
+func newDecisionCache() *decisionCache {
+	return &decisionCache{entries: make(map[string]*decision)}
+}
+
+func (cache *decisionCache) get(key string, now time.Time) *decision {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	if now.After(entry.expiresAt) {
+		delete(cache.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (cache *decisionCache) put(key string, entry *decision, now time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if len(cache.entries) >= maxCacheEntries {
+		for k, e := range cache.entries {
+			if now.After(e.expiresAt) {
+				delete(cache.entries, k)
+			}
+		}
+		if len(cache.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	cache.entries[key] = entry
+}
@@ -0,0 +1,53 @@
+package forwardauth
+
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	maxBodySize    = 64 << 10
+)
+
+// Config is the forward authentication configuration of a virtual host.
+type Config struct {
+	Address              string   `json:"address"`
+	AuthRequestHeaders   []string `json:"auth_request_headers,omitempty"`
+	AuthResponseHeaders  []string `json:"auth_response_headers,omitempty"`
+	CacheTTL             string   `json:"cache_ttl,omitempty"`
+	Timeout              string   `json:"timeout,omitempty"`
+	UseClientCertificate bool     `json:"use_client_certificate,omitempty"`
+}
+
+// Validate checks that the forward authentication configuration is usable.
+func (config *Config) Validate() error {
+	address, err := url.Parse(config.Address)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return errors.New("'address' must be an absolute http or https URL")
+	}
+	if config.CacheTTL != "" {
+		if ttl, err := time.ParseDuration(config.CacheTTL); err != nil || ttl < 0 {
+			return errors.New("'cache_ttl' is not a valid duration")
+		}
+	}
+	if config.Timeout != "" {
+		if timeout, err := time.ParseDuration(config.Timeout); err != nil || timeout <= 0 {
+			return errors.New("'timeout' is not a valid duration")
+		}
+	}
+	return nil
+}
+
+func (config *Config) cacheTTL() time.Duration {
+	ttl, _ := time.ParseDuration(config.CacheTTL)
+	return ttl
+}
+
+func (config *Config) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(config.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultTimeout
+}
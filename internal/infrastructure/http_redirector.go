@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/domain"
 )
@@ -13,6 +14,8 @@ type HTTPRedirector struct {
 	redirectRules map[string]string
 	server        *http.Server
 	logger        domain.Logger
+	handler       http.Handler
+	mu            sync.RWMutex
 }
 
 func NewHTTPRedirector(logger domain.Logger) *HTTPRedirector {
@@ -27,11 +30,21 @@ func NewHTTPRedirector(logger domain.Logger) *HTTPRedirector {
 		Handler: hr.mux,
 	}
 
-	hr.mux.HandleFunc("/", hr.handleRedirect)
+	hr.handler = http.HandlerFunc(hr.handleRedirect)
+	hr.mux.HandleFunc("/", hr.handleRequest)
 
 	return hr
 }
 
+// handleRequest serves the request with the handler of the current certificate manager, which
+// answers the ACME HTTP-01 challenges and redirects the rest of requests.
+func (hr *HTTPRedirector) handleRequest(w http.ResponseWriter, r *http.Request) {
+	hr.mu.RLock()
+	handler := hr.handler
+	hr.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
 func (hr *HTTPRedirector) handleRedirect(w http.ResponseWriter, r *http.Request) {
 	host := r.Host
 	path := r.URL.Path
@@ -66,6 +79,15 @@ func (hr *HTTPRedirector) UpdateRedirectRules(virtualHosts []domain.IVirtualHost
 	hr.logger.Info(fmt.Sprintf("Updated %d redirect rules", len(newRules)))
 }
 
+// UpdateCertManager serves the ACME HTTP-01 challenges of the certificate manager, replacing
+// the ones of the previous configuration.
+func (hr *HTTPRedirector) UpdateCertManager(certMgr domain.CertificateManager) {
+	handler := certMgr.HTTPHandler(http.HandlerFunc(hr.handleRedirect))
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.handler = handler
+}
+
 func (hr *HTTPRedirector) Start() error {
 	hr.logger.Info("Starting HTTP redirector on port 80")
 	return hr.server.ListenAndServe()
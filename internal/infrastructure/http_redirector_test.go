@@ -6,9 +6,11 @@ import (
 	"testing"
 
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/domain"
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // MockLogger is a mock implementation of Logger
@@ -53,6 +55,21 @@ func (m *MockVirtualHost) GetAuthorizedCAs() []string {
 	return args.Get(0).([]string)
 }
 
+func (m *MockVirtualHost) GetClientAuth() certs.ClientAuthMode {
+	args := m.Called()
+	return args.Get(0).(certs.ClientAuthMode)
+}
+
+func (m *MockVirtualHost) GetTLSPolicy() *certs.TLSPolicy {
+	args := m.Called()
+	policy, _ := args.Get(0).(*certs.TLSPolicy)
+	return policy
+}
+
+func (m *MockVirtualHost) ReloadClientCAs(changed []string) {
+	m.Called(changed)
+}
+
 func (m *MockVirtualHost) GetServerCertificate() domain.CertificateProvider {
 	args := m.Called()
 	return args.Get(0).(domain.CertificateProvider)
@@ -143,3 +160,45 @@ func TestHTTPRedirector_handleRedirect_WhenNoRule_ThenGenericRedirect(t *testing
 	assert.Equal(t, http.StatusMovedPermanently, w.Code)
 	assert.Equal(t, "https://example.com/path?query=1", w.Header().Get("Location"))
 }
+
+func TestHTTPRedirector_UpdateCertManager_WhenChallengeIsRequested_ThenCertManagerAnswersIt(t *testing.T) {
+	// Arrange
+	mockLogger := &MockLogger{}
+	mockLogger.On("Info", mock.Anything).Return()
+	redirector := NewHTTPRedirector(mockLogger)
+	certMgr := certs.NewCertManager(&autocert.Manager{})
+	certMgr.AddAutoCertificate("example.com")
+
+	req := httptest.NewRequest("GET", "/.well-known/acme-challenge/unknown-token", nil)
+	req.Host = "example.com"
+	w := httptest.NewRecorder()
+
+	// Act
+	redirector.UpdateCertManager(certMgr)
+	redirector.server.Handler.ServeHTTP(w, req)
+
+	// Assert
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+}
+
+func TestHTTPRedirector_UpdateCertManager_WhenRequestIsNotAChallenge_ThenRedirects(t *testing.T) {
+	// Arrange
+	mockLogger := &MockLogger{}
+	mockLogger.On("Info", mock.Anything).Return()
+	redirector := NewHTTPRedirector(mockLogger)
+	certMgr := certs.NewCertManager(&autocert.Manager{})
+	certMgr.AddAutoCertificate("example.com")
+
+	req := httptest.NewRequest("GET", "/path?query=1", nil)
+	req.Host = "example.com"
+	w := httptest.NewRecorder()
+
+	// Act
+	redirector.UpdateCertManager(certMgr)
+	redirector.server.Handler.ServeHTTP(w, req)
+
+	// Assert
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://example.com/path?query=1", w.Header().Get("Location"))
+}
@@ -0,0 +1,64 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Filter is the compiled form of Rules.
+type Filter struct {
+	host  ruleSet
+	paths []pathFilter
+}
+
+type pathFilter struct {
+	path string
+	set  ruleSet
+}
+
+type ruleSet struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Allowed indicates if the client address may access the path. The host rules and
+// the rules of the most specific matching path must both accept the client.
+func (filter *Filter) Allowed(addr netip.Addr, path string) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if !filter.host.allows(addr) {
+		return false
+	}
+	for _, pathFilter := range filter.paths {
+		if hasPathPrefix(path, pathFilter.path) {
+			return pathFilter.set.allows(addr)
+		}
+	}
+	return true
+}
+
+func (set ruleSet) allows(addr netip.Addr) bool {
+	if contains(set.deny, addr) {
+		return false
+	}
+	return len(set.allow) == 0 || contains(set.allow, addr)
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPathPrefix(path string, prefix string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
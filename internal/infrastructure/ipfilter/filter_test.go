@@ -0,0 +1,108 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter_Allowed_WhenRulesMatch_ThenAppliesDenyBeforeAllow(t *testing.T) {
+	// Arrange
+	filter, err := (&Rules{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:  []string{"10.0.5.0/24"},
+		Paths: []*PathRules{
+			{Path: "/admin", Allow: []string{"10.1.0.0/16"}},
+			{Path: "/admin/public"},
+		},
+	}).Compile()
+	require.NoError(t, err)
+	tests := []struct {
+		addr    string
+		path    string
+		allowed bool
+	}{
+		{addr: "10.2.3.4", path: "/", allowed: true},
+		{addr: "::ffff:10.2.3.4", path: "/", allowed: true},
+		{addr: "2001:db8::1", path: "/", allowed: true},
+		{addr: "10.0.5.7", path: "/", allowed: false},
+		{addr: "192.168.1.1", path: "/", allowed: false},
+		{addr: "10.2.3.4", path: "/admin/users", allowed: false},
+		{addr: "10.1.3.4", path: "/admin/users", allowed: true},
+		{addr: "10.2.3.4", path: "/admin/public/logo.png", allowed: true},
+		{addr: "10.2.3.4", path: "/administrator", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr+tt.path, func(t *testing.T) {
+			// Act
+			allowed := filter.Allowed(netip.MustParseAddr(tt.addr), tt.path)
+
+			// Assert
+			assert.Equal(t, tt.allowed, allowed)
+		})
+	}
+}
+
+func TestRules_Validate_WhenEntryIsInvalid_ThenReturnsError(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules *Rules
+	}{
+		{name: "bad cidr", rules: &Rules{Allow: []string{"10.0.0.0/33"}}},
+		{name: "bad address", rules: &Rules{Deny: []string{"example.com"}}},
+		{name: "relative path", rules: &Rules{Paths: []*PathRules{{Path: "admin"}}}},
+		{name: "duplicated path", rules: &Rules{Paths: []*PathRules{{Path: "/a"}, {Path: "/a"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			err := tt.rules.Validate()
+
+			// Assert
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRealIP_Handler_WhenPeerIsTrustedProxy_ThenUsesForwardedClient(t *testing.T) {
+	// Arrange
+	realIP, err := NewRealIP([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	var remoteAddr, forwardedFor string
+	handler := realIP.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.2:4567"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.9, 10.0.0.7")
+
+	// Act
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Assert
+	assert.Equal(t, "203.0.113.9:0", remoteAddr)
+	assert.Equal(t, "1.1.1.1", forwardedFor)
+}
+
+func TestRealIP_ClientIP_WhenPeerIsNotTrusted_ThenIgnoresForwardedHeader(t *testing.T) {
+	// Arrange
+	realIP, err := NewRealIP([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.4:4567"
+	req.Header.Set("X-Forwarded-For", "10.1.1.1")
+
+	// Act
+	addr, index := realIP.ClientIP(req)
+
+	// Assert
+	assert.Equal(t, "198.51.100.4", addr.String())
+	assert.Equal(t, -1, index)
+}
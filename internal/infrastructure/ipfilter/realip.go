@@ -0,0 +1,91 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RealIP is the object responsible to find the address of the client when the proxy
+// is behind other trusted proxies or load balancers.
+type RealIP struct {
+	trusted []netip.Prefix
+}
+
+// NewRealIP returns a new object of RealIP type
+func NewRealIP(trustedProxies []string) (*RealIP, error) {
+	trusted, err := ParsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &RealIP{trusted: trusted}, nil
+}
+
+// ClientIP gets the address of the client. When the peer is a trusted proxy the
+// X-Forwarded-For chain is walked from the right, skipping trusted proxies, and the
+// first untrusted hop is the client. The index of that hop in the chain is returned,
+// or -1 when the peer address was used.
+func (realIP *RealIP) ClientIP(req *http.Request) (netip.Addr, int) {
+	peer := RemoteAddr(req)
+	if !peer.IsValid() || !contains(realIP.trusted, peer) {
+		return peer, -1
+	}
+
+	hops := forwardedFor(req)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			return peer, -1
+		}
+		addr = addr.Unmap()
+		if !contains(realIP.trusted, addr) || i == 0 {
+			return addr, i
+		}
+	}
+	return peer, -1
+}
+
+// Handler rewrites RemoteAddr to the real client address before calling next. The
+// X-Forwarded-For header keeps only the hops in front of the client, so proxies that
+// append RemoteAddr build a correct chain.
+func (realIP *RealIP) Handler(next http.Handler) http.Handler {
+	if len(realIP.trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		addr, index := realIP.ClientIP(req)
+		if index >= 0 {
+			hops := forwardedFor(req)
+			req.Header.Del("X-Forwarded-For")
+			if index > 0 {
+				req.Header.Set("X-Forwarded-For", strings.Join(hops[:index], ", "))
+			}
+			req.RemoteAddr = net.JoinHostPort(addr.String(), "0")
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// RemoteAddr gets the address of the peer of the request.
+func RemoteAddr(req *http.Request) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	if addr, err := netip.ParseAddr(req.RemoteAddr); err == nil {
+		return addr.Unmap()
+	}
+	return netip.Addr{}
+}
+
+func forwardedFor(req *http.Request) []string {
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
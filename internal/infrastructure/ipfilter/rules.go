@@ -0,0 +1,105 @@
+package ipfilter
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Rules are the CIDR access rules of a virtual host. Deny entries win over allow
+// entries, and when allow entries exist only matching clients are accepted.
+type Rules struct {
+	Allow []string     `json:"allow,omitempty"`
+	Deny  []string     `json:"deny,omitempty"`
+	Paths []*PathRules `json:"paths,omitempty"`
+}
+
+// PathRules are additional CIDR access rules for requests under a path prefix.
+type PathRules struct {
+	Path  string   `json:"path"`
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// IsEmpty indicates that the rules do not restrict any client.
+func (rules *Rules) IsEmpty() bool {
+	return rules == nil || (len(rules.Allow) == 0 && len(rules.Deny) == 0 && len(rules.Paths) == 0)
+}
+
+// Validate checks that all entries are valid IP addresses or CIDR prefixes.
+func (rules *Rules) Validate() error {
+	_, err := rules.Compile()
+	return err
+}
+
+// Compile builds the Filter for the rules.
+func (rules *Rules) Compile() (*Filter, error) {
+	host, err := compileSet(rules.Allow, rules.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &Filter{host: host}
+	seen := make(map[string]bool)
+	for i, pathRules := range rules.Paths {
+		if pathRules == nil || !strings.HasPrefix(pathRules.Path, "/") {
+			return nil, fmt.Errorf("paths[%d]: 'path' must start with '/'", i)
+		}
+		if seen[pathRules.Path] {
+			return nil, fmt.Errorf("paths[%d]: path '%s' is duplicated", i, pathRules.Path)
+		}
+		seen[pathRules.Path] = true
+		set, err := compileSet(pathRules.Allow, pathRules.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("paths[%d]: %w", i, err)
+		}
+		filter.paths = append(filter.paths, pathFilter{path: pathRules.Path, set: set})
+	}
+
+	// The most specific path is checked first.
+	sort.SliceStable(filter.paths, func(i, j int) bool {
+		return len(filter.paths[i].path) > len(filter.paths[j].path)
+	})
+	return filter, nil
+}
+
+// ParsePrefixes parses a list of IP addresses or CIDR prefixes. Single addresses
+// are converted to a prefix covering just that address.
+func ParsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, errors.New("empty address entry")
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s'", entry)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address '%s'", entry)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func compileSet(allow []string, deny []string) (ruleSet, error) {
+	allowed, err := ParsePrefixes(allow)
+	if err != nil {
+		return ruleSet{}, fmt.Errorf("allow: %w", err)
+	}
+	denied, err := ParsePrefixes(deny)
+	if err != nil {
+		return ruleSet{}, fmt.Errorf("deny: %w", err)
+	}
+	return ruleSet{allow: allowed, deny: denied}, nil
+}
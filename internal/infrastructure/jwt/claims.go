@@ -0,0 +1,87 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims is the decoded payload of a token.
+type Claims map[string]interface{}
+
+// String gets a claim as a string. Nested claims can be reached with a dotted path.
+func (claims Claims) String(name string) string {
+	switch value := claims.lookup(name).(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case float64, bool:
+		return fmt.Sprint(value)
+	default:
+		return ""
+	}
+}
+
+// Strings gets a claim as a list of strings. A single string value is returned as a one element list.
+func (claims Claims) Strings(name string) []string {
+	switch value := claims.lookup(name).(type) {
+	case string:
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	case []interface{}:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// Time gets a NumericDate claim.
+func (claims Claims) Time(name string) (time.Time, bool) {
+	value, ok := claims.lookup(name).(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// Has indicates if the claim is present.
+func (claims Claims) Has(name string) bool {
+	return claims.lookup(name) != nil
+}
+
+// HasAudience indicates if the aud claim contains any of the audiences.
+func (claims Claims) HasAudience(audiences ...string) bool {
+	for _, aud := range claims.Strings("aud") {
+		for _, expected := range audiences {
+			if aud == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (claims Claims) lookup(name string) interface{} {
+	if value, ok := claims[name]; ok {
+		return value
+	}
+	var current interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(name, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[part]
+	}
+	return current
+}
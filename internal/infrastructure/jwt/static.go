@@ -0,0 +1,109 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// StaticKeySet is a KeySet with keys loaded from local files.
+type StaticKeySet struct {
+	keys map[string]JSONWebKey
+	all  []JSONWebKey
+}
+
+// LoadKeyFiles reads public keys from PEM files (PUBLIC KEY, RSA PUBLIC KEY or
+// CERTIFICATE blocks) or from JWKS documents in JSON format.
+func LoadKeyFiles(paths []string) (*StaticKeySet, error) {
+	keySet := &StaticKeySet{keys: make(map[string]JSONWebKey)}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := keySet.load(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if len(keySet.all) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+	return keySet, nil
+}
+
+// Keys implements KeySet.Keys. Keys from PEM files have no key ID, so they
+// are candidates for any token; JWKS keys are selected by kid when present.
+func (keySet *StaticKeySet) Keys(keyID string, algorithm string) ([]JSONWebKey, error) {
+	if key, ok := keySet.keys[keyID]; ok && keyID != "" {
+		return []JSONWebKey{key}, nil
+	}
+	return keySet.all, nil
+}
+
+func (keySet *StaticKeySet) load(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var document jose.JSONWebKeySet
+		if err := json.Unmarshal(trimmed, &document); err != nil {
+			return fmt.Errorf("invalid JWKS document: %w", err)
+		}
+		for _, jwk := range document.Keys {
+			if !jwk.IsPublic() {
+				return fmt.Errorf("key %q is not a public key", jwk.KeyID)
+			}
+			keySet.add(jwk)
+		}
+		return nil
+	}
+
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := parsePEMBlock(block)
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			keySet.add(JSONWebKey{Key: key})
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("no PEM encoded public key found")
+	}
+	return nil
+}
+
+func (keySet *StaticKeySet) add(key JSONWebKey) {
+	if key.KeyID != "" {
+		keySet.keys[key.KeyID] = key
+	}
+	keySet.all = append(keySet.all, key)
+}
+
+func parsePEMBlock(block *pem.Block) (crypto.PublicKey, error) {
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return certificate.PublicKey, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,125 @@
+package jwt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+)
+
+// SignatureAlgorithms are the signing algorithms accepted by Parse and Verify.
+var SignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// Header is the JOSE header of a signed token.
+type Header struct {
+	Algorithm string
+	KeyID     string
+	Type      string
+}
+
+// Token is a parsed JSON Web Token.
+type Token struct {
+	Raw    string
+	Header Header
+	Claims Claims
+	signed *josejwt.JSONWebToken
+}
+
+// Expectations are the registered claims checked by Validate.
+type Expectations struct {
+	Issuer   string
+	Audience []string
+	Leeway   time.Duration
+	Now      func() time.Time
+}
+
+// Parse decodes a compact serialized JWT without verifying its signature.
+func Parse(raw string) (*Token, error) {
+	signed, err := josejwt.ParseSigned(raw, SignatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if len(signed.Headers) != 1 {
+		return nil, errors.New("token must have exactly one signature")
+	}
+
+	claims := make(Claims)
+	if err := signed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, fmt.Errorf("invalid token payload: %w", err)
+	}
+
+	header := signed.Headers[0]
+	tokenType, _ := header.ExtraHeaders[jose.HeaderType].(string)
+	return &Token{
+		Raw:    raw,
+		Header: Header{Algorithm: header.Algorithm, KeyID: header.KeyID, Type: tokenType},
+		Claims: claims,
+		signed: signed,
+	}, nil
+}
+
+// Verify parses the token and checks its signature with a key from keySet.
+// Keys that declare another algorithm or a use other than "sig" are skipped.
+func Verify(raw string, keySet KeySet) (*Token, error) {
+	token, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := keySet.Keys(token.Header.KeyID, token.Header.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.New("no key available to verify the token")
+	for _, key := range keys {
+		if key.Algorithm != "" && key.Algorithm != token.Header.Algorithm {
+			continue
+		}
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		claims := make(Claims)
+		if err = token.signed.Claims(key.Key, &claims); err == nil {
+			token.Claims = claims
+			return token, nil
+		}
+	}
+	return nil, err
+}
+
+// Validate checks the issuer, audience and time based claims of the token.
+// Tokens without an expiration are rejected.
+func (token *Token) Validate(expectations Expectations) error {
+	now := time.Now()
+	if expectations.Now != nil {
+		now = expectations.Now()
+	}
+
+	if expectations.Issuer != "" && token.Claims.String("iss") != expectations.Issuer {
+		return fmt.Errorf("unexpected issuer %q", token.Claims.String("iss"))
+	}
+
+	if len(expectations.Audience) > 0 && !token.Claims.HasAudience(expectations.Audience...) {
+		return errors.New("token audience does not match")
+	}
+
+	exp, ok := token.Claims.Time("exp")
+	if !ok {
+		return errors.New("token has no expiration")
+	}
+	if now.After(exp.Add(expectations.Leeway)) {
+		return errors.New("token is expired")
+	}
+
+	if nbf, ok := token.Claims.Time("nbf"); ok && now.Add(expectations.Leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
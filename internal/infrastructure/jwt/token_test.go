@@ -0,0 +1,173 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticKeys map[string]JSONWebKey
+
+func (keys staticKeys) Keys(keyID string, algorithm string) ([]JSONWebKey, error) {
+	if key, ok := keys[keyID]; ok {
+		return []JSONWebKey{key}, nil
+	}
+	return nil, errors.New("unknown key")
+}
+
+func sign(t *testing.T, algorithm jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+	options := (&jose.SignerOptions{}).WithType("JWT").WithHeader(jose.HeaderKey("kid"), kid)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key}, options)
+	require.NoError(t, err)
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	require.NoError(t, err)
+	raw, err := signed.CompactSerialize()
+	require.NoError(t, err)
+	return raw
+}
+
+func TestVerify_WhenRS256SignatureIsValid_ThenReturnsToken(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	raw := sign(t, jose.RS256, key, "k1", map[string]interface{}{"sub": "alice"})
+
+	// Act
+	token, err := Verify(raw, staticKeys{"k1": {Key: &key.PublicKey}})
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "alice", token.Claims.String("sub"))
+}
+
+func TestVerify_WhenES256SignatureIsValid_ThenReturnsToken(t *testing.T) {
+	// Arrange
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	raw := sign(t, jose.ES256, key, "ec", map[string]interface{}{"sub": "bob"})
+
+	// Act
+	token, err := Verify(raw, staticKeys{"ec": {Key: &key.PublicKey}})
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "bob", token.Claims.String("sub"))
+}
+
+func TestVerify_WhenSignedWithOtherKey_ThenReturnsError(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	raw := sign(t, jose.RS256, key, "k1", map[string]interface{}{"sub": "alice"})
+
+	// Act
+	token, err := Verify(raw, staticKeys{"k1": {Key: &other.PublicKey}})
+
+	// Assert
+	assert.Error(t, err)
+	assert.Nil(t, token)
+}
+
+func TestVerify_WhenAlgorithmIsNone_ThenReturnsError(t *testing.T) {
+	// Arrange
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory"}`))
+
+	// Act
+	_, err := Verify(header+"."+payload+".", staticKeys{})
+
+	// Assert
+	assert.Error(t, err)
+}
+
+func TestVerify_WhenKeyDeclaresAnotherAlgorithm_ThenReturnsError(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	raw := sign(t, jose.RS256, key, "k1", map[string]interface{}{"sub": "alice"})
+
+	// Act
+	token, err := Verify(raw, staticKeys{"k1": {Key: &key.PublicKey, Algorithm: "PS256"}})
+
+	// Assert
+	assert.Error(t, err)
+	assert.Nil(t, token)
+}
+
+func TestToken_Validate_WhenClaimsMatch_ThenReturnsNil(t *testing.T) {
+	// Arrange
+	now := time.Unix(1700000000, 0)
+	token := &Token{Claims: Claims{"iss": "https://idp", "aud": "api", "exp": float64(now.Unix() + 60)}}
+
+	// Act
+	err := token.Validate(Expectations{Issuer: "https://idp", Audience: []string{"api"}, Now: func() time.Time { return now }})
+
+	// Assert
+	assert.NoError(t, err)
+}
+
+func TestToken_Validate_WhenClaimsDoNotMatch_ThenReturnsError(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		claims Claims
+	}{
+		{name: "wrong issuer", claims: Claims{"iss": "https://other", "aud": "api", "exp": float64(now.Unix() + 60)}},
+		{name: "wrong audience", claims: Claims{"iss": "https://idp", "aud": []interface{}{"web"}, "exp": float64(now.Unix() + 60)}},
+		{name: "expired", claims: Claims{"iss": "https://idp", "aud": "api", "exp": float64(now.Unix() - 120)}},
+		{name: "not yet valid", claims: Claims{"iss": "https://idp", "aud": "api", "exp": float64(now.Unix() + 600), "nbf": float64(now.Unix() + 120)}},
+		{name: "no expiration", claims: Claims{"iss": "https://idp", "aud": "api"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			token := &Token{Claims: tt.claims}
+
+			// Act
+			err := token.Validate(Expectations{Issuer: "https://idp", Audience: []string{"api"}, Leeway: time.Minute, Now: func() time.Time { return now }})
+
+			// Assert
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestClaims_Strings_WhenNestedClaim_ThenReturnsValues(t *testing.T) {
+	// Arrange
+	claims := Claims{"realm_access": map[string]interface{}{"roles": []interface{}{"admin", "dev"}}}
+
+	// Act
+	roles := claims.Strings("realm_access.roles")
+
+	// Assert
+	assert.Equal(t, []string{"admin", "dev"}, roles)
+}
+
+func TestRemoteKeySet_Key_WhenKidIsPublished_ThenReturnsKey(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []JSONWebKey{{Key: &key.PublicKey, KeyID: "k1"}}})
+	}))
+	defer server.Close()
+	keySet := NewRemoteKeySet(server.URL, server.Client())
+
+	// Act
+	publicKeys, err := keySet.Keys("k1", "RS256")
+
+	// Assert
+	require.NoError(t, err)
+	require.Len(t, publicKeys, 1)
+	assert.True(t, key.PublicKey.Equal(publicKeys[0].Key))
+}
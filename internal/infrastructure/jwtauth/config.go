@@ -0,0 +1,121 @@
+package jwtauth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultClockSkew = time.Minute
+
+// Config is the JWT validation configuration of a virtual host.
+type Config struct {
+	JWKSURL        string            `json:"jwks_url,omitempty"`
+	KeyFiles       []string          `json:"key_files,omitempty"`
+	Issuer         string            `json:"issuer,omitempty"`
+	Audiences      []string          `json:"audiences,omitempty"`
+	Algorithms     []string          `json:"algorithms,omitempty"`
+	RequiredClaims map[string]string `json:"required_claims,omitempty"`
+	ClockSkew      string            `json:"clock_skew,omitempty"`
+	ClaimHeaders   map[string]string `json:"claim_headers,omitempty"`
+	Paths          []string          `json:"paths,omitempty"`
+	ExcludedPaths  []string          `json:"excluded_paths,omitempty"`
+}
+
+// Validate checks that the JWT validation configuration is usable.
+func (config *Config) Validate() error {
+	if config.JWKSURL == "" && len(config.KeyFiles) == 0 {
+		return errors.New("either 'jwks_url' or 'key_files' is required")
+	}
+	if config.JWKSURL != "" {
+		address, err := url.Parse(config.JWKSURL)
+		if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+			return errors.New("'jwks_url' must be an absolute http or https URL")
+		}
+	}
+	for _, path := range config.KeyFiles {
+		if strings.TrimSpace(path) == "" {
+			return errors.New("'key_files' cannot contain empty paths")
+		}
+	}
+	for _, algorithm := range config.Algorithms {
+		if !isSupportedAlgorithm(algorithm) {
+			return errors.New("unsupported algorithm '" + algorithm + "'")
+		}
+	}
+	if config.ClockSkew != "" {
+		if skew, err := time.ParseDuration(config.ClockSkew); err != nil || skew < 0 {
+			return errors.New("'clock_skew' is not a valid duration")
+		}
+	}
+	for name := range config.RequiredClaims {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("'required_claims' cannot contain empty claim names")
+		}
+	}
+	for header, claim := range config.ClaimHeaders {
+		if strings.TrimSpace(header) == "" || strings.ContainsAny(header, " :\t\r\n") {
+			return errors.New("'claim_headers' contains an invalid header name '" + header + "'")
+		}
+		if strings.TrimSpace(claim) == "" {
+			return errors.New("'claim_headers' entry '" + header + "' has no claim")
+		}
+	}
+	for _, path := range append(append([]string{}, config.Paths...), config.ExcludedPaths...) {
+		if !strings.HasPrefix(path, "/") {
+			return errors.New("paths must start with '/'")
+		}
+	}
+	return nil
+}
+
+func (config *Config) clockSkew() time.Duration {
+	if skew, err := time.ParseDuration(config.ClockSkew); err == nil && skew >= 0 {
+		return skew
+	}
+	return defaultClockSkew
+}
+
+// protects indicates if the path requires a token.
+func (config *Config) protects(path string) bool {
+	for _, prefix := range config.ExcludedPaths {
+		if hasPathPrefix(path, prefix) {
+			return false
+		}
+	}
+	if len(config.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range config.Paths {
+		if hasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPathPrefix(path string, prefix string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+func canonicalHeaders(headers map[string]string) map[string]string {
+	result := make(map[string]string, len(headers))
+	for header, claim := range headers {
+		result[http.CanonicalHeaderKey(header)] = claim
+	}
+	return result
+}
+
+func isSupportedAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,244 @@
+package jwtauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/jwt"
+)
+
+// gRPC status codes used in gRPC-Web error responses.
+const (
+	grpcPermissionDenied = 7
+	grpcUnauthenticated  = 16
+)
+
+// Error is a token validation failure.
+type Error struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (err *Error) Error() string {
+	return err.Description
+}
+
+// Validator is the object responsible to validate the bearer tokens of the requests to a virtual host.
+type Validator struct {
+	config       *Config
+	keySet       jwt.KeySet
+	claimHeaders map[string]string
+	now          func() time.Time
+}
+
+// NewValidator returns a new object of Validator type. Local key files are read once;
+// keys published at the JWKS URL are fetched on demand.
+func NewValidator(config *Config, client *http.Client) (*Validator, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var keySets multiKeySet
+	if len(config.KeyFiles) > 0 {
+		keySet, err := jwt.LoadKeyFiles(config.KeyFiles)
+		if err != nil {
+			return nil, err
+		}
+		keySets = append(keySets, keySet)
+	}
+	if config.JWKSURL != "" {
+		keySets = append(keySets, jwt.NewRemoteKeySet(config.JWKSURL, client))
+	}
+
+	return &Validator{
+		config:       config,
+		keySet:       keySets,
+		claimHeaders: canonicalHeaders(config.ClaimHeaders),
+		now:          time.Now,
+	}, nil
+}
+
+// Validate checks the bearer token of the request and returns its claims. It returns
+// nil claims and no error when the request path is not protected or the request is a
+// CORS preflight.
+func (validator *Validator) Validate(req *http.Request) (jwt.Claims, error) {
+	if !validator.config.protects(req.URL.Path) || isPreflight(req) {
+		return nil, nil
+	}
+
+	raw := bearerToken(req)
+	if raw == "" {
+		return nil, &Error{Status: http.StatusUnauthorized, Description: "bearer token required"}
+	}
+
+	token, err := jwt.Parse(raw)
+	if err != nil {
+		return nil, invalidToken(err)
+	}
+	if !validator.allows(token.Header.Algorithm) {
+		return nil, invalidToken(errors.New("signing algorithm '" + token.Header.Algorithm + "' is not allowed"))
+	}
+	if token, err = jwt.Verify(raw, validator.keySet); err != nil {
+		return nil, invalidToken(err)
+	}
+	if err := token.Validate(jwt.Expectations{
+		Issuer:   validator.config.Issuer,
+		Audience: validator.config.Audiences,
+		Leeway:   validator.config.clockSkew(),
+		Now:      validator.now,
+	}); err != nil {
+		return nil, invalidToken(err)
+	}
+
+	for name, expected := range validator.config.RequiredClaims {
+		if !hasClaim(token.Claims, name, expected) {
+			return nil, &Error{Status: http.StatusForbidden, Code: "insufficient_scope", Description: "required claim '" + name + "' is missing"}
+		}
+	}
+	return token.Claims, nil
+}
+
+// ApplyClaimHeaders sets the configured claim headers on the upstream request, removing
+// any client supplied copy of them.
+func (validator *Validator) ApplyClaimHeaders(header http.Header, claims jwt.Claims) {
+	for name, claim := range validator.claimHeaders {
+		header.Del(name)
+		if claims == nil {
+			continue
+		}
+		if value := claimValue(claims, claim); value != "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+func (validator *Validator) allows(algorithm string) bool {
+	if len(validator.config.Algorithms) == 0 {
+		return isSupportedAlgorithm(algorithm)
+	}
+	for _, allowed := range validator.config.Algorithms {
+		if allowed == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteError writes a RFC 6750 bearer token error response.
+func WriteError(rw http.ResponseWriter, err error) {
+	validationError := asError(err)
+	challenge := "Bearer"
+	if validationError.Code != "" {
+		challenge += ` error="` + validationError.Code + `", error_description="` + strings.ReplaceAll(validationError.Description, `"`, "'") + `"`
+	}
+	rw.Header().Set("WWW-Authenticate", challenge)
+	http.Error(rw, validationError.Description, validationError.Status)
+}
+
+// WriteGrpcWebError writes the validation failure as a trailers-only gRPC-Web response.
+func WriteGrpcWebError(rw http.ResponseWriter, err error) {
+	validationError := asError(err)
+	status := grpcUnauthenticated
+	if validationError.Status == http.StatusForbidden {
+		status = grpcPermissionDenied
+	}
+	rw.Header().Set("Content-Type", "application/grpc-web+proto")
+	rw.Header().Set("Grpc-Status", strconv.Itoa(status))
+	rw.Header().Set("Grpc-Message", encodeGrpcMessage(validationError.Description))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// encodeGrpcMessage percent-encodes the message as the gRPC spec requires for the
+// Grpc-Message header: every byte outside printable ASCII, and '%' itself.
+func encodeGrpcMessage(message string) string {
+	var builder strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c >= ' ' && c <= '~' && c != '%' {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
+}
+
+func asError(err error) *Error {
+	var validationError *Error
+	if errors.As(err, &validationError) {
+		return validationError
+	}
+	return invalidToken(err)
+}
+
+func invalidToken(err error) *Error {
+	return &Error{Status: http.StatusUnauthorized, Code: "invalid_token", Description: err.Error()}
+}
+
+func bearerToken(req *http.Request) string {
+	value := strings.TrimSpace(req.Header.Get("Authorization"))
+	if len(value) < 7 || !strings.EqualFold(value[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(value[7:])
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// hasClaim checks a required claim. An empty expected value only requires the claim to be
+// present; otherwise the claim, or one of its values, must be equal to it. Space separated
+// string claims like scope are matched value by value.
+func hasClaim(claims jwt.Claims, name string, expected string) bool {
+	if !claims.Has(name) {
+		return false
+	}
+	if expected == "" {
+		return true
+	}
+	values := claims.Strings(name)
+	if len(values) == 1 {
+		values = strings.Fields(values[0])
+	}
+	if len(values) == 0 {
+		values = []string{claims.String(name)}
+	}
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func claimValue(claims jwt.Claims, name string) string {
+	if value := claims.String(name); value != "" {
+		return value
+	}
+	return strings.Join(claims.Strings(name), ",")
+}
+
+// multiKeySet looks up keys in several key sets.
+type multiKeySet []jwt.KeySet
+
+func (keySets multiKeySet) Keys(keyID string, algorithm string) ([]jwt.JSONWebKey, error) {
+	var keys []jwt.JSONWebKey
+	var lastErr error
+	for _, keySet := range keySets {
+		found, err := keySet.Keys(keyID, algorithm)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		keys = append(keys, found...)
+	}
+	if len(keys) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return keys, nil
+}
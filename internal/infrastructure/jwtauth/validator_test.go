@@ -0,0 +1,184 @@
+package jwtauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePublicKey(t *testing.T, key *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "public.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	require.NoError(t, err)
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	require.NoError(t, err)
+	raw, err := signed.CompactSerialize()
+	require.NoError(t, err)
+	return raw
+}
+
+func newRequest(path string, token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "https://api.example.com"+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func newTestValidator(t *testing.T, key *rsa.PrivateKey, config *Config) *Validator {
+	config.KeyFiles = []string{writePublicKey(t, key)}
+	validator, err := NewValidator(config, nil)
+	require.NoError(t, err)
+	return validator
+}
+
+func TestValidator_Validate_WhenTokenIsValid_ThenReturnsClaims(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	validator := newTestValidator(t, key, &Config{Issuer: "https://idp", Audiences: []string{"api"}, RequiredClaims: map[string]string{"scope": "orders:read"}})
+	token := sign(t, key, map[string]interface{}{
+		"iss": "https://idp", "aud": "api", "sub": "alice", "scope": "profile orders:read",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	// Act
+	claims, err := validator.Validate(newRequest("/orders", token))
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "alice", claims.String("sub"))
+}
+
+func TestValidator_Validate_WhenTokenIsRejected_ThenReturnsStatus(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "missing token", token: "", status: http.StatusUnauthorized},
+		{name: "malformed token", token: "abc", status: http.StatusUnauthorized},
+		{name: "unknown key", token: sign(t, other, map[string]interface{}{"iss": "https://idp", "exp": expiresAt, "role": "admin"}), status: http.StatusUnauthorized},
+		{name: "wrong issuer", token: sign(t, key, map[string]interface{}{"iss": "https://evil", "exp": expiresAt, "role": "admin"}), status: http.StatusUnauthorized},
+		{name: "no expiration", token: sign(t, key, map[string]interface{}{"iss": "https://idp", "role": "admin"}), status: http.StatusUnauthorized},
+		{name: "expired", token: sign(t, key, map[string]interface{}{"iss": "https://idp", "exp": time.Now().Add(-time.Hour).Unix(), "role": "admin"}), status: http.StatusUnauthorized},
+		{name: "missing required claim", token: sign(t, key, map[string]interface{}{"iss": "https://idp", "exp": expiresAt, "role": "viewer"}), status: http.StatusForbidden},
+	}
+	validator := newTestValidator(t, key, &Config{Issuer: "https://idp", RequiredClaims: map[string]string{"role": "admin"}})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			claims, err := validator.Validate(newRequest("/", tt.token))
+
+			// Assert
+			require.Error(t, err)
+			assert.Nil(t, claims)
+			assert.Equal(t, tt.status, asError(err).Status)
+		})
+	}
+}
+
+func TestValidator_Validate_WhenPathIsNotProtected_ThenSkipsValidation(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	validator := newTestValidator(t, key, &Config{Paths: []string{"/api"}, ExcludedPaths: []string{"/api/health"}})
+
+	// Act
+	_, publicErr := validator.Validate(newRequest("/apidocs", ""))
+	_, healthErr := validator.Validate(newRequest("/api/health", ""))
+	_, apiErr := validator.Validate(newRequest("/api/orders", ""))
+
+	// Assert
+	assert.NoError(t, publicErr)
+	assert.NoError(t, healthErr)
+	assert.Error(t, apiErr)
+}
+
+func TestValidator_Validate_WhenKeysArePublishedAtJWKSURL_ThenVerifiesToken(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+		}}})
+	}))
+	defer jwks.Close()
+	validator, err := NewValidator(&Config{JWKSURL: jwks.URL}, jwks.Client())
+	require.NoError(t, err)
+
+	// Act
+	claims, err := validator.Validate(newRequest("/", sign(t, key, map[string]interface{}{"sub": "svc", "exp": time.Now().Add(time.Hour).Unix()})))
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, "svc", claims.String("sub"))
+}
+
+func TestValidator_ApplyClaimHeaders_WhenClientSentClaimHeader_ThenReplacesIt(t *testing.T) {
+	// Arrange
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	validator := newTestValidator(t, key, &Config{ClaimHeaders: map[string]string{"x-user": "sub", "X-Roles": "realm_access.roles", "X-Tenant": "tenant"}})
+	header := http.Header{"X-User": {"spoofed"}, "X-Tenant": {"other"}}
+
+	// Act
+	validator.ApplyClaimHeaders(header, map[string]interface{}{
+		"sub":          "alice",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin", "dev"}},
+	})
+
+	// Assert
+	assert.Equal(t, "alice", header.Get("X-User"))
+	assert.Equal(t, "admin,dev", header.Get("X-Roles"))
+	assert.Empty(t, header.Get("X-Tenant"))
+}
+
+func TestWriteGrpcWebError_WhenTokenIsMissing_ThenWritesUnauthenticatedStatus(t *testing.T) {
+	// Arrange
+	rw := httptest.NewRecorder()
+
+	// Act
+	WriteGrpcWebError(rw, &Error{Status: http.StatusUnauthorized, Description: "bearer token required"})
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "16", rw.Header().Get("Grpc-Status"))
+	assert.Equal(t, "bearer token required", rw.Header().Get("Grpc-Message"))
+}
+
+func TestWriteGrpcWebError_WhenMessageIsNotPrintableASCII_ThenPercentEncodesIt(t *testing.T) {
+	// Arrange
+	rw := httptest.NewRecorder()
+
+	// Act
+	WriteGrpcWebError(rw, &Error{Status: http.StatusForbidden, Description: "100% café\nrequired"})
+
+	// Assert
+	assert.Equal(t, "7", rw.Header().Get("Grpc-Status"))
+	assert.Equal(t, "100%25 caf%C3%A9%0Arequired", rw.Header().Get("Grpc-Message"))
+}
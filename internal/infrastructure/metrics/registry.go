@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry used by the proxy and exposed by the ConfigUI.
+var Default = NewRegistry()
+
+// Registry is the object responsible to keep the metrics and write them in the
+// Prometheus text exposition format.
+type Registry struct {
+	mutex   sync.RWMutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(writer io.Writer)
+}
+
+// NewRegistry returns a new object of Registry type
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounterVec registers a counter with the given label names.
+func (registry *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{metricName: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+	registry.register(counter)
+	return counter
+}
+
+// NewGaugeVec registers a gauge with the given label names.
+func (registry *Registry) NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	gauge := &GaugeVec{metricName: name, help: help, labels: labels, values: make(map[string]*gaugeValue)}
+	registry.register(gauge)
+	return gauge
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func (registry *Registry) WriteText(writer io.Writer) error {
+	registry.mutex.RLock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.mutex.RUnlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	buffered := bufio.NewWriter(writer)
+	for _, metric := range metrics {
+		metric.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = registry.WriteText(rw)
+	})
+}
+
+func (registry *Registry) register(metric metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.metrics = append(registry.metrics, metric)
+}
+
+// CounterVec is a monotonic counter partitioned by label values.
+type CounterVec struct {
+	metricName string
+	help       string
+	labels     []string
+	mutex      sync.RWMutex
+	values     map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       atomic.Uint64
+}
+
+// Inc increments the counter for the label values.
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add increments the counter for the label values by delta.
+func (counter *CounterVec) Add(delta uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	counter.mutex.RLock()
+	value, ok := counter.values[key]
+	counter.mutex.RUnlock()
+
+	if !ok {
+		counter.mutex.Lock()
+		if value, ok = counter.values[key]; !ok {
+			value = &counterValue{labelValues: append([]string(nil), labelValues...)}
+			counter.values[key] = value
+		}
+		counter.mutex.Unlock()
+	}
+	value.value.Add(delta)
+}
+
+// Value gets the counter for the label values.
+func (counter *CounterVec) Value(labelValues ...string) uint64 {
+	counter.mutex.RLock()
+	defer counter.mutex.RUnlock()
+	if value, ok := counter.values[strings.Join(labelValues, "\xff")]; ok {
+		return value.value.Load()
+	}
+	return 0
+}
+
+func (counter *CounterVec) name() string {
+	return counter.metricName
+}
+
+func (counter *CounterVec) write(writer io.Writer) {
+	counter.mutex.RLock()
+	defer counter.mutex.RUnlock()
+
+	writeHeader(writer, counter.metricName, counter.help, "counter")
+	for _, key := range sortedKeys(counter.values) {
+		value := counter.values[key]
+		_, _ = fmt.Fprintf(writer, "%s%s %d\n", counter.metricName, formatLabels(counter.labels, value.labelValues), value.value.Load())
+	}
+}
+
+// GaugeVec is a value that can go up and down, partitioned by label values.
+type GaugeVec struct {
+	metricName string
+	help       string
+	labels     []string
+	mutex      sync.RWMutex
+	values     map[string]*gaugeValue
+}
+
+type gaugeValue struct {
+	labelValues []string
+	value       float64
+}
+
+// Set sets the gauge for the label values.
+func (gauge *GaugeVec) Set(value float64, labelValues ...string) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.values[strings.Join(labelValues, "\xff")] = &gaugeValue{labelValues: append([]string(nil), labelValues...), value: value}
+}
+
+// Reset removes the values of all label values.
+func (gauge *GaugeVec) Reset() {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.values = make(map[string]*gaugeValue)
+}
+
+// Value gets the gauge for the label values.
+func (gauge *GaugeVec) Value(labelValues ...string) float64 {
+	gauge.mutex.RLock()
+	defer gauge.mutex.RUnlock()
+	if value, ok := gauge.values[strings.Join(labelValues, "\xff")]; ok {
+		return value.value
+	}
+	return 0
+}
+
+func (gauge *GaugeVec) name() string {
+	return gauge.metricName
+}
+
+func (gauge *GaugeVec) write(writer io.Writer) {
+	gauge.mutex.RLock()
+	defer gauge.mutex.RUnlock()
+
+	writeHeader(writer, gauge.metricName, gauge.help, "gauge")
+	for _, key := range sortedKeys(gauge.values) {
+		value := gauge.values[key]
+		_, _ = fmt.Fprintf(writer, "%s%s %s\n", gauge.metricName, formatLabels(gauge.labels, value.labelValues), strconv.FormatFloat(value.value, 'g', -1, 64))
+	}
+}
+
+func writeHeader(writer io.Writer, name string, help string, kind string) {
+	_, _ = fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+`="`+escapeLabel(value)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_WriteText_WhenCountersIncremented_ThenWritesPrometheusFormat(t *testing.T) {
+	// Arrange
+	registry := NewRegistry()
+	counter := registry.NewCounterVec("requests_total", "Requests.", "host", "reason")
+	counter.Inc("a.example.com", "ip")
+	counter.Add(2, "a.example.com", "ip")
+	counter.Inc(`b"q`, "ip")
+	var out strings.Builder
+
+	// Act
+	err := registry.WriteText(&out)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), counter.Value("a.example.com", "ip"))
+	assert.Equal(t, "# HELP requests_total Requests.\n"+
+		"# TYPE requests_total counter\n"+
+		"requests_total{host=\"a.example.com\",reason=\"ip\"} 3\n"+
+		"requests_total{host=\"b\\\"q\",reason=\"ip\"} 1\n", out.String())
+}
+
+func TestRegistry_WriteText_WhenGaugesSet_ThenWritesLastValues(t *testing.T) {
+	// Arrange
+	registry := NewRegistry()
+	gauge := registry.NewGaugeVec("expiry_seconds", "Expiry.", "host")
+	gauge.Set(1, "old.example.com")
+	gauge.Reset()
+	gauge.Set(1.5, "a.example.com")
+	gauge.Set(1700000000, "b.example.com")
+	var out strings.Builder
+
+	// Act
+	err := registry.WriteText(&out)
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, gauge.Value("a.example.com"))
+	assert.Equal(t, "# HELP expiry_seconds Expiry.\n"+
+		"# TYPE expiry_seconds gauge\n"+
+		"expiry_seconds{host=\"a.example.com\"} 1.5\n"+
+		"expiry_seconds{host=\"b.example.com\"} 1.7e+09\n", out.String())
+}
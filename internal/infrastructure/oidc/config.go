@@ -0,0 +1,124 @@
+package oidc
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRedirectPath    = "/oauth2/callback"
+	defaultCookieName      = "_rp_oidc"
+	defaultSessionLifetime = 8 * time.Hour
+	defaultUserHeader      = "X-Auth-Request-User"
+	defaultEmailHeader     = "X-Auth-Request-Email"
+	defaultGroupsHeader    = "X-Auth-Request-Groups"
+)
+
+// Config is the OpenID Connect login configuration of a virtual host.
+type Config struct {
+	Issuer          string          `json:"issuer"`
+	ClientID        string          `json:"client_id"`
+	ClientSecret    string          `json:"client_secret"`
+	Scopes          []string        `json:"scopes,omitempty"`
+	RedirectPath    string          `json:"redirect_path,omitempty"`
+	CookieName      string          `json:"cookie_name,omitempty"`
+	CookieSecret    string          `json:"cookie_secret"`
+	SessionLifetime string          `json:"session_lifetime,omitempty"`
+	AllowedGroups   []string        `json:"allowed_groups,omitempty"`
+	AllowedEmails   []string        `json:"allowed_emails,omitempty"`
+	GroupsClaim     string          `json:"groups_claim,omitempty"`
+	Headers         *IdentityHeader `json:"headers,omitempty"`
+}
+
+// IdentityHeader names the headers that carry the authenticated identity upstream.
+type IdentityHeader struct {
+	User   string `json:"user,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Groups string `json:"groups,omitempty"`
+}
+
+// Validate checks that the OpenID Connect configuration is usable.
+func (config *Config) Validate() error {
+	if strings.TrimSpace(config.Issuer) == "" {
+		return errors.New("'issuer' field is required")
+	}
+	if !strings.HasPrefix(config.Issuer, "https://") && !strings.HasPrefix(config.Issuer, "http://") {
+		return errors.New("'issuer' must be an http or https URL")
+	}
+	if strings.TrimSpace(config.ClientID) == "" {
+		return errors.New("'client_id' field is required")
+	}
+	if config.RedirectPath != "" && !strings.HasPrefix(config.RedirectPath, "/") {
+		return errors.New("'redirect_path' must start with '/'")
+	}
+	if strings.TrimSpace(config.CookieSecret) == "" {
+		return errors.New("'cookie_secret' field is required")
+	}
+	if len(config.CookieSecret) < 16 {
+		return errors.New("'cookie_secret' must have at least 16 characters")
+	}
+	if config.SessionLifetime != "" {
+		if _, err := time.ParseDuration(config.SessionLifetime); err != nil {
+			return errors.New("'session_lifetime' is not a valid duration")
+		}
+	}
+	return nil
+}
+
+func (config *Config) redirectPath() string {
+	if config.RedirectPath == "" {
+		return defaultRedirectPath
+	}
+	return config.RedirectPath
+}
+
+func (config *Config) cookieName() string {
+	if config.CookieName == "" {
+		return defaultCookieName
+	}
+	return config.CookieName
+}
+
+func (config *Config) scopes() []string {
+	scopes := []string{"openid"}
+	for _, scope := range config.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(config.Scopes) == 0 {
+		scopes = append(scopes, "profile", "email")
+	}
+	return scopes
+}
+
+func (config *Config) sessionLifetime() time.Duration {
+	if lifetime, err := time.ParseDuration(config.SessionLifetime); err == nil && lifetime > 0 {
+		return lifetime
+	}
+	return defaultSessionLifetime
+}
+
+func (config *Config) groupsClaim() string {
+	if config.GroupsClaim == "" {
+		return "groups"
+	}
+	return config.GroupsClaim
+}
+
+func (config *Config) headers() IdentityHeader {
+	headers := IdentityHeader{User: defaultUserHeader, Email: defaultEmailHeader, Groups: defaultGroupsHeader}
+	if config.Headers != nil {
+		if config.Headers.User != "" {
+			headers.User = config.Headers.User
+		}
+		if config.Headers.Email != "" {
+			headers.Email = config.Headers.Email
+		}
+		if config.Headers.Groups != "" {
+			headers.Groups = config.Headers.Groups
+		}
+	}
+	return headers
+}
@@ -0,0 +1,390 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/jwt"
+)
+
+const clockSkew = time.Minute
+
+// Logger is the logging contract used by the gateway.
+type Logger interface {
+	Info(msg string)
+	Error(msg string)
+}
+
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// Gateway is the object responsible to authenticate the requests of a
+// virtual host against an OpenID Connect provider using the authorization
+// code flow, keeping the identity in an encrypted session cookie.
+type Gateway struct {
+	config   *Config
+	basePath string
+	logger   Logger
+	client   *http.Client
+	codec    *cookieCodec
+	provider *providerMetadata
+	keySet   jwt.KeySet
+	mutex    sync.Mutex
+	now      func() time.Time
+}
+
+// NewGateway returns a new object of Gateway type. The vhost is the from of the virtual host, its
+// sessions are only accepted by it, and basePath is its path prefix, where the callback is
+// handled and the cookies are sent.
+func NewGateway(config *Config, vhost string, basePath string, logger Logger) (*Gateway, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	codec, err := newCookieCodec(config.CookieSecret, config.ClientID, strings.TrimSuffix(config.Issuer, "/"), vhost)
+	if err != nil {
+		return nil, err
+	}
+	return &Gateway{
+		config:   config,
+		basePath: strings.TrimSuffix(basePath, "/"),
+		logger:   logger,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		codec:    codec,
+		now:      time.Now,
+	}, nil
+}
+
+// Authenticate returns the identity of the request. When there is no valid
+// session the response is written (login redirect, callback handling or an
+// error) and nil is returned.
+func (gateway *Gateway) Authenticate(rw http.ResponseWriter, req *http.Request) *Identity {
+	if req.URL.Path == gateway.callbackPath() {
+		gateway.handleCallback(rw, req)
+		return nil
+	}
+
+	if identity := gateway.readSession(req); identity != nil {
+		return identity
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(rw, "Not authorized", http.StatusUnauthorized)
+		return nil
+	}
+
+	gateway.startLogin(rw, req)
+	return nil
+}
+
+// ForwardIdentity replaces any client supplied identity headers with the authenticated ones.
+func (gateway *Gateway) ForwardIdentity(header http.Header, identity *Identity) {
+	names := gateway.config.headers()
+	header.Del(names.User)
+	header.Del(names.Email)
+	header.Del(names.Groups)
+	if identity == nil {
+		return
+	}
+	header.Set(names.User, identity.Subject)
+	if identity.Email != "" {
+		header.Set(names.Email, identity.Email)
+	}
+	if len(identity.Groups) > 0 {
+		header.Set(names.Groups, strings.Join(identity.Groups, ","))
+	}
+}
+
+func (gateway *Gateway) readSession(req *http.Request) *Identity {
+	cookie, err := req.Cookie(gateway.config.cookieName())
+	if err != nil {
+		return nil
+	}
+	var identity Identity
+	if err := gateway.codec.decode(cookie.Name, cookie.Value, &identity); err != nil {
+		return nil
+	}
+	if gateway.now().Unix() >= identity.ExpiresAt {
+		return nil
+	}
+	// the allowed users may have changed since the login
+	if !gateway.isAllowed(&identity) {
+		return nil
+	}
+	return &identity
+}
+
+func (gateway *Gateway) startLogin(rw http.ResponseWriter, req *http.Request) {
+	provider, err := gateway.discover()
+	if err != nil {
+		gateway.logger.Error(fmt.Sprintf("oidc: discovery failed: %v", err))
+		http.Error(rw, "Authentication provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	stateCookieName := gateway.stateCookieName()
+	value, err := gateway.codec.encode(stateCookieName, loginState{State: state, Nonce: nonce, ReturnTo: req.URL.RequestURI()})
+	if err != nil {
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(rw, gateway.newCookie(req, stateCookieName, value, 10*time.Minute))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", gateway.config.ClientID)
+	params.Set("redirect_uri", gateway.redirectURI(req))
+	params.Set("scope", strings.Join(gateway.config.scopes(), " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(rw, req, provider.AuthorizationEndpoint+separator+params.Encode(), http.StatusFound)
+}
+
+func (gateway *Gateway) handleCallback(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		gateway.logger.Error(fmt.Sprintf("oidc: provider returned error %q: %s", providerError, query.Get("error_description")))
+		http.Error(rw, "Authentication failed", http.StatusUnauthorized)
+		return
+	}
+
+	stateCookieName := gateway.stateCookieName()
+	cookie, err := req.Cookie(stateCookieName)
+	if err != nil {
+		http.Error(rw, "Missing login state", http.StatusBadRequest)
+		return
+	}
+	var login loginState
+	if err := gateway.codec.decode(stateCookieName, cookie.Value, &login); err != nil || login.State != query.Get("state") {
+		http.Error(rw, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(rw, gateway.newCookie(req, stateCookieName, "", -1))
+
+	identity, err := gateway.exchange(req, query.Get("code"), login.Nonce)
+	if err != nil {
+		gateway.logger.Error(fmt.Sprintf("oidc: login failed: %v", err))
+		http.Error(rw, "Authentication failed", http.StatusUnauthorized)
+		return
+	}
+
+	if !gateway.isAllowed(identity) {
+		gateway.logger.Info(fmt.Sprintf("oidc: access denied to '%v'", identity.Subject))
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	value, err := gateway.codec.encode(gateway.config.cookieName(), identity)
+	if err != nil {
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(rw, gateway.newCookie(req, gateway.config.cookieName(), value, gateway.config.sessionLifetime()))
+	gateway.logger.Info(fmt.Sprintf("oidc: '%v' logged in", identity.Subject))
+
+	http.Redirect(rw, req, safeReturnTo(login.ReturnTo), http.StatusFound)
+}
+
+func (gateway *Gateway) exchange(req *http.Request, code string, nonce string) (*Identity, error) {
+	if code == "" {
+		return nil, errors.New("missing authorization code")
+	}
+	provider, err := gateway.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", gateway.redirectURI(req))
+	form.Set("client_id", gateway.config.ClientID)
+
+	tokenReq, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.Header.Set("Accept", "application/json")
+	if gateway.config.ClientSecret != "" {
+		tokenReq.SetBasicAuth(url.QueryEscape(gateway.config.ClientID), url.QueryEscape(gateway.config.ClientSecret))
+	}
+
+	resp, err := gateway.client.Do(tokenReq)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if tokenResponse.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	token, err := jwt.Verify(tokenResponse.IDToken, gateway.keySet)
+	if err != nil {
+		return nil, err
+	}
+	if err := token.Validate(jwt.Expectations{
+		Issuer:   provider.Issuer,
+		Audience: []string{gateway.config.ClientID},
+		Leeway:   clockSkew,
+		Now:      gateway.now,
+	}); err != nil {
+		return nil, err
+	}
+	if token.Claims.String("nonce") != nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	if token.Claims.String("sub") == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+
+	return &Identity{
+		Subject:   token.Claims.String("sub"),
+		Email:     token.Claims.String("email"),
+		Groups:    token.Claims.Strings(gateway.config.groupsClaim()),
+		ExpiresAt: gateway.now().Add(gateway.config.sessionLifetime()).Unix(),
+	}, nil
+}
+
+func (gateway *Gateway) isAllowed(identity *Identity) bool {
+	if len(gateway.config.AllowedEmails) == 0 && len(gateway.config.AllowedGroups) == 0 {
+		return true
+	}
+
+	email := strings.ToLower(identity.Email)
+	for _, allowed := range gateway.config.AllowedEmails {
+		allowed = strings.ToLower(allowed)
+		if email != "" && (email == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed))) {
+			return true
+		}
+	}
+
+	for _, allowed := range gateway.config.AllowedGroups {
+		for _, group := range identity.Groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (gateway *Gateway) discover() (*providerMetadata, error) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+
+	if gateway.provider != nil {
+		return gateway.provider, nil
+	}
+
+	issuer := strings.TrimSuffix(gateway.config.Issuer, "/")
+	resp, err := gateway.client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned status %d", resp.StatusCode)
+	}
+
+	var metadata providerMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %w", err)
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", metadata.Issuer, gateway.config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JwksURI == "" {
+		return nil, errors.New("discovery document is incomplete")
+	}
+
+	gateway.provider = &metadata
+	gateway.keySet = jwt.NewRemoteKeySet(metadata.JwksURI, gateway.client)
+	gateway.logger.Info(fmt.Sprintf("oidc: discovered provider '%v'", metadata.Issuer))
+	return gateway.provider, nil
+}
+
+func (gateway *Gateway) redirectURI(req *http.Request) string {
+	scheme := "https"
+	if req.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + req.Host + gateway.callbackPath()
+}
+
+// callbackPath is the redirect path under the path prefix of the virtual host.
+func (gateway *Gateway) callbackPath() string {
+	return gateway.basePath + gateway.config.redirectPath()
+}
+
+// cookiePath scopes the cookies to the path prefix of the virtual host.
+func (gateway *Gateway) cookiePath() string {
+	if gateway.basePath == "" {
+		return "/"
+	}
+	return gateway.basePath
+}
+
+func (gateway *Gateway) stateCookieName() string {
+	return gateway.config.cookieName() + "_state"
+}
+
+func (gateway *Gateway) newCookie(req *http.Request, name string, value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     gateway.cookiePath(),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	} else {
+		cookie.MaxAge = int(maxAge.Seconds())
+	}
+	return cookie
+}
+
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+	return returnTo
+}
@@ -0,0 +1,305 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// stubProvider is a minimal OpenID Connect provider issuing RS256 id_tokens.
+type stubProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	nonce  string
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider := &stubProvider{key: key, claims: map[string]interface{}{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.server.URL,
+			"authorization_endpoint": provider.server.URL + "/authorize",
+			"token_endpoint":         provider.server.URL + "/token",
+			"jwks_uri":               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		if clientID != "dashboard" || secret != "s3cret" || r.FormValue("code") != "good-code" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   provider.server.URL,
+			"aud":   "dashboard",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": provider.nonce,
+		}
+		for name, value := range provider.claims {
+			claims[name] = value
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": provider.sign(t, claims)})
+	})
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (provider *stubProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "stub"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, provider.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestGateway(t *testing.T, provider *stubProvider, config *Config) *Gateway {
+	logger := &mocks.MockLogger{}
+	logger.On("Info", mock.Anything).Maybe()
+	logger.On("Error", mock.Anything).Maybe()
+	config.Issuer = provider.server.URL
+	config.ClientID = "dashboard"
+	config.ClientSecret = "s3cret"
+	config.CookieSecret = "0123456789abcdef0123456789abcdef"
+	gateway, err := NewGateway(config, "dashboard.local", "", logger)
+	require.NoError(t, err)
+	return gateway
+}
+
+// login runs the authorization code flow and returns the cookies set by the callback.
+func login(t *testing.T, gateway *Gateway, provider *stubProvider) *httptest.ResponseRecorder {
+	start := httptest.NewRecorder()
+	assert.Nil(t, gateway.Authenticate(start, httptest.NewRequest(http.MethodGet, "http://dashboard.local/reports?page=2", nil)))
+	require.Equal(t, http.StatusFound, start.Code)
+
+	location, err := url.Parse(start.Header().Get("Location"))
+	require.NoError(t, err)
+	provider.nonce = location.Query().Get("nonce")
+
+	callback := httptest.NewRequest(http.MethodGet, "http://dashboard.local/oauth2/callback?code=good-code&state="+location.Query().Get("state"), nil)
+	for _, cookie := range start.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	result := httptest.NewRecorder()
+	assert.Nil(t, gateway.Authenticate(result, callback))
+	return result
+}
+
+func TestGateway_Authenticate_WhenNoSession_ThenRedirectsToProvider(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	gateway := newTestGateway(t, provider, &Config{Scopes: []string{"openid", "email"}})
+	rw := httptest.NewRecorder()
+
+	// Act
+	identity := gateway.Authenticate(rw, httptest.NewRequest(http.MethodGet, "http://dashboard.local/", nil))
+
+	// Assert
+	assert.Nil(t, identity)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, provider.server.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "dashboard", location.Query().Get("client_id"))
+	assert.Equal(t, "openid email", location.Query().Get("scope"))
+	assert.Equal(t, "http://dashboard.local/oauth2/callback", location.Query().Get("redirect_uri"))
+}
+
+func TestGateway_Authenticate_WhenVirtualHostHasPathPrefix_ThenCallbackIsUnderPrefix(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	gateway := newTestGateway(t, provider, &Config{})
+	gateway.basePath = "/dashboard"
+	rw := httptest.NewRecorder()
+
+	// Act
+	identity := gateway.Authenticate(rw, httptest.NewRequest(http.MethodGet, "http://apps.local/dashboard/", nil))
+	callback := httptest.NewRecorder()
+	gateway.Authenticate(callback, httptest.NewRequest(http.MethodGet, "http://apps.local/dashboard/oauth2/callback?code=good-code&state=forged", nil))
+
+	// Assert
+	assert.Nil(t, identity)
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "http://apps.local/dashboard/oauth2/callback", location.Query().Get("redirect_uri"))
+	assert.Equal(t, http.StatusBadRequest, callback.Code)
+}
+
+func TestGateway_Authenticate_WhenGatewayIsRecreatedWithSameSecret_ThenKeepsSession(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	provider.claims = map[string]interface{}{"sub": "u-1"}
+	callback := login(t, newTestGateway(t, provider, &Config{}), provider)
+	reloaded := newTestGateway(t, provider, &Config{})
+	req := httptest.NewRequest(http.MethodGet, "http://dashboard.local/reports", nil)
+	for _, cookie := range callback.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	// Act
+	identity := reloaded.Authenticate(httptest.NewRecorder(), req)
+
+	// Assert
+	require.NotNil(t, identity)
+	assert.Equal(t, "u-1", identity.Subject)
+}
+
+func TestGateway_Authenticate_WhenCallbackSucceeds_ThenSetsSessionAndForwardsIdentity(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	provider.claims = map[string]interface{}{"sub": "u-1", "email": "alice@example.com", "groups": []string{"ops"}}
+	gateway := newTestGateway(t, provider, &Config{AllowedGroups: []string{"ops"}, Headers: &IdentityHeader{User: "X-User"}})
+
+	// Act
+	callback := login(t, gateway, provider)
+	req := httptest.NewRequest(http.MethodGet, "http://dashboard.local/reports", nil)
+	for _, cookie := range callback.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	identity := gateway.Authenticate(httptest.NewRecorder(), req)
+
+	// Assert
+	assert.Equal(t, http.StatusFound, callback.Code)
+	assert.Equal(t, "/reports?page=2", callback.Header().Get("Location"))
+	require.NotNil(t, identity)
+	header := http.Header{"X-User": {"spoofed"}}
+	gateway.ForwardIdentity(header, identity)
+	assert.Equal(t, "u-1", header.Get("X-User"))
+	assert.Equal(t, "alice@example.com", header.Get(defaultEmailHeader))
+	assert.Equal(t, "ops", header.Get(defaultGroupsHeader))
+}
+
+func TestGateway_Authenticate_WhenSessionIsFromAnotherVirtualHostOrNoLongerAllowed_ThenStartsLogin(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	provider.claims = map[string]interface{}{"sub": "u-1", "email": "alice@example.com"}
+	callback := login(t, newTestGateway(t, provider, &Config{}), provider)
+	otherHost := newTestGateway(t, provider, &Config{})
+	otherHost.codec, _ = newCookieCodec(otherHost.config.CookieSecret, otherHost.config.ClientID, otherHost.config.Issuer, "admin.local")
+	restricted := newTestGateway(t, provider, &Config{AllowedEmails: []string{"bob@example.com"}})
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://dashboard.local/reports", nil)
+		for _, cookie := range callback.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	// Act
+	otherHostIdentity := otherHost.Authenticate(httptest.NewRecorder(), request())
+	restrictedIdentity := restricted.Authenticate(httptest.NewRecorder(), request())
+
+	// Assert
+	assert.Nil(t, otherHostIdentity)
+	assert.Nil(t, restrictedIdentity)
+}
+
+func TestGateway_Authenticate_WhenVirtualHostHasPathPrefix_ThenCookiesAreScopedToIt(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	gateway := newTestGateway(t, provider, &Config{})
+	gateway.basePath = "/dashboard"
+	rw := httptest.NewRecorder()
+
+	// Act
+	gateway.Authenticate(rw, httptest.NewRequest(http.MethodGet, "http://apps.local/dashboard/", nil))
+
+	// Assert
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "/dashboard", cookies[0].Path)
+}
+
+func TestGateway_Authenticate_WhenIdentityIsNotAllowed_ThenReturnsForbidden(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	provider.claims = map[string]interface{}{"sub": "u-2", "email": "bob@other.com"}
+	gateway := newTestGateway(t, provider, &Config{AllowedEmails: []string{"@example.com"}})
+
+	// Act
+	callback := login(t, gateway, provider)
+
+	// Assert
+	assert.Equal(t, http.StatusForbidden, callback.Code)
+}
+
+func TestGateway_Authenticate_WhenStateDoesNotMatch_ThenReturnsBadRequest(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	gateway := newTestGateway(t, provider, &Config{})
+	rw := httptest.NewRecorder()
+
+	// Act
+	identity := gateway.Authenticate(rw, httptest.NewRequest(http.MethodGet, "http://dashboard.local/oauth2/callback?code=good-code&state=forged", nil))
+
+	// Assert
+	assert.Nil(t, identity)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestGateway_Authenticate_WhenSessionCookieIsTampered_ThenStartsLogin(t *testing.T) {
+	// Arrange
+	provider := newStubProvider(t)
+	gateway := newTestGateway(t, provider, &Config{})
+	req := httptest.NewRequest(http.MethodGet, "http://dashboard.local/", nil)
+	req.AddCookie(&http.Cookie{Name: defaultCookieName, Value: "bm90LWEtdmFsaWQtc2Vzc2lvbg"})
+	rw := httptest.NewRecorder()
+
+	// Act
+	identity := gateway.Authenticate(rw, req)
+
+	// Assert
+	assert.Nil(t, identity)
+	assert.Equal(t, http.StatusFound, rw.Code)
+}
+
+func TestConfig_Validate_WhenRequiredFieldsMissing_ThenReturnsError(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "missing issuer", config: Config{ClientID: "id"}},
+		{name: "missing client id", config: Config{Issuer: "https://idp"}},
+		{name: "relative redirect path", config: Config{Issuer: "https://idp", ClientID: "id", RedirectPath: "callback", CookieSecret: "0123456789abcdef"}},
+		{name: "missing cookie secret", config: Config{Issuer: "https://idp", ClientID: "id"}},
+		{name: "short cookie secret", config: Config{Issuer: "https://idp", ClientID: "id", CookieSecret: "short"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			err := tt.config.Validate()
+
+			// Assert
+			assert.Error(t, err)
+		})
+	}
+}
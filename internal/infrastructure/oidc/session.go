@@ -0,0 +1,88 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Identity is the authenticated user kept in the session cookie.
+type Identity struct {
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	ReturnTo string `json:"return_to"`
+}
+
+// cookieCodec seals cookie values with AES-GCM so they cannot be read or forged by the client.
+// The values are bound to the cookie name and to a context, so a cookie sealed for a client of
+// a provider on a virtual host is not accepted by another one sharing the secret.
+type cookieCodec struct {
+	aead    cipher.AEAD
+	context string
+}
+
+func newCookieCodec(secret string, context ...string) (*cookieCodec, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieCodec{aead: aead, context: strings.Join(context, "\x00")}, nil
+}
+
+func (codec *cookieCodec) encode(name string, value interface{}) (string, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, codec.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := codec.aead.Seal(nonce, nonce, plain, codec.additionalData(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (codec *cookieCodec) decode(name string, encoded string, value interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < codec.aead.NonceSize() {
+		return errors.New("cookie value is too short")
+	}
+	nonce, ciphertext := sealed[:codec.aead.NonceSize()], sealed[codec.aead.NonceSize():]
+	plain, err := codec.aead.Open(nil, nonce, ciphertext, codec.additionalData(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, value)
+}
+
+func (codec *cookieCodec) additionalData(name string) []byte {
+	return []byte(name + "\x00" + codec.context)
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,95 @@
+package revocation
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Logger is the logging contract used by the checker.
+type Logger interface {
+	Error(msg string)
+}
+
+// RevokedError reports a revoked certificate.
+type RevokedError struct {
+	Subject string
+	Serial  string
+}
+
+func (err *RevokedError) Error() string {
+	return fmt.Sprintf("certificate '%s' (serial %s) is revoked", err.Subject, err.Serial)
+}
+
+// Checker is the object responsible to check the revocation status of verified client
+// certificate chains against CRLs and OCSP responders.
+type Checker struct {
+	config *Config
+	logger Logger
+	crls   *crlStore
+	ocsp   *ocspClient
+}
+
+// NewChecker returns a new object of Checker type. The CRLs are loaded before returning.
+func NewChecker(config *Config, logger Logger) (*Checker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: config.timeout()}
+	checker := &Checker{config: config, logger: logger}
+	if len(config.CRLs) > 0 {
+		checker.crls = newCRLStore(config.CRLs, config.crlRefresh(), client, logger, time.Now)
+	}
+	if config.OCSP {
+		checker.ocsp = newOCSPClient(config.OCSPResponder, config.ocspCacheTTL(), client, time.Now)
+	}
+	return checker, nil
+}
+
+// Check checks every certificate of a verified chain, from the leaf to the root, against its
+// issuer. A revoked certificate always returns a RevokedError. When the status can not be
+// established an error is returned, unless the checker fails open.
+func (checker *Checker) Check(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		certificate, issuer := chain[i], chain[i+1]
+		revoked, err := checker.status(certificate, issuer)
+		if revoked {
+			return &RevokedError{Subject: certificate.Subject.String(), Serial: certificate.SerialNumber.Text(16)}
+		}
+		if err == nil {
+			continue
+		}
+		if !checker.config.FailOpen {
+			return fmt.Errorf("revocation status unavailable: %w", err)
+		}
+		checker.logger.Error(fmt.Sprintf("revocation: accepting '%v' without status: %v", certificate.Subject, err))
+	}
+	return nil
+}
+
+func (checker *Checker) status(certificate *x509.Certificate, issuer *x509.Certificate) (bool, error) {
+	var failure error
+	if checker.crls != nil {
+		revoked, err := checker.crls.check(certificate, issuer)
+		if revoked {
+			return true, nil
+		}
+		failure = err
+	}
+	if checker.ocsp != nil {
+		revoked, err := checker.ocsp.check(certificate, issuer)
+		switch {
+		case revoked:
+			return true, nil
+		case err == nil:
+			// An OCSP answer establishes the status even when the CRLs could not.
+			return false, nil
+		case !errors.Is(err, errNoResponder):
+			failure = err
+		}
+	}
+	return false, failure
+}
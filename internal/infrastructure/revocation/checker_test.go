@@ -0,0 +1,301 @@
+package revocation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testPKI struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	client *x509.Certificate
+}
+
+func newTestPKI(t *testing.T, ocspServer string) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ocspServer != "" {
+		clientTemplate.OCSPServer = []string{ocspServer}
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, ca, &clientKey.PublicKey, caKey)
+	require.NoError(t, err)
+	client, err := x509.ParseCertificate(clientDER)
+	require.NoError(t, err)
+
+	return &testPKI{ca: ca, caKey: caKey, client: client}
+}
+
+func (pki *testPKI) writeCRL(t *testing.T, revoked ...*big.Int) string {
+	return pki.writeCRLUntil(t, time.Now().Add(time.Hour), revoked...)
+}
+
+func (pki *testPKI) writeCRLUntil(t *testing.T, nextUpdate time.Time, revoked ...*big.Int) string {
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, serial := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, pki.ca, pki.caKey)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600))
+	return path
+}
+
+func (pki *testPKI) chain() []*x509.Certificate {
+	return []*x509.Certificate{pki.client, pki.ca}
+}
+
+func newOCSPResponder(t *testing.T, status int, calls *int32) (*httptest.Server, *testPKI) {
+	return newOCSPResponderAt(t, status, calls, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+}
+
+// newOCSPResponderAt starts a responder whose answers have the given validity.
+func newOCSPResponderAt(t *testing.T, status int, calls *int32, thisUpdate time.Time, nextUpdate time.Time) (*httptest.Server, *testPKI) {
+	var pki *testPKI
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+		response, err := ocsp.CreateResponse(pki.ca, pki.ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   nextUpdate,
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, pki.caKey)
+		require.NoError(t, err)
+		_, _ = w.Write(response)
+	}))
+	pki = newTestPKI(t, server.URL)
+	t.Cleanup(server.Close)
+	return server, pki
+}
+
+func TestChecker_Check_WhenCRLRevokesCertificate_ThenReturnsRevokedError(t *testing.T) {
+	// Arrange
+	pki := newTestPKI(t, "")
+	checker, err := NewChecker(&Config{CRLs: []string{pki.writeCRL(t, big.NewInt(42))}}, &mocks.MockLogger{})
+	require.NoError(t, err)
+
+	// Act
+	err = checker.Check(pki.chain())
+
+	// Assert
+	var revokedErr *RevokedError
+	assert.True(t, errors.As(err, &revokedErr))
+	assert.Equal(t, "2a", revokedErr.Serial)
+}
+
+func TestChecker_Check_WhenCRLDoesNotListCertificate_ThenReturnsNil(t *testing.T) {
+	// Arrange
+	pki := newTestPKI(t, "")
+	checker, err := NewChecker(&Config{CRLs: []string{pki.writeCRL(t, big.NewInt(7))}}, &mocks.MockLogger{})
+	require.NoError(t, err)
+
+	// Act
+	err = checker.Check(pki.chain())
+
+	// Assert
+	assert.NoError(t, err)
+}
+
+func TestChecker_Check_WhenCRLCannotBeLoaded_ThenAppliesFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		failOpen bool
+		fails    bool
+	}{
+		{name: "fail closed", failOpen: false, fails: true},
+		{name: "fail open", failOpen: true, fails: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			logger := &mocks.MockLogger{}
+			logger.On("Error", mock.Anything)
+			pki := newTestPKI(t, "")
+			checker, err := NewChecker(&Config{CRLs: []string{filepath.Join(t.TempDir(), "missing.crl")}, FailOpen: tt.failOpen}, logger)
+			require.NoError(t, err)
+
+			// Act
+			err = checker.Check(pki.chain())
+
+			// Assert
+			assert.Equal(t, tt.fails, err != nil)
+		})
+	}
+}
+
+func TestChecker_Check_WhenOCSPResponderRevokes_ThenReturnsRevokedErrorAndCachesIt(t *testing.T) {
+	// Arrange
+	var calls int32
+	_, pki := newOCSPResponder(t, ocsp.Revoked, &calls)
+	checker, err := NewChecker(&Config{OCSP: true}, &mocks.MockLogger{})
+	require.NoError(t, err)
+
+	// Act
+	first := checker.Check(pki.chain())
+	second := checker.Check(pki.chain())
+
+	// Assert
+	var revokedErr *RevokedError
+	assert.True(t, errors.As(first, &revokedErr))
+	assert.True(t, errors.As(second, &revokedErr))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestChecker_Check_WhenOCSPResponderAnswersGood_ThenReturnsNil(t *testing.T) {
+	// Arrange
+	var calls int32
+	responder, pki := newOCSPResponder(t, ocsp.Good, &calls)
+	checker, err := NewChecker(&Config{OCSP: true, OCSPResponder: responder.URL}, &mocks.MockLogger{})
+	require.NoError(t, err)
+
+	// Act
+	err = checker.Check(pki.chain())
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestChecker_Check_WhenOCSPResponseIsStaleOrFromFuture_ThenAppliesFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		thisUpdate time.Time
+		nextUpdate time.Time
+		failOpen   bool
+		fails      bool
+	}{
+		{name: "expired fail closed", thisUpdate: time.Now().Add(-2 * time.Hour), nextUpdate: time.Now().Add(-time.Hour), fails: true},
+		{name: "from future fail closed", thisUpdate: time.Now().Add(time.Hour), nextUpdate: time.Now().Add(2 * time.Hour), fails: true},
+		{name: "expired fail open", thisUpdate: time.Now().Add(-2 * time.Hour), nextUpdate: time.Now().Add(-time.Hour), failOpen: true, fails: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Arrange
+			logger := &mocks.MockLogger{}
+			logger.On("Error", mock.Anything)
+			var calls int32
+			_, pki := newOCSPResponderAt(t, ocsp.Good, &calls, tt.thisUpdate, tt.nextUpdate)
+			checker, err := NewChecker(&Config{OCSP: true, FailOpen: tt.failOpen}, logger)
+			require.NoError(t, err)
+
+			// Act
+			first := checker.Check(pki.chain())
+			second := checker.Check(pki.chain())
+
+			// Assert
+			assert.Equal(t, tt.fails, first != nil)
+			assert.Equal(t, tt.fails, second != nil)
+			assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestChecker_Check_WhenNoCRLCoversIssuer_ThenReturnsError(t *testing.T) {
+	// Arrange
+	pki := newTestPKI(t, "")
+	other := newTestPKI(t, "")
+	checker, err := NewChecker(&Config{CRLs: []string{other.writeCRL(t)}}, &mocks.MockLogger{})
+	require.NoError(t, err)
+
+	// Act
+	err = checker.Check(pki.chain())
+
+	// Assert
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no CRL available for 'CN=Test CA'")
+}
+
+func TestChecker_Check_WhenOneCoveringCRLIsExpired_ThenUsesTheCurrentOne(t *testing.T) {
+	// Arrange
+	pki := newTestPKI(t, "")
+	expired := pki.writeCRLUntil(t, time.Now().Add(-time.Minute))
+	expiredOnly, err := NewChecker(&Config{CRLs: []string{expired}}, &mocks.MockLogger{})
+	require.NoError(t, err)
+	withCurrent, err := NewChecker(&Config{CRLs: []string{expired, pki.writeCRL(t)}}, &mocks.MockLogger{})
+	require.NoError(t, err)
+
+	// Act
+	expiredErr := expiredOnly.Check(pki.chain())
+	currentErr := withCurrent.Check(pki.chain())
+
+	// Assert
+	require.Error(t, expiredErr)
+	assert.Contains(t, expiredErr.Error(), "expired")
+	assert.NoError(t, currentErr)
+}
+
+func TestConfig_Validate_WhenConfigIsInvalid_ThenReturnsError(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *Config
+		expected string
+	}{
+		{name: "nothing to check", config: &Config{}, expected: "at least one of 'crls' or 'ocsp' is required"},
+		{name: "bad responder", config: &Config{OCSP: true, OCSPResponder: "ldap://ca"}, expected: "'ocsp_responder' must be an absolute http or https URL"},
+		{name: "bad refresh", config: &Config{CRLs: []string{"/ca.crl"}, CRLRefresh: "soon"}, expected: "'crl_refresh' is not a valid duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Act
+			err := tt.config.Validate()
+
+			// Assert
+			assert.EqualError(t, err, tt.expected)
+		})
+	}
+}
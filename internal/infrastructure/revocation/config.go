@@ -0,0 +1,87 @@
+package revocation
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCRLRefresh   = time.Hour
+	defaultOCSPCacheTTL = time.Hour
+	defaultTimeout      = 5 * time.Second
+	maxResponseSize     = 10 << 20
+)
+
+// Config is the revocation checking configuration of the client certificates of a virtual host.
+type Config struct {
+	CRLs          []string `json:"crls,omitempty"`
+	CRLRefresh    string   `json:"crl_refresh,omitempty"`
+	OCSP          bool     `json:"ocsp,omitempty"`
+	OCSPResponder string   `json:"ocsp_responder,omitempty"`
+	OCSPCacheTTL  string   `json:"ocsp_cache_ttl,omitempty"`
+	Timeout       string   `json:"timeout,omitempty"`
+	FailOpen      bool     `json:"fail_open,omitempty"`
+}
+
+// Validate checks that the revocation configuration is usable.
+func (config *Config) Validate() error {
+	if len(config.CRLs) == 0 && !config.OCSP {
+		return errors.New("at least one of 'crls' or 'ocsp' is required")
+	}
+	for i, location := range config.CRLs {
+		if strings.TrimSpace(location) == "" {
+			return fmt.Errorf("crls[%d]: location cannot be empty", i)
+		}
+		if isURL(location) {
+			if parsed, err := url.Parse(location); err != nil || parsed.Host == "" {
+				return fmt.Errorf("crls[%d]: invalid URL '%s'", i, location)
+			}
+		}
+	}
+	if config.OCSPResponder != "" {
+		responder, err := url.Parse(config.OCSPResponder)
+		if err != nil || !isURL(config.OCSPResponder) || responder.Host == "" {
+			return errors.New("'ocsp_responder' must be an absolute http or https URL")
+		}
+	}
+	durations := [][2]string{
+		{"crl_refresh", config.CRLRefresh},
+		{"ocsp_cache_ttl", config.OCSPCacheTTL},
+		{"timeout", config.Timeout},
+	}
+	for _, duration := range durations {
+		if duration[1] == "" {
+			continue
+		}
+		if value, err := time.ParseDuration(duration[1]); err != nil || value <= 0 {
+			return fmt.Errorf("'%s' is not a valid duration", duration[0])
+		}
+	}
+	return nil
+}
+
+func (config *Config) crlRefresh() time.Duration {
+	return parseDuration(config.CRLRefresh, defaultCRLRefresh)
+}
+
+func (config *Config) ocspCacheTTL() time.Duration {
+	return parseDuration(config.OCSPCacheTTL, defaultOCSPCacheTTL)
+}
+
+func (config *Config) timeout() time.Duration {
+	return parseDuration(config.Timeout, defaultTimeout)
+}
+
+func parseDuration(value string, fallback time.Duration) time.Duration {
+	if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+		return duration
+	}
+	return fallback
+}
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
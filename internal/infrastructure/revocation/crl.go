@@ -0,0 +1,134 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// crlStore keeps the revocation lists of the configured locations. The lists are loaded
+// again in the background once the refresh interval has passed; a location that fails to
+// load keeps its previous list.
+type crlStore struct {
+	locations  []string
+	refresh    time.Duration
+	client     *http.Client
+	logger     Logger
+	now        func() time.Time
+	mu         sync.RWMutex
+	lists      map[string]*x509.RevocationList
+	loadedAt   time.Time
+	refreshing atomic.Bool
+}
+
+func newCRLStore(locations []string, refresh time.Duration, client *http.Client, logger Logger, now func() time.Time) *crlStore {
+	store := &crlStore{
+		locations: locations,
+		refresh:   refresh,
+		client:    client,
+		logger:    logger,
+		now:       now,
+		lists:     make(map[string]*x509.RevocationList),
+	}
+	store.load()
+	return store
+}
+
+func (store *crlStore) load() {
+	for _, location := range store.locations {
+		list, err := store.fetch(location)
+		if err != nil {
+			store.logger.Error(fmt.Sprintf("revocation: failed to load CRL '%s': %v", location, err))
+			continue
+		}
+		store.mu.Lock()
+		store.lists[location] = list
+		store.mu.Unlock()
+	}
+	store.mu.Lock()
+	store.loadedAt = store.now()
+	store.mu.Unlock()
+}
+
+func (store *crlStore) fetch(location string) (*x509.RevocationList, error) {
+	var data []byte
+	var err error
+	if isURL(location) {
+		data, err = store.download(location)
+	} else {
+		data, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
+
+func (store *crlStore) download(location string) ([]byte, error) {
+	resp, err := store.client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+}
+
+// refreshIfDue starts a background load when the refresh interval has passed.
+func (store *crlStore) refreshIfDue() {
+	store.mu.RLock()
+	due := store.now().Sub(store.loadedAt) >= store.refresh
+	store.mu.RUnlock()
+	if due && store.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer store.refreshing.Store(false)
+			store.load()
+		}()
+	}
+}
+
+// check looks for the certificate in the lists signed by its issuer. It returns an error
+// when no list covers the issuer, or when every list covering it is out of date. A
+// certificate listed in an out of date list is still revoked.
+func (store *crlStore) check(certificate *x509.Certificate, issuer *x509.Certificate) (bool, error) {
+	store.refreshIfDue()
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	covered := false
+	var expired error
+	for _, list := range store.lists {
+		if !bytes.Equal(list.RawIssuer, certificate.RawIssuer) || list.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(certificate.SerialNumber) == 0 {
+				return true, nil
+			}
+		}
+		if !list.NextUpdate.IsZero() && store.now().After(list.NextUpdate) {
+			expired = fmt.Errorf("CRL of '%v' expired at %v", issuer.Subject, list.NextUpdate)
+			continue
+		}
+		covered = true
+	}
+	if covered {
+		return false, nil
+	}
+	if expired != nil {
+		return false, expired
+	}
+	return false, fmt.Errorf("no CRL available for '%v'", issuer.Subject)
+}
@@ -0,0 +1,140 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	maxOCSPCacheEntries = 10000
+	// ocspClockSkew is how far in the future the ThisUpdate of a response is accepted.
+	ocspClockSkew = 5 * time.Minute
+)
+
+// errNoResponder is returned for certificates without an OCSP responder.
+var errNoResponder = errors.New("no OCSP responder")
+
+type ocspEntry struct {
+	revoked bool
+	expires time.Time
+}
+
+// ocspClient asks the OCSP responders about certificates and caches their answers until
+// the next update announced by the responder, limited by the cache TTL.
+type ocspClient struct {
+	responder string
+	ttl       time.Duration
+	client    *http.Client
+	now       func() time.Time
+	mu        sync.Mutex
+	cache     map[string]ocspEntry
+}
+
+func newOCSPClient(responder string, ttl time.Duration, client *http.Client, now func() time.Time) *ocspClient {
+	return &ocspClient{
+		responder: responder,
+		ttl:       ttl,
+		client:    client,
+		now:       now,
+		cache:     make(map[string]ocspEntry),
+	}
+}
+
+// check returns the OCSP status of the certificate, or errNoResponder when there is no
+// responder to ask.
+func (client *ocspClient) check(certificate *x509.Certificate, issuer *x509.Certificate) (bool, error) {
+	responder := client.responder
+	if responder == "" && len(certificate.OCSPServer) > 0 {
+		responder = certificate.OCSPServer[0]
+	}
+	if responder == "" {
+		return false, errNoResponder
+	}
+
+	key := cacheKey(certificate, issuer)
+	now := client.now()
+	client.mu.Lock()
+	entry, ok := client.cache[key]
+	client.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.revoked, nil
+	}
+
+	response, err := client.query(responder, certificate, issuer)
+	if err != nil {
+		return false, err
+	}
+
+	var revoked bool
+	switch response.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		revoked = true
+	default:
+		return false, fmt.Errorf("OCSP responder '%s' does not know the certificate", responder)
+	}
+	// a stale or replayed good answer does not establish the status, a revocation is final
+	if !revoked && !response.NextUpdate.IsZero() && now.After(response.NextUpdate) {
+		return false, fmt.Errorf("OCSP response of '%s' expired at %v", responder, response.NextUpdate)
+	}
+	if !revoked && response.ThisUpdate.After(now.Add(ocspClockSkew)) {
+		return false, fmt.Errorf("OCSP response of '%s' is not valid until %v", responder, response.ThisUpdate)
+	}
+
+	expires := now.Add(client.ttl)
+	if !response.NextUpdate.IsZero() && response.NextUpdate.Before(expires) {
+		expires = response.NextUpdate
+	}
+	client.put(key, ocspEntry{revoked: revoked, expires: expires}, now)
+	return revoked, nil
+}
+
+func (client *ocspClient) query(responder string, certificate *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(certificate, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("OCSP responder '%s' unavailable: %w", responder, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder '%s' returned status %d", responder, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, certificate, issuer)
+}
+
+func (client *ocspClient) put(key string, entry ocspEntry, now time.Time) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.cache) >= maxOCSPCacheEntries {
+		for cached, cachedEntry := range client.cache {
+			if !now.Before(cachedEntry.expires) {
+				delete(client.cache, cached)
+			}
+		}
+	}
+	if entry.expires.After(now) && len(client.cache) < maxOCSPCacheEntries {
+		client.cache[key] = entry
+	}
+}
+
+func cacheKey(certificate *x509.Certificate, issuer *x509.Certificate) string {
+	sum := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:]) + ":" + certificate.SerialNumber.Text(16)
+}
@@ -1,6 +1,7 @@
 package presentation
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -11,6 +12,11 @@ import (
 	certificates "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
 )
 
+const serverPasswordFile = "server.password"
+
+// ErrInvalidCertificate is returned when an uploaded server certificate cannot be served.
+var ErrInvalidCertificate = errors.New("invalid server certificate")
+
 // CertificateService implementa la responsabilidad de gestionar certificados
 type CertificateService struct {
 	fileService IFileService
@@ -26,45 +32,13 @@ func NewCertificateService(fileService IFileService, logger domain.Logger) ICert
 }
 
 // HandleServerCertificates implementa ICertificateService.HandleServerCertificates
-func (cs *CertificateService) HandleServerCertificates(r *http.Request, certDir string) (*certificates.CertificateDefs, error) {
-	var serverCert *certificates.CertificateDefs
-
+func (cs *CertificateService) HandleServerCertificates(r *http.Request, certDir string, from string) (*certificates.CertificateDefs, error) {
 	useServerCert := r.FormValue("useServerCert") == "on"
 	if !useServerCert {
 		return nil, nil
 	}
 
-	// Save server certificate if provided
-	if _, header, err := r.FormFile("serverCertFile"); err == nil {
-		serverCertPath := filepath.Join(certDir, header.Filename)
-		if err := cs.fileService.SaveCertificateFromForm(r, "serverCertFile", serverCertPath); err != nil {
-			cs.logger.Error(fmt.Sprintf("Failed to save server cert: %v", err))
-			return nil, err
-		}
-		cs.logger.Info(fmt.Sprintf("Saved server certificate to %s", serverCertPath))
-
-		if serverCert == nil {
-			serverCert = &certificates.CertificateDefs{}
-		}
-		serverCert.PublicKey = serverCertPath
-	}
-
-	// Save server key if provided
-	if _, header, err := r.FormFile("serverKeyFile"); err == nil {
-		serverKeyPath := filepath.Join(certDir, header.Filename)
-		if err := cs.fileService.SaveCertificateFromForm(r, "serverKeyFile", serverKeyPath); err != nil {
-			cs.logger.Error(fmt.Sprintf("Failed to save server key: %v", err))
-			return nil, err
-		}
-		cs.logger.Info(fmt.Sprintf("Saved server key to %s", serverKeyPath))
-
-		if serverCert == nil {
-			serverCert = &certificates.CertificateDefs{}
-		}
-		serverCert.PrivateKey = serverKeyPath
-	}
-
-	return serverCert, nil
+	return cs.handleServerCertificateUploads(r, certDir, from, nil)
 }
 
 // HandleClientCertificates implementa ICertificateService.HandleClientCertificates
@@ -95,7 +69,7 @@ func (cs *CertificateService) HandleClientCertificates(r *http.Request, certDir
 }
 
 // HandleCertificateUpdates implementa ICertificateService.HandleCertificateUpdates
-func (cs *CertificateService) HandleCertificateUpdates(r *http.Request, certDir string, oldVH interface{}) (*certificates.CertificateDefs, *certificates.CertificateDefs, []string, []string, error) {
+func (cs *CertificateService) HandleCertificateUpdates(r *http.Request, certDir string, from string, oldVH interface{}) (*certificates.CertificateDefs, *certificates.CertificateDefs, []string, []string, error) {
 	// Collect old certificate paths for cleanup
 	oldServerPaths, oldClientPaths := cs.collectOldCertificatePaths(oldVH)
 
@@ -103,11 +77,8 @@ func (cs *CertificateService) HandleCertificateUpdates(r *http.Request, certDir
 	serverCert, clientCert := cs.initializeCertificateCopies(oldVH)
 
 	// Handle certificate updates
-	if err := cs.handleServerCertificateUpdate(r, certDir, &serverCert); err != nil {
-		return nil, nil, nil, nil, err
-	}
-
-	if err := cs.handleServerKeyUpdate(r, certDir, &serverCert); err != nil {
+	serverCert, err := cs.handleServerCertificateUploads(r, certDir, from, serverCert)
+	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
@@ -155,12 +126,7 @@ func (cs *CertificateService) extractCertPaths(serverCert *certificates.Certific
 	var clientPaths []string
 
 	if serverCert != nil {
-		if serverCert.PublicKey != "" {
-			serverPaths = append(serverPaths, serverCert.PublicKey)
-		}
-		if serverCert.PrivateKey != "" {
-			serverPaths = append(serverPaths, serverCert.PrivateKey)
-		}
+		serverPaths = append(serverPaths, serverCert.Files()...)
 	}
 
 	if clientCert != nil && len(clientCert.CaPem) > 0 {
@@ -176,13 +142,8 @@ func (cs *CertificateService) CollectAllCertsInUse(config *domain.Config) map[st
 
 	// Check WebVirtualHosts
 	for _, vh := range config.WebVirtualHosts {
-		if vh.ServerCertificate != nil {
-			if vh.ServerCertificate.PublicKey != "" {
-				certsInUse[vh.ServerCertificate.PublicKey] = true
-			}
-			if vh.ServerCertificate.PrivateKey != "" {
-				certsInUse[vh.ServerCertificate.PrivateKey] = true
-			}
+		for _, file := range vh.ServerCertificate.Files() {
+			certsInUse[file] = true
 		}
 		if vh.ClientCertificate != nil {
 			for _, ca := range vh.ClientCertificate.CaPem {
@@ -193,13 +154,8 @@ func (cs *CertificateService) CollectAllCertsInUse(config *domain.Config) map[st
 
 	// Check GrpcWebVirtualHosts
 	for _, vh := range config.GrpcWebVirtualHosts {
-		if vh.ServerCertificate != nil {
-			if vh.ServerCertificate.PublicKey != "" {
-				certsInUse[vh.ServerCertificate.PublicKey] = true
-			}
-			if vh.ServerCertificate.PrivateKey != "" {
-				certsInUse[vh.ServerCertificate.PrivateKey] = true
-			}
+		for _, file := range vh.ServerCertificate.Files() {
+			certsInUse[file] = true
 		}
 		if vh.ClientCertificate != nil {
 			for _, ca := range vh.ClientCertificate.CaPem {
@@ -313,26 +269,12 @@ func (cs *CertificateService) collectOldCertificatePaths(oldVH interface{}) ([]s
 
 	// Try to extract certificates from the virtual host
 	if vh, ok := oldVH.(*domain.WebVirtualHost); ok {
-		if vh.ServerCertificate != nil {
-			if vh.ServerCertificate.PublicKey != "" {
-				oldServerPaths = append(oldServerPaths, vh.ServerCertificate.PublicKey)
-			}
-			if vh.ServerCertificate.PrivateKey != "" {
-				oldServerPaths = append(oldServerPaths, vh.ServerCertificate.PrivateKey)
-			}
-		}
+		oldServerPaths = append(oldServerPaths, vh.ServerCertificate.Files()...)
 		if vh.ClientCertificate != nil && len(vh.ClientCertificate.CaPem) > 0 {
 			oldClientPaths = append(oldClientPaths, vh.ClientCertificate.CaPem...)
 		}
 	} else if vh, ok := oldVH.(*domain.GrpcWebVirtualHost); ok {
-		if vh.ServerCertificate != nil {
-			if vh.ServerCertificate.PublicKey != "" {
-				oldServerPaths = append(oldServerPaths, vh.ServerCertificate.PublicKey)
-			}
-			if vh.ServerCertificate.PrivateKey != "" {
-				oldServerPaths = append(oldServerPaths, vh.ServerCertificate.PrivateKey)
-			}
-		}
+		oldServerPaths = append(oldServerPaths, vh.ServerCertificate.Files()...)
 		if vh.ClientCertificate != nil && len(vh.ClientCertificate.CaPem) > 0 {
 			oldClientPaths = append(oldClientPaths, vh.ClientCertificate.CaPem...)
 		}
@@ -351,28 +293,44 @@ func (cs *CertificateService) initializeCertificateCopies(oldVH interface{}) (*c
 		// Copy existing certificates
 		if vh.ServerCertificate != nil {
 			serverCert = &certificates.CertificateDefs{
-				PublicKey:  vh.ServerCertificate.PublicKey,
-				PrivateKey: vh.ServerCertificate.PrivateKey,
-				CaPem:      vh.ServerCertificate.CaPem,
+				PublicKey:    vh.ServerCertificate.PublicKey,
+				PrivateKey:   vh.ServerCertificate.PrivateKey,
+				PKCS12:       vh.ServerCertificate.PKCS12,
+				PasswordEnv:  vh.ServerCertificate.PasswordEnv,
+				PasswordFile: vh.ServerCertificate.PasswordFile,
+				CaPem:        vh.ServerCertificate.CaPem,
+				KeyPairs:     vh.ServerCertificate.KeyPairs,
 			}
 		}
 		if vh.ClientCertificate != nil {
 			clientCert = &certificates.CertificateDefs{
-				CaPem: vh.ClientCertificate.CaPem,
+				CaPem:              vh.ClientCertificate.CaPem,
+				ServerName:         vh.ClientCertificate.ServerName,
+				InsecureSkipVerify: vh.ClientCertificate.InsecureSkipVerify,
+				PinnedPublicKeys:   vh.ClientCertificate.PinnedPublicKeys,
+				SPIFFEIDs:          vh.ClientCertificate.SPIFFEIDs,
 			}
 		}
 	} else if vh, ok := oldVH.(*domain.GrpcWebVirtualHost); ok {
 		// Copy existing certificates
 		if vh.ServerCertificate != nil {
 			serverCert = &certificates.CertificateDefs{
-				PublicKey:  vh.ServerCertificate.PublicKey,
-				PrivateKey: vh.ServerCertificate.PrivateKey,
-				CaPem:      vh.ServerCertificate.CaPem,
+				PublicKey:    vh.ServerCertificate.PublicKey,
+				PrivateKey:   vh.ServerCertificate.PrivateKey,
+				PKCS12:       vh.ServerCertificate.PKCS12,
+				PasswordEnv:  vh.ServerCertificate.PasswordEnv,
+				PasswordFile: vh.ServerCertificate.PasswordFile,
+				CaPem:        vh.ServerCertificate.CaPem,
+				KeyPairs:     vh.ServerCertificate.KeyPairs,
 			}
 		}
 		if vh.ClientCertificate != nil {
 			clientCert = &certificates.CertificateDefs{
-				CaPem: vh.ClientCertificate.CaPem,
+				CaPem:              vh.ClientCertificate.CaPem,
+				ServerName:         vh.ClientCertificate.ServerName,
+				InsecureSkipVerify: vh.ClientCertificate.InsecureSkipVerify,
+				PinnedPublicKeys:   vh.ClientCertificate.PinnedPublicKeys,
+				SPIFFEIDs:          vh.ClientCertificate.SPIFFEIDs,
 			}
 		}
 	}
@@ -392,7 +350,15 @@ func (cs *CertificateService) handleServerCertificateUpdate(r *http.Request, cer
 		if *serverCert == nil {
 			*serverCert = &certificates.CertificateDefs{}
 		}
-		(*serverCert).PublicKey = serverCertPath
+		// a PKCS#12 bundle replaces both the certificate and the key
+		if isPKCS12File(header.Filename) {
+			(*serverCert).PKCS12 = serverCertPath
+			(*serverCert).PublicKey = ""
+			(*serverCert).PrivateKey = ""
+		} else {
+			(*serverCert).PublicKey = serverCertPath
+			(*serverCert).PKCS12 = ""
+		}
 	}
 	return nil
 }
@@ -410,10 +376,113 @@ func (cs *CertificateService) handleServerKeyUpdate(r *http.Request, certDir str
 			*serverCert = &certificates.CertificateDefs{}
 		}
 		(*serverCert).PrivateKey = serverKeyPath
+		(*serverCert).PKCS12 = ""
 	}
 	return nil
 }
 
+// handleServerPasswordUpdate saves the password of an encrypted key or a PKCS#12 bundle next to
+// the certificate, readable only by the owner.
+func (cs *CertificateService) handleServerPasswordUpdate(r *http.Request, certDir string, serverCert *certificates.CertificateDefs) error {
+	password := r.FormValue("serverCertPassword")
+	if password == "" || serverCert == nil {
+		return nil
+	}
+	passwordPath := filepath.Join(certDir, serverPasswordFile)
+	if err := os.WriteFile(passwordPath, []byte(password), 0600); err != nil {
+		cs.logger.Error(fmt.Sprintf("Failed to save server certificate password: %v", err))
+		return err
+	}
+	cs.logger.Info(fmt.Sprintf("Saved server certificate password to %s", passwordPath))
+	serverCert.PasswordFile = passwordPath
+	serverCert.PasswordEnv = ""
+	return nil
+}
+
+// handleServerCertificateUploads saves the uploaded server certificate, key and password in a
+// staging directory and only moves them to the certificate directory once the resulting
+// certificate is valid for the server name of from, so an invalid upload never replaces the
+// files in use.
+func (cs *CertificateService) handleServerCertificateUploads(r *http.Request, certDir string, from string, serverCert *certificates.CertificateDefs) (*certificates.CertificateDefs, error) {
+	stagingDir, err := os.MkdirTemp(certDir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(stagingDir) }()
+
+	if err := cs.handleServerCertificateUpdate(r, stagingDir, &serverCert); err != nil {
+		return nil, err
+	}
+
+	if err := cs.handleServerKeyUpdate(r, stagingDir, &serverCert); err != nil {
+		return nil, err
+	}
+
+	if err := cs.handleServerPasswordUpdate(r, stagingDir, serverCert); err != nil {
+		return nil, err
+	}
+
+	if err := cs.validateServerCertificate(serverCert, from); err != nil {
+		return nil, err
+	}
+
+	if err := cs.moveUploads(serverCert, stagingDir, certDir); err != nil {
+		return nil, err
+	}
+	return serverCert, nil
+}
+
+// validateServerCertificate checks that the server certificate can be served for the server name
+// of from: the key matches, the certificate is currently valid with a complete chain and covers
+// the server name.
+func (cs *CertificateService) validateServerCertificate(serverCert *certificates.CertificateDefs, from string) error {
+	if serverCert == nil {
+		return nil
+	}
+	if serverCert.PKCS12 == "" && (serverCert.PublicKey == "" || serverCert.PrivateKey == "") {
+		return fmt.Errorf("%w: the certificate and its private key, or a PKCS#12 bundle, are required", ErrInvalidCertificate)
+	}
+	if err := serverCert.CheckServerCertificate(domain.ServerNameOf(from)); err != nil {
+		cs.logger.Error(fmt.Sprintf("Invalid server certificate for %s: %v", from, err))
+		return fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	return nil
+}
+
+// moveUploads moves the files saved in the staging directory to the certificate directory. The
+// key, the bundle and the password are encrypted first when key_encryption is configured.
+func (cs *CertificateService) moveUploads(serverCert *certificates.CertificateDefs, stagingDir string, certDir string) error {
+	if serverCert == nil {
+		return nil
+	}
+	for _, path := range []string{serverCert.PrivateKey, serverCert.PKCS12, serverCert.PasswordFile} {
+		if path == "" || filepath.Dir(path) != stagingDir {
+			continue
+		}
+		if err := certificates.EncryptFile(path); err != nil {
+			cs.logger.Error(fmt.Sprintf("Failed to encrypt %s: %v", path, err))
+			return err
+		}
+	}
+	for _, path := range []*string{&serverCert.PublicKey, &serverCert.PrivateKey, &serverCert.PKCS12, &serverCert.PasswordFile} {
+		if *path == "" || filepath.Dir(*path) != stagingDir {
+			continue
+		}
+		destPath := filepath.Join(certDir, filepath.Base(*path))
+		if err := os.Rename(*path, destPath); err != nil {
+			cs.logger.Error(fmt.Sprintf("Failed to move %s to %s: %v", *path, destPath, err))
+			return err
+		}
+		*path = destPath
+	}
+	return nil
+}
+
+func isPKCS12File(name string) bool {
+	extension := strings.ToLower(filepath.Ext(name))
+	return extension == ".p12" || extension == ".pfx"
+}
+
 func (cs *CertificateService) handleClientCertificateUpdate(r *http.Request, certDir string, clientCert **certificates.CertificateDefs) error {
 	if _, header, err := r.FormFile("clientCertFile"); err == nil {
 		clientCertPath := filepath.Join(certDir, header.Filename)
@@ -0,0 +1,93 @@
+package presentation
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newServerCertificateRequest(t *testing.T, bundle string, password string) *http.Request {
+	data, err := os.ReadFile(filepath.Join("..", "infrastructure", "certificates", "testdata", bundle))
+	require.NoError(t, err)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("useServerCert", "on"))
+	require.NoError(t, writer.WriteField("serverCertPassword", password))
+	part, err := writer.CreateFormFile("serverCertFile", bundle)
+	require.NoError(t, err)
+	_, err = part.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	req := httptest.NewRequest(http.MethodPost, "/virtualhosts", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func newTestCertificateService() ICertificateService {
+	logger := &mocks.MockLogger{}
+	logger.On("Info", mock.Anything).Maybe()
+	logger.On("Error", mock.Anything).Maybe()
+	return NewCertificateService(NewFileService(logger), logger)
+}
+
+func TestCertificateService_HandleServerCertificates_WhenPKCS12IsUploaded_ThenSavesBundleAndPassword(t *testing.T) {
+	// Arrange
+	certDir := t.TempDir()
+	req := newServerCertificateRequest(t, "bundle.p12", "changeit")
+
+	// Act
+	serverCert, err := newTestCertificateService().HandleServerCertificates(req, certDir, "example.com")
+
+	// Assert
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(certDir, "bundle.p12"), serverCert.PKCS12)
+	assert.Empty(t, serverCert.PublicKey)
+	require.Equal(t, filepath.Join(certDir, serverPasswordFile), serverCert.PasswordFile)
+	info, err := os.Stat(serverCert.PasswordFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestCertificateService_HandleServerCertificates_WhenPasswordIsWrong_ThenReturnsError(t *testing.T) {
+	// Arrange
+	certDir := t.TempDir()
+	req := newServerCertificateRequest(t, "bundle.p12", "wrong")
+
+	// Act
+	serverCert, err := newTestCertificateService().HandleServerCertificates(req, certDir, "example.com")
+
+	// Assert
+	assert.Nil(t, serverCert)
+	assert.ErrorIs(t, err, ErrInvalidCertificate)
+	assert.ErrorContains(t, err, "incorrect password")
+	entries, err := os.ReadDir(certDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCertificateService_HandleCertificateUpdates_WhenCertificateDoesNotCoverHost_ThenKeepsPreviousFiles(t *testing.T) {
+	// Arrange
+	certDir := t.TempDir()
+	previous := filepath.Join(certDir, "bundle.p12")
+	require.NoError(t, os.WriteFile(previous, []byte("previous"), 0600))
+	req := newServerCertificateRequest(t, "bundle.p12", "changeit")
+	require.NoError(t, req.ParseMultipartForm(1<<20))
+
+	// Act
+	_, _, _, _, err := newTestCertificateService().HandleCertificateUpdates(req, certDir, "www.example.com", nil)
+
+	// Assert
+	assert.EqualError(t, err, "invalid server certificate: certificate does not cover 'www.example.com', it covers example.com")
+	data, err := os.ReadFile(previous)
+	require.NoError(t, err)
+	assert.Equal(t, "previous", string(data))
+}
@@ -3,6 +3,7 @@ package presentation
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/janmbaco/go-infrastructure/v2/configuration"
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/domain"
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/metrics"
 )
 
 //go:embed static/css/* static/js/*
@@ -74,12 +77,20 @@ func (cui *ConfigUI) SetupRoutes(mux *http.ServeMux) {
 		cui.handleEditVirtualHost(w, r, path)
 	}))
 	mux.HandleFunc("/virtualhosts/", recoverFunc(cui.handleVirtualHostActions))
+	mux.HandleFunc("/certificates", recoverFunc(cui.handleCertificates))
 
 	// API routes (all wrapped with recovery)
 	mux.HandleFunc("/api/config", recoverFunc(cui.handleGetConfig))
 	mux.HandleFunc("/api/config/update", recoverFunc(cui.handleUpdateConfig))
 	mux.HandleFunc("/api/virtualhosts", recoverFunc(cui.handleVirtualHostsAPI))
 	mux.HandleFunc("/api/virtualhosts/", recoverFunc(cui.handleVirtualHostAPI))
+	mux.HandleFunc("/api/certificates", recoverFunc(cui.handleCertificatesAPI))
+	mux.HandleFunc("/api/certificates/reloads", recoverFunc(cui.handleCertificateReloads))
+	mux.HandleFunc("/api/certificates/local-ca.pem", recoverFunc(cui.handleLocalCARoot))
+	mux.HandleFunc("/api/certificates/acme", recoverFunc(cui.handleACMEStatuses))
+	mux.HandleFunc("/api/certificates/ech", recoverFunc(cui.handleECHStatus))
+	mux.HandleFunc("/api/certificates/acme/", recoverFunc(cui.handleACMERenewal))
+	mux.Handle("/metrics", metrics.Default.Handler())
 
 	cui.logger.Info("ConfigUI routes set up with panic recovery")
 }
@@ -98,19 +109,23 @@ func (cui *ConfigUI) handleDashboard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
-		Title        string
-		ActivePage   string
-		Template     string
-		Config       *domain.Config
-		VirtualHosts []domain.IVirtualHost
-		IsLocalhost  bool
+		Title              string
+		ActivePage         string
+		Template           string
+		Config             *domain.Config
+		VirtualHosts       []domain.IVirtualHost
+		CertificateReloads []certs.ReloadEvent
+		ACMEStatuses       []certs.ACMEStatus
+		IsLocalhost        bool
 	}{
-		Title:        "Dashboard - Reverse Proxy Config",
-		ActivePage:   "dashboard",
-		Template:     "dashboard-content",
-		Config:       config,
-		VirtualHosts: vhCollection,
-		IsLocalhost:  strings.Contains(r.Host, "localhost") || strings.Contains(r.Host, "127.0.0.1"),
+		Title:              "Dashboard - Reverse Proxy Config",
+		ActivePage:         "dashboard",
+		Template:           "dashboard-content",
+		Config:             config,
+		VirtualHosts:       vhCollection,
+		CertificateReloads: certs.Reloads.Events(),
+		ACMEStatuses:       certs.Inventory.ACMEStatuses(),
+		IsLocalhost:        strings.Contains(r.Host, "localhost") || strings.Contains(r.Host, "127.0.0.1"),
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -359,6 +374,134 @@ func (cui *ConfigUI) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(config)
 }
 
+func (cui *ConfigUI) handleCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := cui.configHandler.GetConfig().(*domain.Config)
+	certificates := certs.Inventory.Certificates()
+	expiring := 0
+	for _, certificate := range certificates {
+		if certificate.Expiring {
+			expiring++
+		}
+	}
+
+	data := struct {
+		Title         string
+		ActivePage    string
+		Template      string
+		Certificates  []certs.CertificateInfo
+		ExpiringCount int
+		WarningDays   int
+		HasLocalCA    bool
+	}{
+		Title:         "Certificates - Reverse Proxy Config",
+		ActivePage:    "certificates",
+		Template:      "certificates-content",
+		Certificates:  certificates,
+		ExpiringCount: expiring,
+		WarningDays:   int(config.GetCertExpiryWarning().Hours() / 24),
+		HasLocalCA:    certs.Inventory.LocalCARoot() != nil,
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := cui.templates.ExecuteTemplate(w, "base", data); err != nil {
+		cui.logger.Error("Template execution error: " + err.Error())
+		http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (cui *ConfigUI) handleCertificatesAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(certs.Inventory.Certificates())
+}
+
+// handleLocalCARoot downloads the root certificate of the local CA, to be trusted by the clients.
+func (cui *ConfigUI) handleLocalCARoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	root := certs.Inventory.LocalCARoot()
+	if root == nil {
+		http.Error(w, "The local CA is not configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="local-ca.pem"`)
+	_, _ = w.Write(root)
+}
+
+func (cui *ConfigUI) handleCertificateReloads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(certs.Reloads.Events())
+}
+
+func (cui *ConfigUI) handleACMEStatuses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(certs.Inventory.ACMEStatuses())
+}
+
+// handleECHStatus gets the ECH config to publish in the HTTPS DNS records of the hosts.
+func (cui *ConfigUI) handleECHStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := certs.Inventory.ECHStatus()
+	if status == nil {
+		http.Error(w, "ECH is not configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// handleACMERenewal handles POST /api/certificates/acme/{host}/renew.
+func (cui *ConfigUI) handleACMERenewal(w http.ResponseWriter, r *http.Request) {
+	host, isRenewal := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/certificates/acme/"), "/renew")
+	if !isRenewal || host == "" || strings.Contains(host, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := certs.Inventory.RenewACMECertificate(host)
+	switch {
+	case errors.Is(err, certs.ErrUnknownACMEHost):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, certs.ErrACMERenewalInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cui.logger.Info(fmt.Sprintf("Renewal of the certificate of '%v' requested", host))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": certs.ACMEStateRenewing})
+}
+
 func (cui *ConfigUI) handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -428,6 +571,10 @@ func (cui *ConfigUI) createVirtualHost(w http.ResponseWriter, r *http.Request) {
 	config := cui.configHandler.GetConfig().(*domain.Config)
 
 	newVH, err := cui.virtualHostService.CreateVirtualHost(r, config)
+	if errors.Is(err, ErrInvalidCertificate) {
+		writeInvalidCertificate(w, err)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create virtual host: %v", err), http.StatusInternalServerError)
 		return
@@ -486,6 +633,10 @@ func (cui *ConfigUI) updateVirtualHost(w http.ResponseWriter, r *http.Request, i
 	config := cui.configHandler.GetConfig().(*domain.Config)
 
 	newVH, oldServerPaths, oldClientPaths, err := cui.virtualHostService.UpdateVirtualHost(r, id, config)
+	if errors.Is(err, ErrInvalidCertificate) {
+		writeInvalidCertificate(w, err)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to update virtual host: %v", err), http.StatusInternalServerError)
 		return
@@ -586,3 +737,14 @@ func (cui *ConfigUI) Start(port string) error {
 	cui.logger.Info("ConfigUI server started successfully")
 	return server.ListenAndServe()
 }
+
+// writeInvalidCertificate rejects an upload with a certificate that cannot be served, with the
+// reason shown by the virtual host form.
+func writeInvalidCertificate(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   err.Error(),
+	})
+}
@@ -19,9 +19,9 @@ type IVirtualHostService interface {
 
 // ICertificateService define la responsabilidad de gestionar certificados
 type ICertificateService interface {
-	HandleServerCertificates(r *http.Request, certDir string) (*certificates.CertificateDefs, error)
+	HandleServerCertificates(r *http.Request, certDir string, from string) (*certificates.CertificateDefs, error)
 	HandleClientCertificates(r *http.Request, certDir string) (*certificates.CertificateDefs, error)
-	HandleCertificateUpdates(r *http.Request, certDir string, oldVH interface{}) (*certificates.CertificateDefs, *certificates.CertificateDefs, []string, []string, error)
+	HandleCertificateUpdates(r *http.Request, certDir string, from string, oldVH interface{}) (*certificates.CertificateDefs, *certificates.CertificateDefs, []string, []string, error)
 	CollectCertPathsFromVH(config *domain.Config, id string) ([]string, []string)
 	CollectAllCertsInUse(config *domain.Config) map[string]bool
 	DeleteUnusedCertFiles(serverCertPaths, clientCertPaths []string, certsInUse map[string]bool)
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/domain"
+	certs "github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/certificates"
 	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/grpcutil"
+	"github.com/janmbaco/go-reverseproxy-ssl/v3/internal/infrastructure/ipfilter"
 )
 
 // VirtualHostService implementa la responsabilidad de gestionar operaciones de virtual hosts
@@ -70,6 +73,11 @@ func (vhs *VirtualHostService) createWebVirtualHost(r *http.Request, config *dom
 
 	vhs.logger.Info(fmt.Sprintf("Creating web virtual host: from=%s, scheme=%s, host=%s, port=%d", from, scheme, hostName, port))
 
+	ipRules, err := vhs.parseIPRules(r, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create certificate directory
 	certDir, err := vhs.fileService.CreateCertDirectory(config, from)
 	if err != nil {
@@ -77,9 +85,9 @@ func (vhs *VirtualHostService) createWebVirtualHost(r *http.Request, config *dom
 	}
 
 	// Handle server certificates
-	serverCert, err := vhs.certificateService.HandleServerCertificates(r, certDir)
+	serverCert, err := vhs.certificateService.HandleServerCertificates(r, certDir, from)
 	if err != nil {
-		return nil, fmt.Errorf("failed to handle server certificates: %v", err)
+		return nil, fmt.Errorf("failed to handle server certificates: %w", err)
 	}
 
 	// Handle client certificates
@@ -98,6 +106,8 @@ func (vhs *VirtualHostService) createWebVirtualHost(r *http.Request, config *dom
 				Port:              port,
 				Path:              pathValue,
 				ServerCertificate: serverCert,
+				ClientAuth:        vhs.parseClientAuth(r, ""),
+				IPRules:           ipRules,
 			},
 			ClientCertificate: clientCert,
 		},
@@ -129,6 +139,11 @@ func (vhs *VirtualHostService) createGrpcWebVirtualHost(r *http.Request, config
 
 	vhs.logger.Info(fmt.Sprintf("Creating gRPC-Web virtual host: from=%s, grpcHost=%s, grpcPort=%d", from, grpcHostName, grpcPort))
 
+	ipRules, err := vhs.parseIPRules(r, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	// Parse gRPC services and methods
 	grpcServices := make(map[string][]string)
 	serviceNames := r.Form["grpcServiceName[]"]
@@ -165,9 +180,9 @@ func (vhs *VirtualHostService) createGrpcWebVirtualHost(r *http.Request, config
 	}
 
 	// Handle server certificates
-	serverCert, err := vhs.certificateService.HandleServerCertificates(r, certDir)
+	serverCert, err := vhs.certificateService.HandleServerCertificates(r, certDir, from)
 	if err != nil {
-		return nil, fmt.Errorf("failed to handle server certificates: %v", err)
+		return nil, fmt.Errorf("failed to handle server certificates: %w", err)
 	}
 
 	// Handle client certificates
@@ -185,6 +200,8 @@ func (vhs *VirtualHostService) createGrpcWebVirtualHost(r *http.Request, config
 				HostName:          grpcHostName,
 				Port:              grpcPort,
 				ServerCertificate: serverCert,
+				ClientAuth:        vhs.parseClientAuth(r, ""),
+				IPRules:           ipRules,
 			},
 			ClientCertificate: clientCert,
 		},
@@ -258,6 +275,10 @@ func (vhs *VirtualHostService) updateWebVirtualHost(r *http.Request, id string,
 	// Get form values with defaults from existing
 	from := vhs.getFormValueOrDefault(r, "from", webVH.From)
 	port := vhs.parsePortFromForm(r, webVH.Port)
+	ipRules, err := vhs.parseIPRules(r, webVH.IPRules)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	// Create certificate directory
 	certDir, err := vhs.fileService.CreateCertDirectory(config, from)
@@ -266,9 +287,9 @@ func (vhs *VirtualHostService) updateWebVirtualHost(r *http.Request, id string,
 	}
 
 	// Handle certificate updates
-	serverCert, clientCert, oldServerPaths, oldClientPaths, err := vhs.certificateService.HandleCertificateUpdates(r, certDir, webVH)
+	serverCert, clientCert, oldServerPaths, oldClientPaths, err := vhs.certificateService.HandleCertificateUpdates(r, certDir, from, webVH)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to handle certificates: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to handle certificates: %w", err)
 	}
 
 	// Create new virtual host
@@ -281,11 +302,20 @@ func (vhs *VirtualHostService) updateWebVirtualHost(r *http.Request, id string,
 				Port:              port,
 				Path:              r.FormValue("path"),
 				ServerCertificate: serverCert,
+				ClientAuth:        vhs.parseClientAuth(r, webVH.ClientAuth),
+				ClientCertRules:   webVH.ClientCertRules,
+				Revocation:        webVH.Revocation,
+				TLSPolicy:         webVH.TLSPolicy,
+				IPRules:           ipRules,
 			},
 			ClientCertificate: clientCert,
+			ForwardClientCert: webVH.ForwardClientCert,
+			ForwardAuth:       webVH.ForwardAuth,
+			JWT:               webVH.JWT,
 		},
 		ResponseHeaders:  make(map[string]string), // Initialize empty map
 		NeedPkFromClient: false,                   // Default to false
+		OIDC:             webVH.OIDC,              // Keep login gateway settings
 	}
 	newVH.EnsureID()        // Generate new ID
 	newVH.SetURLToReplace() // Initialize URL replacement fields
@@ -314,6 +344,10 @@ func (vhs *VirtualHostService) updateGrpcWebVirtualHost(r *http.Request, id stri
 	authority := vhs.getFormValueOrDefault(r, "authority", grpcVH.GrpcWebProxy.Authority)
 	grpcHostName := vhs.getFormValueOrDefault(r, "grpcHostName", grpcVH.HostName)
 	grpcPort := vhs.parsePortFromFormField(r, "grpcPort", grpcVH.Port)
+	ipRules, err := vhs.parseIPRules(r, grpcVH.IPRules)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	// Parse gRPC services and methods
 	grpcServices := make(map[string][]string)
@@ -351,9 +385,9 @@ func (vhs *VirtualHostService) updateGrpcWebVirtualHost(r *http.Request, id stri
 	}
 
 	// Handle certificate updates
-	serverCert, clientCert, oldServerPaths, oldClientPaths, err := vhs.certificateService.HandleCertificateUpdates(r, certDir, grpcVH)
+	serverCert, clientCert, oldServerPaths, oldClientPaths, err := vhs.certificateService.HandleCertificateUpdates(r, certDir, from, grpcVH)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to handle certificates: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to handle certificates: %w", err)
 	}
 
 	// Create new virtual host
@@ -365,8 +399,16 @@ func (vhs *VirtualHostService) updateGrpcWebVirtualHost(r *http.Request, id stri
 				HostName:          grpcHostName,
 				Port:              grpcPort,
 				ServerCertificate: serverCert,
+				ClientAuth:        vhs.parseClientAuth(r, grpcVH.ClientAuth),
+				ClientCertRules:   grpcVH.ClientCertRules,
+				Revocation:        grpcVH.Revocation,
+				TLSPolicy:         grpcVH.TLSPolicy,
+				IPRules:           ipRules,
 			},
 			ClientCertificate: clientCert,
+			ForwardClientCert: grpcVH.ForwardClientCert,
+			ForwardAuth:       grpcVH.ForwardAuth,
+			JWT:               grpcVH.JWT,
 		},
 		GrpcWebProxy: &grpcutil.GrpcWebProxy{
 			GrpcProxy: grpcutil.GrpcProxy{
@@ -508,6 +550,68 @@ func (vhs *VirtualHostService) parsePortFromFormField(r *http.Request, fieldName
 	return defaultPort
 }
 
+// parseClientAuth reads the client certificate policy from the form. When the form has no
+// client auth field the current policy is kept.
+func (vhs *VirtualHostService) parseClientAuth(r *http.Request, current certs.ClientAuthMode) certs.ClientAuthMode {
+	if _, ok := r.Form["clientAuth"]; !ok {
+		return current
+	}
+	mode := certs.ClientAuthMode(r.FormValue("clientAuth"))
+	if err := mode.Validate(); err != nil {
+		vhs.logger.Error(err.Error())
+		return current
+	}
+	return mode
+}
+
+// parseIPRules reads the IP access rules from the form. When the form has no IP rule
+// fields the current rules are kept.
+func (vhs *VirtualHostService) parseIPRules(r *http.Request, current *ipfilter.Rules) (*ipfilter.Rules, error) {
+	_, hasAllow := r.Form["ipAllow"]
+	_, hasDeny := r.Form["ipDeny"]
+	_, hasPaths := r.Form["ipRulePath[]"]
+	if !hasAllow && !hasDeny && !hasPaths {
+		return current, nil
+	}
+
+	rules := &ipfilter.Rules{
+		Allow: splitAddressList(r.FormValue("ipAllow")),
+		Deny:  splitAddressList(r.FormValue("ipDeny")),
+	}
+	paths := r.Form["ipRulePath[]"]
+	allows := r.Form["ipRuleAllow[]"]
+	denies := r.Form["ipRuleDeny[]"]
+	for i, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		pathRules := &ipfilter.PathRules{Path: path}
+		if i < len(allows) {
+			pathRules.Allow = splitAddressList(allows[i])
+		}
+		if i < len(denies) {
+			pathRules.Deny = splitAddressList(denies[i])
+		}
+		rules.Paths = append(rules.Paths, pathRules)
+	}
+
+	if rules.IsEmpty() {
+		return nil, nil
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid IP rules: %v", err)
+	}
+	return rules, nil
+}
+
+// splitAddressList splits a list of addresses separated by commas, spaces or new lines.
+func splitAddressList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+}
+
 func (vhs *VirtualHostService) removeVirtualHostByID(config *domain.Config, id string) (string, bool) {
 	// Ensure all virtual hosts have IDs
 	for _, vh := range config.WebVirtualHosts {